@@ -14,7 +14,7 @@ type AckAgent struct {
 }
 
 func (a *AckAgent) Run(conn *Connection) {
-	a.Init("AckAgent", conn.OriginalDestinationCID)
+	a.Init("AckAgent", conn)
 	a.DisableAcks = make(map[PNSpace]bool)
 	a.TotalDataAcked = make(map[PNSpace]uint64)
 
@@ -24,6 +24,7 @@ func (a *AckAgent) Run(conn *Connection) {
 	go func() {
 		defer a.Logger.Println("Agent terminated")
 		defer close(a.closed)
+		defer a.RecoverCrash()
 		for {
 			select {
 			case i := <-incomingPackets:
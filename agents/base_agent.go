@@ -10,15 +10,14 @@ package agents
 import (
 	. "github.com/RohitPanda/quic-tracker"
 	"log"
-	"os"
 	"fmt"
 	"encoding/hex"
-	"time"
+	"runtime/debug"
 )
 
 type Agent interface {
 	Name() string
-	Init(name string, SCID ConnectionID)
+	Init(name string, conn *Connection)
 	Run(conn *Connection)
 	Stop()
 	Join()
@@ -26,21 +25,35 @@ type Agent interface {
 
 // All agents should embed this structure
 type BaseAgent struct {
-	name   string
-	Logger *log.Logger
-	close  chan bool
-	closed chan bool
+	name    string
+	Logger  *log.Logger
+	close   chan bool
+	closed  chan bool
+	crashes chan AgentCrash
 }
 
 func (a *BaseAgent) Name() string { return a.name }
 
 // All agents that embed this structure must call Init() as soon as their Run() method is called
-func (a *BaseAgent) Init(name string, ODCID ConnectionID) {
+func (a *BaseAgent) Init(name string, conn *Connection) {
 	a.name = name
-	a.Logger = log.New(os.Stderr, fmt.Sprintf("[%s/%s] ", hex.EncodeToString(ODCID), a.Name()), log.Lshortfile)
+	a.Logger = log.New(conn.LogOutput, fmt.Sprintf("[%s/%s] ", hex.EncodeToString(conn.OriginalDestinationCID), a.Name()), log.Lshortfile)
 	a.Logger.Println("Agent started")
 	a.close = make(chan bool)
 	a.closed = make(chan bool)
+	a.crashes = conn.Crashes
+}
+
+// Recovers a panic of a goroutine of the agent and reports it on the Crashes channel of the connection. It must be the
+// last function deferred by each goroutine the agent starts, so that the panic is recovered before the agent closes.
+func (a *BaseAgent) RecoverCrash() {
+	if r := recover(); r != nil {
+		a.Logger.Printf("Agent panicked: %v\n", r)
+		select {
+		case a.crashes <- AgentCrash{a.name, fmt.Sprint(r), string(debug.Stack())}:
+		default:
+		}
+	}
 }
 
 func (a *BaseAgent) Stop() {
@@ -89,7 +102,7 @@ func (c *ConnectionAgents) StopAll() {
 
 // This function sends an (CONNECTION|APPLICATION)_CLOSE frame and wait for it to be sent out. Then it stops all the
 // agents attached to this connection.
-func (c *ConnectionAgents) CloseConnection(quicLayer bool, errorCode uint16, reasonPhrase string) {
+func (c *ConnectionAgents) CloseConnection(quicLayer bool, errorCode uint64, reasonPhrase string) {
 	a := &ClosingAgent{QuicLayer: quicLayer, ErrorCode: errorCode, ReasonPhrase: reasonPhrase}
 	c.Add(a)
 	a.Join()
@@ -98,14 +111,22 @@ func (c *ConnectionAgents) CloseConnection(quicLayer bool, errorCode uint16, rea
 
 // Returns the agents needed for a basic QUIC connection to operate
 func GetDefaultAgents() []Agent {
-	return []Agent{
+	rttAgent := &RTTAgent{}
+	recoveryAgent := &RecoveryAgent{RTTAgent: rttAgent}
+	sendingAgent := &SendingAgent{MTU: 1200, RecoveryAgent: recoveryAgent, RTTAgent: rttAgent}
+	recoveryAgent.SendingAgent = sendingAgent
+	defaultAgents := []Agent{
 		&SocketAgent{},
 		&ParsingAgent{},
 		&BufferAgent{},
 		&TLSAgent{},
 		&AckAgent{},
-		&SendingAgent{MTU: 1200},
-		&RecoveryAgent{TimerValue: 500 * time.Millisecond},
-		&RTTAgent{},
+		rttAgent,
+		recoveryAgent, // The RecoveryAgent must run before the SendingAgent registers to its events
+		sendingAgent,
+	}
+	if QlogDirectory != "" {
+		defaultAgents = append(defaultAgents, &QlogAgent{Directory: QlogDirectory, RTTAgent: rttAgent, RecoveryAgent: recoveryAgent, SendingAgent: sendingAgent})
 	}
+	return defaultAgents
 }
@@ -9,7 +9,7 @@ type BufferAgent struct {
 }
 
 func (a *BufferAgent) Run(conn *Connection) {
-	a.Init("BufferAgent", conn.OriginalDestinationCID)
+	a.Init("BufferAgent", conn)
 
 	uPChan := make(chan interface{}, 1000)
 	conn.UnprocessedPayloads.Register(uPChan)
@@ -22,6 +22,7 @@ func (a *BufferAgent) Run(conn *Connection) {
 	go func() {
 		defer a.Logger.Println("Agent terminated")
 		defer close(a.closed)
+		defer a.RecoverCrash()
 		for {
 			select {
 			case i := <-uPChan:
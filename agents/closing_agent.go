@@ -6,12 +6,12 @@ import . "github.com/RohitPanda/quic-tracker"
 type ClosingAgent struct {
 	BaseAgent
 	QuicLayer bool
-	ErrorCode uint16
+	ErrorCode uint64
 	ReasonPhrase string
 }
 
 func (a *ClosingAgent) Run (conn *Connection) {
-	a.Init("ClosingAgent", conn.OriginalDestinationCID)
+	a.Init("ClosingAgent", conn)
 
 	outgoingPackets := make(chan interface{}, 1000)
 	conn.OutgoingPackets.Register(outgoingPackets)
@@ -19,6 +19,7 @@ func (a *ClosingAgent) Run (conn *Connection) {
 	go func() {
 		defer a.Logger.Println("Agent terminated")
 		defer close(a.closed)
+		defer a.RecoverCrash()
 
 		conn.CloseConnection(a.QuicLayer, a.ErrorCode, a.ReasonPhrase)
 		for {
@@ -0,0 +1,288 @@
+package agents
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// A CongestionController limits the number of bytes the SendingAgent can have in flight. It is fed with the packets
+// sent on the connection and with the acknowledgements and losses detected by the RecoveryAgent. Only ack-eliciting
+// packets are accounted for.
+type CongestionController interface {
+	Name() string
+	OnPacketSent(size int)
+	OnPacketsAcked(packets []AckedPacket)
+	OnPacketsLost(packets []LostPacket)
+	OnPacketsDiscarded(packets []AckedPacket) // The packets were removed from flight without being acknowledged nor lost
+	CanSend() bool
+	CongestionWindow() uint64
+	BytesInFlight() uint64
+}
+
+// Returns a new congestion controller given its name, either newreno, cubic, bbr-lite or unlimited
+func NewCongestionController(name string, maxDatagramSize uint16) (CongestionController, error) {
+	switch name {
+	case "newreno":
+		return NewNewReno(maxDatagramSize), nil
+	case "cubic":
+		return NewCubic(maxDatagramSize), nil
+	case "bbr-lite":
+		return NewBBRLite(maxDatagramSize), nil
+	case "unlimited":
+		return NewUnlimited(), nil
+	}
+	return nil, fmt.Errorf("unknown congestion controller %s", name)
+}
+
+type congestionState struct {
+	maxDatagramSize  uint64
+	congestionWindow uint64
+	bytesInFlight    uint64
+}
+
+func newCongestionState(maxDatagramSize uint16) congestionState { // See https://tools.ietf.org/html/rfc9002#section-7.2
+	mds := uint64(maxDatagramSize)
+	initialWindow := 2 * mds
+	if initialWindow < 14720 {
+		initialWindow = 14720
+	}
+	if initialWindow > 10*mds {
+		initialWindow = 10 * mds
+	}
+	return congestionState{maxDatagramSize: mds, congestionWindow: initialWindow}
+}
+func (s *congestionState) minimumWindow() uint64 { return 2 * s.maxDatagramSize }
+func (s *congestionState) removeFromFlight(size int) {
+	if uint64(size) > s.bytesInFlight {
+		s.bytesInFlight = 0
+	} else {
+		s.bytesInFlight -= uint64(size)
+	}
+}
+func (s *congestionState) OnPacketSent(size int)    { s.bytesInFlight += uint64(size) }
+func (s *congestionState) CanSend() bool            { return s.bytesInFlight < s.congestionWindow }
+func (s *congestionState) CongestionWindow() uint64 { return s.congestionWindow }
+func (s *congestionState) BytesInFlight() uint64    { return s.bytesInFlight }
+func (s *congestionState) OnPacketsDiscarded(packets []AckedPacket) {
+	for _, p := range packets {
+		s.removeFromFlight(p.Size)
+	}
+}
+
+// Implements the congestion controller described in https://tools.ietf.org/html/rfc9002#section-7
+// TODO: Detect persistent congestion
+type NewReno struct {
+	congestionState
+	ssthresh          uint64
+	recoveryStartTime time.Time
+}
+
+func NewNewReno(maxDatagramSize uint16) *NewReno {
+	return &NewReno{congestionState: newCongestionState(maxDatagramSize), ssthresh: math.MaxUint64}
+}
+func (c *NewReno) Name() string { return "newreno" }
+func (c *NewReno) OnPacketsAcked(packets []AckedPacket) {
+	for _, p := range packets {
+		c.removeFromFlight(p.Size)
+		if !p.SentTime.After(c.recoveryStartTime) {
+			continue
+		}
+		if c.congestionWindow < c.ssthresh {
+			c.congestionWindow += uint64(p.Size)
+		} else {
+			c.congestionWindow += c.maxDatagramSize * uint64(p.Size) / c.congestionWindow
+		}
+	}
+}
+func (c *NewReno) OnPacketsLost(packets []LostPacket) {
+	var largestLostSent time.Time
+	for _, p := range packets {
+		c.removeFromFlight(p.Size)
+		if p.SentTime.After(largestLostSent) {
+			largestLostSent = p.SentTime
+		}
+	}
+	if largestLostSent.After(c.recoveryStartTime) { // Enters recovery
+		c.recoveryStartTime = time.Now()
+		c.ssthresh = c.congestionWindow / 2
+		c.congestionWindow = c.ssthresh
+		if c.congestionWindow < c.minimumWindow() {
+			c.congestionWindow = c.minimumWindow()
+		}
+	}
+}
+
+const (
+	cubicC    = 0.4
+	cubicBeta = 0.7
+)
+
+// Implements the congestion controller described in https://tools.ietf.org/html/rfc9438, using the same slow start and
+// recovery period as NewReno
+type Cubic struct {
+	congestionState
+	ssthresh          uint64
+	recoveryStartTime time.Time
+	epochStart        time.Time
+	wMax              float64 // In segments
+	k                 float64 // In seconds
+	wEst              float64 // In segments
+}
+
+func NewCubic(maxDatagramSize uint16) *Cubic {
+	return &Cubic{congestionState: newCongestionState(maxDatagramSize), ssthresh: math.MaxUint64}
+}
+func (c *Cubic) Name() string { return "cubic" }
+func (c *Cubic) OnPacketsAcked(packets []AckedPacket) {
+	for _, p := range packets {
+		c.removeFromFlight(p.Size)
+		if !p.SentTime.After(c.recoveryStartTime) {
+			continue
+		}
+		if c.congestionWindow < c.ssthresh {
+			c.congestionWindow += uint64(p.Size)
+			continue
+		}
+
+		cwnd := float64(c.congestionWindow) / float64(c.maxDatagramSize)
+		if c.epochStart.IsZero() { // See https://tools.ietf.org/html/rfc9438#section-4.2
+			c.epochStart = time.Now()
+			if c.wMax < cwnd {
+				c.wMax = cwnd
+			}
+			c.k = math.Cbrt((c.wMax - cwnd) / cubicC)
+			c.wEst = cwnd
+		}
+		t := time.Now().Sub(c.epochStart).Seconds()
+		target := cubicC*math.Pow(t-c.k, 3) + c.wMax
+		c.wEst += 3 * (1 - cubicBeta) / (1 + cubicBeta) * float64(p.Size) / float64(c.congestionWindow) // See https://tools.ietf.org/html/rfc9438#section-4.3
+		if c.wEst > target {
+			target = c.wEst
+		}
+		if target > 1.5*cwnd {
+			target = 1.5 * cwnd
+		}
+		if target > cwnd {
+			c.congestionWindow += uint64((target - cwnd) / cwnd * float64(p.Size))
+		}
+	}
+}
+func (c *Cubic) OnPacketsLost(packets []LostPacket) {
+	var largestLostSent time.Time
+	for _, p := range packets {
+		c.removeFromFlight(p.Size)
+		if p.SentTime.After(largestLostSent) {
+			largestLostSent = p.SentTime
+		}
+	}
+	if largestLostSent.After(c.recoveryStartTime) {
+		c.recoveryStartTime = time.Now()
+		cwnd := float64(c.congestionWindow) / float64(c.maxDatagramSize)
+		if cwnd < c.wMax { // Fast convergence, see https://tools.ietf.org/html/rfc9438#section-4.7
+			c.wMax = cwnd * (1 + cubicBeta) / 2
+		} else {
+			c.wMax = cwnd
+		}
+		c.epochStart = time.Time{}
+		c.ssthresh = uint64(float64(c.congestionWindow) * cubicBeta)
+		c.congestionWindow = c.ssthresh
+		if c.congestionWindow < c.minimumWindow() {
+			c.congestionWindow = c.minimumWindow()
+		}
+	}
+}
+
+const bbrBandwidthSamples = 10
+
+type bbrAckSample struct {
+	time time.Time
+	size int
+}
+
+// A simplified BBR that keeps its window at twice the estimated bandwidth-delay product. The bottleneck bandwidth is
+// the maximum of the last delivery rates, each measured over the last minimum RTT, and the delay is the minimum RTT
+// observed. Since the delivery rate is bounded by the window, the window doubles every RTT until the bottleneck is
+// reached. Losses are ignored.
+type BBRLite struct {
+	congestionState
+	acks          []bbrAckSample
+	firstAck      time.Time
+	deliveryRates []float64 // In bytes per second
+	minRTT        time.Duration
+}
+
+func NewBBRLite(maxDatagramSize uint16) *BBRLite {
+	return &BBRLite{congestionState: newCongestionState(maxDatagramSize)}
+}
+func (c *BBRLite) Name() string { return "bbr-lite" }
+func (c *BBRLite) OnPacketsAcked(packets []AckedPacket) {
+	if len(packets) == 0 {
+		return
+	}
+	now := time.Now()
+	if c.firstAck.IsZero() {
+		c.firstAck = now
+	}
+	for _, p := range packets {
+		c.removeFromFlight(p.Size)
+		c.acks = append(c.acks, bbrAckSample{now, p.Size})
+		if rtt := now.Sub(p.SentTime); c.minRTT == 0 || rtt < c.minRTT {
+			c.minRTT = rtt
+		}
+	}
+	for len(c.acks) > 0 && now.Sub(c.acks[0].time) > c.minRTT {
+		c.acks = c.acks[1:]
+	}
+	if now.Sub(c.firstAck) < c.minRTT || c.minRTT == 0 { // Not enough samples yet
+		return
+	}
+	var delivered int
+	for _, a := range c.acks {
+		delivered += a.size
+	}
+	c.deliveryRates = append(c.deliveryRates, float64(delivered)/c.minRTT.Seconds())
+	if len(c.deliveryRates) > bbrBandwidthSamples {
+		c.deliveryRates = c.deliveryRates[1:]
+	}
+	c.congestionWindow = uint64(2 * c.BottleneckBandwidth() * c.minRTT.Seconds())
+	if c.congestionWindow < c.minimumWindow() {
+		c.congestionWindow = c.minimumWindow()
+	}
+}
+func (c *BBRLite) OnPacketsLost(packets []LostPacket) {
+	for _, p := range packets {
+		c.removeFromFlight(p.Size)
+	}
+}
+
+// Returns the estimated bottleneck bandwidth in bytes per second
+func (c *BBRLite) BottleneckBandwidth() float64 {
+	var max float64
+	for _, r := range c.deliveryRates {
+		if r > max {
+			max = r
+		}
+	}
+	return max
+}
+
+// Does not limit the sending rate, as QUIC-Tracker did before congestion control was introduced
+type Unlimited struct {
+	congestionState
+}
+
+func NewUnlimited() *Unlimited {
+	return &Unlimited{congestionState{congestionWindow: math.MaxUint64}}
+}
+func (c *Unlimited) Name() string { return "unlimited" }
+func (c *Unlimited) OnPacketsAcked(packets []AckedPacket) {
+	for _, p := range packets {
+		c.removeFromFlight(p.Size)
+	}
+}
+func (c *Unlimited) OnPacketsLost(packets []LostPacket) {
+	for _, p := range packets {
+		c.removeFromFlight(p.Size)
+	}
+}
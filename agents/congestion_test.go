@@ -0,0 +1,112 @@
+package agents
+
+import (
+	. "github.com/RohitPanda/quic-tracker"
+	"math"
+	"testing"
+	"time"
+)
+
+// See https://tools.ietf.org/html/rfc9002#section-7.2
+func TestInitialWindow(t *testing.T) {
+	for mds, expected := range map[uint16]uint64{1000: 10000, 1200: 12000, 1472: 14720, 1500: 14720, 9000: 18000} {
+		if cwnd := newCongestionState(mds).congestionWindow; cwnd != expected {
+			t.Errorf("max_datagram_size %d: expected an initial window of %d, got %d", mds, expected, cwnd)
+		}
+	}
+}
+
+func TestNewReno(t *testing.T) {
+	c := NewNewReno(1200)
+	c.OnPacketSent(1200)
+	c.OnPacketSent(1200)
+	if c.BytesInFlight() != 2400 || !c.CanSend() {
+		t.Errorf("expected 2400 bytes in flight, got %d", c.BytesInFlight())
+	}
+	c.OnPacketsAcked([]AckedPacket{{0, time.Now(), 1200}})
+	if c.CongestionWindow() != 13200 || c.BytesInFlight() != 1200 {
+		t.Errorf("expected the window to grow by the bytes acknowledged in slow start, got %d", c.CongestionWindow())
+	}
+
+	beforeLoss := time.Now()
+	c.OnPacketsLost([]LostPacket{{1, beforeLoss, 1200}})
+	if c.CongestionWindow() != 6600 || c.ssthresh != 6600 || c.BytesInFlight() != 0 {
+		t.Errorf("expected the window to be halved, got %d", c.CongestionWindow())
+	}
+	c.OnPacketsLost([]LostPacket{{2, beforeLoss, 1200}})
+	c.OnPacketsAcked([]AckedPacket{{3, beforeLoss, 1200}})
+	if c.CongestionWindow() != 6600 {
+		t.Errorf("expected the window not to change for packets sent before the recovery period, got %d", c.CongestionWindow())
+	}
+
+	afterLoss := c.recoveryStartTime.Add(time.Millisecond)
+	c.OnPacketsAcked([]AckedPacket{{4, afterLoss, 1200}})
+	if expected := uint64(6600 + 1200*1200/6600); c.CongestionWindow() != expected {
+		t.Errorf("expected the window to grow to %d in congestion avoidance, got %d", expected, c.CongestionWindow())
+	}
+
+	for i := 0; i < 10; i++ {
+		c.OnPacketsLost([]LostPacket{{PacketNumber(5 + i), c.recoveryStartTime.Add(time.Millisecond), 1200}})
+	}
+	if c.CongestionWindow() != c.minimumWindow() {
+		t.Errorf("expected the window to be bounded by the minimum window, got %d", c.CongestionWindow())
+	}
+}
+
+func TestCubic(t *testing.T) {
+	c := NewCubic(1000)
+	c.congestionWindow = 100 * 1000
+	c.OnPacketsLost([]LostPacket{{0, time.Now(), 1000}})
+	if c.wMax != 100 || c.CongestionWindow() != 70*1000 {
+		t.Errorf("expected W_max to be 100 segments and the window to be reduced to 70 segments, got %f and %d", c.wMax, c.CongestionWindow())
+	}
+
+	sent := c.recoveryStartTime.Add(time.Millisecond)
+	c.OnPacketsAcked([]AckedPacket{{1, sent, 1000}})
+	if c.CongestionWindow() < 70*1000 || c.CongestionWindow() > 70*1000*3/2 {
+		t.Errorf("expected the window to grow by at most half of it, got %d", c.CongestionWindow())
+	}
+
+	c.congestionWindow = 70 * 1000
+	c.OnPacketsLost([]LostPacket{{2, c.recoveryStartTime.Add(time.Millisecond), 1000}})
+	if math.Abs(c.wMax-70*(1+cubicBeta)/2) > 1e-9 || c.CongestionWindow() != 49*1000 {
+		t.Errorf("expected fast convergence to reduce W_max to %f, got %f", 70*(1+cubicBeta)/2, c.wMax)
+	}
+}
+
+func TestBBRLite(t *testing.T) {
+	c := NewBBRLite(1200)
+	now := time.Now()
+	c.minRTT = 100 * time.Millisecond
+	c.firstAck = now.Add(-time.Second)
+
+	var packets []AckedPacket
+	for i := 0; i < 100; i++ {
+		packets = append(packets, AckedPacket{PacketNumber(i), now.Add(-200 * time.Millisecond), 1250})
+	}
+	c.OnPacketsAcked(packets)
+	if bw := c.BottleneckBandwidth(); math.Abs(bw-1250000) > 1 {
+		t.Errorf("expected a bottleneck bandwidth of 1.25MB/s, got %f", bw)
+	}
+	if cwnd := c.CongestionWindow(); cwnd < 249999 || cwnd > 250001 {
+		t.Errorf("expected a window of twice the bandwidth-delay product of 125000 bytes, got %d", cwnd)
+	}
+
+	c.acks = nil
+	c.OnPacketsAcked([]AckedPacket{{100, now.Add(-200 * time.Millisecond), 1250}})
+	if cwnd := c.CongestionWindow(); cwnd < 249999 {
+		t.Errorf("expected the window to follow the maximum delivery rate, got %d", cwnd)
+	}
+	c.OnPacketsLost([]LostPacket{{101, now, 1250}})
+	if cwnd := c.CongestionWindow(); cwnd < 249999 {
+		t.Errorf("expected the losses to be ignored, got %d", cwnd)
+	}
+
+	c = NewBBRLite(1200)
+	c.minRTT = 100 * time.Millisecond
+	c.firstAck = now.Add(-time.Second)
+	c.OnPacketsAcked([]AckedPacket{{0, now.Add(-200 * time.Millisecond), 10}})
+	if c.CongestionWindow() != c.minimumWindow() {
+		t.Errorf("expected the window to be bounded by the minimum window, got %d", c.CongestionWindow())
+	}
+}
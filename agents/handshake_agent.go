@@ -1,7 +1,6 @@
 package agents
 
 import (
-	"bytes"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -35,7 +34,7 @@ type HandshakeAgent struct {
 }
 
 func (a *HandshakeAgent) Run(conn *Connection) {
-	a.Init("HandshakeAgent", conn.OriginalDestinationCID)
+	a.Init("HandshakeAgent", conn)
 	a.HandshakeStatus = broadcast.NewBroadcaster(10)
 	a.sendInitial = make(chan bool, 1)
 
@@ -58,6 +57,7 @@ func (a *HandshakeAgent) Run(conn *Connection) {
 	go func() {
 		defer a.Logger.Println("Agent terminated")
 		defer close(a.closed)
+		defer a.RecoverCrash()
 		for {
 			select {
 			case <-a.sendInitial:
@@ -73,12 +73,16 @@ func (a *HandshakeAgent) Run(conn *Connection) {
 					}
 					conn.SendPacket(conn.GetInitialPacket(), EncryptionLevelInitial)
 				case *RetryPacket:
-					if !a.IgnoreRetry && bytes.Equal(conn.DestinationCID, p.OriginalDestinationCID) && !a.receivedRetry {  // TODO: Check the original_connection_id TP too
+					if !a.IgnoreRetry && !a.receivedRetry {  // The ParsingAgent discards invalid Retries, the TLSAgent authenticates the retry_source_connection_id TP
 						a.receivedRetry = true
-						conn.DestinationCID = p.Header().(*LongHeader).SourceCID
-						tlsTP := conn.TLSTPHandler
-						conn.TransitionTo(QuicVersion, QuicALPNToken)
-						conn.TLSTPHandler = tlsTP
+						conn.DestinationCID = p.Header().(*RetryHeader).SourceCID
+						conn.RetrySourceCID = conn.DestinationCID
+						tlsTP, compatibleVersions := conn.TLSTPHandler, conn.CompatibleVersions  // The versions offered must be kept for an upgrade after the Retry
+						if err := conn.TransitionTo(conn.Version, conn.ALPN); err != nil {
+							a.HandshakeStatus.Submit(HandshakeStatus{false, p, err})
+							return
+						}
+						conn.TLSTPHandler, conn.CompatibleVersions = tlsTP, compatibleVersions
 						conn.Token = p.RetryToken
 						a.TLSAgent.Stop()
 						a.TLSAgent.Join()
@@ -137,6 +141,7 @@ func (a *HandshakeAgent) Run(conn *Connection) {
 	a.HandshakeStatus.Register(status)
 
 	go func() {
+		defer a.RecoverCrash()
 		for {
 			select {
 			case i := <-status:
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	. "github.com/RohitPanda/quic-tracker"
 	"github.com/RohitPanda/quic-tracker/http3"
+	"github.com/RohitPanda/quic-tracker/qpack"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/dustin/go-broadcast"
 	"math"
@@ -40,7 +41,7 @@ type HTTPAgent struct {
 	BaseAgent
 	conn                 *Connection
 	QPACK                QPACKAgent
-	QPACKEncoderOpts     uint32
+	QPACKEncoderOpts     qpack.EncoderOpts
 	HTTPResponseReceived broadcast.Broadcaster //type: HTTPResponse
 	FrameReceived        broadcast.Broadcaster //type: HTTPFrameReceived
 	streamData           chan streamData
@@ -56,7 +57,7 @@ const (
 )
 
 func (a *HTTPAgent) Run(conn *Connection) {
-	a.Init("HTTPAgent", conn.OriginalDestinationCID)
+	a.Init("HTTPAgent", conn)
 	a.conn = conn
 	a.QPACK = QPACKAgent{EncoderStreamID: 6, DecoderStreamID: 10}
 	a.QPACK.Run(conn)
@@ -93,6 +94,7 @@ func (a *HTTPAgent) Run(conn *Connection) {
 	go func() {
 		defer a.Logger.Println("Agent terminated")
 		defer close(a.closed)
+		defer a.RecoverCrash()
 		for {
 			select {
 			case i := <-incomingPackets:
@@ -160,9 +162,9 @@ func (a *HTTPAgent) Run(conn *Connection) {
 							settingsQPACKBlockedStreams = s.Value.Value
 						}
 					}
-					a.QPACK.InitEncoder(uint(settingsHeaderTableSize), uint(settingsHeaderTableSize), uint(settingsQPACKBlockedStreams), a.QPACKEncoderOpts)
+					a.QPACK.InitEncoder(settingsHeaderTableSize, settingsHeaderTableSize, settingsQPACKBlockedStreams, a.QPACKEncoderOpts)
 				default:
-					spew.Dump(fr)
+					a.Logger.Printf("Unhandled HTTP frame %s", spew.Sdump(fr))
 				}
 			case i := <-decodedHeaders:
 				dHdrs := i.(DecodedHeaders)
@@ -236,6 +238,7 @@ func (a *HTTPAgent) SendRequest(path, method, authority string, headers map[stri
 	a.responseBuffer[streamID] = response
 
 	go func() { // Pipes the data from the response stream to the agent
+		defer a.RecoverCrash()
 		for {
 			select {
 			case i := <-streamChan:
@@ -0,0 +1,33 @@
+package agents
+
+import (
+	"time"
+)
+
+const pacingGain = 1.25 // See https://tools.ietf.org/html/rfc9002#section-7.7
+
+// A Pacer spaces out the ack-eliciting packets sent so that a congestion window is sent over a smoothed RTT instead of
+// in a single burst. It does not pace until an RTT sample is available or when the congestion window is unlimited.
+type Pacer struct {
+	nextSendTime time.Time
+}
+
+// Returns how long the next packet should wait before being sent
+func (p *Pacer) Delay(now time.Time) time.Duration {
+	if now.Before(p.nextSendTime) {
+		return p.nextSendTime.Sub(now)
+	}
+	return 0
+}
+
+func (p *Pacer) OnPacketSent(now time.Time, size int, congestionWindow uint64, smoothedRTT time.Duration) {
+	if smoothedRTT == 0 || congestionWindow == 0 {
+		p.nextSendTime = time.Time{}
+		return
+	}
+	interval := time.Duration(float64(smoothedRTT) * float64(size) / (pacingGain * float64(congestionWindow)))
+	if p.nextSendTime.Before(now) {
+		p.nextSendTime = now
+	}
+	p.nextSendTime = p.nextSendTime.Add(interval)
+}
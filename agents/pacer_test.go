@@ -0,0 +1,34 @@
+package agents
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacer(t *testing.T) {
+	p := new(Pacer)
+	now := time.Now()
+	interval := 8 * time.Millisecond // A window of 12000 bytes sent over 100ms with a gain of 1.25
+	p.OnPacketSent(now, 1200, 12000, 100*time.Millisecond)
+	if d := p.Delay(now); d != interval {
+		t.Errorf("expected a delay of %s, got %s", interval, d)
+	}
+	p.OnPacketSent(now, 1200, 12000, 100*time.Millisecond)
+	if d := p.Delay(now); d != 2*interval {
+		t.Errorf("expected the intervals to add up to %s, got %s", 2*interval, d)
+	}
+	if d := p.Delay(now.Add(3 * interval)); d != 0 {
+		t.Errorf("expected no delay once the send time is passed, got %s", d)
+	}
+
+	later := now.Add(time.Second)
+	p.OnPacketSent(later, 600, 12000, 100*time.Millisecond)
+	if d := p.Delay(later); d != interval/2 {
+		t.Errorf("expected the idle time not to be accumulated as credit, got a delay of %s", d)
+	}
+
+	p.OnPacketSent(later, 1200, 12000, 0)
+	if d := p.Delay(later); d != 0 {
+		t.Errorf("expected no pacing without an RTT sample, got a delay of %s", d)
+	}
+}
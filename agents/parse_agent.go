@@ -11,12 +11,13 @@ import (
 // UnprocessedPayloads queue.
 type ParsingAgent struct {
 	BaseAgent
-	conn *Connection
+	conn          *Connection
+	retryAccepted bool
 }
 
 func (a *ParsingAgent) Run(conn *Connection) {
 	a.conn = conn
-	a.Init("ParsingAgent", conn.OriginalDestinationCID)
+	a.Init("ParsingAgent", conn)
 
 	incomingPayloads := make(chan interface{})
 	a.conn.IncomingPayloads.Register(incomingPayloads)
@@ -24,6 +25,7 @@ func (a *ParsingAgent) Run(conn *Connection) {
 	go func() {
 		defer a.Logger.Println("Agent terminated")
 		defer close(a.closed)
+		defer a.RecoverCrash()
 		for {
 		packetSelect:
 			select {
@@ -33,10 +35,18 @@ func (a *ParsingAgent) Run(conn *Connection) {
 				for off < len(udpPayload) {
 					ciphertext := udpPayload[off:]
 					header := ReadHeader(bytes.NewReader(ciphertext), a.conn)
+
+					if lh, ok := header.(*LongHeader); ok && lh.PacketType() == Initial && lh.Version != a.conn.Version && a.conn.OffersVersion(lh.Version) {
+						if err := a.conn.UpgradeVersion(lh.Version); err != nil {
+							a.Logger.Printf("Could not upgrade to version %08x: %s\n", lh.Version, err.Error())
+							break packetSelect
+						}
+					}
+
 					cryptoState := a.conn.CryptoStates[header.EncryptionLevel()]
 
 					if lh, ok := header.(*LongHeader); ok && lh.Version == 0x00000000 {
-						packet := ReadVersionNegotationPacket(bytes.NewReader(ciphertext))
+						packet := ReadVersionNegotationPacket(bytes.NewReader(ciphertext), a.conn)
 
 						a.SaveCleartextPacket(ciphertext, packet.Pointer())
 						a.conn.IncomingPackets.Submit(packet)
@@ -112,8 +122,21 @@ func (a *ParsingAgent) Run(conn *Connection) {
 						off = len(udpPayload)
 					case Retry:
 						cleartext = ciphertext
-						packet = ReadRetryPacket(bytes.NewReader(cleartext), a.conn)
+						retry := ReadRetryPacket(bytes.NewReader(cleartext), a.conn)
 						off = len(udpPayload)
+						if a.retryAccepted { // A client accepts a single Retry, see https://tools.ietf.org/html/rfc9000#section-17.2.5.2
+							a.Logger.Println("Discarding Retry packet received after the first one")
+							a.SaveCleartextPacket(cleartext, retry.Pointer())
+							break packetSelect
+						}
+						if err := retry.Validate(a.conn.OriginalDestinationCID); err != nil {
+							a.Logger.Printf("Discarding Retry packet: %s\n", err.Error())
+							a.conn.RejectRetry(retry, err.Error())
+							a.SaveCleartextPacket(cleartext, retry.Pointer())
+							break packetSelect
+						}
+						a.retryAccepted = true
+						packet = retry
 					default:
 						a.Logger.Printf("Packet type is unknown, the first byte is %x\n", ciphertext[0])
 						break packetSelect
@@ -0,0 +1,280 @@
+package agents
+
+import (
+	. "github.com/RohitPanda/quic-tracker"
+	"github.com/dustin/go-broadcast"
+	"time"
+)
+
+const ( // See https://tools.ietf.org/html/rfc8899#section-5.1.2
+	pmtudBasePLPMTU  = 1200          // The smallest datagram size QUIC requires, see https://tools.ietf.org/html/rfc9000#section-14
+	pmtudMaxPLPMTUv4 = 1500 - 20 - 8 // An Ethernet MTU minus the IPv4 and UDP headers
+	pmtudMaxPLPMTUv6 = 1500 - 40 - 8
+	pmtudMaxProbes   = 3
+)
+
+type PMTUDStatus struct {
+	PLPMTU         uint16
+	SearchComplete bool
+	BlackHole      bool
+}
+
+// The PMTUDAgent implements the Datagram Packetization Layer Path MTU Discovery of RFC 8899 as described in
+// https://tools.ietf.org/html/rfc9000#section-14.3. Once 1-RTT keys are available, it binary searches the largest
+// datagram size accepted on the path, between BasePLPMTU and the smallest of MaxPLPMTU and the max_udp_payload_size
+// of the peer. Each size is probed with a PING frame padded to it, sent by the SendingAgent which is thus required. The
+// probes are recognised among the packets sent by their content. A size is confirmed when one of its probes is
+// acknowledged and is abandoned when MaxProbes of them were not acknowledged within ProbeTimeout. Each confirmed size
+// is fed back into the SendingAgent. When MaxProbes packets larger than BasePLPMTU are lost in a row, the path is
+// considered as a black hole, the PLPMTU falls back to BasePLPMTU and the search is restarted. The Don't Fragment bit
+// is set on the socket of the SocketAgent, if given, so that the probes are not fragmented.
+type PMTUDAgent struct {
+	BaseAgent
+	SocketAgent   *SocketAgent
+	SendingAgent  *SendingAgent
+	RecoveryAgent *RecoveryAgent
+	BasePLPMTU    uint16
+	MaxPLPMTU     uint16
+	MaxProbes     int
+	ProbeTimeout  time.Duration // Defaults to twice the 1-RTT probe timeout computed from the estimates of the RTTAgent
+	PLPMTU        uint16
+	ProbedSizes   map[uint16]bool       // Records whether each size probed was acknowledged
+	Status        broadcast.Broadcaster //type: PMTUDStatus
+}
+
+func (a *PMTUDAgent) Run(conn *Connection) {
+	a.Init("PMTUDAgent", conn)
+	a.Status = broadcast.NewBroadcaster(10)
+
+	if a.BasePLPMTU == 0 {
+		a.BasePLPMTU = pmtudBasePLPMTU
+	}
+	if a.MaxPLPMTU == 0 {
+		if conn.UseIPv6 {
+			a.MaxPLPMTU = pmtudMaxPLPMTUv6
+		} else {
+			a.MaxPLPMTU = pmtudMaxPLPMTUv4
+		}
+	}
+	if a.MaxProbes == 0 {
+		a.MaxProbes = pmtudMaxProbes
+	}
+	a.PLPMTU = a.BasePLPMTU
+	a.ProbedSizes = make(map[uint16]bool)
+
+	if a.SocketAgent != nil {
+		if err := a.SocketAgent.ConfigureDontFragment(); err != nil {
+			a.Logger.Printf("Could not set the Don't Fragment bit, probes may be fragmented: %s\n", err.Error())
+		}
+	}
+
+	incomingPackets := make(chan interface{}, 1000)
+	conn.IncomingPackets.Register(incomingPackets)
+	outgoingPackets := make(chan interface{}, 1000)
+	conn.OutgoingPackets.Register(outgoingPackets)
+	eLAvailable := make(chan interface{}, 10)
+	conn.EncryptionLevelsAvailable.Register(eLAvailable)
+
+	var acks, losses, estimates chan interface{}
+	if a.RecoveryAgent != nil {
+		acks = make(chan interface{}, 1000)
+		a.RecoveryAgent.Acks.Register(acks)
+		losses = make(chan interface{}, 1000)
+		a.RecoveryAgent.Losses.Register(losses)
+		if a.RecoveryAgent.RTTAgent != nil && a.RecoveryAgent.RTTAgent.Estimates != nil {
+			estimates = make(chan interface{}, 1000)
+			a.RecoveryAgent.RTTAgent.Estimates.Register(estimates)
+		}
+	}
+	var rtt RTTEstimates
+
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+
+	started := conn.CryptoStates[EncryptionLevel1RTT] != nil && conn.CryptoStates[EncryptionLevel1RTT].HeaderWrite != nil
+	var searching bool
+	var searchLow, searchHigh, probedSize uint16
+	var probeCount, largeLosses int
+	probes := make(map[PacketNumber]uint16)
+
+	stopTimer := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+	aeadOverhead := func() int {
+		return conn.CryptoStates[EncryptionLevel1RTT].Write.Overhead()
+	}
+	probeTimeout := func() time.Duration {
+		if a.ProbeTimeout > 0 {
+			return a.ProbeTimeout
+		}
+		return 2 * computeProbeTimeout(rtt, peerMaxAckDelay(conn))
+	}
+	setPLPMTU := func(size uint16) {
+		a.PLPMTU = size
+		if a.SendingAgent != nil { // The MTU of the SendingAgent bounds the frames of a packet
+			a.SendingAgent.SetMTU(size - uint16(1+len(conn.DestinationCID)+4+aeadOverhead()))
+		}
+	}
+	sendProbe := func() {
+		probeCount++
+		a.Logger.Printf("Probing a PLPMTU of %d bytes (attempt %d/%d)\n", probedSize, probeCount, a.MaxProbes)
+		a.SendingAgent.SendProbe(EncryptionLevel1RTT, int(probedSize)) // The probe is recorded once sent
+		stopTimer()
+		timer.Reset(probeTimeout())
+	}
+	nextProbe := func() {
+		if searchHigh <= searchLow {
+			searching = false
+			a.Logger.Printf("Search has completed, PLPMTU is %d bytes\n", a.PLPMTU)
+			a.Status.Submit(PMTUDStatus{a.PLPMTU, true, false})
+			return
+		}
+		probedSize = searchLow + (searchHigh-searchLow+1)/2
+		probeCount = 0
+		sendProbe()
+	}
+	startSearch := func(high uint16) {
+		if a.SendingAgent == nil {
+			a.Logger.Println("No SendingAgent to send the probes, the search is not started")
+			return
+		}
+		if tp := conn.TLSTPHandler.ReceivedParameters; tp != nil && tp.MaxPacketSize > 0 && tp.MaxPacketSize < uint64(high) {
+			high = uint16(tp.MaxPacketSize)
+		}
+		searching = true
+		searchLow, searchHigh = a.PLPMTU, high
+		probes = make(map[PacketNumber]uint16)
+		nextProbe()
+	}
+
+	go func() {
+		defer a.Logger.Println("Agent terminated")
+		defer close(a.closed)
+		defer a.RecoverCrash()
+
+		if started {
+			startSearch(a.MaxPLPMTU)
+		}
+
+		for {
+			select {
+			case i := <-eLAvailable:
+				if dEL := i.(DirectionalEncryptionLevel); !started && dEL.EncryptionLevel == EncryptionLevel1RTT && !dEL.Read {
+					started = true
+					startSearch(a.MaxPLPMTU)
+				}
+			case i := <-outgoingPackets:
+				if p, ok := i.(Framer); ok && isPMTUProbe(p) {
+					probes[p.Header().PacketNumber()] = uint16(len(p.Encode(p.EncodePayload())) + aeadOverhead())
+				}
+			case i := <-incomingPackets:
+				p, ok := i.(Framer)
+				if !ok || p.PNSpace() != PNSpaceAppData || len(probes) == 0 {
+					break
+				}
+				for _, f := range append(p.GetAll(AckType), p.GetAll(AckECNType)...) {
+					var ack *AckFrame
+					switch frame := f.(type) {
+					case *AckFrame:
+						ack = frame
+					case *AckECNFrame:
+						ack = &frame.AckFrame
+					}
+					for _, r := range ack.GetAckedRanges() {
+						for pn, size := range probes {
+							if !r.Contains(pn) {
+								continue
+							}
+							delete(probes, pn)
+							a.ProbedSizes[size] = true
+							if size > a.PLPMTU {
+								a.Logger.Printf("Probe of %d bytes was acknowledged\n", size)
+								setPLPMTU(size)
+								a.Status.Submit(PMTUDStatus{a.PLPMTU, false, false})
+							}
+							if searching && size > searchLow {
+								searchLow = size
+								if searchHigh < searchLow {
+									searchHigh = searchLow
+								}
+								if size >= probedSize {
+									stopTimer()
+									nextProbe()
+								}
+							}
+						}
+					}
+				}
+			case i := <-estimates:
+				rtt = i.(RTTEstimates)
+			case <-timer.C:
+				if !searching {
+					break
+				}
+				if probeCount < a.MaxProbes {
+					sendProbe()
+					break
+				}
+				a.Logger.Printf("No probe of %d bytes was acknowledged\n", probedSize)
+				if !a.ProbedSizes[probedSize] {
+					a.ProbedSizes[probedSize] = false
+				}
+				searchHigh = probedSize - 1
+				nextProbe()
+			case i := <-acks:
+				e := i.(AckEvent)
+				if !started || e.PNSpace != PNSpaceAppData || e.Discarded {
+					break
+				}
+				for _, p := range e.Packets {
+					if p.Size+aeadOverhead() > int(a.BasePLPMTU) {
+						largeLosses = 0
+					}
+				}
+			case i := <-losses:
+				e := i.(LossEvent)
+				if !started || e.PNSpace != PNSpaceAppData {
+					break
+				}
+				for _, p := range e.Packets {
+					if p.Size+aeadOverhead() > int(a.BasePLPMTU) {
+						largeLosses++
+					}
+				}
+				if largeLosses >= a.MaxProbes && a.PLPMTU > a.BasePLPMTU { // See https://tools.ietf.org/html/rfc8899#section-4.3
+					a.Logger.Printf("%d packets larger than %d bytes were lost, falling back to this size\n", largeLosses, a.BasePLPMTU)
+					largeLosses = 0
+					previous := a.PLPMTU
+					setPLPMTU(a.BasePLPMTU)
+					a.Status.Submit(PMTUDStatus{a.PLPMTU, false, true})
+					stopTimer()
+					startSearch(previous - 1)
+				}
+			case <-a.close:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// PMTU probes only contain a PING frame and padding. Their loss is not a sign of congestion, see
+// https://tools.ietf.org/html/rfc9000#section-14.4
+func isPMTUProbe(p Framer) bool {
+	if _, ok := p.(*ProtectedPacket); !ok || !p.Contains(PingType) || !p.Contains(PaddingFrameType) {
+		return false
+	}
+	for _, f := range p.GetFrames() {
+		if f.FrameType() != PingType && f.FrameType() != PaddingFrameType {
+			return false
+		}
+	}
+	return true
+}
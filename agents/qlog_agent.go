@@ -0,0 +1,397 @@
+package agents
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	. "github.com/RohitPanda/quic-tracker"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"time"
+)
+
+// When set, GetDefaultAgents adds a QlogAgent writing a file in this directory for each connection
+var QlogDirectory string
+
+// The QlogAgent writes the events of the connection in the qlog format, see
+// https://tools.ietf.org/html/draft-ietf-quic-qlog-main-schema-03 and
+// https://tools.ietf.org/html/draft-ietf-quic-qlog-quic-events-02. The events are written as JSON-SEQ records to
+// Writer, or to a file named after the server and the original destination CID in Directory when Writer is not set.
+// Packets sent and received, key updates, RTT estimates, congestion state and losses are logged. The latter require
+// the RTTAgent, the RecoveryAgent and the SendingAgent to be set.
+type QlogAgent struct {
+	BaseAgent
+	Directory     string
+	Writer        io.Writer
+	RTTAgent      *RTTAgent
+	RecoveryAgent *RecoveryAgent
+	SendingAgent  *SendingAgent
+	start         time.Time
+	keyPhases     map[Direction]KeyPhaseBit
+	generations   map[Direction]int
+}
+
+type qlogEvent struct {
+	Time float64     `json:"time"` // In milliseconds relative to the reference time
+	Name string      `json:"name"`
+	Data interface{} `json:"data"`
+}
+
+func (a *QlogAgent) Run(conn *Connection) {
+	a.Init("QlogAgent", conn)
+	a.start = time.Now()
+	a.keyPhases = map[Direction]KeyPhaseBit{ToServer: KeyPhaseZero, ToClient: KeyPhaseZero}
+	a.generations = make(map[Direction]int)
+
+	var file *os.File
+	if a.Writer == nil {
+		name := hex.EncodeToString(conn.OriginalDestinationCID) + ".sqlog"
+		if conn.ServerName != "" {
+			name = conn.ServerName + "_" + name
+		}
+		var err error
+		file, err = os.Create(path.Join(a.Directory, name))
+		if err != nil {
+			a.Logger.Println("Could not create qlog file:", err.Error())
+			close(a.closed)
+			return
+		}
+		a.Writer = file
+	}
+	a.writeRecord(map[string]interface{}{
+		"qlog_version": "0.3",
+		"qlog_format":  "JSON-SEQ",
+		"title":        "QUIC-Tracker " + conn.ServerName,
+		"trace": map[string]interface{}{
+			"vantage_point": map[string]string{"name": "quic-tracker", "type": "client"},
+			"common_fields": map[string]interface{}{
+				"ODCID":          hex.EncodeToString(conn.OriginalDestinationCID),
+				"protocol_type":  []string{"QUIC"},
+				"time_format":    "relative",
+				"reference_time": float64(a.start.UnixNano()) / 1e6,
+			},
+		},
+	})
+
+	incomingPackets := make(chan interface{}, 1000)
+	conn.IncomingPackets.Register(incomingPackets)
+	outgoingPackets := make(chan interface{}, 1000)
+	conn.OutgoingPackets.Register(outgoingPackets)
+	eLAvailable := make(chan interface{}, 10)
+	conn.EncryptionLevelsAvailable.Register(eLAvailable)
+
+	var estimates, losses, probeTimeouts, congestionStates chan interface{}
+	if a.RTTAgent != nil {
+		estimates = make(chan interface{}, 1000)
+		a.RTTAgent.Estimates.Register(estimates)
+	}
+	if a.RecoveryAgent != nil {
+		losses = make(chan interface{}, 1000)
+		a.RecoveryAgent.Losses.Register(losses)
+		probeTimeouts = make(chan interface{}, 10)
+		a.RecoveryAgent.ProbeTimeouts.Register(probeTimeouts)
+	}
+	if a.SendingAgent != nil && a.SendingAgent.CongestionStates != nil {
+		congestionStates = make(chan interface{}, 1000)
+		a.SendingAgent.CongestionStates.Register(congestionStates)
+	}
+
+	go func() {
+		defer a.Logger.Println("Agent terminated")
+		defer close(a.closed)
+		defer a.RecoverCrash()
+		if file != nil {
+			defer file.Close()
+		}
+
+		handle := func(i interface{}, events chan interface{}) {
+			switch events {
+			case outgoingPackets:
+				a.onPacket(i.(Packet), ToServer)
+			case incomingPackets:
+				a.onPacket(i.(Packet), ToClient)
+			case eLAvailable:
+				a.onEncryptionLevelAvailable(i.(DirectionalEncryptionLevel))
+			case estimates:
+				e := i.(RTTEstimates)
+				a.writeEvent("recovery:metrics_updated", map[string]interface{}{
+					"min_rtt":      float64(e.MinRTT) / 1e3,
+					"latest_rtt":   float64(e.LatestRTT) / 1e3,
+					"smoothed_rtt": float64(e.SmoothedRTT) / 1e3,
+					"rtt_variance": float64(e.RTTVar) / 1e3,
+				})
+			case losses:
+				e := i.(LossEvent)
+				for _, p := range e.Packets {
+					a.writeEvent("recovery:packet_lost", map[string]interface{}{
+						"header": map[string]interface{}{"packet_type": qlogPNSpaceType(e.PNSpace), "packet_number": p.PacketNumber},
+					})
+				}
+			case probeTimeouts:
+				a.writeEvent("recovery:metrics_updated", map[string]interface{}{"pto_count": i.(ProbeTimeoutEvent).PTOCount})
+			case congestionStates:
+				s := i.(CongestionState)
+				a.writeEvent("recovery:metrics_updated", map[string]interface{}{
+					"congestion_window": s.CongestionWindow,
+					"bytes_in_flight":   s.BytesInFlight,
+				})
+			}
+		}
+
+		channels := []chan interface{}{outgoingPackets, incomingPackets, eLAvailable, estimates, losses, probeTimeouts, congestionStates}
+		for {
+			select {
+			case i := <-outgoingPackets:
+				handle(i, outgoingPackets)
+			case i := <-incomingPackets:
+				handle(i, incomingPackets)
+			case i := <-eLAvailable:
+				handle(i, eLAvailable)
+			case i := <-estimates:
+				handle(i, estimates)
+			case i := <-losses:
+				handle(i, losses)
+			case i := <-probeTimeouts:
+				handle(i, probeTimeouts)
+			case i := <-congestionStates:
+				handle(i, congestionStates)
+			case <-a.close:
+				for _, c := range channels { // Logs the events still queued
+					for drained := c == nil; !drained; {
+						select {
+						case i := <-c:
+							handle(i, c)
+						default:
+							drained = true
+						}
+					}
+				}
+				return
+			}
+		}
+	}()
+}
+
+func (a *QlogAgent) writeRecord(record interface{}) {
+	content, err := json.Marshal(record)
+	if err != nil {
+		a.Logger.Println("Could not encode qlog record:", err.Error())
+		return
+	}
+	a.Writer.Write(append(append([]byte{0x1e}, content...), '\n')) // See https://tools.ietf.org/html/rfc7464
+}
+
+func (a *QlogAgent) writeEvent(name string, data interface{}) {
+	a.writeRecord(qlogEvent{float64(time.Now().Sub(a.start).Nanoseconds()) / 1e6, name, data})
+}
+
+func (a *QlogAgent) onPacket(packet Packet, direction Direction) {
+	header := map[string]interface{}{}
+	data := map[string]interface{}{"header": header}
+	switch p := packet.(type) {
+	case *VersionNegotiationPacket:
+		header["packet_type"] = "version_negotiation"
+		header["dcid"] = hex.EncodeToString(p.DestinationCID)
+		header["scid"] = hex.EncodeToString(p.SourceCID)
+		var versions []string
+		for _, v := range p.SupportedVersions {
+			versions = append(versions, v.String())
+		}
+		data["supported_versions"] = versions
+		data["raw"] = map[string]int{"length": len(p.EncodePayload())} // The payload contains the header
+	case *RetryPacket:
+		header["packet_type"] = "retry"
+		if h, ok := p.Header().(*RetryHeader); ok {
+			header["dcid"] = hex.EncodeToString(h.DestinationCID)
+			header["scid"] = hex.EncodeToString(h.SourceCID)
+		}
+		data["retry_token"] = map[string]string{"data": hex.EncodeToString(p.RetryToken)}
+	default:
+		switch h := packet.Header().(type) {
+		case *LongHeader:
+			header["packet_type"] = qlogPacketType(h.PacketType())
+			header["dcid"] = hex.EncodeToString(h.DestinationCID)
+			header["scid"] = hex.EncodeToString(h.SourceCID)
+		case *ShortHeader:
+			header["packet_type"] = qlogPacketType(ShortHeaderPacket)
+			header["dcid"] = hex.EncodeToString(h.DestinationCID)
+			header["key_phase_bit"] = h.KeyPhase
+			a.onKeyPhase(h.KeyPhase, direction)
+		}
+		header["packet_number"] = packet.Header().PacketNumber()
+	}
+	if _, ok := data["raw"]; !ok {
+		data["raw"] = map[string]int{"length": len(packet.Encode(packet.EncodePayload()))}
+	}
+
+	framer, isFramer := packet.(Framer)
+	var frames []interface{}
+	if isFramer {
+		frames = QlogFrames(framer.GetFrames())
+	}
+	if direction == ToServer {
+		if isFramer {
+			data["frames"] = frames
+		}
+		a.writeEvent("transport:packet_sent", data)
+		return
+	}
+	a.writeEvent("transport:packet_received", data)
+	if isFramer {
+		a.writeEvent("transport:frames_processed", map[string]interface{}{"frames": frames, "packet_number": header["packet_number"]})
+	}
+}
+
+// Logs the new secrets made available by the TLS stack
+func (a *QlogAgent) onEncryptionLevelAvailable(level DirectionalEncryptionLevel) {
+	var keyType string
+	switch level.EncryptionLevel {
+	case EncryptionLevel0RTT:
+		keyType = "0rtt_secret"
+	case EncryptionLevelHandshake:
+		keyType = "handshake_secret"
+	case EncryptionLevel1RTT:
+		keyType = "1rtt_secret"
+	default:
+		return
+	}
+	if level.Read {
+		keyType = "server_" + keyType
+	} else {
+		keyType = "client_" + keyType
+	}
+	a.writeEvent("security:key_updated", map[string]interface{}{"key_type": keyType, "trigger": "tls"})
+}
+
+// Logs the key updates, which are detected by a change of the key phase bit of the 1-RTT packets
+func (a *QlogAgent) onKeyPhase(keyPhase KeyPhaseBit, direction Direction) {
+	if a.keyPhases[direction] == keyPhase {
+		return
+	}
+	a.keyPhases[direction] = keyPhase
+	a.generations[direction]++
+	keyType, trigger := "client_1rtt_secret", "local_update"
+	if direction == ToClient {
+		keyType, trigger = "server_1rtt_secret", "remote_update"
+	}
+	a.writeEvent("security:key_updated", map[string]interface{}{"key_type": keyType, "trigger": trigger, "generation": a.generations[direction]})
+}
+
+func qlogPacketType(packetType PacketType) string {
+	switch packetType {
+	case Initial:
+		return "initial"
+	case Handshake:
+		return "handshake"
+	case ZeroRTTProtected:
+		return "0RTT"
+	case Retry:
+		return "retry"
+	}
+	return "1RTT"
+}
+
+func qlogPNSpaceType(space PNSpace) string {
+	switch space {
+	case PNSpaceInitial:
+		return "initial"
+	case PNSpaceHandshake:
+		return "handshake"
+	}
+	return "1RTT"
+}
+
+// Returns the qlog representation of the frames, consecutive padding frames are merged into one
+func QlogFrames(frames []Frame) []interface{} {
+	var qlogFrames []interface{}
+	var padding map[string]interface{}
+	for _, f := range frames {
+		if f.FrameType() == PaddingFrameType && padding != nil {
+			padding["payload_length"] = padding["payload_length"].(int) + 1
+			continue
+		}
+		q := qlogFrame(f)
+		padding = nil
+		if f.FrameType() == PaddingFrameType {
+			padding = q
+		}
+		qlogFrames = append(qlogFrames, q)
+	}
+	return qlogFrames
+}
+
+// Returns the qlog representation of the frame, see https://tools.ietf.org/html/draft-ietf-quic-qlog-quic-events-02#appendix-A.7
+func qlogFrame(frame Frame) map[string]interface{} {
+	if v := reflect.ValueOf(frame); v.Kind() != reflect.Ptr { // Some frames are queued by value
+		pointer := reflect.New(v.Type())
+		pointer.Elem().Set(v)
+		frame = pointer.Interface().(Frame)
+	}
+	switch f := frame.(type) {
+	case *PaddingFrame:
+		return map[string]interface{}{"frame_type": "padding", "payload_length": 1}
+	case *PingFrame:
+		return map[string]interface{}{"frame_type": "ping"}
+	case *AckFrame:
+		return qlogAckFrame(f)
+	case *AckECNFrame:
+		q := qlogAckFrame(&f.AckFrame)
+		q["ect0"], q["ect1"], q["ce"] = f.ECT0Count, f.ECT1Count, f.ECTCECount
+		return q
+	case *ResetStream:
+		return map[string]interface{}{"frame_type": "reset_stream", "stream_id": f.StreamId, "error_code": f.ApplicationErrorCode, "final_size": f.FinalOffset}
+	case *StopSendingFrame:
+		return map[string]interface{}{"frame_type": "stop_sending", "stream_id": f.StreamId, "error_code": f.ApplicationErrorCode}
+	case *CryptoFrame:
+		return map[string]interface{}{"frame_type": "crypto", "offset": f.Offset, "length": f.Length}
+	case *NewTokenFrame:
+		return map[string]interface{}{"frame_type": "new_token", "token": map[string]string{"data": hex.EncodeToString(f.Token)}}
+	case *StreamFrame:
+		return map[string]interface{}{"frame_type": "stream", "stream_id": f.StreamId, "offset": f.Offset, "length": f.Length, "fin": f.FinBit}
+	case *MaxDataFrame:
+		return map[string]interface{}{"frame_type": "max_data", "maximum": f.MaximumData}
+	case *MaxStreamDataFrame:
+		return map[string]interface{}{"frame_type": "max_stream_data", "stream_id": f.StreamId, "maximum": f.MaximumStreamData}
+	case *MaxStreamsFrame:
+		return map[string]interface{}{"frame_type": "max_streams", "stream_type": qlogStreamType(f.StreamsType), "maximum": f.MaximumStreams}
+	case *DataBlockedFrame:
+		return map[string]interface{}{"frame_type": "data_blocked", "limit": f.DataLimit}
+	case *StreamDataBlockedFrame:
+		return map[string]interface{}{"frame_type": "stream_data_blocked", "stream_id": f.StreamId, "limit": f.StreamDataLimit}
+	case *StreamsBlockedFrame:
+		return map[string]interface{}{"frame_type": "streams_blocked", "stream_type": qlogStreamType(f.StreamsType), "limit": f.StreamLimit}
+	case *NewConnectionIdFrame:
+		return map[string]interface{}{"frame_type": "new_connection_id", "sequence_number": f.Sequence, "retire_prior_to": f.RetirePriorTo,
+			"connection_id": hex.EncodeToString(f.ConnectionId), "stateless_reset_token": hex.EncodeToString(f.StatelessResetToken[:])}
+	case *RetireConnectionId:
+		return map[string]interface{}{"frame_type": "retire_connection_id", "sequence_number": f.SequenceNumber}
+	case *PathChallenge:
+		return map[string]interface{}{"frame_type": "path_challenge", "data": hex.EncodeToString(f.Data[:])}
+	case *PathResponse:
+		return map[string]interface{}{"frame_type": "path_response", "data": hex.EncodeToString(f.Data[:])}
+	case *ConnectionCloseFrame:
+		return map[string]interface{}{"frame_type": "connection_close", "error_space": "transport", "error_code": f.ErrorCode,
+			"trigger_frame_type": f.ErrorFrameType, "reason": f.ReasonPhrase}
+	case *ApplicationCloseFrame:
+		return map[string]interface{}{"frame_type": "connection_close", "error_space": "application"}
+	case *HandshakeDoneFrame:
+		return map[string]interface{}{"frame_type": "handshake_done"}
+	}
+	return map[string]interface{}{"frame_type": "unknown", "raw_frame_type": uint64(frame.FrameType())}
+}
+
+func qlogAckFrame(f *AckFrame) map[string]interface{} {
+	var ranges [][]PacketNumber
+	for _, r := range f.GetAckedRanges() {
+		ranges = append([][]PacketNumber{{r.Smallest, r.Largest}}, ranges...) // In ascending order
+	}
+	return map[string]interface{}{"frame_type": "ack", "ack_delay": f.AckDelay, "acked_ranges": ranges}
+}
+
+func qlogStreamType(streamsType StreamsType) string {
+	if streamsType == BidiStreams {
+		return "bidirectional"
+	}
+	return "unidirectional"
+}
@@ -1,9 +1,10 @@
 package agents
 
 import (
+	"bytes"
 	. "github.com/RohitPanda/quic-tracker"
+	"github.com/RohitPanda/quic-tracker/qpack"
 	"github.com/dustin/go-broadcast"
-	"github.com/mpiraux/ls-qpack-go"
 	"math"
 )
 
@@ -21,17 +22,35 @@ type EncodedHeaders struct {
 	Headers  []byte
 }
 
-// The QPACK Agent is TODO
+// A QPACKInstruction was read or written on the encoder or decoder stream given
+type QPACKInstruction struct {
+	StreamID    uint64
+	Instruction qpack.Instruction
+}
+
+type qpackEncoderSettings struct {
+	maxTableCapacity, tableCapacity, maxBlockedStreams uint64
+	opts                                               qpack.EncoderOpts
+}
+
+// The QPACK Agent encodes and decodes the headers of the HTTPAgent. It opens the encoder and decoder streams and
+// exchanges the instructions of the encoder and of the decoder over them. Every instruction read and written is
+// broadcast, so that the use of the dynamic table by the peer can be inspected.
 type QPACKAgent struct {
 	BaseAgent
-	EncoderStreamID uint64
-	DecoderStreamID uint64
-	DecodeHeaders   chan EncodedHeaders
-	DecodedHeaders  broadcast.Broadcaster //type: DecodedHeaders
-	EncodeHeaders   chan DecodedHeaders
-	EncodedHeaders  broadcast.Broadcaster //type: EncodedHeaders
-	encoder         *ls_qpack_go.QPackEncoder
-	decoder         *ls_qpack_go.QPackDecoder
+	EncoderStreamID     uint64
+	DecoderStreamID     uint64
+	MaxTableCapacity    uint64 // The capacity of the dynamic table of the decoder, defaults to 4096
+	MaxBlockedStreams   uint64 // The number of streams the decoder accepts to be blocked, defaults to 100
+	DecodeHeaders       chan EncodedHeaders
+	DecodedHeaders      broadcast.Broadcaster //type: DecodedHeaders
+	EncodeHeaders       chan DecodedHeaders
+	EncodedHeaders      broadcast.Broadcaster //type: EncodedHeaders
+	InstructionReceived broadcast.Broadcaster //type: QPACKInstruction
+	InstructionSent     broadcast.Broadcaster //type: QPACKInstruction
+	encoder             *qpack.Encoder
+	decoder             *qpack.Decoder
+	initEncoder         chan qpackEncoderSettings
 }
 
 const (
@@ -39,42 +58,61 @@ const (
 )
 
 func (a *QPACKAgent) Run(conn *Connection) {
-	a.Init("QPACKAgent", conn.OriginalDestinationCID)
+	a.Init("QPACKAgent", conn)
 	a.DecodedHeaders = broadcast.NewBroadcaster(1000)
 	a.EncodedHeaders = broadcast.NewBroadcaster(1000)
+	a.InstructionReceived = broadcast.NewBroadcaster(1000)
+	a.InstructionSent = broadcast.NewBroadcaster(1000)
 	a.DecodeHeaders = make(chan EncodedHeaders, 1000)
 	a.EncodeHeaders = make(chan DecodedHeaders, 1000)
+	a.initEncoder = make(chan qpackEncoderSettings, 1)
 
 	incomingPackets := make(chan interface{}, 1000)
 	conn.IncomingPackets.Register(incomingPackets)
 
-	a.encoder = ls_qpack_go.NewQPackEncoder(false)
-	a.decoder = ls_qpack_go.NewQPackDecoder(1024, 100)
+	if a.MaxTableCapacity == 0 {
+		a.MaxTableCapacity = 4096
+	}
+	if a.MaxBlockedStreams == 0 {
+		a.MaxBlockedStreams = 100
+	}
+	a.encoder = qpack.NewEncoder(0)
+	a.decoder = qpack.NewDecoder(a.MaxTableCapacity, a.MaxBlockedStreams)
 
 	peerEncoderStreamId := QPACKNoStream
 	peerDecoderStreamId := QPACKNoStream
 	peerEncoderStream := make(chan interface{}, 1000)
 	peerDecoderStream := make(chan interface{}, 1000)
 
-	checkForDecodedHeaders := func() {
-		for _, dhb := range a.decoder.DecodedHeaderBlocks() {
-			if len(dhb.Headers()) > 0 {
-				headers := make([]HTTPHeader, len(dhb.Headers()))
-				for i, h := range dhb.Headers() {
-					headers[i] = HTTPHeader{h.Name, h.Value}
-				}
-				a.DecodedHeaders.Submit(DecodedHeaders{dhb.StreamID, headers})
-				if len(dhb.DecoderStream()) > 0 {
-					conn.FrameQueue.Submit(QueuedFrame{NewStreamFrame(a.DecoderStreamID, conn.Streams.Get(a.DecoderStreamID), dhb.DecoderStream(), false), EncryptionLevelBestAppData})
-				}
-				a.Logger.Printf("Submitted %d decoded headers on stream %d\n", len(headers), dhb.StreamID)
-			}
+	sendInstructions := func(streamID uint64, instructions []qpack.Instruction) {
+		if len(instructions) == 0 {
+			return
+		}
+		for _, i := range instructions {
+			a.InstructionSent.Submit(QPACKInstruction{streamID, i})
+			a.Logger.Printf("Sending %s on stream %d\n", i.String(), streamID)
+		}
+		conn.FrameQueue.Submit(QueuedFrame{NewStreamFrame(streamID, conn.Streams.Get(streamID), qpack.EncodeInstructions(instructions), false), EncryptionLevelBestAppData})
+	}
+	receivedInstructions := func(streamID uint64, instructions []qpack.Instruction) {
+		for _, i := range instructions {
+			a.InstructionReceived.Submit(QPACKInstruction{streamID, i})
+			a.Logger.Printf("Received %s on stream %d\n", i.String(), streamID)
+		}
+	}
+	submitDecodedHeaders := func(streamID uint64, fields []qpack.HeaderField) {
+		headers := make([]HTTPHeader, len(fields))
+		for i, h := range fields {
+			headers[i] = HTTPHeader{h.Name, h.Value}
 		}
+		a.DecodedHeaders.Submit(DecodedHeaders{streamID, headers})
+		a.Logger.Printf("Submitted %d decoded headers on stream %d\n", len(headers), streamID)
 	}
 
 	go func() {
 		defer a.Logger.Println("Agent terminated")
 		defer close(a.closed)
+		defer a.RecoverCrash()
 		for {
 			select {
 			case i := <-incomingPackets:
@@ -82,85 +120,99 @@ func (a *QPACKAgent) Run(conn *Connection) {
 				if p.PNSpace() == PNSpaceAppData {
 					for _, f := range p.(Framer).GetAll(StreamType) {
 						s := f.(*StreamFrame)
-						if s.Offset == 0 && s.StreamId&0x2 == 2 {
-							if s.StreamData[0] == 'H' {
-								if peerEncoderStreamId != QPACKNoStream {
-									a.Logger.Printf("Peer attempted to open another encoder stream on stream %d\n", s.StreamId)
-									continue
-								}
-								peerEncoderStreamId = s.StreamId
-								conn.Streams.Get(s.StreamId).ReadChan.Register(peerEncoderStream)
-								a.Logger.Printf("Peer opened encoder stream on stream %d\n", s.StreamId)
-								if s.Length > 1 {
-									peerEncoderStream <- s.StreamData[1:]
-								}
-							} else if s.StreamData[0] == 'h' {
-								if peerDecoderStreamId != QPACKNoStream {
-									a.Logger.Printf("Peer attempted to open another decoder stream on stream %d\n", s.StreamId)
-									continue
-								}
-								peerDecoderStreamId = s.StreamId
-								conn.Streams.Get(s.StreamId).ReadChan.Register(peerDecoderStream)
-								a.Logger.Printf("Peer opened decoder stream on stream %d\n", s.StreamId)
-								if s.Length > 1 {
-									peerDecoderStream <- s.StreamData[1:]
-								}
+						if s.Offset != 0 || s.StreamId&0x2 != 2 {
+							continue
+						}
+						streamType, err := ReadVarInt(bytes.NewReader(s.StreamData))
+						if err != nil {
+							a.Logger.Printf("Could not read the type of stream %d from %d bytes\n", s.StreamId, len(s.StreamData))
+							continue
+						}
+						data := s.StreamData[streamType.Length:]
+						switch streamType.Value {
+						case qpack.EncoderStreamType:
+							if peerEncoderStreamId != QPACKNoStream {
+								a.Logger.Printf("Peer attempted to open another encoder stream on stream %d\n", s.StreamId)
+								continue
+							}
+							peerEncoderStreamId = s.StreamId
+							conn.Streams.Get(s.StreamId).ReadChan.Register(peerEncoderStream)
+							a.Logger.Printf("Peer opened encoder stream on stream %d\n", s.StreamId)
+							if len(data) > 0 {
+								peerEncoderStream <- data
+							}
+						case qpack.DecoderStreamType:
+							if peerDecoderStreamId != QPACKNoStream {
+								a.Logger.Printf("Peer attempted to open another decoder stream on stream %d\n", s.StreamId)
+								continue
+							}
+							peerDecoderStreamId = s.StreamId
+							conn.Streams.Get(s.StreamId).ReadChan.Register(peerDecoderStream)
+							a.Logger.Printf("Peer opened decoder stream on stream %d\n", s.StreamId)
+							if len(data) > 0 {
+								peerDecoderStream <- data
 							}
 						}
 					}
 				}
 			case i := <-peerEncoderStream:
 				data := i.([]byte)
-				if a.decoder.EncoderIn(data) {
-					a.Logger.Printf("Decoder failed on encoder stream input\n")
+				instructions, unblocked, err := a.decoder.EncoderIn(data)
+				receivedInstructions(peerEncoderStreamId, instructions)
+				if err != nil {
+					a.Logger.Printf("Decoder failed on encoder stream input: %s\n", err.Error())
 					return
 				}
 				a.Logger.Printf("Fed %d bytes from the encoder stream to the decoder\n", len(data))
-				checkForDecodedHeaders()
+				for _, dfs := range unblocked {
+					submitDecodedHeaders(dfs.StreamID, dfs.Headers)
+				}
+				sendInstructions(a.DecoderStreamID, a.decoder.DecoderInstructions())
 			case i := <-peerDecoderStream:
 				data := i.([]byte)
-				if a.encoder.DecoderIn(data) {
-					a.Logger.Printf("Encoder failed on decoder stream input\n")
+				instructions, err := a.encoder.DecoderIn(data)
+				receivedInstructions(peerDecoderStreamId, instructions)
+				if err != nil {
+					a.Logger.Printf("Encoder failed on decoder stream input: %s\n", err.Error())
 					return
 				}
 				a.Logger.Printf("Fed %d bytes from the decoder stream to the encoder\n", len(data))
-				checkForDecodedHeaders()
+			case s := <-a.initEncoder:
+				a.encoder = qpack.NewEncoder(s.opts)
+				sendInstructions(a.EncoderStreamID, a.encoder.Init(s.maxTableCapacity, s.tableCapacity, s.maxBlockedStreams))
+				a.Logger.Printf("Encoder initialized with MTC=%d, TC=%d, MBS=%d and opts=%d\n", s.maxTableCapacity, s.tableCapacity, s.maxBlockedStreams, s.opts)
 			case e := <-a.EncodeHeaders:
-				if a.encoder.StartHeaderBlock(e.StreamID, /*TODO*/ 0) {
-					a.Logger.Printf("Encoder failed to start header block\n")
-					return
+				fields := make([]qpack.HeaderField, len(e.Headers))
+				for i, h := range e.Headers {
+					fields[i] = qpack.HeaderField{Name: h.Name, Value: h.Value}
 				}
-				var encStream []byte
-				var encHeaders []byte
-				for _, h := range e.Headers {
-					es, eh := a.encoder.Encode(h.Name, h.Value)
-					encStream = append(encStream, es...)
-					encHeaders = append(encHeaders, eh...)
-				}
-				hdp := a.encoder.EndHeaderBlock()
-				payload := append(hdp, encHeaders...)
+				payload, instructions := a.encoder.Encode(e.StreamID, fields)
+				sendInstructions(a.EncoderStreamID, instructions)
 				a.EncodedHeaders.Submit(EncodedHeaders{e.StreamID, payload})
-				a.Logger.Printf("Encoded %d headers in %d bytes, with %d additional bytes on the encoder stream\n", len(e.Headers), len(payload), len(encStream))
-				if len(encStream) > 0 {
-					conn.FrameQueue.Submit(QueuedFrame{NewStreamFrame(a.EncoderStreamID, conn.Streams.Get(a.EncoderStreamID), encStream, false), EncryptionLevelBestAppData})
-					a.Logger.Printf("Enqueued %d bytes on the encoder stream\n", len(encStream))
-				}
+				a.Logger.Printf("Encoded %d headers in %d bytes, with %d instructions on the encoder stream\n", len(e.Headers), len(payload), len(instructions))
 			case d := <-a.DecodeHeaders:
-				ret := a.decoder.HeaderIn(d.Headers, d.StreamID)
-				if ret < len(d.Headers) {
-					a.Logger.Printf("Decoder is blocked and waiting for encoder input before decoding the %d bytes remaining on stream %d\n", len(d.Headers) - ret, d.StreamID)
+				headers, blocked, err := a.decoder.HeaderIn(d.StreamID, d.Headers)
+				if err != nil {
+					a.Logger.Printf("Decoder failed on stream %d: %s\n", d.StreamID, err.Error())
+					return
 				}
-				checkForDecodedHeaders()
+				if blocked {
+					a.Logger.Printf("Decoder is blocked and waiting for encoder input before decoding the %d bytes on stream %d\n", len(d.Headers), d.StreamID)
+					continue
+				}
+				submitDecodedHeaders(d.StreamID, headers)
+				sendInstructions(a.DecoderStreamID, a.decoder.DecoderInstructions())
 			case <-a.close:
 				return
 			}
 		}
 	}()
 
-	conn.FrameQueue.Submit(QueuedFrame{NewStreamFrame(a.EncoderStreamID, conn.Streams.Get(a.EncoderStreamID), []byte{'H'}, false), EncryptionLevelBestAppData})
-	conn.FrameQueue.Submit(QueuedFrame{NewStreamFrame(a.DecoderStreamID, conn.Streams.Get(a.DecoderStreamID), []byte{'h'}, false), EncryptionLevelBestAppData})
+	conn.FrameQueue.Submit(QueuedFrame{NewStreamFrame(a.EncoderStreamID, conn.Streams.Get(a.EncoderStreamID), NewVarInt(qpack.EncoderStreamType).Encode(), false), EncryptionLevelBestAppData})
+	conn.FrameQueue.Submit(QueuedFrame{NewStreamFrame(a.DecoderStreamID, conn.Streams.Get(a.DecoderStreamID), NewVarInt(qpack.DecoderStreamType).Encode(), false), EncryptionLevelBestAppData})
+}
+
+// Configures the encoder with the settings of the peer and the capacity of the dynamic table to use
+func (a *QPACKAgent) InitEncoder(maxTableCapacity uint64, tableCapacity uint64, maxBlockedStreams uint64, opts qpack.EncoderOpts) {
+	a.initEncoder <- qpackEncoderSettings{maxTableCapacity, tableCapacity, maxBlockedStreams, opts}
 }
-func (a *QPACKAgent) InitEncoder(headerTableSize uint, dynamicTablesize uint, maxRiskedStreams uint, opts uint32) {
-	a.encoder.Init(headerTableSize, dynamicTablesize, maxRiskedStreams, opts)
-	a.Logger.Printf("Encoder initialized with HTS=%d, DTS=%d, MRS=%d and opts=%d\n", headerTableSize, dynamicTablesize, maxRiskedStreams, opts)
-}
\ No newline at end of file
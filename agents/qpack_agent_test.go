@@ -0,0 +1,41 @@
+package agents
+
+import (
+	. "github.com/RohitPanda/quic-tracker"
+	"github.com/RohitPanda/quic-tracker/qpack"
+	"testing"
+	"time"
+)
+
+// See https://tools.ietf.org/html/rfc9204#section-4.2
+func TestQPACKAgentStreamTypes(t *testing.T) {
+	conn := testConnection()
+	a := &QPACKAgent{EncoderStreamID: 6, DecoderStreamID: 10}
+	a.Run(conn)
+	defer a.Join()
+	defer a.Stop()
+
+	instructions := make(chan interface{}, 10)
+	a.InstructionReceived.Register(instructions)
+
+	p := NewProtectedPacket(conn)
+	p.AddFrame(NewStreamFrame(3, conn.Streams.Get(3), nil, false))
+	p.AddFrame(NewStreamFrame(7, conn.Streams.Get(7), []byte{'H', 0x3f, 0xe1, 0x1f}, false))
+	p.AddFrame(NewStreamFrame(11, conn.Streams.Get(11), append(NewVarInt(qpack.EncoderStreamType).Encode(), qpack.EncodeInstructions([]qpack.Instruction{&qpack.SetDynamicTableCapacity{Capacity: 4096}})...), false))
+	conn.IncomingPackets.Submit(p)
+
+	select {
+	case i := <-instructions:
+		q := i.(QPACKInstruction)
+		if c, ok := q.Instruction.(*qpack.SetDynamicTableCapacity); !ok || q.StreamID != 11 || c.Capacity != 4096 {
+			t.Errorf("expected a set_dynamic_table_capacity(4096) on stream 11, got %s on stream %d", q.Instruction.String(), q.StreamID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the instruction on the encoder stream was not received")
+	}
+	select {
+	case i := <-instructions:
+		t.Errorf("unexpected instruction %s on stream %d", i.(QPACKInstruction).Instruction.String(), i.(QPACKInstruction).StreamID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -2,28 +2,120 @@ package agents
 
 import (
 	. "github.com/RohitPanda/quic-tracker"
+	"github.com/dustin/go-broadcast"
+	"sort"
 	"time"
 )
 
-// The RecoveryAgent is responsible of retransmitting frames that are part of packets considered as lost. It currently
-// implements a simpler version of the Fast Retransmit mechanism and a linear Retransmission Timeout alarm.
+const ( // See https://tools.ietf.org/html/rfc9002#appendix-A.2
+	kPacketThreshold    = 3
+	kTimeThreshold      = 9.0 / 8
+	kGranularity        = time.Millisecond
+	kInitialRTT         = 333 * time.Millisecond
+	kDefaultMaxAckDelay = 25 * time.Millisecond
+	kMaxProbes          = 2
+	kMaxPTOBackoff      = 16
+)
+
+// The RecoveryAgent is responsible of detecting lost packets and retransmitting the frames they contained. It
+// implements the packet and time thresholds loss detection as well as the probe timeout of RFC 9002, using the
+// estimates published by the RTTAgent when available. Acknowledgements, losses and probe timeouts are published on
+// broadcasters. PMTU probes are not tracked, as their loss is not a sign of congestion.
 type RecoveryAgent struct {
 	BaseAgent
-	conn                 *Connection
-	retransmissionBuffer map[PNSpace]map[PacketNumber]RetransmittableFrames
-	TimerValue           time.Duration
+	conn              *Connection
+	RTTAgent          *RTTAgent
+	SendingAgent      *SendingAgent         // Sends the padded Initial probes, an unpadded PING frame is queued when not set
+	TimerValue        time.Duration         // Replaces the probe timeout computed from the RTT estimates when set
+	Acks              broadcast.Broadcaster //type: AckEvent
+	Losses            broadcast.Broadcaster //type: LossEvent
+	ProbeTimeouts     broadcast.Broadcaster //type: ProbeTimeoutEvent
+	PTOCount          int
+	spaces            map[PNSpace]*recoverySpace
+	rtt               RTTEstimates
+	initialSent       bool
+	handshakeKeys     bool
+	handshakeComplete bool
+	timer             *time.Timer
+}
+
+// A LossEvent contains the packets of a given space that were declared lost at the same time
+type LossEvent struct {
+	PNSpace
+	Packets []LostPacket
+}
+
+// A ProbeTimeoutEvent is sent when the probe timeout of the given space expired, PTOCount is the number of
+// consecutive probe timeouts
+type ProbeTimeoutEvent struct {
+	PNSpace
+	PTOCount int
+}
+
+// An AckEvent contains the ack-eliciting packets of a given space that were newly acknowledged by an ACK frame. When
+// Discarded is set, the packets were not acknowledged but removed from flight because their space was discarded.
+type AckEvent struct {
+	PNSpace
+	Packets   []AckedPacket
+	Discarded bool
+}
+
+type AckedPacket struct {
+	PacketNumber
+	SentTime time.Time
+	Size     int
+}
+
+type LostPacket struct {
+	PacketNumber
+	SentTime time.Time
+	Size     int
+}
+
+type trackedPacket struct {
+	sent         time.Time
+	size         int
+	ackEliciting bool
+	frames       *RetransmittableFrames
+}
+
+type recoverySpace struct {
+	sentPackets          map[PacketNumber]*trackedPacket
+	largestAcked         PacketNumber
+	hasLargestAcked      bool
+	lossTime             time.Time
+	lastAckElicitingSent time.Time
+}
+
+func newRecoverySpace() *recoverySpace {
+	return &recoverySpace{sentPackets: make(map[PacketNumber]*trackedPacket)}
+}
+
+func (s *recoverySpace) ackElicitingInFlight() bool {
+	for _, p := range s.sentPackets {
+		if p.ackEliciting {
+			return true
+		}
+	}
+	return false
 }
 
 func (a *RecoveryAgent) Run(conn *Connection) {
-	a.Init("RecoveryAgent", conn.OriginalDestinationCID)
+	a.Init("RecoveryAgent", conn)
 	a.conn = conn
+	a.Acks = broadcast.NewBroadcaster(1000)
+	a.Losses = broadcast.NewBroadcaster(1000)
+	a.ProbeTimeouts = broadcast.NewBroadcaster(10)
 
-	a.retransmissionBuffer = map[PNSpace]map[PacketNumber]RetransmittableFrames{
-		PNSpaceInitial:   make(map[PacketNumber]RetransmittableFrames),
-		PNSpaceHandshake: make(map[PacketNumber]RetransmittableFrames),
-		PNSpaceAppData:   make(map[PacketNumber]RetransmittableFrames),
+	a.spaces = map[PNSpace]*recoverySpace{
+		PNSpaceInitial:   newRecoverySpace(),
+		PNSpaceHandshake: newRecoverySpace(),
+		PNSpaceAppData:   newRecoverySpace(),
+	}
+	a.timer = time.NewTimer(0)
+	if !a.timer.Stop() {
+		<-a.timer.C
 	}
-	retransmissionTicker := time.NewTicker(100 * time.Millisecond)
 
 	incomingPackets := make(chan interface{}, 1000)
 	conn.IncomingPackets.Register(incomingPackets)
@@ -34,22 +126,22 @@ func (a *RecoveryAgent) Run(conn *Connection) {
 	eLAvailable := make(chan interface{}, 1000)
 	conn.EncryptionLevelsAvailable.Register(eLAvailable)
 
+	var estimates chan interface{}
+	if a.RTTAgent != nil && a.RTTAgent.Estimates != nil {
+		estimates = make(chan interface{}, 1000)
+		a.RTTAgent.Estimates.Register(estimates)
+	}
+
 	go func() {
 		defer a.Logger.Println("Agent terminated")
 		defer close(a.closed)
+		defer a.RecoverCrash()
 		for {
 			select {
-			case <-retransmissionTicker.C:
-				var batch RetransmitBatch
-				for _, buffer := range a.retransmissionBuffer {
-					for k, v := range buffer {
-						if time.Now().Sub(v.Timestamp) > a.TimerValue {
-							batch = append(batch, v)
-							delete(buffer, k)
-						}
-					}
-				}
-				a.RetransmitBatch(batch)
+			case <-a.timer.C:
+				a.onLossDetectionTimeout()
+			case i := <-estimates:
+				a.rtt = i.(RTTEstimates)
 			case i := <-incomingPackets:
 				switch p := i.(type) {
 				case Framer:
@@ -67,65 +159,323 @@ func (a *RecoveryAgent) Run(conn *Connection) {
 						if ack.LargestAcknowledged > conn.LargestPNsAcknowledged[p.PNSpace()] {
 							conn.LargestPNsAcknowledged[p.PNSpace()] = ack.LargestAcknowledged
 						}
-						a.RetransmitBatch(a.ProcessAck(ack, p.PNSpace()))
+						a.ProcessAck(ack, p.PNSpace())
 					}
 					if len(ackFrames) == 0 && p.PNSpace() == PNSpaceInitial { // Some implementations do not send ACK in this PNSpace
 						a.Logger.Printf("Packet %s doesn't contain ACK frames, emptying the corresponding retransmission buffer anyway\n", p.ShortString())
-						a.retransmissionBuffer[p.PNSpace()] = make(map[PacketNumber]RetransmittableFrames)
+						a.discardSpace(PNSpaceInitial)
 					}
 				case *RetryPacket:
 					a.Logger.Println("Received a Retry packet, emptying Initial retransmit buffer")
-					a.retransmissionBuffer[PNSpaceInitial] = make(map[PacketNumber]RetransmittableFrames)
+					a.discardSpace(PNSpaceInitial)
+					a.PTOCount = 0
 				case *VersionNegotiationPacket:
 					a.Logger.Println("Received a VN packet, emptying Initial retransmit buffer")
-					a.retransmissionBuffer[PNSpaceInitial] = make(map[PacketNumber]RetransmittableFrames)
+					a.discardSpace(PNSpaceInitial)
+					a.PTOCount = 0
 				}
 			case i := <-outgoingPackets:
 				switch p := i.(type) {
 				case Framer:
-					frames := p.GetRetransmittableFrames()
-					if len(frames) > 0 {
-						a.retransmissionBuffer[p.PNSpace()][p.Header().PacketNumber()] = *NewRetransmittableFrames(frames, p.EncryptionLevel())
+					if !isAckEliciting(p) || isPMTUProbe(p) {
+						break
 					}
+					tp := &trackedPacket{sent: time.Now(), size: len(p.Encode(p.EncodePayload())), ackEliciting: true}
+					if frames := p.GetRetransmittableFrames(); len(frames) > 0 {
+						tp.frames = NewRetransmittableFrames(frames, p.EncryptionLevel())
+					}
+					a.onPacketSent(p.PNSpace(), p.Header().PacketNumber(), tp)
 				}
 			case i := <-eLAvailable:
 				eL := i.(DirectionalEncryptionLevel)
-				if eL.EncryptionLevel == EncryptionLevel1RTT { // Handshake has completed, empty the retransmission buffers
+				if eL.EncryptionLevel == EncryptionLevelHandshake && !eL.Read {
+					a.handshakeKeys = true
+				}
+				if eL.EncryptionLevel == EncryptionLevel1RTT && !a.handshakeComplete { // Handshake has completed, empty the retransmission buffers
 					a.Logger.Println("Handshake has completed, emptying the two retransmission buffers")
-					a.retransmissionBuffer[PNSpaceInitial] = make(map[PacketNumber]RetransmittableFrames)
-					a.retransmissionBuffer[PNSpaceHandshake] = make(map[PacketNumber]RetransmittableFrames)
+					a.handshakeComplete = true
+					a.discardSpace(PNSpaceInitial)
+					a.discardSpace(PNSpaceHandshake)
+					a.PTOCount = 0
 				}
 			case <-a.close:
+				a.timer.Stop()
 				return
 			}
 		}
 	}()
 }
 
-func (a *RecoveryAgent) ProcessAck(ack *AckFrame, space PNSpace) RetransmitBatch { // Triggers fast retransmit and removes frames scheduled to be retransmitted
-	threshold := uint64(1000)
-	var frames RetransmitBatch
-	currentPacketNumber := ack.LargestAcknowledged
-	buffer := a.retransmissionBuffer[space]
-	delete(buffer, currentPacketNumber)
-	for i := uint64(0); i < ack.AckBlocks[0].Block && i < threshold; i++ {
-		currentPacketNumber--
-		delete(buffer, currentPacketNumber)
-	}
-	for _, ackBlock := range ack.AckBlocks[1:] {
-		for i := uint64(0); i <= ackBlock.Gap && i < threshold; i++ { // See https://tools.ietf.org/html/draft-ietf-quic-transport-10#section-8.15.1
-			if f, ok := buffer[currentPacketNumber]; ok {
-				frames = append(frames, f)
+func (a *RecoveryAgent) onPacketSent(space PNSpace, pn PacketNumber, p *trackedPacket) {
+	s := a.spaces[space]
+	s.sentPackets[pn] = p
+	s.lastAckElicitingSent = p.sent
+	if space == PNSpaceInitial {
+		a.initialSent = true
+	}
+	a.setLossDetectionTimer()
+}
+
+// Removes the packets acknowledged by the frame and detects the packets that are now considered lost
+func (a *RecoveryAgent) ProcessAck(ack *AckFrame, space PNSpace) {
+	s := a.spaces[space]
+	if !s.hasLargestAcked || ack.LargestAcknowledged > s.largestAcked {
+		s.largestAcked = ack.LargestAcknowledged
+		s.hasLargestAcked = true
+	}
+
+	ranges := ack.GetAckedRanges()
+	var newlyAcked []AckedPacket
+	for pn, p := range s.sentPackets { // Ranges can be arbitrarily large, iterating on the packets sent is safer
+		for _, r := range ranges {
+			if r.Contains(pn) {
+				delete(s.sentPackets, pn)
+				newlyAcked = append(newlyAcked, AckedPacket{pn, p.sent, p.size})
+				break
+			}
+		}
+	}
+	if len(newlyAcked) == 0 {
+		return
+	}
+	a.Acks.Submit(AckEvent{space, newlyAcked, false})
+
+	a.detectLostPackets(space)
+	if space != PNSpaceInitial { // The client cannot be sure the server has validated its address before, see https://tools.ietf.org/html/rfc9002#section-6.2.1
+		a.PTOCount = 0
+	}
+	a.setLossDetectionTimer()
+}
+
+// Returns the estimates as durations, the initial RTT is used until the first estimate is received
+func rttDurations(rtt RTTEstimates) (latestRTT time.Duration, smoothedRTT time.Duration, rttVar time.Duration) {
+	if rtt.SmoothedRTT == 0 {
+		return kInitialRTT, kInitialRTT, kInitialRTT / 2
+	}
+	return time.Duration(rtt.LatestRTT) * time.Microsecond, time.Duration(rtt.SmoothedRTT) * time.Microsecond, time.Duration(rtt.RTTVar) * time.Microsecond
+}
+
+func (a *RecoveryAgent) rttEstimates() (latestRTT time.Duration, smoothedRTT time.Duration, rttVar time.Duration) {
+	return rttDurations(a.rtt)
+}
+
+func peerMaxAckDelay(conn *Connection) time.Duration {
+	if tp := conn.TLSTPHandler.ReceivedParameters; tp != nil && tp.MaxAckDelay > 0 {
+		return time.Duration(tp.MaxAckDelay) * time.Millisecond
+	}
+	return kDefaultMaxAckDelay
+}
+
+// Returns the probe timeout before any backoff, see https://tools.ietf.org/html/rfc9002#section-6.2.1
+func computeProbeTimeout(rtt RTTEstimates, maxAckDelay time.Duration) time.Duration {
+	_, smoothedRTT, rttVar := rttDurations(rtt)
+	pto := smoothedRTT + 4*rttVar
+	if 4*rttVar < kGranularity {
+		pto = smoothedRTT + kGranularity
+	}
+	return pto + maxAckDelay
+}
+
+func (a *RecoveryAgent) probeTimeout(space PNSpace) time.Duration {
+	var maxAckDelay time.Duration
+	if space == PNSpaceAppData {
+		maxAckDelay = peerMaxAckDelay(a.conn)
+	}
+	pto := computeProbeTimeout(a.rtt, maxAckDelay)
+	if a.TimerValue > 0 {
+		pto = a.TimerValue
+	}
+	backoff := a.PTOCount
+	if backoff > kMaxPTOBackoff {
+		backoff = kMaxPTOBackoff
+	}
+	return pto * (1 << uint(backoff))
+}
+
+func (a *RecoveryAgent) detectLostPackets(space PNSpace) { // See https://tools.ietf.org/html/rfc9002#appendix-A.10
+	s := a.spaces[space]
+	s.lossTime = time.Time{}
+	if !s.hasLargestAcked {
+		return
+	}
+
+	latestRTT, smoothedRTT, _ := a.rttEstimates()
+	if smoothedRTT > latestRTT {
+		latestRTT = smoothedRTT
+	}
+	lossDelay := time.Duration(kTimeThreshold * float64(latestRTT))
+	if lossDelay < kGranularity {
+		lossDelay = kGranularity
+	}
+	lostSendTime := time.Now().Add(-lossDelay)
+
+	var lost []LostPacket
+	var batch RetransmitBatch
+	for pn, p := range s.sentPackets {
+		if pn > s.largestAcked {
+			continue
+		}
+		if !p.sent.After(lostSendTime) || s.largestAcked >= pn+kPacketThreshold {
+			delete(s.sentPackets, pn)
+			lost = append(lost, LostPacket{pn, p.sent, p.size})
+			if p.frames != nil {
+				batch = append(batch, *p.frames)
+			}
+		} else if s.lossTime.IsZero() || p.sent.Add(lossDelay).Before(s.lossTime) {
+			s.lossTime = p.sent.Add(lossDelay)
+		}
+	}
+
+	if len(lost) > 0 {
+		sort.Slice(lost, func(i, j int) bool { return lost[i].PacketNumber < lost[j].PacketNumber })
+		sort.Sort(batch)
+		a.Logger.Printf("Declared %d packet(s) lost in space %s, largest lost is %d\n", len(lost), space.String(), lost[len(lost)-1].PacketNumber)
+		a.Losses.Submit(LossEvent{space, lost})
+		a.RetransmitBatch(batch)
+	}
+}
+
+func (a *RecoveryAgent) earliestLossTime() (time.Time, PNSpace) {
+	var earliest time.Time
+	var space PNSpace
+	for _, sp := range []PNSpace{PNSpaceInitial, PNSpaceHandshake, PNSpaceAppData} {
+		if t := a.spaces[sp].lossTime; !t.IsZero() && (earliest.IsZero() || t.Before(earliest)) {
+			earliest, space = t, sp
+		}
+	}
+	return earliest, space
+}
+
+// The client assumes the server has validated its address once one of its Handshake packets is acknowledged, see
+// https://tools.ietf.org/html/rfc9002#section-6.2.2.1
+func (a *RecoveryAgent) peerCompletedAddressValidation() bool {
+	return a.handshakeComplete || a.spaces[PNSpaceHandshake].hasLargestAcked
+}
+
+func (a *RecoveryAgent) earliestPTO() (time.Time, PNSpace) {
+	var earliest time.Time
+	var space PNSpace
+	if !a.ackElicitingInFlight() { // Arms the PTO to prevent an anti-amplification deadlock, see https://tools.ietf.org/html/rfc9002#section-6.2.2.1
+		if !a.initialSent || a.peerCompletedAddressValidation() {
+			return earliest, space
+		}
+		space = PNSpaceInitial
+		if a.handshakeKeys {
+			space = PNSpaceHandshake
+		}
+		return time.Now().Add(a.probeTimeout(space)), space
+	}
+	for _, sp := range []PNSpace{PNSpaceInitial, PNSpaceHandshake, PNSpaceAppData} {
+		s := a.spaces[sp]
+		if !s.ackElicitingInFlight() || (sp == PNSpaceAppData && !a.handshakeComplete) {
+			continue
+		}
+		if t := s.lastAckElicitingSent.Add(a.probeTimeout(sp)); earliest.IsZero() || t.Before(earliest) {
+			earliest, space = t, sp
+		}
+	}
+	return earliest, space
+}
+
+func (a *RecoveryAgent) ackElicitingInFlight() bool {
+	for _, s := range a.spaces {
+		if s.ackElicitingInFlight() {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *RecoveryAgent) setLossDetectionTimer() {
+	if !a.timer.Stop() {
+		select {
+		case <-a.timer.C:
+		default:
+		}
+	}
+	t, _ := a.earliestLossTime()
+	if t.IsZero() {
+		t, _ = a.earliestPTO()
+	}
+	if t.IsZero() {
+		return
+	}
+	a.timer.Reset(time.Until(t))
+}
+
+func (a *RecoveryAgent) onLossDetectionTimeout() {
+	if t, space := a.earliestLossTime(); !t.IsZero() {
+		a.detectLostPackets(space)
+		a.setLossDetectionTimer()
+		return
+	}
+	t, space := a.earliestPTO()
+	if t.IsZero() {
+		return
+	}
+	a.PTOCount++
+	a.Logger.Printf("Probe timeout expired in space %s, sending probes (pto_count=%d)\n", space.String(), a.PTOCount)
+	a.ProbeTimeouts.Submit(ProbeTimeoutEvent{space, a.PTOCount})
+	a.sendProbes(space)
+	a.setLossDetectionTimer()
+}
+
+// Sends up to two ack-eliciting packets in the given space, retransmitting the oldest frames in flight when possible
+func (a *RecoveryAgent) sendProbes(space PNSpace) {
+	s := a.spaces[space]
+	var inFlight RetransmitBatch
+	for _, p := range s.sentPackets {
+		if p.frames != nil {
+			inFlight = append(inFlight, *p.frames)
+		}
+	}
+	sort.Sort(inFlight)
+	if len(inFlight) > kMaxProbes {
+		inFlight = inFlight[:kMaxProbes]
+	}
+	if len(inFlight) > 0 {
+		a.RetransmitBatch(inFlight)
+		return
+	}
+	level := EncryptionLevelBestAppData
+	switch space {
+	case PNSpaceInitial: // Ack-eliciting Initial packets of the client are padded, see https://tools.ietf.org/html/rfc9000#section-14.1
+		if a.SendingAgent != nil {
+			initialLength := MinimumInitialLength
+			if a.conn.UseIPv6 {
+				initialLength = MinimumInitialLengthv6
 			}
-			currentPacketNumber--
-			delete(buffer, currentPacketNumber)
+			a.SendingAgent.SendProbe(EncryptionLevelInitial, initialLength)
+			return
 		}
-		for i := uint64(0); i < ackBlock.Block && i < threshold; i++ {
-			currentPacketNumber--
-			delete(buffer, currentPacketNumber)
+		level = EncryptionLevelInitial
+	case PNSpaceHandshake:
+		level = EncryptionLevelHandshake
+	}
+	a.conn.FrameQueue.Submit(QueuedFrame{new(PingFrame), level})
+}
+
+func (a *RecoveryAgent) discardSpace(space PNSpace) {
+	var discarded []AckedPacket
+	for pn, p := range a.spaces[space].sentPackets {
+		discarded = append(discarded, AckedPacket{pn, p.sent, p.size})
+	}
+	if len(discarded) > 0 {
+		a.Acks.Submit(AckEvent{space, discarded, true})
+	}
+	a.spaces[space] = newRecoverySpace()
+	a.setLossDetectionTimer()
+}
+
+func isAckEliciting(p Framer) bool {
+	for _, f := range p.GetFrames() {
+		switch f.FrameType() {
+		case AckType, AckECNType, PaddingFrameType, ConnectionCloseType, ApplicationCloseType:
+		default:
+			return true
 		}
 	}
-	return frames
+	return false
 }
 
 func (a *RecoveryAgent) RetransmitBatch(batch RetransmitBatch) {
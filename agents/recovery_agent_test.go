@@ -0,0 +1,140 @@
+package agents
+
+import (
+	. "github.com/RohitPanda/quic-tracker"
+	"github.com/dustin/go-broadcast"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// Returns a connection whose agents do not log and have no socket to write to
+func testConnection() *Connection {
+	conn, err := NewConnection("", QuicVersion1, "hq-interop", []byte{1, 2, 3, 4, 5, 6, 7, 8}, []byte{8, 7, 6, 5, 4, 3, 2, 1}, nil, nil)
+	if err != nil {
+		panic(err) // QUIC v1 is supported by all the TLS providers
+	}
+	conn.LogOutput = ioutil.Discard
+	return conn
+}
+
+// Returns a RecoveryAgent in the state of Run() without its goroutine, so that its methods can be called directly
+func testRecoveryAgent() *RecoveryAgent {
+	conn := testConnection()
+	a := &RecoveryAgent{conn: conn}
+	a.Init("RecoveryAgent", conn)
+	a.Acks = broadcast.NewBroadcaster(1000)
+	a.Losses = broadcast.NewBroadcaster(1000)
+	a.ProbeTimeouts = broadcast.NewBroadcaster(10)
+	a.spaces = map[PNSpace]*recoverySpace{
+		PNSpaceInitial:   newRecoverySpace(),
+		PNSpaceHandshake: newRecoverySpace(),
+		PNSpaceAppData:   newRecoverySpace(),
+	}
+	a.timer = time.NewTimer(time.Hour)
+	return a
+}
+
+func receiveLoss(t *testing.T, losses chan interface{}) LossEvent {
+	select {
+	case i := <-losses:
+		return i.(LossEvent)
+	case <-time.After(time.Second):
+		t.Fatal("no loss was declared")
+		return LossEvent{}
+	}
+}
+
+func TestRecoveryPacketThreshold(t *testing.T) {
+	a := testRecoveryAgent()
+	losses := make(chan interface{}, 10)
+	a.Losses.Register(losses)
+	for pn := PacketNumber(0); pn < 5; pn++ {
+		a.onPacketSent(PNSpaceAppData, pn, &trackedPacket{sent: time.Now(), size: 100, ackEliciting: true})
+	}
+	a.ProcessAck(&AckFrame{LargestAcknowledged: 4, AckBlocks: []AckBlock{{0, 0}}}, PNSpaceAppData)
+
+	e := receiveLoss(t, losses)
+	if e.PNSpace != PNSpaceAppData || len(e.Packets) != 2 || e.Packets[0].PacketNumber != 0 || e.Packets[1].PacketNumber != 1 {
+		t.Errorf("expected packets 0 and 1 to be lost, got %+v", e)
+	}
+	s := a.spaces[PNSpaceAppData]
+	if len(s.sentPackets) != 2 || s.lossTime.IsZero() {
+		t.Errorf("expected packets 2 and 3 to wait for the time threshold, got %+v", s)
+	}
+}
+
+func TestRecoveryTimeThreshold(t *testing.T) {
+	a := testRecoveryAgent()
+	a.rtt = RTTEstimates{LatestRTT: 10000, SmoothedRTT: 10000, RTTVar: 5000}
+	losses := make(chan interface{}, 10)
+	a.Losses.Register(losses)
+	a.onPacketSent(PNSpaceHandshake, 0, &trackedPacket{sent: time.Now().Add(-20 * time.Millisecond), size: 100, ackEliciting: true})
+	a.onPacketSent(PNSpaceHandshake, 1, &trackedPacket{sent: time.Now(), size: 100, ackEliciting: true})
+	a.ProcessAck(&AckFrame{LargestAcknowledged: 1, AckBlocks: []AckBlock{{0, 0}}}, PNSpaceHandshake)
+
+	if e := receiveLoss(t, losses); e.PNSpace != PNSpaceHandshake || len(e.Packets) != 1 || e.Packets[0].PacketNumber != 0 {
+		t.Errorf("expected packet 0 to be lost, got %+v", e)
+	}
+}
+
+func TestRecoveryProbeTimeout(t *testing.T) {
+	a := testRecoveryAgent()
+	if pto := a.probeTimeout(PNSpaceInitial); pto != 3*kInitialRTT {
+		t.Errorf("expected a PTO of %s before any RTT sample, got %s", 3*kInitialRTT, pto)
+	}
+	a.rtt = RTTEstimates{LatestRTT: 100000, SmoothedRTT: 100000, RTTVar: 10000}
+	if pto := a.probeTimeout(PNSpaceHandshake); pto != 140*time.Millisecond {
+		t.Errorf("expected a PTO of 140ms, got %s", pto)
+	}
+	if pto := a.probeTimeout(PNSpaceAppData); pto != 140*time.Millisecond+kDefaultMaxAckDelay {
+		t.Errorf("expected the PTO to include max_ack_delay, got %s", pto)
+	}
+	a.PTOCount = 2
+	if pto := a.probeTimeout(PNSpaceHandshake); pto != 560*time.Millisecond {
+		t.Errorf("expected the PTO to be backed off to 560ms, got %s", pto)
+	}
+	a.TimerValue = 50 * time.Millisecond
+	if pto := a.probeTimeout(PNSpaceHandshake); pto != 200*time.Millisecond {
+		t.Errorf("expected TimerValue to replace the PTO, got %s", pto)
+	}
+}
+
+func TestRecoveryEarliestPTO(t *testing.T) {
+	a := testRecoveryAgent()
+	a.onPacketSent(PNSpaceAppData, 0, &trackedPacket{sent: time.Now(), ackEliciting: true})
+	a.onPacketSent(PNSpaceHandshake, 0, &trackedPacket{sent: time.Now().Add(-time.Second), ackEliciting: true})
+	if _, space := a.earliestPTO(); space != PNSpaceHandshake {
+		t.Errorf("expected the Handshake PTO to be the earliest, got %s", space)
+	}
+	a.discardSpace(PNSpaceHandshake)
+	if pto, _ := a.earliestPTO(); !pto.IsZero() {
+		t.Error("the PTO was armed in the application data space before the handshake completed")
+	}
+	a.handshakeComplete = true
+	if pto, space := a.earliestPTO(); pto.IsZero() || space != PNSpaceAppData {
+		t.Errorf("expected the application data PTO to be armed, got %s in %s", pto, space)
+	}
+}
+
+// See https://tools.ietf.org/html/rfc9002#section-6.2.2.1
+func TestRecoveryAntiDeadlockPTO(t *testing.T) {
+	a := testRecoveryAgent()
+	if pto, _ := a.earliestPTO(); !pto.IsZero() {
+		t.Error("the PTO was armed before the first Initial packet was sent")
+	}
+	a.onPacketSent(PNSpaceInitial, 0, &trackedPacket{sent: time.Now(), ackEliciting: true})
+	a.ProcessAck(&AckFrame{LargestAcknowledged: 0, AckBlocks: []AckBlock{{0, 0}}}, PNSpaceInitial)
+	if pto, space := a.earliestPTO(); pto.IsZero() || space != PNSpaceInitial {
+		t.Errorf("expected the PTO to be armed in the Initial space with nothing in flight, got %s in %s", pto, space)
+	}
+	a.handshakeKeys = true
+	if pto, space := a.earliestPTO(); pto.IsZero() || space != PNSpaceHandshake {
+		t.Errorf("expected the PTO to be armed in the Handshake space once its keys are available, got %s in %s", pto, space)
+	}
+	a.onPacketSent(PNSpaceHandshake, 0, &trackedPacket{sent: time.Now(), ackEliciting: true})
+	a.ProcessAck(&AckFrame{LargestAcknowledged: 0, AckBlocks: []AckBlock{{0, 0}}}, PNSpaceHandshake)
+	if pto, _ := a.earliestPTO(); !pto.IsZero() {
+		t.Error("the PTO was armed with nothing in flight after the server validated the address")
+	}
+}
@@ -2,10 +2,13 @@ package agents
 
 import (
 	. "github.com/RohitPanda/quic-tracker"
+	"github.com/dustin/go-broadcast"
 	"time"
 	"math"
 )
 
+// The RTTAgent estimates the RTT of the connection from the ACK frames received. The estimates are in microseconds
+// and are published after each update.
 type RTTAgent struct {
 	BaseAgent
 	MinRTT             uint64
@@ -15,6 +18,14 @@ type RTTAgent struct {
 	MaxAckDelay        uint64
 	SentPackets        map[PNSpace]map[PacketNumber]SentPacket
 	LargestSentPackets map[PNSpace]PacketNumber
+	Estimates          broadcast.Broadcaster //type: RTTEstimates
+}
+
+type RTTEstimates struct {
+	MinRTT      uint64
+	LatestRTT   uint64
+	SmoothedRTT uint64
+	RTTVar      uint64
 }
 
 type SentPacket struct {
@@ -24,8 +35,9 @@ type SentPacket struct {
 }
 
 func (a *RTTAgent) Run(conn *Connection) {
-	a.Init("RTTAgent", conn.OriginalDestinationCID)
+	a.Init("RTTAgent", conn)
 	a.MinRTT = math.MaxUint64
+	a.Estimates = broadcast.NewBroadcaster(1000)
 
 	a.SentPackets = map[PNSpace]map[PacketNumber]SentPacket{
 		PNSpaceInitial:   make(map[PacketNumber]SentPacket),
@@ -44,6 +56,7 @@ func (a *RTTAgent) Run(conn *Connection) {
 	go func() { // TODO: Support ACK_ECN
 		defer a.Logger.Println("Agent terminated")
 		defer close(a.closed)
+		defer a.RecoverCrash()
 
 		for {
 			select {
@@ -110,4 +123,7 @@ func (a *RTTAgent) UpdateRTT(ackDelay uint64, ackOnly bool) { // TODO: https://t
 		a.SmoothedRTT = uint64(0.875 * float64(a.SmoothedRTT) + 0.125 * float64(a.LatestRTT))
 	}
 	a.Logger.Printf("LatestRTT = %d, MinRTT = %d, SmoothedRTT = %d, RTTVar = %d", a.LatestRTT, a.MinRTT, a.SmoothedRTT, a.RTTVar)
+	if a.Estimates != nil {
+		a.Estimates.Submit(RTTEstimates{a.MinRTT, a.LatestRTT, a.SmoothedRTT, a.RTTVar})
+	}
 }
@@ -2,27 +2,97 @@ package agents
 
 import (
 	. "github.com/RohitPanda/quic-tracker"
+	"github.com/RohitPanda/quic-tracker/lib"
+	"github.com/dustin/go-broadcast"
 	"time"
 	"sort"
+	"sync"
+	"unsafe"
 )
 
 // The SendingAgent is responsible of bundling the frames queued for sending into packets. If the frames queued for a
 // given encryption level are smaller than a given MTU, it will wait a window of 5ms before sending them in the hope
 // that more will be queued. Frames that require an unavailable encryption level are queued until it is made available.
-// It also merge the ACK frames inside a given packet before sending.
+// It also merge the ACK frames inside a given packet before sending. Ack-eliciting packets are held back while the
+// CongestionController does not allow more bytes in flight, except for probes sent after a probe timeout. The
+// congestion controller is fed with the events of the RecoveryAgent. When not set, the one named by the
+// CongestionControl attribute of the connection is used, NewReno by default. Congestion control is disabled when the
+// RecoveryAgent is missing or stopped. Ack-eliciting packets are also paced using the smoothed RTT published by the
+// RTTAgent, unless DisablePacing is set on the agent or on the connection. The MTU can be changed while the agent runs
+// using SetMTU(). Other agents send their probes using SendProbe(), so that all the packet numbers are allocated by the
+// agent.
 type SendingAgent struct {
 	BaseAgent
-	MTU uint16
+	MTU                  uint16
+	RecoveryAgent        *RecoveryAgent
+	RTTAgent             *RTTAgent
+	CongestionController CongestionController
+	CongestionStates     broadcast.Broadcaster //type: CongestionState
+	DisablePacing        bool
+	requestsMutex        sync.Mutex
+	mtuUpdates           chan uint16
+	probeRequests        chan probeRequest
+}
+
+type probeRequest struct {
+	EncryptionLevel
+	size int
+}
+
+// A CongestionState is a snapshot of the congestion controller taken after it processed acknowledgements or losses
+type CongestionState struct {
+	CongestionWindow uint64
+	BytesInFlight    uint64
+}
+
+type blockedPacket struct {
+	Packet
+	EncryptionLevel
 }
 
 func (a *SendingAgent) Run(conn *Connection) {
-	a.Init("SendingAgent", conn.OriginalDestinationCID)
+	a.Init("SendingAgent", conn)
+	mtuUpdates, probeRequests := a.requests()
+	a.CongestionStates = broadcast.NewBroadcaster(1000)
 
 	frameQueue := make(chan interface{}, 1000)
 	conn.FrameQueue.Register(frameQueue)
+	outgoingPackets := make(chan interface{}, 1000)
+	conn.OutgoingPackets.Register(outgoingPackets)
+
+	var acks, losses, probeTimeouts chan interface{}
+	var recoveryClosed chan bool
+	if a.RecoveryAgent != nil {
+		acks = make(chan interface{}, 1000)
+		a.RecoveryAgent.Acks.Register(acks)
+		losses = make(chan interface{}, 1000)
+		a.RecoveryAgent.Losses.Register(losses)
+		probeTimeouts = make(chan interface{}, 10)
+		a.RecoveryAgent.ProbeTimeouts.Register(probeTimeouts)
+		recoveryClosed = a.RecoveryAgent.closed
+		if a.CongestionController == nil && conn.CongestionControl != "" {
+			var err error
+			if a.CongestionController, err = NewCongestionController(conn.CongestionControl, a.MTU); err != nil {
+				a.Logger.Printf("%s, using NewReno instead\n", err)
+			}
+		}
+		if a.CongestionController == nil {
+			a.CongestionController = NewNewReno(a.MTU)
+		}
+	} else {
+		a.CongestionController = NewUnlimited()
+	}
+	a.DisablePacing = a.DisablePacing || conn.DisablePacing
 	newEncryptionLevelAvailable := make(chan interface{}, 10)
 	conn.EncryptionLevelsAvailable.Register(newEncryptionLevelAvailable)
 
+	var estimates chan interface{}
+	if a.RTTAgent != nil && a.RTTAgent.Estimates != nil {
+		estimates = make(chan interface{}, 1000)
+		a.RTTAgent.Estimates.Register(estimates)
+	}
+	var smoothedRTT time.Duration
+
 	encryptionLevels := []EncryptionLevel{EncryptionLevelInitial, EncryptionLevel0RTT, EncryptionLevelHandshake, EncryptionLevel1RTT, EncryptionLevelBest, EncryptionLevelBestAppData}
 	encryptionLevelsAvailable := map[DirectionalEncryptionLevel]bool {
 		{EncryptionLevelNone, false}: true,
@@ -41,6 +111,74 @@ func (a *SendingAgent) Run(conn *Connection) {
 		}
 	}
 
+	ownPackets := make(map[unsafe.Pointer]bool)
+	var blockedPackets []blockedPacket
+	probeCredit := 0
+
+	pacer := &Pacer{}
+	pacingTimer := time.NewTimer(0)
+	if !pacingTimer.Stop() {
+		<-pacingTimer.C
+	}
+	isPacing := func() bool {
+		_, unlimited := a.CongestionController.(*Unlimited)
+		return !a.DisablePacing && !unlimited && a.RTTAgent != nil
+	}
+	pacingDelay := func() time.Duration {
+		if !isPacing() {
+			return 0
+		}
+		return pacer.Delay(time.Now())
+	}
+	armPacingTimer := func(d time.Duration) {
+		if !pacingTimer.Stop() {
+			select {
+			case <-pacingTimer.C:
+			default:
+			}
+		}
+		pacingTimer.Reset(d)
+	}
+
+	send := func(packet Packet, level EncryptionLevel) {
+		conn.SendPacket(packet, level)
+		if f, ok := packet.(Framer); ok && isAckEliciting(f) && !isPMTUProbe(f) {
+			size := len(packet.Encode(packet.EncodePayload()))
+			ownPackets[packet.Pointer()] = true
+			a.CongestionController.OnPacketSent(size)
+			if isPacing() {
+				pacer.OnPacketSent(time.Now(), size, a.CongestionController.CongestionWindow(), smoothedRTT)
+			}
+		}
+	}
+	sendBlockedPackets := func() {
+		for len(blockedPackets) > 0 && a.CongestionController.CanSend() {
+			if d := pacingDelay(); d > 0 {
+				armPacingTimer(d)
+				return
+			}
+			send(blockedPackets[0].Packet, blockedPackets[0].EncryptionLevel)
+			blockedPackets = blockedPackets[1:]
+		}
+	}
+	sendPacket := func(packet Packet, level EncryptionLevel) {
+		if f, ok := packet.(Framer); ok && !isAckEliciting(f) {
+			send(packet, level)
+		} else if len(blockedPackets) == 0 && a.CongestionController.CanSend() && pacingDelay() == 0 {
+			send(packet, level)
+		} else if probeCredit > 0 {
+			probeCredit--
+			send(packet, level)
+		} else {
+			blockedPackets = append(blockedPackets, blockedPacket{packet, level})
+			if a.CongestionController.CanSend() {
+				sendBlockedPackets() // Waits for the pacer
+			} else {
+				a.Logger.Printf("Congestion window is full (%d/%d bytes), holding back packet %s\n", a.CongestionController.BytesInFlight(), a.CongestionController.CongestionWindow(), packet.ShortString())
+			}
+		}
+	}
+
 	fillWithLevel := func(packet Framer, level EncryptionLevel) {
 		var ackFrames []*AckFrame
 
@@ -68,13 +206,14 @@ func (a *SendingAgent) Run(conn *Connection) {
 			a.Logger.Printf("Timer for encryption level %s fired, scheduling the sending of %d bytes in %d frames\n", level.String(), frameBufferLength[level], len(frameBuffer[level]))
 
 			fillWithLevel(packet, level)
-			conn.SendPacket(packet, level)
+			sendPacket(packet, level)
 		}
 	}
 
 	go func() {
 		defer a.Logger.Println("Agent terminated")
 		defer close(a.closed)
+		defer a.RecoverCrash()
 		for {
 			select {
 			case i := <-frameQueue:
@@ -112,7 +251,7 @@ func (a *SendingAgent) Run(conn *Connection) {
 						a.Logger.Printf("Encryption level %s is not available, putting the packet in the buffer\n", qf.EncryptionLevel.String())
 						packetBuffer[packet.EncryptionLevel()] = append(packetBuffer[packet.EncryptionLevel()], packet)
 					} else {
-						conn.SendPacket(packet, qf.EncryptionLevel)
+						sendPacket(packet, qf.EncryptionLevel)
 					}
 				} else {
 					frameBuffer[qf.EncryptionLevel] = append(frameBuffer[qf.EncryptionLevel], qf.Frame)
@@ -166,10 +305,55 @@ func (a *SendingAgent) Run(conn *Connection) {
 				}
 
 				for _, p := range packetBuffer[eL] {
-					conn.SendPacket(p, eL)
+					sendPacket(p, eL)
 				}
 				packetBuffer[eL] = nil
 				timers[eL].Reset(0)
+			case i := <-outgoingPackets:
+				p := i.(Packet)
+				if ownPackets[p.Pointer()] {
+					delete(ownPackets, p.Pointer())
+				} else if f, ok := p.(Framer); ok && isAckEliciting(f) && !isPMTUProbe(f) { // Sent by another agent
+					a.CongestionController.OnPacketSent(len(p.Encode(p.EncodePayload())))
+				}
+			case i := <-acks:
+				e := i.(AckEvent)
+				if e.Discarded {
+					a.CongestionController.OnPacketsDiscarded(e.Packets)
+				} else {
+					a.CongestionController.OnPacketsAcked(e.Packets)
+				}
+				a.CongestionStates.Submit(CongestionState{a.CongestionController.CongestionWindow(), a.CongestionController.BytesInFlight()})
+				sendBlockedPackets()
+			case i := <-losses:
+				a.CongestionController.OnPacketsLost(i.(LossEvent).Packets)
+				a.CongestionStates.Submit(CongestionState{a.CongestionController.CongestionWindow(), a.CongestionController.BytesInFlight()})
+				sendBlockedPackets()
+			case <-probeTimeouts:
+				probeCredit = kMaxProbes
+				for len(blockedPackets) > 0 && probeCredit > 0 {
+					probeCredit--
+					send(blockedPackets[0].Packet, blockedPackets[0].EncryptionLevel)
+					blockedPackets = blockedPackets[1:]
+				}
+			case i := <-estimates:
+				smoothedRTT = time.Duration(i.(RTTEstimates).SmoothedRTT) * time.Microsecond
+			case <-pacingTimer.C:
+				sendBlockedPackets()
+			case mtu := <-mtuUpdates:
+				a.Logger.Printf("MTU changed from %d to %d bytes\n", a.MTU, mtu)
+				a.MTU = mtu
+			case r := <-probeRequests:
+				if cryptoState := conn.CryptoStates[r.EncryptionLevel]; cryptoState == nil || cryptoState.Write == nil {
+					a.Logger.Printf("Encryption level %s is not available, discarding the probe of %d bytes\n", r.EncryptionLevel.String(), r.size)
+					break
+				}
+				send(newProbePacket(conn, r.EncryptionLevel, r.size), r.EncryptionLevel)
+			case <-recoveryClosed:
+				a.Logger.Println("RecoveryAgent has stopped, disabling congestion control")
+				a.CongestionController = NewUnlimited()
+				recoveryClosed = nil
+				sendBlockedPackets()
 			case <-a.close:
 					return
 			}
@@ -177,6 +361,66 @@ func (a *SendingAgent) Run(conn *Connection) {
 	}()
 }
 
+// Returns the channels of the requests made to the agent, which can be made before it runs
+func (a *SendingAgent) requests() (chan uint16, chan probeRequest) {
+	a.requestsMutex.Lock()
+	defer a.requestsMutex.Unlock()
+	if a.mtuUpdates == nil {
+		a.mtuUpdates = make(chan uint16, 10)
+		a.probeRequests = make(chan probeRequest, 10)
+	}
+	return a.mtuUpdates, a.probeRequests
+}
+
+// Changes the maximum size of the frames bundled in a packet. It does not block, the oldest changes are discarded when
+// they are not processed, e.g. before the agent runs or once it has stopped.
+func (a *SendingAgent) SetMTU(mtu uint16) {
+	mtuUpdates, _ := a.requests()
+	for {
+		select {
+		case mtuUpdates <- mtu:
+			return
+		default:
+			select {
+			case <-mtuUpdates:
+			default:
+			}
+		}
+	}
+}
+
+// Sends a packet of the Initial, Handshake or 1-RTT encryption level containing a PING frame padded to a datagram of
+// the given size, regardless of the congestion controller and of the pacer. It does not block, the probe is discarded
+// when too many are pending.
+func (a *SendingAgent) SendProbe(level EncryptionLevel, size int) {
+	_, probeRequests := a.requests()
+	select {
+	case probeRequests <- probeRequest{level, size}:
+	default:
+	}
+}
+
+func newProbePacket(conn *Connection, level EncryptionLevel, size int) Framer {
+	var packet Framer
+	switch level {
+	case EncryptionLevelInitial:
+		packet = NewInitialPacket(conn)
+	case EncryptionLevelHandshake:
+		packet = NewHandshakePacket(conn)
+	default:
+		packet = NewProtectedPacket(conn)
+	}
+	packet.AddFrame(new(PingFrame))
+	length := packet.Header().HeaderLength() + len(packet.EncodePayload()) + conn.CryptoStates[level].Write.Overhead()
+	if h, ok := packet.Header().(*LongHeader); ok { // The Length field is set when the packet is encrypted
+		length += lib.VarIntLen(uint64(size)) - h.Length.Length
+	}
+	for ; length < size; length++ {
+		packet.AddFrame(new(PaddingFrame))
+	}
+	return packet
+}
+
 var elOrder = []DirectionalEncryptionLevel {{EncryptionLevel1RTT, false}, {EncryptionLevel0RTT, false}, {EncryptionLevelHandshake, false}, {EncryptionLevelInitial, false}}
 var elAppDataOrder = []DirectionalEncryptionLevel {{EncryptionLevel1RTT, false}, {EncryptionLevel0RTT, false}}
 
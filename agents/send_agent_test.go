@@ -0,0 +1,206 @@
+package agents
+
+import (
+	. "github.com/RohitPanda/quic-tracker"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSendingAgentSetMTU(t *testing.T) {
+	a := &SendingAgent{MTU: 1200, DisablePacing: true}
+	a.Run(testConnection())
+
+	done := make(chan bool)
+	go func() {
+		for mtu := uint16(1201); mtu <= 1250; mtu++ {
+			a.SetMTU(mtu)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("SetMTU blocked")
+	}
+	for len(a.mtuUpdates) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	a.Stop()
+	a.Join()
+	if a.MTU != 1250 {
+		t.Errorf("expected an MTU of 1250 bytes, got %d", a.MTU)
+	}
+
+	stopped := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			a.SetMTU(1300)
+		}
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("SetMTU blocked after the agent stopped")
+	}
+}
+
+func TestSendingAgentSetMTUBeforeRun(t *testing.T) {
+	a := &SendingAgent{MTU: 1200, DisablePacing: true}
+	done := make(chan bool)
+	go func() {
+		for mtu := uint16(1201); mtu <= 1250; mtu++ {
+			a.SetMTU(mtu)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("SetMTU blocked before the agent runs")
+	}
+	a.Run(testConnection())
+	for len(a.mtuUpdates) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	a.Stop()
+	a.Join()
+	if a.MTU != 1250 {
+		t.Errorf("expected an MTU of 1250 bytes, got %d", a.MTU)
+	}
+}
+
+// Connects the UDP socket of the connection to a local socket, which is returned
+func dialTestPeer(t *testing.T, conn *Connection) *net.UDPConn {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.UdpConnection, err = net.DialUDP("udp", nil, peer.LocalAddr().(*net.UDPAddr)); err != nil {
+		peer.Close()
+		t.Fatal(err)
+	}
+	return peer
+}
+
+func TestSendingAgentSendProbe(t *testing.T) {
+	conn := testConnection()
+	peer := dialTestPeer(t, conn)
+	defer peer.Close()
+	defer conn.UdpConnection.Close()
+	outgoingPackets := make(chan interface{}, 100)
+	conn.OutgoingPackets.Register(outgoingPackets)
+
+	a := &SendingAgent{MTU: 1200}
+	a.SendProbe(EncryptionLevelInitial, MinimumInitialLength) // Sent once the agent runs
+	a.Run(conn)
+	for i := 0; i < 5; i++ {
+		conn.FrameQueue.Submit(QueuedFrame{&CryptoFrame{Offset: uint64(i * 100), Length: 100, CryptoData: make([]byte, 100)}, EncryptionLevelInitial})
+		a.SendProbe(EncryptionLevelInitial, MinimumInitialLength)
+	}
+	a.SendProbe(EncryptionLevelHandshake, MinimumInitialLength) // Without keys
+
+	packetNumbers := make(map[PacketNumber]bool)
+	probes := 0
+	deadline := time.After(100 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case i := <-outgoingPackets:
+			p := i.(Framer)
+			if packetNumbers[p.Header().PacketNumber()] {
+				t.Errorf("packet number %d was sent twice", p.Header().PacketNumber())
+			}
+			packetNumbers[p.Header().PacketNumber()] = true
+			if p.Contains(PingType) {
+				probes++
+			}
+		case <-deadline:
+			done = true
+		}
+	}
+	a.Stop()
+	a.Join()
+	if probes != 6 {
+		t.Errorf("expected 6 probes to be sent, %d were sent", probes)
+	}
+
+	datagrams := make(map[int]int)
+	buffer := make([]byte, 2000)
+	for peer.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); ; {
+		n, err := peer.Read(buffer)
+		if err != nil {
+			break
+		}
+		datagrams[n]++
+	}
+	if datagrams[MinimumInitialLength] != probes {
+		t.Errorf("expected the probes to be padded to %d bytes, the datagrams sent have sizes %v", MinimumInitialLength, datagrams)
+	}
+}
+
+// Publishes a smoothed RTT of 10 seconds and queues a frame filling an Initial packet every 10 ms, the pacer spaces
+// these packets out by hundreds of milliseconds. It returns the agent stopped and the number of packets sent in 100 ms.
+func sendBurst(t *testing.T, conn *Connection) (*SendingAgent, int) {
+	peer := dialTestPeer(t, conn)
+	defer peer.Close()
+	defer conn.UdpConnection.Close()
+
+	rttAgent := &RTTAgent{}
+	recoveryAgent := &RecoveryAgent{RTTAgent: rttAgent}
+	a := &SendingAgent{MTU: 1200, RecoveryAgent: recoveryAgent, RTTAgent: rttAgent}
+	for _, agent := range []Agent{rttAgent, recoveryAgent, a} {
+		agent.Run(conn)
+	}
+	outgoingPackets := make(chan interface{}, 100)
+	conn.OutgoingPackets.Register(outgoingPackets)
+
+	rttAgent.Estimates.Submit(RTTEstimates{SmoothedRTT: uint64(10 * time.Second / time.Microsecond)})
+	time.Sleep(10 * time.Millisecond)
+
+	sent, queued := 0, 0
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(100 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case <-ticker.C:
+			if queued < 5 {
+				conn.FrameQueue.Submit(QueuedFrame{&CryptoFrame{Offset: uint64(queued * 1000), Length: 1000, CryptoData: make([]byte, 1000)}, EncryptionLevelInitial})
+				queued++
+			}
+		case <-outgoingPackets:
+			sent++
+		case <-deadline:
+			done = true
+		}
+	}
+	for _, agent := range []Agent{a, recoveryAgent, rttAgent} { // The SendingAgent disables congestion control when the RecoveryAgent stops
+		agent.Stop()
+		agent.Join()
+	}
+	return a, sent
+}
+
+func TestSendingAgentConnectionOptions(t *testing.T) {
+	conn := testConnection()
+	conn.CongestionControl = "cubic"
+	conn.DisablePacing = true
+	a, sent := sendBurst(t, conn)
+	if _, ok := a.CongestionController.(*Cubic); !ok {
+		t.Errorf("expected the CUBIC congestion controller to be used, got %s", a.CongestionController.Name())
+	} else if a.CongestionController.BytesInFlight() == 0 {
+		t.Errorf("the packets sent were not accounted for by the congestion controller")
+	}
+	if sent != 5 {
+		t.Errorf("expected the 5 packets to be sent without pacing, %d were sent", sent)
+	}
+
+	a, sent = sendBurst(t, testConnection())
+	if _, ok := a.CongestionController.(*NewReno); !ok {
+		t.Errorf("expected the NewReno congestion controller to be used by default, got %s", a.CongestionController.Name())
+	}
+	if sent != 1 {
+		t.Errorf("expected the packets to be paced, %d were sent", sent)
+	}
+}
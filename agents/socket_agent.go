@@ -32,13 +32,14 @@ type SocketAgent struct {
 }
 
 func (a *SocketAgent) Run(conn *Connection) {
-	a.Init("SocketAgent", conn.OriginalDestinationCID)
+	a.Init("SocketAgent", conn)
 	a.conn = conn
 	a.SocketStatus = broadcast.NewBroadcaster(10)
 	a.ECNStatus = broadcast.NewBroadcaster(1000)
 	recChan := make(chan []byte)
 
 	go func() {
+		defer a.RecoverCrash()
 		for {
 			recBuf := make([]byte, MaxUDPPayloadSize)
 			oob := make([]byte, 128) // Find a reasonable upper-bound
@@ -66,6 +67,9 @@ func (a *SocketAgent) Run(conn *Connection) {
 			a.Logger.Printf("Received %d bytes from UDP socket\n", i)
 			payload := make([]byte, i)
 			copy(payload, recBuf[:i])
+			if conn.ReceivedDatagramHandler != nil {
+				conn.ReceivedDatagramHandler(payload)
+			}
 			recChan <- payload
 		}
 	}()
@@ -73,6 +77,7 @@ func (a *SocketAgent) Run(conn *Connection) {
 	go func() {
 		defer a.Logger.Println("Agent terminated")
 		defer close(a.closed)
+		defer a.RecoverCrash()
 		for {
 			select {
 			case p, open := <-recChan:
@@ -119,6 +124,23 @@ func (a *SocketAgent) ConfigureECN() error {
 	return nil
 }
 
+// Sets the Don't Fragment bit on the datagrams sent, so that packets larger than the path MTU are dropped instead of
+// being fragmented. This is required for probing the path MTU.
+func (a *SocketAgent) ConfigureDontFragment() error {
+	s, err := a.conn.UdpConnection.SyscallConn()
+	if err != nil {
+		return err
+	}
+	f := func(fd uintptr) {
+		var u *compat.Utils
+		err = u.SetDontFragment(int(fd), a.conn.UseIPv6)
+	}
+	if cErr := s.Control(f); cErr != nil {
+		return cErr
+	}
+	return err
+}
+
 type cmsgHdr struct {
 	cLength uint64
 	cLevel int32
@@ -23,7 +23,7 @@ type TLSAgent struct {
 }
 
 func (a *TLSAgent) Run(conn *Connection) {
-	a.Init("TLSAgent", conn.OriginalDestinationCID)
+	a.Init("TLSAgent", conn)
 	a.TLSStatus = broadcast.NewBroadcaster(10)
 	a.ResumptionTicket = broadcast.NewBroadcaster(10)
 
@@ -43,10 +43,13 @@ func (a *TLSAgent) Run(conn *Connection) {
 	}
 
 	var resumptionTicketSent bool
+	var serverHello []byte
+	var serverInitialSourceCID ConnectionID
 
 	go func() {
 		defer a.Logger.Println("Agent terminated")
 		defer close(a.closed)
+		defer a.RecoverCrash()
 
 		for {
 			select {
@@ -55,6 +58,9 @@ func (a *TLSAgent) Run(conn *Connection) {
 				if _, ok := packet.(Framer); !ok {
 					break
 				}
+				if _, ok := packet.(*InitialPacket); ok && serverInitialSourceCID == nil {
+					serverInitialSourceCID = packet.Header().(*LongHeader).SourceCID
+				}
 				cryptoChan := cryptoChans[packet.PNSpace()]
 
 				var handshakeData []byte
@@ -81,6 +87,14 @@ func (a *TLSAgent) Run(conn *Connection) {
 							a.TLSStatus.Submit(TLSStatus{false, packet, err})
 						}
 
+						if packet.PNSpace() == PNSpaceInitial && conn.CipherSuite == 0 {
+							serverHello = append(serverHello, handshakeData...)
+							if suite, err := ReadServerHelloCipherSuite(serverHello); err == nil {
+								a.Logger.Printf("Server selected cipher suite %s\n", suite.String())
+								conn.CipherSuite = suite
+							}
+						}
+
 						if conn.CryptoStates[EncryptionLevelHandshake] == nil {
 							conn.CryptoStates[EncryptionLevelHandshake] = new(CryptoState)
 						}
@@ -88,11 +102,13 @@ func (a *TLSAgent) Run(conn *Connection) {
 						if conn.CryptoStates[EncryptionLevelHandshake] != nil {
 							if conn.CryptoStates[EncryptionLevelHandshake].HeaderRead == nil && len(conn.Tls.HandshakeReadSecret()) > 0 {
 								a.Logger.Printf("Installing handshake read crypto with secret %s\n", hex.EncodeToString(conn.Tls.HandshakeReadSecret()))
-								conn.CryptoStates[EncryptionLevelHandshake].InitRead(conn.Tls, conn.Tls.HandshakeReadSecret())
+								conn.CryptoStates[EncryptionLevelHandshake].InitRead(conn.Tls, conn.VersionProfile, conn.CipherSuite, conn.Tls.HandshakeReadSecret())
+								conn.LogSecret("SERVER_HANDSHAKE_TRAFFIC_SECRET", conn.Tls.HandshakeReadSecret())
 							}
 							if conn.CryptoStates[EncryptionLevelHandshake].HeaderWrite == nil && len(conn.Tls.HandshakeWriteSecret()) > 0 {
 								a.Logger.Printf("Installing handshake write crypto with secret %s\n", hex.EncodeToString(conn.Tls.HandshakeWriteSecret()))
-								conn.CryptoStates[EncryptionLevelHandshake].InitWrite(conn.Tls, conn.Tls.HandshakeWriteSecret())
+								conn.CryptoStates[EncryptionLevelHandshake].InitWrite(conn.Tls, conn.VersionProfile, conn.CipherSuite, conn.Tls.HandshakeWriteSecret())
+								conn.LogSecret("CLIENT_HANDSHAKE_TRAFFIC_SECRET", conn.Tls.HandshakeWriteSecret())
 							}
 						}
 
@@ -104,14 +120,26 @@ func (a *TLSAgent) Run(conn *Connection) {
 
 						if !notCompleted && conn.CryptoStates[EncryptionLevel1RTT] == nil {
 							a.Logger.Printf("Handshake has completed, installing protected crypto {read=%s, write=%s}\n", hex.EncodeToString(conn.Tls.ProtectedReadSecret()), hex.EncodeToString(conn.Tls.ProtectedWriteSecret()))
-							conn.CryptoStates[EncryptionLevel1RTT] = NewProtectedCryptoState(conn.Tls, conn.Tls.ProtectedReadSecret(), conn.Tls.ProtectedWriteSecret())
-							conn.ExporterSecret = conn.Tls.ExporterSecret()
+							conn.CryptoStates[EncryptionLevel1RTT] = NewProtectedCryptoState(conn.Tls, conn.VersionProfile, conn.CipherSuite, conn.Tls.ProtectedReadSecret(), conn.Tls.ProtectedWriteSecret())
+							conn.LogSecret("CLIENT_TRAFFIC_SECRET_0", conn.Tls.ProtectedWriteSecret())
+							conn.LogSecret("SERVER_TRAFFIC_SECRET_0", conn.Tls.ProtectedReadSecret())
+							if secret, err := conn.Tls.ExporterSecret(); err == nil {
+								conn.ExporterSecret = secret
+							} else {
+								a.Logger.Printf("The exporter secret is not available: %s\n", err.Error())
+							}
 
 							// TODO: Check negotiated ALPN ?
 
 							err = conn.TLSTPHandler.ReceiveExtensionData(conn.Tls.ReceivedQUICTransportParameters())
+							if err == nil {
+								err = conn.TLSTPHandler.AuthenticateConnectionIds(conn.OriginalDestinationCID, serverInitialSourceCID, conn.RetrySourceCID)
+							}
 							if err != nil {
-								a.Logger.Printf("Failed to decode extension data: %s\n", err.Error())
+								a.Logger.Printf("Invalid transport parameters received: %s\n", err.Error())
+								if tpErr, ok := err.(*TransportParameterError); ok {
+									conn.CloseConnection(true, tpErr.ErrorCode(), tpErr.Reason)
+								}
 							}
 							a.TLSStatus.Submit(TLSStatus{true, packet, err})
 						}
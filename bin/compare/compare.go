@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/RohitPanda/quic-tracker/scenarii"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func main() {
+	threshold := flag.Duration("threshold", time.Second, "The duration delta from which the durations of the runs are reported. The durations are not compared when set to zero.")
+	definitions := flag.String("definitions", "", "A YAML scenario definition, or a directory of them, used to name and rank the verdicts of the scenarii defined in YAML.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] baseline.json results.json\n\nPrints the host×scenario verdicts that changed between two test suite results files, the new crashes and the duration deltas beyond the threshold. It exits with 1 when a verdict regressed.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+	if *definitions != "" {
+		if err := scenarii.RegisterDefinitions(*definitions); err != nil {
+			println(err.Error())
+			os.Exit(-1)
+		}
+	}
+
+	baseline, err := scenarii.ReadTraces(flag.Arg(0))
+	if err != nil {
+		println(err.Error())
+		os.Exit(-1)
+	}
+	current, err := scenarii.ReadTraces(flag.Arg(1))
+	if err != nil {
+		println(err.Error())
+		os.Exit(-1)
+	}
+
+	comparison := scenarii.Compare(baseline, current, *threshold)
+	printComparison(os.Stdout, comparison)
+	if len(comparison.Regressions()) > 0 {
+		os.Exit(1)
+	}
+}
+
+func printComparison(out io.Writer, comparison *scenarii.Comparison) {
+	var regressions, crashes, others []scenarii.Change
+	for _, c := range comparison.Verdicts {
+		if c.Crash() {
+			crashes = append(crashes, c)
+		} else if c.Regression() {
+			regressions = append(regressions, c)
+		} else {
+			others = append(others, c)
+		}
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	printChanges(w, "New crashes", crashes)
+	printChanges(w, "Regressions", regressions)
+	printChanges(w, "Other verdict changes", others)
+	if len(comparison.Durations) > 0 {
+		fmt.Fprintf(w, "Durations:\n")
+		for _, c := range comparison.Durations {
+			fmt.Fprintf(w, "  %s\t%s\t%d ms -> %d ms (%+d ms)\n", c.Scenario, c.Host, c.Baseline.Duration, c.Current.Duration, c.DurationDelta())
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+
+	fmt.Fprintf(out, "%d regressions, %d new crashes, %d other verdict changes, %d duration changes\n", len(regressions)+len(crashes), len(crashes), len(others), len(comparison.Durations))
+}
+
+func printChanges(w io.Writer, title string, changes []scenarii.Change) {
+	if len(changes) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s:\n", title)
+	for _, c := range changes {
+		fmt.Fprintf(w, "  %s\t%s\t%s -> %s\n", c.Scenario, c.Host, formatResult(c.Baseline), formatResult(c.Current))
+	}
+	fmt.Fprintln(w)
+}
+
+// Formats the verdict of the test case and its result, e.g. "Host did not migrate (failure)"
+func formatResult(c *scenarii.TestCase) string {
+	if c == nil {
+		return "not run"
+	}
+	if c.Passed() {
+		return c.Verdict
+	}
+	return fmt.Sprintf("%s (%s)", c.Verdict, c.Result())
+}
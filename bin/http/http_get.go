@@ -6,6 +6,8 @@ import (
 	"strings"
 	"fmt"
 	"encoding/json"
+	"io"
+	"os"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
@@ -22,26 +24,44 @@ func main() {
 	address := flag.String("address", "", "The address to connect to")
 	useIPv6 := flag.Bool("6", false, "Use IPV6")
 	url := flag.String("url", "/index.html", "The URL to request")
-	netInterface := flag.String("interface", "", "The interface to listen to when capturing pcap")
 	timeout := flag.Int("timeout", 10, "The number of seconds after which the program will timeout")
+	versionName := flag.String("version", "v1", "The QUIC version to use, either v1, v2, draft-17 or an hexadecimal version number")
+	tlsProvider := flag.String("tls", "", "The TLS stack to use, either pigotls or crypto/tls. The first available that supports the version is used if not set, pigotls only supports the draft versions")
+	keyLogFilename := flag.String("keylog", os.Getenv("SSLKEYLOGFILE"), "The file to append the TLS secrets to in the NSS key log format. Defaults to the SSLKEYLOGFILE environment variable.")
 	flag.Parse()
 
-	t := time.NewTimer(time.Duration(*timeout) * time.Second)
-	conn, err := m.NewDefaultConnection(*address, (*address)[:strings.LastIndex(*address, ":")], nil, *useIPv6, false)
+	version, err := m.ParseVersion(*versionName)
 	if err != nil {
 		panic(err)
 	}
 
-	pcap, err := m.StartPcapCapture(conn, *netInterface)
+	if err := m.SetDefaultTLSProvider(*tlsProvider); err != nil {
+		panic(err)
+	}
+
+	var keyLog io.Writer
+	if *keyLogFilename != "" {
+		keyLogFile, err := os.OpenFile(*keyLogFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			panic(err)
+		}
+		defer keyLogFile.Close()
+		keyLog = keyLogFile
+	}
+
+	t := time.NewTimer(time.Duration(*timeout) * time.Second)
+	conn, err := m.NewDefaultConnection(*address, (*address)[:strings.LastIndex(*address, ":")], nil, *useIPv6, false, version, keyLog)
 	if err != nil {
 		panic(err)
 	}
 
+	pcap := m.StartPcapCapture(conn)
+
 	trace := m.NewTrace("http_get", 1, *address)
 	trace.AttachTo(conn)
 	defer func() {
 		trace.Complete(conn)
-		err = trace.AddPcap(conn, pcap)
+		err = trace.AddPcap(pcap)
 		if err != nil {
 			trace.Results["pcap_error"] = err.Error()
 		}
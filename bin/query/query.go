@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/RohitPanda/quic-tracker/store"
+	"os"
+	"text/tabwriter"
+)
+
+func main() {
+	database := flag.String("db", "", "The SQLite database in which the test suite recorded its runs, see its -store flag.")
+	host := flag.String("host", "", "The host to query, with or without its port.")
+	scenario := flag.String("scenario", "", "Only prints the results of the given scenario. The results of all the scenarii are printed if not set.")
+	runs := flag.Int("runs", 10, "The number of runs in which the host was tested to print, the most recent first.")
+	format := flag.String("format", "text", "The output format, either text or json.")
+	flag.Parse()
+
+	if *database == "" || *host == "" {
+		println("The db and host parameters are required")
+		os.Exit(-1)
+	}
+	if *format != "text" && *format != "json" {
+		println("Unknown format", *format)
+		os.Exit(-1)
+	}
+	if _, err := os.Stat(*database); err != nil {
+		println(err.Error())
+		os.Exit(-1)
+	}
+
+	s, err := store.Open(*database)
+	if err != nil {
+		println(err.Error())
+		os.Exit(-1)
+	}
+	defer s.Close()
+
+	entries, err := s.History(*host, *scenario, *runs)
+	if err != nil {
+		println(err.Error())
+		os.Exit(-1)
+	}
+
+	if *format == "json" {
+		out, _ := json.MarshalIndent(entries, "", "    ")
+		os.Stdout.Write(out)
+		os.Stdout.WriteString("\n")
+		return
+	}
+	if len(entries) == 0 {
+		fmt.Printf("No run of %s was recorded\n", *host)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "Run\tStarted at\tCommit\tScenario\tHost\tIP\tVerdict\tDuration (ms)")
+	for _, e := range entries {
+		verdict := e.Verdict
+		if e.ErrorCode != 0 {
+			verdict = fmt.Sprintf("%s (%s)", e.Verdict, e.Severity)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%d\n", e.Run.Id, e.Run.StartedAt.Format("2006-01-02 15:04:05"), shortCommit(e.Run.Commit), e.Scenario, e.Host, e.Ip, verdict, e.Duration)
+	}
+	w.Flush()
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 8 {
+		return commit[:8]
+	}
+	return commit
+}
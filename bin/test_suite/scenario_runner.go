@@ -3,20 +3,35 @@ package main
 import (
 	"os"
 	qt "github.com/RohitPanda/quic-tracker"
+	"github.com/RohitPanda/quic-tracker/agents"
 	s "github.com/RohitPanda/quic-tracker/scenarii"
+	"github.com/RohitPanda/quic-tracker/proxy"
 	"flag"
-	"strings"
 	"time"
 	"encoding/json"
+	"io"
+	"net"
 )
 
 func main() {
 	host := flag.String("host", "", "The host endpoint to run the test against.")
 	url := flag.String("url", "/index.html", "The URL to request when performing tests that needs data to be sent.")
+	sni := flag.String("sni", "", "The server name to indicate. Defaults to the hostname of the host, none is indicated for IP addresses.")
+	addressFlag := flag.String("address", "", "The IP address of the host to connect to. The host is resolved if not set.")
+	race := flag.Bool("race", false, "Connects to the address of the host that completes a handshake first in a happy eyeballs race.")
+	alpn := flag.String("alpn", "", "The ALPN token to offer. Defaults to the token of the version for the application of the scenario.")
 	scenarioName := flag.String("scenario", "", "The particular scenario to run.")
+	definitionsPath := flag.String("definitions", "", "A YAML file or a directory of YAML files defining additional scenarii, see the scenarii.Definition type.")
 	outputFile := flag.String("output", "", "The file to write the output to. Output to stdout if not set.")
 	debug := flag.Bool("debug", false, "Enables debugging information to be printed.")
-	netInterface := flag.String("interface", "", "The interface to listen to when capturing pcap.")
+	versionName := flag.String("version", "v1", "The QUIC version to use, either v1, v2, draft-17 or an hexadecimal version number.")
+	tlsProvider := flag.String("tls", "", "The TLS stack to use, either pigotls or crypto/tls. The first available that supports the version is used if not set, pigotls only supports the draft versions.")
+	impairment := flag.String("impairment", "", "The impairment profile of the path, either a predefined profile, a JSON document or a JSON file. The path is not impaired if not set.")
+	qlogDirectory := flag.String("qlog", os.Getenv("QLOGDIR"), "The directory to write a qlog file for each connection to. Defaults to the QLOGDIR environment variable, no qlog file is written if not set.")
+	keyLogFilename := flag.String("keylog", os.Getenv("SSLKEYLOGFILE"), "The file to append the TLS secrets to in the NSS key log format. Defaults to the SSLKEYLOGFILE environment variable.")
+	deadline := flag.Int("deadline", int(s.DefaultRunDeadline.Seconds()), "The number of seconds after which the run is abandoned.")
+	congestionControl := flag.String("congestion", "newreno", "The congestion controller to use, either newreno, cubic, bbr-lite or unlimited.")
+	disablePacing := flag.Bool("no-pacing", false, "Sends the packets as soon as the congestion controller allows it instead of pacing them.")
 	flag.Parse()
 
 	if *host == "" || *url == "" || *scenarioName == "" {
@@ -24,42 +39,87 @@ func main() {
 		os.Exit(-1)
 	}
 
-	scenario, ok := s.GetAllScenarii()[*scenarioName]
-	if !ok {
-		println("Unknown scenario", *scenarioName)
-		return
+	version, err := qt.ParseVersion(*versionName)
+	if err != nil {
+		println(err.Error())
+		os.Exit(-1)
+	}
+
+	if err := qt.SetDefaultTLSProvider(*tlsProvider); err != nil {
+		println(err.Error())
+		os.Exit(-1)
 	}
 
-	trace := qt.NewTrace(scenario.Name(), scenario.Version(), *host)
+	agents.QlogDirectory = *qlogDirectory
 
-	conn, err := qt.NewDefaultConnection(*host, strings.Split(*host, ":")[0], nil, scenario.IPv6(), scenario.HTTP3()) // Raw IPv6 are not handled correctly
+	if _, err := agents.NewCongestionController(*congestionControl, 1200); err != nil {
+		println(err.Error())
+		os.Exit(-1)
+	}
 
-	if err == nil {
-		pcap, err := qt.StartPcapCapture(conn, *netInterface)
+	var profile *proxy.Profile
+	if *impairment != "" {
+		p, err := proxy.LoadProfile(*impairment)
 		if err != nil {
-			trace.Results["pcap_start_error"] = err.Error()
+			println(err.Error())
+			os.Exit(-1)
 		}
+		profile = &p
+	}
 
-		trace.AttachTo(conn)
+	if *definitionsPath != "" {
+		if err := s.RegisterDefinitions(*definitionsPath); err != nil {
+			println(err.Error())
+			os.Exit(-1)
+		}
+	}
 
-		start := time.Now()
-		scenario.Run(conn, trace, *url, *debug)
-		trace.Duration = uint64(time.Now().Sub(start).Seconds() * 1000)
-		ip := strings.Replace(conn.ConnectedIp().String(), "[", "", -1)
-		trace.Ip = ip[:strings.LastIndex(ip, ":")]
-		trace.StartedAt = start.Unix()
+	scenario, ok := s.GetAllScenarii()[*scenarioName]
+	if !ok {
+		println("Unknown scenario", *scenarioName)
+		return
+	}
 
-		trace.Complete(conn)
-		conn.Close()
-		err = trace.AddPcap(conn, pcap)
+	var keyLog io.Writer
+	if *keyLogFilename != "" {
+		keyLogFile, err := os.OpenFile(*keyLogFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 		if err != nil {
-			trace.Results["pcap_completed_error"] = err.Error()
+			println(err.Error())
+			os.Exit(-1)
 		}
-	} else {
-		trace.ErrorCode = 255
-		trace.Results["udp_error"] = err.Error()
+		defer keyLogFile.Close()
+		keyLog = keyLogFile
 	}
 
+	var address *net.UDPAddr
+	if *addressFlag != "" {
+		_, port, err := net.SplitHostPort(*host)
+		if err == nil {
+			address, err = net.ResolveUDPAddr("udp", net.JoinHostPort(*addressFlag, port))
+		}
+		if err != nil {
+			println(err.Error())
+			os.Exit(-1)
+		}
+	}
+
+	trace := s.RunScenario(scenario, *host, s.RunConfig{
+		URL:        *url,
+		SNI:        *sni,
+		ALPN:       *alpn,
+		Debug:      *debug,
+		Version:    version,
+		Impairment: profile,
+		KeyLog:     keyLog,
+		Deadline:   time.Duration(*deadline) * time.Second,
+
+		Address:       address,
+		RaceAddresses: *race,
+
+		CongestionControl: *congestionControl,
+		DisablePacing:     *disablePacing,
+	})
+
 	out, _ := json.Marshal(trace)
 	if *outputFile != "" {
 		os.Remove(*outputFile)
@@ -1,12 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"os"
 	"sort"
 	"github.com/RohitPanda/quic-tracker/scenarii"
 	qt "github.com/RohitPanda/quic-tracker"
-	"bufio"
 	"strings"
 	"os/exec"
 	"runtime"
@@ -16,19 +16,43 @@ import (
 	"sync"
 	"encoding/json"
 	"time"
+	"io"
+	"strconv"
+	"net"
+	"github.com/RohitPanda/quic-tracker/agents"
+	"github.com/RohitPanda/quic-tracker/proxy"
+	"github.com/RohitPanda/quic-tracker/store"
 )
 
 func main() {
-	hostsFilename := flag.String("hosts", "", "A tab-separated file containing hosts and the URLs used to request data to be sent.")
+	hostsFilename := flag.String("hosts", "", "An inventory of the hosts in the YAML or JSON format, see the scenarii.Inventory type. A tab-separated file containing hosts and the URLs used to request data to be sent is also accepted.")
+	hostTagsList := flag.String("host-tags", "", "A comma-separated list of tags, only the hosts of the inventory having one of them are tested.")
 	scenarioName := flag.String("scenario", "", "A particular scenario to run. Run all of them if the parameter is missing.")
+	tagsList := flag.String("tags", "", "A comma-separated list of tags, only the scenarii having one of them are run, e.g. transport, h3, 0rtt, migration or ipv6.")
+	excludeTagsList := flag.String("exclude-tags", "", "A comma-separated list of tags, the scenarii having one of them are not run.")
+	definitionsPath := flag.String("definitions", "", "A YAML file or a directory of YAML files defining additional scenarii, see the scenarii.Definition type.")
+	list := flag.Bool("list", false, "Lists the scenarii selected with their tags and descriptions, and exits.")
 	outputFilename := flag.String("output", "", "The file to write the output to. Output to stdout if not set.")
 	logsDirectory := flag.String("logs-directory", "/tmp", "Location of the logs.")
-	netInterface := flag.String("interface", "", "The interface to listen to when capturing pcaps. Lets tcpdump decide if not set.")
 	parallel := flag.Bool("parallel", false, "Runs each scenario against multiple hosts at the same time.")
 	maxInstances := flag.Int("max-instances", 10, "Limits the number of parallel scenario runs.")
 	randomise := flag.Bool("randomise", false, "Randomise the execution order of scenarii")
 	debug := flag.Bool("debug", false, "Enables debugging information to be printed.")
+	version := flag.String("version", "v1", "The QUIC version to use, either v1, v2, draft-17 or an hexadecimal version number.")
+	tlsProvider := flag.String("tls", "", "The TLS stack to use, either pigotls or crypto/tls. The first available that supports the version is used if not set, pigotls only supports the draft versions.")
+	impairment := flag.String("impairment", "", "The impairment profile of the path, either a predefined profile, a JSON document or a JSON file. The path is not impaired if not set.")
+	qlog := flag.Bool("qlog", false, "Writes a qlog file for each connection next to the logs of the scenario.")
+	keyLogFilename := flag.String("keylog", os.Getenv("SSLKEYLOGFILE"), "The file to append the TLS secrets to in the NSS key log format. Defaults to the SSLKEYLOGFILE environment variable.")
+	deadline := flag.Int("deadline", int(scenarii.DefaultRunDeadline.Seconds()), "The number of seconds after which a run is abandoned.")
+	congestionControl := flag.String("congestion", "newreno", "The congestion controller to use, either newreno, cubic, bbr-lite or unlimited.")
+	disablePacing := flag.Bool("no-pacing", false, "Sends the packets as soon as the congestion controller allows it instead of pacing them.")
+	addressSelection := flag.String("addresses", "first", "How the addresses of the hosts are selected, either first, all or race. The scenarii are run against the first address resolved, against each address resolved, or against the address of the first handshake completed in a happy eyeballs race.")
+	format := flag.String("format", scenarii.FormatJSON, "The format of the output, either json, junit, markdown or html. The reports other than json have a test case per host and scenario with a named verdict.")
+	isolate := flag.Bool("isolate", false, "Runs each scenario in a separate process using go run, so that a crash of the agents does not stop the test suite.")
+	storeFilename := flag.String("store", "", "A SQLite database to record the run and its traces in, it is created if it does not exist. The run is not recorded if not set.")
+	storePackets := flag.Bool("store-packets", false, "Records the pcap and the packets of the traces in the database as well.")
 	flag.Parse()
+	startedAt := time.Now()
 
 	_, filename, _, ok := runtime.Caller(0)
 	if !ok {
@@ -37,31 +61,123 @@ func main() {
 	}
 	scenarioRunnerFilename := path.Join(path.Dir(filename), "scenario_runner.go")
 
+	if *definitionsPath != "" {
+		if err := scenarii.RegisterDefinitions(*definitionsPath); err != nil {
+			println(err.Error())
+			os.Exit(-1)
+		}
+	}
+
+	scenariiInstances := scenarii.GetAllScenarii()
+
+	if *scenarioName != "" && scenariiInstances[*scenarioName] == nil {
+		println("Unknown scenario", *scenarioName)
+	}
+
+	var tags, excludedTags []string
+	if *tagsList != "" {
+		tags = strings.Split(*tagsList, ",")
+	}
+	if *excludeTagsList != "" {
+		excludedTags = strings.Split(*excludeTagsList, ",")
+	}
+
+	var scenarioIds []string
+	for scenarioId, scenario := range scenariiInstances {
+		metadata := scenario.Metadata()
+		if *scenarioName != "" && *scenarioName != scenarioId || tags != nil && !metadata.HasTag(tags...) || metadata.HasTag(excludedTags...) {
+			continue
+		}
+		scenarioIds = append(scenarioIds, scenarioId)
+	}
+	if !*randomise || *list {
+		sort.Strings(scenarioIds)
+	}
+
+	if *list {
+		for _, id := range scenarioIds {
+			metadata := scenariiInstances[id].Metadata()
+			fmt.Printf("%-26s %-28s %s\n", id, strings.Join(metadata.Tags, ","), metadata.Description)
+		}
+		return
+	}
+
 	if *hostsFilename == "" {
 		println("The hosts parameter is required")
 		os.Exit(-1)
 	}
 
-	file, err := os.Open(*hostsFilename)
+	switch *format {
+	case scenarii.FormatJSON, scenarii.FormatJUnit, scenarii.FormatMarkdown, scenarii.FormatHTML:
+	default:
+		println("Unknown format " + *format)
+		os.Exit(-1)
+	}
+
+	_, err := qt.ParseVersion(*version)
 	if err != nil {
-		panic(err)
+		println(err.Error())
+		os.Exit(-1)
 	}
-	defer file.Close()
 
-	scenariiInstances := scenarii.GetAllScenarii()
+	if _, err := agents.NewCongestionController(*congestionControl, 1200); err != nil {
+		println(err.Error())
+		os.Exit(-1)
+	}
 
-	var scenarioIds []string
-	for scenarioId := range scenariiInstances {
-		scenarioIds = append(scenarioIds, scenarioId)
+	var resultsStore *store.Store
+	if *storeFilename != "" {
+		resultsStore, err = store.Open(*storeFilename)
+		if err != nil {
+			println(err.Error())
+			os.Exit(-1)
+		}
+		defer resultsStore.Close()
 	}
-	if !*randomise {
-		sort.Strings(scenarioIds)
+
+	if err := qt.SetDefaultTLSProvider(*tlsProvider); err != nil {
+		println(err.Error())
+		os.Exit(-1)
 	}
 
-	if *scenarioName != "" && scenariiInstances[*scenarioName] == nil {
-		println("Unknown scenario", *scenarioName)
+	var profile *proxy.Profile
+	if *impairment != "" {
+		p, err := proxy.LoadProfile(*impairment)
+		if err != nil {
+			println(err.Error())
+			os.Exit(-1)
+		}
+		profile = &p
 	}
 
+	var keyLog io.Writer
+	if *keyLogFilename != "" && !*isolate {
+		keyLogFile, err := os.OpenFile(*keyLogFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			println(err.Error())
+			os.Exit(-1)
+		}
+		defer keyLogFile.Close()
+		keyLog = keyLogFile
+	}
+
+	if *addressSelection != "first" && *addressSelection != "all" && *addressSelection != "race" {
+		println("Unknown address selection", *addressSelection)
+		os.Exit(-1)
+	}
+
+	inventory, err := scenarii.LoadInventory(*hostsFilename)
+	if err != nil {
+		println(err.Error())
+		os.Exit(-1)
+	}
+
+	var hostTags []string
+	if *hostTagsList != "" {
+		hostTags = strings.Split(*hostTagsList, ",")
+	}
+
+
 	var results Results
 	result := make(chan *qt.Trace)
 	resultsAgg := make(chan bool)
@@ -74,9 +190,6 @@ func main() {
 	}()
 
 	for _, id := range scenarioIds {
-		if *scenarioName != "" && *scenarioName != id {
-			continue
-		}
 		scenario := scenariiInstances[id]
 
 		if !*parallel {
@@ -89,80 +202,138 @@ func main() {
 		wg := &sync.WaitGroup{}
 
 		os.MkdirAll(path.Join(*logsDirectory, id), os.ModePerm)
+		if *qlog {
+			agents.QlogDirectory = path.Join(*logsDirectory, id)
+		}
 
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			line := strings.Split(scanner.Text(), "\t")
-			host, url := line[0], line[1]
-
-			<-semaphore
-			wg.Add(1)
-			if *debug {
-				fmt.Println("starting", scenario.Name(), "against", host)
+		for _, h := range inventory.Hosts {
+			if len(hostTags) > 0 && !h.HasTag(hostTags...) || h.Skips(id) {
+				continue
+			}
+			alpn, supported := h.ALPN(scenario.HTTP3())
+			if !supported {
+				continue
 			}
+			hostVersion, _ := qt.ParseVersion(h.Version(*version)) // The versions of the inventory are validated when it is loaded
+			h := h
 
-			go func() {
-				defer func() { semaphore <- true }()
-				defer wg.Done()
+			for _, host := range h.Targets() {
+				host := host
 
-				outputFile, err := ioutil.TempFile("", "quic_tracker")
-				if err != nil {
-					println(err.Error())
-					return
+				addresses := []*net.UDPAddr{nil} // The host is resolved by the run
+				if *addressSelection == "all" {
+					addresses, err = scenarii.ScenarioAddresses(scenario, host)
+					if err != nil {
+						trace := GetCrashTrace(scenario, host)
+						trace.ErrorCode = scenarii.R_UDPError
+						trace.Results["udp_error"] = err.Error()
+						result <- trace
+						continue
+					}
 				}
-				outputFile.Close()
 
-				logFile, err := os.Create(path.Join(*logsDirectory, id, host))
-				if err != nil {
-					println(err.Error())
-					return
-				}
-				defer logFile.Close()
+				for _, address := range addresses {
+					address := address
 
-				crashTrace := GetCrashTrace(scenario, host) // Prepare one just in case
-				start := time.Now()
+					<-semaphore
+					wg.Add(1)
+					if *debug {
+						fmt.Println("starting", scenario.Name(), "against", host, address)
+					}
 
-				args := []string{"run", scenarioRunnerFilename, "-host", host, "-url", url, "-scenario", id, "-interface", *netInterface, "-output", outputFile.Name()}
-				if *debug {
-					args = append(args, "-debug")
-				}
+					go func() {
+						defer func() { semaphore <- true }()
+						defer wg.Done()
 
-				c := exec.Command("go", args...)
-				c.Stdout = logFile
-				c.Stderr = logFile
-				err = c.Run()
-				if err != nil {
-					println(err.Error())
-				}
+						logFilename := host
+						if address != nil {
+							logFilename += "_" + address.IP.String()
+						}
+						logFile, err := os.Create(path.Join(*logsDirectory, id, logFilename))
+						if err != nil {
+							println(err.Error())
+							return
+						}
+						defer logFile.Close()
 
-				var trace qt.Trace
-				outputFile, err = os.Open(outputFile.Name())
-				if err != nil {
-					println(err)
-				}
-				defer outputFile.Close()
-				defer os.Remove(outputFile.Name())
-
-				err = json.NewDecoder(outputFile).Decode(&trace)
-				if err != nil {
-					println(err.Error())
-					crashTrace.StartedAt = start.Unix()
-					crashTrace.Duration = uint64(time.Now().Sub(start).Seconds() * 1000)
-					result <- crashTrace
-					return
+						if *isolate {
+							args := []string{"run", scenarioRunnerFilename, "-host", host, "-url", h.URL(), "-sni", h.ServerName(), "-alpn", alpn, "-scenario", id, "-version", h.Version(*version), "-tls", *tlsProvider, "-deadline", strconv.Itoa(*deadline), "-congestion", *congestionControl}
+							if address != nil {
+								args = append(args, "-address", address.IP.String())
+							}
+							if *addressSelection == "race" {
+								args = append(args, "-race")
+							}
+							if *debug {
+								args = append(args, "-debug")
+							}
+							if *keyLogFilename != "" {
+								args = append(args, "-keylog", *keyLogFilename)
+							}
+							if *qlog {
+								args = append(args, "-qlog", path.Join(*logsDirectory, id))
+							}
+							if *impairment != "" {
+								args = append(args, "-impairment", *impairment)
+							}
+							if *definitionsPath != "" {
+								args = append(args, "-definitions", *definitionsPath)
+							}
+							if *disablePacing {
+								args = append(args, "-no-pacing")
+							}
+							result <- runInSubprocess(scenario, host, args, logFile)
+							return
+						}
+
+						result <- scenarii.RunScenario(scenarii.GetAllScenarii()[id], host, scenarii.RunConfig{ // Each run needs its own instance
+							URL:           h.URL(),
+							SNI:           h.ServerName(),
+							ALPN:          alpn,
+							Debug:         *debug,
+							Version:       hostVersion,
+							Impairment:    profile,
+							KeyLog:        keyLog,
+							LogOutput:     logFile,
+							Deadline:      time.Duration(*deadline) * time.Second,
+							Address:       address,
+							RaceAddresses: *addressSelection == "race",
+
+							CongestionControl: *congestionControl,
+							DisablePacing:     *disablePacing,
+						})
+					}()
 				}
-				result <- &trace
-			}()
+			}
 		}
 
 		wg.Wait()
-		file.Seek(0, 0)
 	}
 	close(result)
 	<-resultsAgg
 
 	sort.Sort(results)
-	out, _ := json.Marshal(results)
+	if resultsStore != nil {
+		flags := make(map[string]string)
+		flag.Visit(func(f *flag.Flag) {
+			flags[f.Name] = f.Value.String()
+		})
+		if err := resultsStore.AddRun(&store.Run{Commit: qt.GitCommit(), StartedAt: startedAt, Flags: flags}, results, *storePackets); err != nil {
+			println(err.Error())
+		}
+	}
+
+	var out []byte
+	if *format == scenarii.FormatJSON {
+		out, _ = json.Marshal(results)
+	} else {
+		buffer := new(bytes.Buffer)
+		if err := scenarii.WriteReport(buffer, *format, results); err != nil {
+			println(err.Error())
+			os.Exit(-1)
+		}
+		out = buffer.Bytes()
+	}
 	if *outputFilename != "" {
 		outFile, err := os.Create(*outputFilename)
 		defer outFile.Close()
@@ -177,15 +348,57 @@ func main() {
 	println(string(out))
 }
 
+// Runs the scenario using go run and the given arguments. A trace reporting a crash is returned when the scenario
+// runner does not output one.
+func runInSubprocess(scenario scenarii.Scenario, host string, args []string, logFile *os.File) *qt.Trace {
+	crashTrace := GetCrashTrace(scenario, host) // Prepare one just in case
+	start := time.Now()
+
+	outputFile, err := ioutil.TempFile("", "quic_tracker")
+	if err != nil {
+		println(err.Error())
+		return crashTrace
+	}
+	outputFile.Close()
+	defer os.Remove(outputFile.Name())
+
+	c := exec.Command("go", append(args, "-output", outputFile.Name())...)
+	c.Stdout = logFile
+	c.Stderr = logFile
+	err = c.Run()
+	if err != nil {
+		println(err.Error())
+	}
+
+	var trace qt.Trace
+	outputFile, err = os.Open(outputFile.Name())
+	if err != nil {
+		println(err.Error())
+	} else {
+		defer outputFile.Close()
+		err = json.NewDecoder(outputFile).Decode(&trace)
+	}
+	if err != nil {
+		println(err.Error())
+		crashTrace.StartedAt = start.Unix()
+		crashTrace.Duration = uint64(time.Now().Sub(start).Seconds() * 1000)
+		return crashTrace
+	}
+	return &trace
+}
+
 func GetCrashTrace(scenario scenarii.Scenario, host string) *qt.Trace {
 	trace := qt.NewTrace(scenario.Name(), scenario.Version(), host)
-	trace.ErrorCode = 254
+	trace.ErrorCode = scenarii.R_Crashed
 	return trace
 }
 
 type Results []qt.Trace
 func (a Results) Less(i, j int) bool {
 	if a[i].Scenario == a[j].Scenario {
+		if a[i].Host == a[j].Host {
+			return a[i].Ip < a[j].Ip
+		}
 		return a[i].Host < a[j].Host
 	}
 	return a[i].Scenario < a[j].Scenario
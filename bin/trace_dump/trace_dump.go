@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	qt "github.com/RohitPanda/quic-tracker"
+	"github.com/RohitPanda/quic-tracker/agents"
+	"github.com/RohitPanda/quic-tracker/scenarii"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+type dumpedPacket struct {
+	Direction    qt.Direction  `json:"direction"`
+	Timestamp    int64         `json:"timestamp"`
+	Time         int64         `json:"time"` // Relative to the first packet of the trace in milliseconds
+	PacketType   string        `json:"packet_type,omitempty"`
+	PacketNumber *uint64       `json:"packet_number,omitempty"`
+	KeyPhase     *bool         `json:"key_phase,omitempty"`
+	Length       int           `json:"length"`
+	IsOfInterest bool          `json:"is_of_interest"`
+	Details      string        `json:"details,omitempty"`
+	Frames       []interface{} `json:"frames,omitempty"`
+	Error        string        `json:"error,omitempty"`
+}
+
+type dumpedConnection struct {
+	ClientCID string         `json:"client_cid"`
+	ServerCID string         `json:"server_cid"`
+	Packets   []dumpedPacket `json:"packets"`
+}
+
+type dumpedTrace struct {
+	Scenario    string             `json:"scenario"`
+	Host        string             `json:"host"`
+	Ip          string             `json:"ip"`
+	ErrorCode   uint8              `json:"error_code"`
+	Connections []dumpedConnection `json:"connections"`
+}
+
+func main() {
+	format := flag.String("format", "text", "The output format, either text or json.")
+	onlyOfInterest := flag.Bool("interest", false, "Only prints the packets marked of interest.")
+	scenario := flag.String("scenario", "", "Only prints the traces of the given scenario.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [results.json ...]\n\nDecodes the packets of the traces in the files, or of stdin when no file is given.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *format != "text" && *format != "json" {
+		println("Unknown format", *format)
+		os.Exit(-1)
+	}
+
+	var traces []qt.Trace
+	inputs := flag.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+	for _, input := range inputs {
+		t, err := scenarii.ReadTraces(input)
+		if err != nil {
+			println(err.Error())
+			os.Exit(-1)
+		}
+		traces = append(traces, t...)
+	}
+
+	var dumped []dumpedTrace
+	for _, trace := range traces {
+		if *scenario != "" && trace.Scenario != *scenario {
+			continue
+		}
+		dumped = append(dumped, dumpTrace(&trace, *onlyOfInterest))
+	}
+
+	if *format == "json" {
+		out, _ := json.MarshalIndent(dumped, "", "    ")
+		os.Stdout.Write(out)
+		os.Stdout.WriteString("\n")
+		return
+	}
+	for _, trace := range dumped {
+		printTrace(os.Stdout, trace)
+	}
+}
+
+func dumpTrace(trace *qt.Trace, onlyOfInterest bool) dumpedTrace {
+	d := dumpedTrace{Scenario: trace.Scenario, Host: trace.Host, Ip: trace.Ip, ErrorCode: trace.ErrorCode}
+	var start int64
+	if len(trace.Stream) > 0 {
+		start = trace.Stream[0].Timestamp
+	}
+	for _, c := range trace.DecodeStream() {
+		dc := dumpedConnection{ClientCID: hex.EncodeToString(c.ClientCID), ServerCID: hex.EncodeToString(c.ServerCID)}
+		for _, p := range c.Packets {
+			if onlyOfInterest && !p.IsOfInterest {
+				continue
+			}
+			dc.Packets = append(dc.Packets, dumpPacket(p, start))
+		}
+		d.Connections = append(d.Connections, dc)
+	}
+	return d
+}
+
+func dumpPacket(p qt.DecodedPacket, start int64) dumpedPacket {
+	d := dumpedPacket{Direction: p.Direction, Timestamp: p.Timestamp, Time: p.Timestamp - start, Length: len(p.Data), IsOfInterest: p.IsOfInterest}
+	if p.Error != nil {
+		d.Error = p.Error.Error()
+		return d
+	}
+	switch packet := p.Packet.(type) {
+	case *qt.VersionNegotiationPacket:
+		d.PacketType = "Version Negotiation"
+		var versions []string
+		for _, v := range packet.SupportedVersions {
+			versions = append(versions, fmt.Sprintf("%#x", uint32(v)))
+		}
+		d.Details = "supported_versions=[" + strings.Join(versions, " ") + "]"
+		return d
+	case *qt.RetryPacket:
+		d.PacketType = qt.Retry.String()
+		d.Details = fmt.Sprintf("token_length=%d", len(packet.RetryToken))
+		return d
+	}
+
+	header := p.Packet.Header()
+	pn := uint64(header.PacketNumber())
+	d.PacketType = header.PacketType().String()
+	d.PacketNumber = &pn
+	if h, ok := header.(*qt.ShortHeader); ok {
+		keyPhase := bool(h.KeyPhase)
+		d.KeyPhase = &keyPhase
+	}
+	if framer, ok := p.Packet.(qt.Framer); ok {
+		d.Frames = agents.QlogFrames(framer.GetFrames())
+	}
+	return d
+}
+
+func printTrace(w io.Writer, trace dumpedTrace) {
+	fmt.Fprintf(w, "%s against %s (%s), error code %d\n", trace.Scenario, trace.Host, trace.Ip, trace.ErrorCode)
+	for i, c := range trace.Connections {
+		fmt.Fprintf(w, "  Connection %d, client CID %s, server CID %s\n", i+1, orNone(c.ClientCID), orNone(c.ServerCID))
+		for _, p := range c.Packets {
+			printPacket(w, p)
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+func printPacket(w io.Writer, p dumpedPacket) {
+	arrow := "->"
+	if p.Direction == qt.ToClient {
+		arrow = "<-"
+	}
+	marker := " "
+	if p.IsOfInterest {
+		marker = "*"
+	}
+	line := fmt.Sprintf("  %s %7dms %s", marker, p.Time, arrow)
+	if p.Error != "" {
+		fmt.Fprintf(w, "%s %d bytes could not be parsed: %s\n", line, p.Length, p.Error)
+		return
+	}
+	line += " " + p.PacketType
+	if p.PacketNumber != nil {
+		line += fmt.Sprintf(" #%d", *p.PacketNumber)
+	}
+	if p.KeyPhase != nil && *p.KeyPhase {
+		line += " key_phase=1"
+	}
+	line += fmt.Sprintf(", %d bytes", p.Length)
+	if p.Details != "" {
+		line += ", " + p.Details
+	}
+	fmt.Fprintln(w, line)
+	for _, f := range p.Frames {
+		fmt.Fprintf(w, "%16s%s\n", "", formatFrame(f.(map[string]interface{})))
+	}
+}
+
+// Formats the qlog representation of a frame as its type followed by its fields
+func formatFrame(frame map[string]interface{}) string {
+	var keys []string
+	for k := range frame {
+		if k != "frame_type" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	fields := []string{strings.ToUpper(fmt.Sprint(frame["frame_type"]))}
+	for _, k := range keys {
+		fields = append(fields, k+"="+formatValue(frame[k]))
+	}
+	return strings.Join(fields, " ")
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case [][]qt.PacketNumber: // ACK ranges
+		var ranges []string
+		for _, r := range v {
+			if r[0] == r[1] {
+				ranges = append(ranges, fmt.Sprint(r[0]))
+			} else {
+				ranges = append(ranges, fmt.Sprintf("%d-%d", r[0], r[1]))
+			}
+		}
+		return "[" + strings.Join(ranges, ",") + "]"
+	case map[string]string:
+		return v["data"]
+	case string:
+		return fmt.Sprintf("%q", v)
+	}
+	return fmt.Sprint(value)
+}
+
+func orNone(cid string) string {
+	if cid == "" {
+		return "none"
+	}
+	return cid
+}
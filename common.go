@@ -34,22 +34,15 @@ import (
 	"bytes"
 	"encoding/binary"
 	. "github.com/RohitPanda/quic-tracker/lib"
-	_ "github.com/mpiraux/ls-qpack-go"
-	"github.com/mpiraux/pigotls"
 	"math"
 )
 
-// TODO: Reconsider the use of global variables
-var QuicVersion uint32 = 0xff000011 // See https://tools.ietf.org/html/draft-ietf-quic-transport-08#section-4
-var QuicALPNToken = "hq-17"         // See https://www.ietf.org/mail-archive/web/quic/current/msg01882.html
-var QuicH3ALPNToken = "h3-17"       // See https://tools.ietf.org/html/draft-ietf-quic-http-17#section-2.1
+var QuicVersion uint32 = QuicVersion1 // The version used by default for new connections, see versions.go
 
 const (
 	MinimumInitialLength   = 1252
 	MinimumInitialLengthv6 = 1232
 	MaxUDPPayloadSize      = 65507
-	MaximumVersion         = 0xff000011
-	MinimumVersion         = 0xff000011
 )
 
 // errors
@@ -57,6 +50,7 @@ const (
 const (
 	ERR_STREAM_LIMIT_ERROR = 0x04
 	ERR_STREAM_STATE_ERROR = 0x05
+	ERR_TRANSPORT_PARAMETER_ERROR = 0x08
 	ERR_PROTOCOL_VIOLATION = 0x0a
 )
 
@@ -154,24 +148,24 @@ var PNSpaceToString = map[PNSpace]string{
 	PNSpaceAppData: "Application data",
 }
 
-var PNSpaceToEpoch = map[PNSpace]pigotls.Epoch{
-	PNSpaceInitial: pigotls.EpochInitial,
-	PNSpaceHandshake: pigotls.EpochHandshake,
-	PNSpaceAppData: pigotls.Epoch1RTT,
+var PNSpaceToEpoch = map[PNSpace]Epoch{
+	PNSpaceInitial: EpochInitial,
+	PNSpaceHandshake: EpochHandshake,
+	PNSpaceAppData: Epoch1RTT,
 }
 
-var EpochToPNSpace = map[pigotls.Epoch]PNSpace {
-	pigotls.EpochInitial: PNSpaceInitial,
-	pigotls.EpochHandshake: PNSpaceHandshake,
-	pigotls.Epoch0RTT: PNSpaceAppData,
-	pigotls.Epoch1RTT: PNSpaceAppData,
+var EpochToPNSpace = map[Epoch]PNSpace {
+	EpochInitial: PNSpaceInitial,
+	EpochHandshake: PNSpaceHandshake,
+	Epoch0RTT: PNSpaceAppData,
+	Epoch1RTT: PNSpaceAppData,
 }
 
 func (pns PNSpace) String() string {
 	return PNSpaceToString[pns]
 }
 
-func (pns PNSpace) Epoch() pigotls.Epoch {
+func (pns PNSpace) Epoch() Epoch {
 	return PNSpaceToEpoch[pns]
 }
 
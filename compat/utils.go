@@ -2,4 +2,5 @@ package compat
 
 type UtilsInterface interface {
 	SetRECVTOS(fd int) error
-}
\ No newline at end of file
+	SetDontFragment(fd int, ipv6 bool) error
+}
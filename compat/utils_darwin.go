@@ -3,9 +3,18 @@ package compat
 import "syscall"
 
 const IP_RECVTOS = 27
+const IP_DONTFRAG = 28
+const IPV6_DONTFRAG = 62
 
 type Utils byte
 
 func (u *Utils) SetRECVTOS(fd int) error {
 	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, IP_RECVTOS, 1)
 }
+
+func (u *Utils) SetDontFragment(fd int, ipv6 bool) error {
+	if ipv6 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, IPV6_DONTFRAG, 1)
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, IP_DONTFRAG, 1)
+}
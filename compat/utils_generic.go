@@ -9,3 +9,10 @@ type Utils byte
 func (u *Utils) SetRECVTOS(fd int) error {
 	return syscall.SetsockoptByte(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVTOS, 1)
 }
+
+func (u *Utils) SetDontFragment(fd int, ipv6 bool) error {
+	if ipv6 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+}
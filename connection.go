@@ -1,18 +1,19 @@
 package quictracker
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	. "github.com/RohitPanda/quic-tracker/lib"
 	"github.com/dustin/go-broadcast"
-	"github.com/mpiraux/pigotls"
+	"io"
 	"log"
 	"net"
 	"os"
 	"sort"
-	"strings"
+	"sync"
 	"unsafe"
 )
 
@@ -22,9 +23,11 @@ type Connection struct {
 	UseIPv6        bool
 	Host           *net.UDPAddr
 
-	Tls           *pigotls.Connection
+	Tls           TLSProvider
 	TLSTPHandler  *TLSTransportParameterHandler
 	KeyPhaseIndex uint
+	CipherSuites  []CipherSuite // The cipher suites offered in order of preference, the TLS stack chooses them when empty
+	CipherSuite   CipherSuite   // The cipher suite selected by the server
 
 	CryptoStates   map[EncryptionLevel]*CryptoState
 
@@ -32,6 +35,11 @@ type Connection struct {
 
 	ReceivedPacketHandler func([]byte, unsafe.Pointer)
 	SentPacketHandler     func([]byte, unsafe.Pointer)
+	ReceivedDatagramHandler func([]byte) // Called with the UDP payloads as received from the network
+	SentDatagramHandler     func([]byte) // Called with the UDP payloads as sent on the network
+	KeyLog                  io.Writer    // When set, the secrets are appended in the NSS key log format as they are installed
+	CongestionControl       string       // The congestion controller of the SendingAgent, see agents.NewCongestionController. NewReno is used if not set
+	DisablePacing           bool         // Whether the SendingAgent sends the packets allowed by the congestion controller without pacing them
 
 	CryptoStreams       CryptoStreams  // TODO: It should be a parent class without closing states
 	Streams             Streams
@@ -42,15 +50,21 @@ type Connection struct {
 	UnprocessedPayloads       broadcast.Broadcaster //type: UnprocessedPayload
 	EncryptionLevelsAvailable broadcast.Broadcaster //type: DirectionalEncryptionLevel
 	FrameQueue                broadcast.Broadcaster //type: QueuedFrame
+	Crashes                   chan AgentCrash       // The panics recovered in the goroutines of the agents
 
 	OriginalDestinationCID ConnectionID
+	RetrySourceCID         ConnectionID // The source CID of the Retry accepted during the handshake, if any
 	SourceCID              ConnectionID
 	DestinationCID         ConnectionID
 	Version                uint32
+	VersionProfile         *VersionProfile
+	CompatibleVersions     []uint32 // The versions offered for an upgrade during the handshake, none by default, see OfferCompatibleVersions
 	ALPN                   string
 
 	Token            []byte
 	ResumptionTicket []byte
+	rejectedRetries  []RejectedRetry // The Retry packets discarded because they failed validation
+	retriesMutex     sync.Mutex
 
 	PacketNumber           map[PNSpace]PacketNumber // Stores the next PN to be sent
 	LargestPNsReceived     map[PNSpace]PacketNumber // Stores the largest PN received
@@ -58,8 +72,49 @@ type Connection struct {
 
 	AckQueue             map[PNSpace][]PacketNumber // Stores the packet numbers to be acked TODO: This should be a channel actually
 	Logger               *log.Logger
+	LogOutput            io.Writer // The agents attached to the connection write their logs to it
 }
+// An AgentCrash records a panic recovered in the goroutine of an agent
+type AgentCrash struct {
+	Agent      string
+	Panic      string
+	StackTrace string
+}
+
+// Returned when the connection cannot use a version, e.g. because no TLS provider compiled in sends the transport
+// parameters in the extension of its profile
+type UnsupportedVersionError struct {
+	Version uint32
+	Reason  string
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("version %08x is not supported: %s", e.Version, e.Reason)
+}
+
+type RejectedRetry struct {
+	Packet *RetryPacket
+	Reason string
+}
+
+// Records a Retry packet discarded because it failed validation
+func (c *Connection) RejectRetry(packet *RetryPacket, reason string) {
+	c.retriesMutex.Lock()
+	defer c.retriesMutex.Unlock()
+	c.rejectedRetries = append(c.rejectedRetries, RejectedRetry{packet, reason})
+}
+
+// Returns the Retry packets discarded so far because they failed validation
+func (c *Connection) RejectedRetries() []RejectedRetry {
+	c.retriesMutex.Lock()
+	defer c.retriesMutex.Unlock()
+	return append([]RejectedRetry(nil), c.rejectedRetries...)
+}
+
 func (c *Connection) ConnectedIp() net.Addr {
+	if c.Host != nil { // The UDP connection can be relayed, e.g. by an impairment proxy
+		return c.Host
+	}
 	return c.UdpConnection.RemoteAddr()
 }
 func (c *Connection) nextPacketNumber(space PNSpace) PacketNumber {  // TODO: This should be thread safe
@@ -71,30 +126,12 @@ func (c *Connection) SendPacket(packet Packet, level EncryptionLevel) {
 	switch packet.PNSpace() {
 	case PNSpaceInitial, PNSpaceHandshake, PNSpaceAppData:
 		c.Logger.Printf("Sending packet {type=%s, number=%d}\n", packet.Header().PacketType().String(), packet.Header().PacketNumber())
-		cryptoState := c.CryptoStates[level]
-
-		payload := packet.EncodePayload()
-		if h, ok := packet.Header().(*LongHeader); ok {
-			h.Length = NewVarInt(uint64(h.TruncatedPN().Length + len(payload) + cryptoState.Write.Overhead()))
-		}
-
-		header := packet.EncodeHeader()
-		protectedPayload := cryptoState.Write.Encrypt(payload, uint64(packet.Header().PacketNumber()), header)
-		packetBytes := append(header, protectedPayload...)
 
-		firstByteMask := byte(0x1F)
-		if packet.Header().PacketType() != ShortHeaderPacket {
-			firstByteMask = 0x0F
+		datagram := c.EncryptPacket(packet, level)
+		c.UdpConnection.Write(datagram)
+		if c.SentDatagramHandler != nil {
+			c.SentDatagramHandler(datagram)
 		}
-		sample, pnOffset := GetPacketSample(packet.Header(), packetBytes)
-		mask := cryptoState.HeaderWrite.Encrypt(sample, make([]byte, 5, 5))
-		packetBytes[0] ^= mask[0] & firstByteMask
-
-		for i := 0; i < packet.Header().TruncatedPN().Length; i++ {
-			packetBytes[pnOffset+i] ^= mask[1+i]
-		}
-
-		c.UdpConnection.Write(packetBytes)
 
 		if c.SentPacketHandler != nil {
 			c.SentPacketHandler(packet.Encode(packet.EncodePayload()), packet.Pointer())
@@ -104,15 +141,42 @@ func (c *Connection) SendPacket(packet Packet, level EncryptionLevel) {
 		// Clients do not send cleartext packets
 	}
 }
+// Protects the payload and the header of the packet with the keys of the given encryption level and returns the bytes
+// to put on the wire. The Length field of long headers is set accordingly.
+func (c *Connection) EncryptPacket(packet Packet, level EncryptionLevel) []byte {
+	cryptoState := c.CryptoStates[level]
+
+	payload := packet.EncodePayload()
+	if h, ok := packet.Header().(*LongHeader); ok {
+		h.Length = NewVarInt(uint64(h.TruncatedPN().Length + len(payload) + cryptoState.Write.Overhead()))
+	}
+
+	header := packet.EncodeHeader()
+	protectedPayload := cryptoState.Write.Encrypt(payload, uint64(packet.Header().PacketNumber()), header)
+	packetBytes := append(header, protectedPayload...)
+
+	firstByteMask := byte(0x1F)
+	if packet.Header().PacketType() != ShortHeaderPacket {
+		firstByteMask = 0x0F
+	}
+	sample, pnOffset := GetPacketSample(packet.Header(), packetBytes)
+	mask := cryptoState.HeaderWrite.Encrypt(sample, make([]byte, 5, 5))
+	packetBytes[0] ^= mask[0] & firstByteMask
+
+	for i := 0; i < packet.Header().TruncatedPN().Length; i++ {
+		packetBytes[pnOffset+i] ^= mask[1+i]
+	}
+	return packetBytes
+}
 func (c *Connection) GetInitialPacket() *InitialPacket {
 	extensionData, err := c.TLSTPHandler.GetExtensionData()
 	if err != nil {
 		println(err)
 		return nil
 	}
-	c.Tls.SetQUICTransportParameters(extensionData)
+	c.Tls.SetQUICTransportParameters(extensionData)  // The TLS provider sends them in the extension of VersionProfile, see NewTLSProvider
 
-	tlsOutput, notComplete, err := c.Tls.HandleMessage(nil, pigotls.EpochInitial)
+	tlsOutput, notComplete, err := c.Tls.HandleMessage(nil, EpochInitial)
 	if err != nil || !notComplete {
 		println(err.Error())
 		return nil
@@ -122,7 +186,8 @@ func (c *Connection) GetInitialPacket() *InitialPacket {
 
 	if len(c.Tls.ZeroRTTSecret()) > 0 {
 		c.Logger.Printf("0-RTT secret is available, installing crypto state")
-		c.CryptoStates[EncryptionLevel0RTT] = NewProtectedCryptoState(c.Tls, nil, c.Tls.ZeroRTTSecret())
+		c.CryptoStates[EncryptionLevel0RTT] = NewProtectedCryptoState(c.Tls, c.VersionProfile, 0, nil, c.Tls.ZeroRTTSecret())
+		c.LogSecret("CLIENT_EARLY_TRAFFIC_SECRET", c.Tls.ZeroRTTSecret())
 		c.EncryptionLevelsAvailable.Submit(DirectionalEncryptionLevel{EncryptionLevel0RTT, false})
 	}
 
@@ -143,22 +208,27 @@ func (c *Connection) GetInitialPacket() *InitialPacket {
 
 	return initialPacket
 }
+// Transitions to the most preferred version of the VN packet that can be used. An UnsupportedVersionError is returned
+// when the versions in common cannot be used, e.g. the draft versions when no TLS provider sends their extension.
 func (c *Connection) ProcessVersionNegotation(vn *VersionNegotiationPacket) error {
-	var version uint32
-	for _, v := range vn.SupportedVersions {
-		if v >= MinimumVersion && v <= MaximumVersion {
-			version = uint32(v)
+	var err error
+	for _, p := range VersionProfiles {  // VersionProfiles is sorted by order of preference
+		for _, v := range vn.SupportedVersions {
+			if uint32(v) != p.Version {
+				continue
+			}
+			if err = c.TransitionTo(p.Version, p.TranslateALPN(c.ALPN, c.VersionProfile)); err == nil {
+				return nil
+			}
+			c.Logger.Printf("Version %s cannot be used: %s\n", p, err.Error())
 		}
 	}
-	if version == 0 {
-		c.Logger.Println("No appropriate version was found in the VN packet")
-		c.Logger.Printf("Versions received: %v\n", vn.SupportedVersions)
-		return errors.New("no appropriate version found")
+	if err != nil {
+		return err
 	}
-	QuicVersion = version
-	QuicALPNToken = fmt.Sprintf("%s-%02d", strings.Split(c.ALPN, "-")[0], version & 0xff)
-	c.TransitionTo(QuicVersion, QuicALPNToken)
-	return nil
+	c.Logger.Println("No appropriate version was found in the VN packet")
+	c.Logger.Printf("Versions received: %v\n", vn.SupportedVersions)
+	return errors.New("no appropriate version found")
 }
 func (c *Connection) GetAckFrame(space PNSpace) *AckFrame { // Returns an ack frame based on the packet numbers received
 	sort.Sort(PacketNumberQueue(c.AckQueue[space]))
@@ -187,17 +257,35 @@ func (c *Connection) GetAckFrame(space PNSpace) *AckFrame { // Returns an ack fr
 	}
 	return frame
 }
-func (c *Connection) TransitionTo(version uint32, ALPN string) {
+// Resets the connection to start a new handshake using the given version and ALPN. An UnsupportedVersionError is
+// returned and the connection is left unchanged when no TLS provider can be used with the version.
+func (c *Connection) TransitionTo(version uint32, ALPN string) error {
 	var prevVersion uint32
 	if c.Version == 0 {
 		prevVersion = QuicVersion
 	} else {
 		prevVersion = c.Version
 	}
+	profile := GetVersionProfile(version)
+	if profile == nil {  // Unknown versions are used to trigger VN, the default wire image is used for them
+		profile = GetVersionProfile(QuicVersion)
+	}
+	tls, err := NewTLSProvider(c.ServerName, ALPN, c.ResumptionTicket, profile.TransportParametersExtension)
+	if err != nil {
+		return &UnsupportedVersionError{version, err.Error()}
+	}
 	c.TLSTPHandler = NewTLSTransportParameterHandler(version, prevVersion)
+	c.TLSTPHandler.InitialSourceConnectionId = c.SourceCID
 	c.Version = version
+	c.VersionProfile = profile
+	c.CompatibleVersions = nil
+	c.TLSTPHandler.VersionInformation = &VersionInformationParameter{version, []uint32{version}}
 	c.ALPN = ALPN
-	c.Tls = pigotls.NewConnection(c.ServerName, c.ALPN, c.ResumptionTicket)
+	c.Tls = tls
+	c.CipherSuite = 0
+	if err := c.applyCipherSuites(); err != nil {
+		c.Logger.Printf("Could not restrict the cipher suites offered: %s\n", err.Error())
+	}
 	c.PacketNumber = make(map[PNSpace]PacketNumber)
 	c.LargestPNsReceived = make(map[PNSpace]PacketNumber)
 	c.LargestPNsAcknowledged = make(map[PNSpace]PacketNumber)
@@ -211,8 +299,57 @@ func (c *Connection) TransitionTo(version uint32, ALPN string) {
 	c.CryptoStreams = make(map[PNSpace]*Stream)
 	c.CryptoStates[EncryptionLevelInitial] = NewInitialPacketProtection(c)
 	c.Streams = make(map[uint64]*Stream)
+	return nil
+}
+// Sets the cipher suites offered in the ClientHello, in order of preference. It must be called before the handshake
+// starts. An error is returned when the TLS stack cannot restrict the cipher suites it offers.
+func (c *Connection) SetCipherSuites(suites []CipherSuite) error {
+	c.CipherSuites = suites
+	return c.applyCipherSuites()
+}
+func (c *Connection) applyCipherSuites() error {
+	if len(c.CipherSuites) == 0 {
+		return nil
+	}
+	return c.Tls.SetCipherSuites(c.CipherSuites)
+}
+// Offers the server to upgrade the connection to the given versions during the handshake, by listing them in the
+// version_information transport parameter. It must be called before the handshake starts. The versions offered are
+// reset by TransitionTo. See https://tools.ietf.org/html/rfc9368#section-2.3
+func (c *Connection) OfferCompatibleVersions(versions ...uint32) error {
+	for _, v := range versions {
+		if !c.VersionProfile.IsCompatibleWith(v) {
+			return fmt.Errorf("version %08x is not compatible with %s", v, c.VersionProfile)
+		}
+	}
+	c.CompatibleVersions = versions
+	c.TLSTPHandler.VersionInformation = &VersionInformationParameter{c.Version, append([]uint32{c.Version}, versions...)}
+	return nil
 }
-func (c *Connection) CloseConnection(quicLayer bool, errCode uint16, reasonPhrase string) {
+// Returns whether the version was offered for an upgrade, see OfferCompatibleVersions
+func (c *Connection) OffersVersion(version uint32) bool {
+	for _, v := range c.CompatibleVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+// Switches the connection to a compatible version chosen by the server during the handshake, keeping the TLS state
+// and the packet number spaces. See https://tools.ietf.org/html/rfc9368#section-2.3
+func (c *Connection) UpgradeVersion(version uint32) error {
+	profile := GetVersionProfile(version)
+	if profile == nil || !c.OffersVersion(version) {
+		return fmt.Errorf("version %08x was not offered for an upgrade from %s", version, c.VersionProfile)
+	}
+	c.Logger.Printf("Upgrading from version %s to version %s\n", c.VersionProfile, profile)
+	c.Version = version
+	c.VersionProfile = profile
+	c.TLSTPHandler.NegotiatedVersion = version
+	c.CryptoStates[EncryptionLevelInitial] = NewInitialPacketProtection(c)
+	return nil
+}
+func (c *Connection) CloseConnection(quicLayer bool, errCode uint64, reasonPhrase string) {
 	if quicLayer {
 		c.FrameQueue.Submit(QueuedFrame{&ConnectionCloseFrame{errCode,0, uint64(len(reasonPhrase)), reasonPhrase}, EncryptionLevelBest})
 	} else {
@@ -226,6 +363,33 @@ func (c *Connection) Close() {
 	c.Tls.Close()
 	c.UdpConnection.Close()
 }
+// Writes the logs of the connection and of the agents attached to it afterwards to w
+func (c *Connection) SetLogOutput(w io.Writer) {
+	c.LogOutput = w
+	c.Logger.SetOutput(w)
+}
+// Appends the secret to KeyLog in the NSS key log format
+func (c *Connection) LogSecret(label string, secret []byte) {
+	if c.KeyLog != nil && len(secret) > 0 {
+		WriteKeyLogLine(c.KeyLog, label, c.Tls.ClientRandom(), secret)
+	}
+}
+// Installs the packet protection keys of the next key phase, see https://tools.ietf.org/html/rfc9001#section-6. The
+// header protection keys are kept. The secrets are logged with an increasing index, e.g. CLIENT_TRAFFIC_SECRET_1, as
+// the NSS key log format has no label for them. Wireshark derives them from the secrets of the first phase.
+func (c *Connection) UpdateKeys() {
+	readSecret, writeSecret := c.Tls.ProtectedReadSecret(), c.Tls.ProtectedWriteSecret()
+	for i := uint(0); i <= c.KeyPhaseIndex; i++ {
+		readSecret, writeSecret = NextTrafficSecret(c, readSecret), NextTrafficSecret(c, writeSecret)
+	}
+	oldState := c.CryptoStates[EncryptionLevel1RTT]
+	c.CryptoStates[EncryptionLevel1RTT] = NewProtectedCryptoState(c.Tls, c.VersionProfile, c.CipherSuite, readSecret, writeSecret)
+	c.CryptoStates[EncryptionLevel1RTT].HeaderRead = oldState.HeaderRead
+	c.CryptoStates[EncryptionLevel1RTT].HeaderWrite = oldState.HeaderWrite
+	c.KeyPhaseIndex++
+	c.LogSecret(fmt.Sprintf("CLIENT_TRAFFIC_SECRET_%d", c.KeyPhaseIndex), writeSecret)
+	c.LogSecret(fmt.Sprintf("SERVER_TRAFFIC_SECRET_%d", c.KeyPhaseIndex), readSecret)
+}
 func EstablishUDPConnection(addr *net.UDPAddr) (*net.UDPConn, error) {
 	udpConn, err := net.DialUDP(addr.Network(), nil, addr)
 	if err != nil {
@@ -233,7 +397,44 @@ func EstablishUDPConnection(addr *net.UDPAddr) (*net.UDPConn, error) {
 	}
 	return udpConn, nil
 }
-func NewDefaultConnection(address string, serverName string, resumptionTicket []byte, useIPv6 bool, negotiateHTTP3 bool) (*Connection, error) {
+// Resolves the IPv4 and IPv6 addresses of the given host and port. They are sorted as recommended by
+// https://tools.ietf.org/html/rfc8305#section-4, i.e. the families are interleaved starting with IPv6.
+func ResolveAddresses(address string) ([]*net.UDPAddr, error) {
+	host, service, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort("udp", service)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 []*net.UDPAddr
+	for _, ip := range ips {
+		addr := &net.UDPAddr{IP: ip.IP, Port: port, Zone: ip.Zone}
+		if ip.IP.To4() != nil {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	var addresses []*net.UDPAddr
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			addresses = append(addresses, v6[i])
+		}
+		if i < len(v4) {
+			addresses = append(addresses, v4[i])
+		}
+	}
+	return addresses, nil
+}
+// Creates a new connection to the given address. The version of QuicVersion is used when version is zero. When keyLog
+// is not nil, the secrets of the connection are appended to it, see KeyLog.
+func NewDefaultConnection(address string, serverName string, resumptionTicket []byte, useIPv6 bool, negotiateHTTP3 bool, version uint32, keyLog io.Writer) (*Connection, error) {
 	scid := make([]byte, 8, 8)
 	dcid := make([]byte, 8, 8)
 	rand.Read(scid)
@@ -255,19 +456,34 @@ func NewDefaultConnection(address string, serverName string, resumptionTicket []
 		return nil, err
 	}
 
-	var c *Connection
+	if version == 0 {
+		version = QuicVersion
+	}
+	profile := GetVersionProfile(version)
+	if profile == nil {
+		udpConn.Close()
+		return nil, &UnsupportedVersionError{version, "unknown version"}
+	}
+
+	ALPN := profile.ALPN
 	if negotiateHTTP3 {
-		c = NewConnection(serverName, QuicVersion, QuicH3ALPNToken, scid, dcid, udpConn, resumptionTicket)
-	} else {
-		c = NewConnection(serverName, QuicVersion, QuicALPNToken, scid, dcid, udpConn, resumptionTicket)
+		ALPN = profile.H3ALPN
+	}
+	c, err := NewConnection(serverName, version, ALPN, scid, dcid, udpConn, resumptionTicket)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
 	}
 
 	c.UseIPv6 = useIPv6
 	c.Host = udpAddr
+	c.KeyLog = keyLog
 	return c, nil
 }
 
-func NewConnection(serverName string, version uint32, ALPN string, SCID []byte, DCID[]byte , udpConn *net.UDPConn, resumptionTicket []byte) *Connection {
+// Creates a new connection over the given UDP connection. An UnsupportedVersionError is returned when the version
+// cannot be used.
+func NewConnection(serverName string, version uint32, ALPN string, SCID []byte, DCID[]byte , udpConn *net.UDPConn, resumptionTicket []byte) (*Connection, error) {
 	c := new(Connection)
 	c.ServerName = serverName
 	c.UdpConnection = udpConn
@@ -283,10 +499,13 @@ func NewConnection(serverName string, version uint32, ALPN string, SCID []byte,
 	c.UnprocessedPayloads = broadcast.NewBroadcaster(1000)
 	c.EncryptionLevelsAvailable = broadcast.NewBroadcaster(10)
 	c.FrameQueue = broadcast.NewBroadcaster(1000)
+	c.Crashes = make(chan AgentCrash, 10)
 
-	c.Logger = log.New(os.Stderr, fmt.Sprintf("[CID %s] ", hex.EncodeToString(c.OriginalDestinationCID)), log.Lshortfile)
-
-	c.TransitionTo(version, ALPN)
+	c.LogOutput = os.Stderr
+	c.Logger = log.New(c.LogOutput, fmt.Sprintf("[CID %s] ", hex.EncodeToString(c.OriginalDestinationCID)), log.Lshortfile)
 
-	return c
+	if err := c.TransitionTo(version, ALPN); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
@@ -1,15 +1,20 @@
 package quictracker
 
 import (
-	"github.com/mpiraux/pigotls"
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/RohitPanda/quic-tracker/lib"
+	"golang.org/x/crypto/chacha20"
 )
 
-var quicVersionSalt = []byte{  // See https://tools.ietf.org/html/draft-ietf-quic-tls-17#section-5.2
-	0xef, 0x4f, 0xb0, 0xab, 0xb4, 0x74, 0x70, 0xc4,
-	0x1b, 0xef, 0xcf, 0x80, 0x31, 0x33, 0x4f, 0xae,
-	0x48, 0x5e, 0x09, 0xa0,
-}
-
 const (
 	clientInitialLabel = "client in"
 	serverInitialLabel = "server in"
@@ -49,11 +54,11 @@ var packetTypeToEncryptionLevel = map[PacketType]EncryptionLevel{
 	ShortHeaderPacket: EncryptionLevel1RTT,
 }
 
-var EpochToEncryptionLevel = map[pigotls.Epoch]EncryptionLevel {
-	pigotls.EpochInitial: EncryptionLevelInitial,
-	pigotls.Epoch0RTT: EncryptionLevel0RTT,
-	pigotls.EpochHandshake: EncryptionLevelHandshake,
-	pigotls.Epoch1RTT: EncryptionLevel1RTT,
+var EpochToEncryptionLevel = map[Epoch]EncryptionLevel {
+	EpochInitial: EncryptionLevelInitial,
+	Epoch0RTT: EncryptionLevel0RTT,
+	EpochHandshake: EncryptionLevelHandshake,
+	Epoch1RTT: EncryptionLevel1RTT,
 }
 
 type DirectionalEncryptionLevel struct {
@@ -61,41 +66,259 @@ type DirectionalEncryptionLevel struct {
 	Read bool
 }
 
+// A CipherSuite is a TLS 1.3 cipher suite, see https://tools.ietf.org/html/rfc8446#appendix-B.4
+type CipherSuite uint16
+
+const (
+	TLS_AES_128_GCM_SHA256       CipherSuite = 0x1301
+	TLS_AES_256_GCM_SHA384       CipherSuite = 0x1302
+	TLS_CHACHA20_POLY1305_SHA256 CipherSuite = 0x1303
+)
+
+var cipherSuiteToString = map[CipherSuite]string{
+	TLS_AES_128_GCM_SHA256:       "TLS_AES_128_GCM_SHA256",
+	TLS_AES_256_GCM_SHA384:       "TLS_AES_256_GCM_SHA384",
+	TLS_CHACHA20_POLY1305_SHA256: "TLS_CHACHA20_POLY1305_SHA256",
+}
+
+func (s CipherSuite) String() string {
+	if name, ok := cipherSuiteToString[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown cipher suite 0x%04x", uint16(s))
+}
+
+func (s CipherSuite) Hash() crypto.Hash {
+	if s == TLS_AES_256_GCM_SHA384 {
+		return crypto.SHA384
+	}
+	return crypto.SHA256
+}
+
+// Returns the size of the AEAD and header protection keys of the cipher suite
+func (s CipherSuite) KeySize() int {
+	if s == TLS_AES_128_GCM_SHA256 {
+		return 16
+	}
+	return 32
+}
+
+func (s CipherSuite) newPacketCipher(key []byte, iv []byte) (PacketCipher, error) {
+	var aead cipher.AEAD
+	var err error
+	switch s {
+	case TLS_AES_128_GCM_SHA256, TLS_AES_256_GCM_SHA384:
+		aead, err = lib.NewWrappedAESGCM(key, iv)
+	case TLS_CHACHA20_POLY1305_SHA256:
+		aead, err = lib.NewWrappedChaCha20Poly1305(key, iv)
+	default:
+		err = errors.New(s.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &wrappedAEAD{aead}, nil
+}
+
+// See https://tools.ietf.org/html/rfc9001#section-5.4.3 and https://tools.ietf.org/html/rfc9001#section-5.4.4
+func (s CipherSuite) newHeaderCipher(key []byte) (HeaderCipher, error) {
+	switch s {
+	case TLS_AES_128_GCM_SHA256, TLS_AES_256_GCM_SHA384:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return &aesHeaderCipher{block}, nil
+	case TLS_CHACHA20_POLY1305_SHA256:
+		if len(key) != chacha20.KeySize {
+			return nil, fmt.Errorf("invalid ChaCha20 key length %d", len(key))
+		}
+		return &chachaHeaderCipher{key}, nil
+	}
+	return nil, errors.New(s.String())
+}
+
+// Reads the cipher suite selected by the server in a ServerHello or a HelloRetryRequest message, see
+// https://tools.ietf.org/html/rfc8446#section-4.1.3
+func ReadServerHelloCipherSuite(message []byte) (CipherSuite, error) {
+	const sessionIdOffset = 1 + 3 + 2 + 32 // msg_type, length, legacy_version and random
+	if len(message) < sessionIdOffset+1 || message[0] != 0x02 {
+		return 0, errors.New("not a ServerHello message")
+	}
+	suiteOffset := sessionIdOffset + 1 + int(message[sessionIdOffset])
+	if len(message) < suiteOffset+2 {
+		return 0, errors.New("ServerHello message is too short")
+	}
+	return CipherSuite(binary.BigEndian.Uint16(message[suiteOffset:])), nil
+}
+
+// See https://tools.ietf.org/html/rfc5869#section-2.2
+func HkdfExtract(hash crypto.Hash, salt []byte, ikm []byte) []byte {
+	mac := hmac.New(hash.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// See https://tools.ietf.org/html/rfc8446#section-7.1, the label is prefixed with the given base instead of "tls13 "
+func HkdfExpandLabel(hash crypto.Hash, secret []byte, label string, context []byte, length int, labelBase string) []byte {
+	hkdfLabel := new(bytes.Buffer)
+	binary.Write(hkdfLabel, binary.BigEndian, uint16(length))
+	hkdfLabel.WriteByte(uint8(len(labelBase) + len(label)))
+	hkdfLabel.WriteString(labelBase)
+	hkdfLabel.WriteString(label)
+	hkdfLabel.WriteByte(uint8(len(context)))
+	hkdfLabel.Write(context)
+
+	var output, block []byte // See https://tools.ietf.org/html/rfc5869#section-2.3
+	mac := hmac.New(hash.New, secret)
+	for i := byte(1); len(output) < length; i++ {
+		mac.Reset()
+		mac.Write(block)
+		mac.Write(hkdfLabel.Bytes())
+		mac.Write([]byte{i})
+		block = mac.Sum(nil)
+		output = append(output, block...)
+	}
+	return output[:length]
+}
+
+// A PacketCipher protects the payload of packets.
+type PacketCipher interface {
+	Encrypt(cleartext []byte, seq uint64, aad []byte) []byte
+	Decrypt(ciphertext []byte, seq uint64, aad []byte) []byte
+	Overhead() int
+}
+
+// A HeaderCipher computes the masks used for header protection.
+type HeaderCipher interface {
+	Encrypt(sample []byte, cleartext []byte) []byte
+}
+
+// A CryptoState holds the packet and header protection of an encryption level. The cipher suite can be zero when it is
+// not known, e.g. for 0-RTT, the one the TLS stack used for the secret is then used.
 type CryptoState struct {
-	Read        *pigotls.AEAD
-	Write       *pigotls.AEAD
-	HeaderRead  *pigotls.Cipher
-	HeaderWrite *pigotls.Cipher
+	Read        PacketCipher
+	Write       PacketCipher
+	HeaderRead  HeaderCipher
+	HeaderWrite HeaderCipher
 }
 
-func (s *CryptoState) InitRead(tls *pigotls.Connection, readSecret []byte) {
-	s.Read = tls.NewAEAD(readSecret, false)
-	s.HeaderRead = tls.NewCipher(tls.HkdfExpandLabel(readSecret, "hp", nil, tls.AEADKeySize(), pigotls.QuicBaseLabel))
+func (s *CryptoState) InitRead(tls TLSProvider, profile *VersionProfile, suite CipherSuite, readSecret []byte) {
+	if suite == 0 {
+		suite = tls.CipherSuite()
+	}
+	s.Read = newPacketCipher(profile, suite, readSecret)
+	s.HeaderRead = newHeaderCipher(profile, suite, readSecret)
 }
 
-func (s *CryptoState) InitWrite(tls *pigotls.Connection, writeSecret []byte) {
-	s.Write = tls.NewAEAD(writeSecret, true)
-	s.HeaderWrite = tls.NewCipher(tls.HkdfExpandLabel(writeSecret, "hp", nil, tls.AEADKeySize(), pigotls.QuicBaseLabel))
+func (s *CryptoState) InitWrite(tls TLSProvider, profile *VersionProfile, suite CipherSuite, writeSecret []byte) {
+	if suite == 0 {
+		suite = tls.CipherSuite()
+	}
+	s.Write = newPacketCipher(profile, suite, writeSecret)
+	s.HeaderWrite = newHeaderCipher(profile, suite, writeSecret)
 }
 
+// Initial packets are always protected with AEAD_AES_128_GCM, see https://tools.ietf.org/html/rfc9001#section-5.2
 func NewInitialPacketProtection(conn *Connection) *CryptoState {
-	initialSecret := conn.Tls.HkdfExtract(quicVersionSalt, conn.DestinationCID)
-	readSecret := conn.Tls.HkdfExpandLabel(initialSecret, serverInitialLabel, nil, conn.Tls.HashDigestSize(), pigotls.BaseLabel)
-	writeSecret := conn.Tls.HkdfExpandLabel(initialSecret, clientInitialLabel, nil, conn.Tls.HashDigestSize(), pigotls.BaseLabel)
-	return NewProtectedCryptoState(conn.Tls, readSecret, writeSecret)
+	hash := TLS_AES_128_GCM_SHA256.Hash()
+	initialSecret := HkdfExtract(hash, conn.VersionProfile.InitialSalt, conn.DestinationCID)
+	readSecret := HkdfExpandLabel(hash, initialSecret, serverInitialLabel, nil, hash.Size(), BaseLabel)
+	writeSecret := HkdfExpandLabel(hash, initialSecret, clientInitialLabel, nil, hash.Size(), BaseLabel)
+	return NewProtectedCryptoState(conn.Tls, conn.VersionProfile, TLS_AES_128_GCM_SHA256, readSecret, writeSecret)
 }
 
-func NewProtectedCryptoState(tls *pigotls.Connection, readSecret []byte, writeSecret []byte) *CryptoState {
+func NewProtectedCryptoState(tls TLSProvider, profile *VersionProfile, suite CipherSuite, readSecret []byte, writeSecret []byte) *CryptoState {
 	s := new(CryptoState)
 	if len(readSecret) > 0 {
-		s.InitRead(tls, readSecret)
+		s.InitRead(tls, profile, suite, readSecret)
 	}
 	if len(writeSecret) > 0 {
-		s.InitWrite(tls, writeSecret)
+		s.InitWrite(tls, profile, suite, writeSecret)
 	}
 	return s
 }
 
+func newPacketCipher(profile *VersionProfile, suite CipherSuite, secret []byte) PacketCipher {
+	key := HkdfExpandLabel(suite.Hash(), secret, profile.KeyLabel, nil, suite.KeySize(), profile.LabelBase)
+	iv := HkdfExpandLabel(suite.Hash(), secret, profile.IVLabel, nil, 12, profile.LabelBase)
+	c, err := suite.newPacketCipher(key, iv)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func newHeaderCipher(profile *VersionProfile, suite CipherSuite, secret []byte) HeaderCipher {
+	c, err := suite.newHeaderCipher(HkdfExpandLabel(suite.Hash(), secret, profile.HPLabel, nil, suite.KeySize(), profile.LabelBase))
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+type wrappedAEAD struct {
+	aead cipher.AEAD
+}
+
+func (a *wrappedAEAD) Encrypt(cleartext []byte, seq uint64, aad []byte) []byte {
+	nonce := make([]byte, 8)
+	binary.BigEndian.PutUint64(nonce, seq)
+	return a.aead.Seal(nil, nonce, cleartext, aad)
+}
+func (a *wrappedAEAD) Decrypt(ciphertext []byte, seq uint64, aad []byte) []byte {
+	nonce := make([]byte, 8)
+	binary.BigEndian.PutUint64(nonce, seq)
+	cleartext, err := a.aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil
+	}
+	return cleartext
+}
+func (a *wrappedAEAD) Overhead() int { return a.aead.Overhead() }
+
+// The mask is the output of AES-ECB over the sample
+type aesHeaderCipher struct {
+	block cipher.Block
+}
+
+func (c *aesHeaderCipher) Encrypt(sample []byte, cleartext []byte) []byte {
+	mask := make([]byte, aes.BlockSize)
+	c.block.Encrypt(mask, sample)
+	out := make([]byte, len(cleartext))
+	for i := range cleartext {
+		out[i] = cleartext[i] ^ mask[i]
+	}
+	return out
+}
+
+// The mask is the ChaCha20 keystream using the first 4 bytes of the sample as block counter and the remaining 12 as
+// nonce
+type chachaHeaderCipher struct {
+	key []byte
+}
+
+func (c *chachaHeaderCipher) Encrypt(sample []byte, cleartext []byte) []byte {
+	stream, err := chacha20.NewUnauthenticatedCipher(c.key, sample[4:16])
+	if err != nil {
+		return nil
+	}
+	stream.SetCounter(binary.LittleEndian.Uint32(sample[:4]))
+	out := make([]byte, len(cleartext))
+	stream.XORKeyStream(out, cleartext)
+	return out
+}
+
+// Derives the traffic secret of the next key phase, see https://tools.ietf.org/html/rfc9001#section-6
+func NextTrafficSecret(conn *Connection, secret []byte) []byte {
+	suite := conn.CipherSuite
+	if suite == 0 {
+		suite = conn.Tls.CipherSuite()
+	}
+	hash := suite.Hash()
+	return HkdfExpandLabel(hash, secret, conn.VersionProfile.KeyUpdateLabel, nil, hash.Size(), conn.VersionProfile.KeyUpdateLabelBase)
+}
+
 func GetPacketSample(header Header, packetBytes []byte) ([]byte, int) {
 	var pnOffset int
 	sampleLength := 16
@@ -116,3 +339,21 @@ func GetPacketSample(header Header, packetBytes []byte) ([]byte, int) {
 
 	return packetBytes[sampleOffset:sampleOffset+sampleLength], pnOffset
 }
+
+// Computes the integrity tag of a Retry packet, i.e. the output of AEAD_AES_128_GCM over the Retry pseudo-packet
+// formed with the original destination CID. See https://tools.ietf.org/html/rfc9001#section-5.8
+func ComputeRetryIntegrityTag(profile *VersionProfile, originalDestinationCID ConnectionID, retryPacket []byte) ([]byte, error) {
+	block, err := aes.NewCipher(profile.RetryKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	pseudoPacket := new(bytes.Buffer)
+	pseudoPacket.WriteByte(uint8(len(originalDestinationCID)))
+	pseudoPacket.Write(originalDestinationCID)
+	pseudoPacket.Write(retryPacket)
+	return aead.Seal(nil, profile.RetryNonce, nil, pseudoPacket.Bytes()), nil
+}
@@ -0,0 +1,69 @@
+package quictracker
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// See https://tools.ietf.org/html/rfc9001#appendix-A.2
+func TestAESHeaderProtection(t *testing.T) {
+	hp, err := TLS_AES_128_GCM_SHA256.newHeaderCipher(decodeHex(t, "9f50449e04a0e810283a1e9933adedd2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mask := hp.Encrypt(decodeHex(t, "d1b1c98dd7689fb8ec11d242b123dc9b"), make([]byte, 5)); hex.EncodeToString(mask) != "437b9aec36" {
+		t.Errorf("expected the mask 437b9aec36, got %x", mask)
+	}
+}
+
+// See https://tools.ietf.org/html/rfc9001#appendix-A.5
+func TestChaCha20Poly1305ShortHeaderPacket(t *testing.T) {
+	suite := TLS_CHACHA20_POLY1305_SHA256
+	hash := suite.Hash()
+	profile := VersionProfileV1
+	secret := decodeHex(t, "9ac312a7f877468ebe69422748ad00a15443f18203a07d6060f688f30f21632b")
+	key := HkdfExpandLabel(hash, secret, profile.KeyLabel, nil, suite.KeySize(), profile.LabelBase)
+	iv := HkdfExpandLabel(hash, secret, profile.IVLabel, nil, 12, profile.LabelBase)
+	hpKey := HkdfExpandLabel(hash, secret, profile.HPLabel, nil, suite.KeySize(), profile.LabelBase)
+	ku := HkdfExpandLabel(hash, secret, profile.KeyUpdateLabel, nil, hash.Size(), profile.KeyUpdateLabelBase)
+	for name, c := range map[string]struct{ derived, expected string }{
+		"key": {hex.EncodeToString(key), "c6d98ff3441c3fe1b2182094f69caa2ed4b716b65488960a7a984979fb23e1c8"},
+		"iv":  {hex.EncodeToString(iv), "e0459b3474bdd0e44a41c144"},
+		"hp":  {hex.EncodeToString(hpKey), "25a282b9e82f06f21f488917a4fc8f1b73573685608597d0efcb076b0ab7a7a4"},
+		"ku":  {hex.EncodeToString(ku), "1223504755036d556342ee9361d253421a826c9ecdf3c7148684b36b714881f9"},
+	} {
+		if c.derived != c.expected {
+			t.Errorf("expected the %s %s, got %s", name, c.expected, c.derived)
+		}
+	}
+
+	packetCipher, err := suite.newPacketCipher(key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := decodeHex(t, "4200bff4")
+	payload := packetCipher.Encrypt([]byte{0x01}, 654360564, header)
+	if hex.EncodeToString(payload) != "655e5cd55c41f69080575d7999c25a5bfb" {
+		t.Errorf("unexpected protected payload %x", payload)
+	}
+	if cleartext := packetCipher.Decrypt(payload, 654360564, header); !bytes.Equal(cleartext, []byte{0x01}) {
+		t.Errorf("unexpected decrypted payload %x", cleartext)
+	}
+
+	hp, err := suite.newHeaderCipher(hpKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mask := hp.Encrypt(payload[1:17], make([]byte, 5))
+	if hex.EncodeToString(mask) != "aefefe7d03" {
+		t.Errorf("expected the mask aefefe7d03, got %x", mask)
+	}
+	protected := []byte{header[0] ^ mask[0]&0x1f, header[1] ^ mask[1], header[2] ^ mask[2], header[3] ^ mask[3]}
+	if hex.EncodeToString(protected) != "4cfe4189" {
+		t.Errorf("expected the protected header 4cfe4189, got %x", protected)
+	}
+	if _, err := suite.newHeaderCipher(hpKey[:16]); err == nil {
+		t.Error("a ChaCha20 header protection key of 16 bytes was accepted")
+	}
+}
@@ -11,7 +11,7 @@ import (
 
 type Frame interface {
 	FrameType() FrameType
-	writeTo(buffer *bytes.Buffer)
+	writeTo(buffer *bytes.Buffer, profile *VersionProfile)
 	shouldBeRetransmitted() bool
 	FrameLength() uint16
 }
@@ -25,6 +25,9 @@ func NewFrame(buffer *bytes.Reader, conn *Connection) (Frame, error) {
 	}
 	buffer.UnreadByte()
 	frameType := FrameType(typeByte)
+	if !conn.VersionProfile.SupportsFrame(frameType) {
+		return nil, errors.New(fmt.Sprintf("Frame type %d is not defined in version %s", typeByte, conn.VersionProfile))
+	}
 	switch {
 	case frameType == PaddingFrameType:
 		return Frame(NewPaddingFrame(buffer)), nil
@@ -35,9 +38,9 @@ func NewFrame(buffer *bytes.Reader, conn *Connection) (Frame, error) {
 	case frameType == AckECNType:
 		return Frame(ReadAckECNFrame(buffer, conn)), nil
 	case frameType == ResetStreamType:
-		return Frame(NewResetStream(buffer)), nil
+		return Frame(NewResetStream(buffer, conn)), nil
 	case frameType == StopSendingType:
-		return Frame(NewStopSendingFrame(buffer)), nil
+		return Frame(NewStopSendingFrame(buffer, conn)), nil
 	case frameType == CryptoType:
 		return Frame(ReadCryptoFrame(buffer, conn)), nil
 	case frameType == NewTokenType:
@@ -57,7 +60,7 @@ func NewFrame(buffer *bytes.Reader, conn *Connection) (Frame, error) {
 	case frameType&0xFE == StreamsBlockedType:
 		return Frame(NewStreamIdNeededFrame(buffer)), nil
 	case frameType == NewConnectionIdType:
-		return Frame(NewNewConnectionIdFrame(buffer)), nil
+		return Frame(NewNewConnectionIdFrame(buffer, conn)), nil
 	case frameType == RetireConnectionIdType:
 		return Frame(ReadRetireConnectionId(buffer)), nil
 	case frameType == PathChallengeType:
@@ -65,9 +68,11 @@ func NewFrame(buffer *bytes.Reader, conn *Connection) (Frame, error) {
 	case frameType == PathResponseType:
 		return Frame(ReadPathResponse(buffer)), nil
 	case frameType == ConnectionCloseType:
-		return Frame(NewConnectionCloseFrame(buffer)), nil
+		return Frame(NewConnectionCloseFrame(buffer, conn)), nil
 	case frameType == ApplicationCloseType:
-		return Frame(NewApplicationCloseFrame(buffer)), nil
+		return Frame(NewApplicationCloseFrame(buffer, conn)), nil
+	case frameType == HandshakeDoneType:
+		return Frame(ReadHandshakeDoneFrame(buffer)), nil
 	default:
 		return nil, errors.New(fmt.Sprintf("Unknown frame type %d", typeByte))
 	}
@@ -97,12 +102,34 @@ const (
 	PathResponseType                 = 0x1b
 	ConnectionCloseType              = 0x1c
 	ApplicationCloseType             = 0x1d
+	HandshakeDoneType                = 0x1e
 )
 
+// Error codes are 16-bit integers in draft versions and varints in RFC versions
+func writeErrorCode(buffer *bytes.Buffer, profile *VersionProfile, errorCode uint64) {
+	if profile.VarIntErrorCodes {
+		WriteVarInt(buffer, errorCode)
+	} else {
+		binary.Write(buffer, binary.BigEndian, uint16(errorCode))
+	}
+}
+func readErrorCode(buffer *bytes.Reader, profile *VersionProfile) uint64 {
+	if profile.VarIntErrorCodes {
+		errorCode, _ := ReadVarIntValue(buffer)
+		return errorCode
+	}
+	var errorCode uint16
+	binary.Read(buffer, binary.BigEndian, &errorCode)
+	return uint64(errorCode)
+}
+func errorCodeLength(errorCode uint64) uint16 { // The largest of both encodings
+	return uint16(Max(2, VarIntLen(errorCode)))
+}
+
 type PaddingFrame byte
 
 func (frame PaddingFrame) FrameType() FrameType { return PaddingFrameType }
-func (frame PaddingFrame) writeTo(buffer *bytes.Buffer) {
+func (frame PaddingFrame) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	WriteVarInt(buffer, uint64(frame.FrameType()))
 }
 func (frame PaddingFrame) shouldBeRetransmitted() bool { return false }
@@ -115,7 +142,7 @@ func NewPaddingFrame(buffer *bytes.Reader) *PaddingFrame {
 type PingFrame byte
 
 func (frame PingFrame) FrameType() FrameType { return PingType }
-func (frame PingFrame) writeTo(buffer *bytes.Buffer) {
+func (frame PingFrame) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	WriteVarInt(buffer, uint64(frame.FrameType()))
 }
 func (frame PingFrame) shouldBeRetransmitted() bool { return false }
@@ -139,7 +166,7 @@ type AckBlock struct {
 
 func (frame AckFrame) FrameType() FrameType        { return AckType }
 func (frame AckFrame) shouldBeRetransmitted() bool { return false }
-func (frame AckFrame) writeTo(buffer *bytes.Buffer) {
+func (frame AckFrame) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	WriteVarInt(buffer, uint64(frame.FrameType()))
 	WriteVarInt(buffer, uint64(frame.LargestAcknowledged))
 	WriteVarInt(buffer, frame.AckDelay)
@@ -184,6 +211,30 @@ func (frame AckFrame) GetAckedPackets() []PacketNumber { // TODO: This is prone
 	}
 	return packets
 }
+type PacketNumberRange struct {
+	Smallest PacketNumber
+	Largest  PacketNumber
+}
+func (r PacketNumberRange) Contains(pn PacketNumber) bool { return pn >= r.Smallest && pn <= r.Largest }
+// Returns the ranges of packet numbers acknowledged by the frame in descending order, see https://tools.ietf.org/html/rfc9000#section-19.3.1
+func (frame AckFrame) GetAckedRanges() []PacketNumberRange {
+	var ranges []PacketNumberRange
+	if len(frame.AckBlocks) == 0 || uint64(frame.LargestAcknowledged) < frame.AckBlocks[0].Block {
+		return ranges
+	}
+	largest := uint64(frame.LargestAcknowledged)
+	smallest := largest - frame.AckBlocks[0].Block
+	ranges = append(ranges, PacketNumberRange{PacketNumber(smallest), PacketNumber(largest)})
+	for _, ackBlock := range frame.AckBlocks[1:] {
+		if smallest < ackBlock.Gap + 2 || smallest - ackBlock.Gap - 2 < ackBlock.Block {
+			break
+		}
+		largest = smallest - ackBlock.Gap - 2
+		smallest = largest - ackBlock.Block
+		ranges = append(ranges, PacketNumberRange{PacketNumber(smallest), PacketNumber(largest)})
+	}
+	return ranges
+}
 func ReadAckFrame(buffer *bytes.Reader) *AckFrame {
 	frame := new(AckFrame)
 	buffer.ReadByte() // Discard frame byte
@@ -214,8 +265,8 @@ type AckECNFrame struct {
 }
 
 func (frame AckECNFrame) FrameType() FrameType { return AckECNType }
-func (frame AckECNFrame) writeTo(buffer *bytes.Buffer) {
-	frame.AckFrame.writeTo(buffer)
+func (frame AckECNFrame) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
+	frame.AckFrame.writeTo(buffer, profile)
 	WriteVarInt(buffer, frame.ECT0Count)
 	WriteVarInt(buffer, frame.ECT1Count)
 	WriteVarInt(buffer, frame.ECTCECount)
@@ -233,46 +284,46 @@ func ReadAckECNFrame(buffer *bytes.Reader, conn *Connection) *AckECNFrame {
 
 type ResetStream struct {
 	StreamId             uint64
-	ApplicationErrorCode uint16
+	ApplicationErrorCode uint64
 	FinalOffset          uint64
 }
 
 func (frame ResetStream) FrameType() FrameType { return ResetStreamType }
-func (frame ResetStream) writeTo(buffer *bytes.Buffer) {
+func (frame ResetStream) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	WriteVarInt(buffer, uint64(frame.FrameType()))
 	WriteVarInt(buffer, frame.StreamId)
-	binary.Write(buffer, binary.BigEndian, frame.ApplicationErrorCode)
+	writeErrorCode(buffer, profile, frame.ApplicationErrorCode)
 	WriteVarInt(buffer, frame.FinalOffset)
 }
 func (frame ResetStream) shouldBeRetransmitted() bool { return true }
-func (frame ResetStream) FrameLength() uint16         { return 1 + uint16(VarIntLen(frame.StreamId)+2+VarIntLen(frame.FinalOffset)) }
-func NewResetStream(buffer *bytes.Reader) *ResetStream {
+func (frame ResetStream) FrameLength() uint16         { return 1 + uint16(VarIntLen(frame.StreamId)+VarIntLen(frame.FinalOffset)) + errorCodeLength(frame.ApplicationErrorCode) }
+func NewResetStream(buffer *bytes.Reader, conn *Connection) *ResetStream {
 	frame := new(ResetStream)
 	buffer.ReadByte() // Discard frame type
 	frame.StreamId, _ = ReadVarIntValue(buffer)
-	binary.Read(buffer, binary.BigEndian, &frame.ApplicationErrorCode)
+	frame.ApplicationErrorCode = readErrorCode(buffer, conn.VersionProfile)
 	frame.FinalOffset, _ = ReadVarIntValue(buffer)
 	return frame
 }
 
 type StopSendingFrame struct {
 	StreamId             uint64
-	ApplicationErrorCode uint16
+	ApplicationErrorCode uint64
 }
 
 func (frame StopSendingFrame) FrameType() FrameType { return StopSendingType }
-func (frame StopSendingFrame) writeTo(buffer *bytes.Buffer) {
+func (frame StopSendingFrame) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	WriteVarInt(buffer, uint64(frame.FrameType()))
 	WriteVarInt(buffer, frame.StreamId)
-	binary.Write(buffer, binary.BigEndian, frame.ApplicationErrorCode)
+	writeErrorCode(buffer, profile, frame.ApplicationErrorCode)
 }
 func (frame StopSendingFrame) shouldBeRetransmitted() bool { return true }
-func (frame StopSendingFrame) FrameLength() uint16         { return 1 + uint16(VarIntLen(frame.StreamId)) + 2 }
-func NewStopSendingFrame(buffer *bytes.Reader) *StopSendingFrame {
+func (frame StopSendingFrame) FrameLength() uint16         { return 1 + uint16(VarIntLen(frame.StreamId)) + errorCodeLength(frame.ApplicationErrorCode) }
+func NewStopSendingFrame(buffer *bytes.Reader, conn *Connection) *StopSendingFrame {
 	frame := new(StopSendingFrame)
 	buffer.ReadByte() // Discard frame type
 	frame.StreamId, _ = ReadVarIntValue(buffer)
-	binary.Read(buffer, binary.BigEndian, &frame.ApplicationErrorCode)
+	frame.ApplicationErrorCode = readErrorCode(buffer, conn.VersionProfile)
 	return frame
 }
 
@@ -283,7 +334,7 @@ type CryptoFrame struct {
 }
 
 func (frame CryptoFrame) FrameType() FrameType { return CryptoType }
-func (frame CryptoFrame) writeTo(buffer *bytes.Buffer) {
+func (frame CryptoFrame) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	WriteVarInt(buffer, uint64(frame.FrameType()))
 	WriteVarInt(buffer, frame.Offset)
 	WriteVarInt(buffer, frame.Length)
@@ -313,7 +364,7 @@ type NewTokenFrame struct {
 }
 
 func (frame NewTokenFrame) FrameType() FrameType { return NewTokenType }
-func (frame NewTokenFrame) writeTo(buffer *bytes.Buffer) {
+func (frame NewTokenFrame) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	WriteVarInt(buffer, uint64(frame.FrameType()))
 	WriteVarInt(buffer, uint64(len(frame.Token)))
 	buffer.Write(frame.Token)
@@ -341,7 +392,7 @@ type StreamFrame struct {
 }
 
 func (frame StreamFrame) FrameType() FrameType { return StreamType }
-func (frame StreamFrame) writeTo(buffer *bytes.Buffer) {
+func (frame StreamFrame) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	typeByte := uint64(frame.FrameType())
 	if frame.FinBit {
 		typeByte |= 0x01
@@ -416,7 +467,7 @@ type MaxDataFrame struct {
 }
 
 func (frame MaxDataFrame) FrameType() FrameType { return MaxDataType }
-func (frame MaxDataFrame) writeTo(buffer *bytes.Buffer) {
+func (frame MaxDataFrame) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	WriteVarInt(buffer, uint64(frame.FrameType()))
 	WriteVarInt(buffer, frame.MaximumData)
 }
@@ -435,7 +486,7 @@ type MaxStreamDataFrame struct {
 }
 
 func (frame MaxStreamDataFrame) FrameType() FrameType { return MaxStreamDataType }
-func (frame MaxStreamDataFrame) writeTo(buffer *bytes.Buffer) {
+func (frame MaxStreamDataFrame) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	WriteVarInt(buffer, uint64(frame.FrameType()))
 	WriteVarInt(buffer, frame.StreamId)
 	WriteVarInt(buffer, frame.MaximumStreamData)
@@ -462,7 +513,7 @@ func (frame MaxStreamsFrame) FrameType() FrameType {
 		return MaxStreamsType + 1
 	}
 }
-func (frame MaxStreamsFrame) writeTo(buffer *bytes.Buffer) {
+func (frame MaxStreamsFrame) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	WriteVarInt(buffer, uint64(frame.FrameType()))
 	WriteVarInt(buffer, frame.MaximumStreams)
 }
@@ -482,7 +533,7 @@ type DataBlockedFrame struct {
 }
 
 func (frame DataBlockedFrame) FrameType() FrameType { return DataBlockedType }
-func (frame DataBlockedFrame) writeTo(buffer *bytes.Buffer) {
+func (frame DataBlockedFrame) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	WriteVarInt(buffer, uint64(frame.FrameType()))
 	WriteVarInt(buffer, frame.DataLimit)
 }
@@ -501,7 +552,7 @@ type StreamDataBlockedFrame struct {
 }
 
 func (frame StreamDataBlockedFrame) FrameType() FrameType { return StreamDataBlockedType }
-func (frame StreamDataBlockedFrame) writeTo(buffer *bytes.Buffer) {
+func (frame StreamDataBlockedFrame) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	WriteVarInt(buffer, uint64(frame.FrameType()))
 	WriteVarInt(buffer, frame.StreamId)
 	WriteVarInt(buffer, frame.StreamDataLimit)
@@ -528,7 +579,7 @@ func (frame StreamsBlockedFrame) FrameType() FrameType {
 		return StreamsBlockedType + 1
 	}
 }
-func (frame StreamsBlockedFrame) writeTo(buffer *bytes.Buffer) {
+func (frame StreamsBlockedFrame) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	WriteVarInt(buffer, uint64(frame.FrameType()))
 	WriteVarInt(buffer, frame.StreamLimit)
 }
@@ -545,25 +596,32 @@ func NewStreamIdNeededFrame(buffer *bytes.Reader) *StreamsBlockedFrame {
 
 type NewConnectionIdFrame struct {
 	Sequence            uint64
+	RetirePriorTo       uint64 // Only present in RFC versions
 	Length              uint8
 	ConnectionId        []byte
 	StatelessResetToken [16]byte
 }
 
 func (frame NewConnectionIdFrame) FrameType() FrameType { return NewConnectionIdType }
-func (frame NewConnectionIdFrame) writeTo(buffer *bytes.Buffer) {
+func (frame NewConnectionIdFrame) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	WriteVarInt(buffer, uint64(frame.FrameType()))
 	WriteVarInt(buffer, frame.Sequence)
+	if profile.RetirePriorTo {
+		WriteVarInt(buffer, frame.RetirePriorTo)
+	}
 	buffer.WriteByte(frame.Length)
 	buffer.Write(frame.ConnectionId)
 	binary.Write(buffer, binary.BigEndian, frame.StatelessResetToken)
 }
 func (frame NewConnectionIdFrame) shouldBeRetransmitted() bool { return true }
-func (frame NewConnectionIdFrame) FrameLength() uint16         { return 1 + uint16(VarIntLen(frame.Sequence)) + 1 + uint16(len(frame.ConnectionId)) + 16 }
-func NewNewConnectionIdFrame(buffer *bytes.Reader) *NewConnectionIdFrame {
+func (frame NewConnectionIdFrame) FrameLength() uint16         { return 1 + uint16(VarIntLen(frame.Sequence)+VarIntLen(frame.RetirePriorTo)) + 1 + uint16(len(frame.ConnectionId)) + 16 }
+func NewNewConnectionIdFrame(buffer *bytes.Reader, conn *Connection) *NewConnectionIdFrame {
 	frame := new(NewConnectionIdFrame)
 	buffer.ReadByte() // Discard frame type
 	frame.Sequence, _ = ReadVarIntValue(buffer)
+	if conn.VersionProfile.RetirePriorTo {
+		frame.RetirePriorTo, _ = ReadVarIntValue(buffer)
+	}
 	frame.Length, _ = buffer.ReadByte()
 	frame.ConnectionId = make([]byte, frame.Length, frame.Length)
 	buffer.Read(frame.ConnectionId)
@@ -576,7 +634,7 @@ type RetireConnectionId struct {
 }
 
 func (frame RetireConnectionId) FrameType() FrameType { return RetireConnectionIdType }
-func (frame RetireConnectionId) writeTo(buffer *bytes.Buffer) {
+func (frame RetireConnectionId) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	WriteVarInt(buffer, uint64(frame.FrameType()))
 	WriteVarInt(buffer, frame.SequenceNumber)
 }
@@ -594,7 +652,7 @@ type PathChallenge struct {
 }
 
 func (frame PathChallenge) FrameType() FrameType { return PathChallengeType }
-func (frame PathChallenge) writeTo(buffer *bytes.Buffer) {
+func (frame PathChallenge) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	WriteVarInt(buffer, uint64(frame.FrameType()))
 	buffer.Write(frame.Data[:])
 }
@@ -612,7 +670,7 @@ type PathResponse struct {
 }
 
 func (frame PathResponse) FrameType() FrameType { return PathResponseType }
-func (frame PathResponse) writeTo(buffer *bytes.Buffer) {
+func (frame PathResponse) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	WriteVarInt(buffer, uint64(frame.FrameType()))
 	buffer.Write(frame.Data[:])
 }
@@ -631,16 +689,16 @@ func NewPathResponse(data [8]byte) *PathResponse {
 }
 
 type ConnectionCloseFrame struct {
-	ErrorCode          uint16
+	ErrorCode          uint64
 	ErrorFrameType     uint64
 	ReasonPhraseLength uint64
 	ReasonPhrase       string
 }
 
 func (frame ConnectionCloseFrame) FrameType() FrameType { return ConnectionCloseType }
-func (frame ConnectionCloseFrame) writeTo(buffer *bytes.Buffer) {
+func (frame ConnectionCloseFrame) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	WriteVarInt(buffer, uint64(frame.FrameType()))
-	binary.Write(buffer, binary.BigEndian, frame.ErrorCode)
+	writeErrorCode(buffer, profile, frame.ErrorCode)
 	WriteVarInt(buffer, frame.ErrorFrameType)
 	WriteVarInt(buffer, frame.ReasonPhraseLength)
 	if frame.ReasonPhraseLength > 0 {
@@ -648,11 +706,11 @@ func (frame ConnectionCloseFrame) writeTo(buffer *bytes.Buffer) {
 	}
 }
 func (frame ConnectionCloseFrame) shouldBeRetransmitted() bool { return false }
-func (frame ConnectionCloseFrame) FrameLength() uint16         { return 1 + 2 + uint16(VarIntLen(frame.ErrorFrameType)+VarIntLen(frame.ReasonPhraseLength)) + uint16(frame.ReasonPhraseLength) }
-func NewConnectionCloseFrame(buffer *bytes.Reader) *ConnectionCloseFrame {
+func (frame ConnectionCloseFrame) FrameLength() uint16         { return 1 + errorCodeLength(frame.ErrorCode) + uint16(VarIntLen(frame.ErrorFrameType)+VarIntLen(frame.ReasonPhraseLength)) + uint16(frame.ReasonPhraseLength) }
+func NewConnectionCloseFrame(buffer *bytes.Reader, conn *Connection) *ConnectionCloseFrame {
 	frame := new(ConnectionCloseFrame)
 	buffer.ReadByte() // Discard frame type
-	binary.Read(buffer, binary.BigEndian, &frame.ErrorCode)
+	frame.ErrorCode = readErrorCode(buffer, conn.VersionProfile)
 	frame.ErrorFrameType, _ = ReadVarIntValue(buffer)
 	frame.ReasonPhraseLength, _ = ReadVarIntValue(buffer)
 	if frame.ReasonPhraseLength > 0 {
@@ -665,26 +723,26 @@ func NewConnectionCloseFrame(buffer *bytes.Reader) *ConnectionCloseFrame {
 
 type ApplicationCloseFrame struct {
 	// TODO: Merge it with 0x1c
-	errorCode          uint16
+	errorCode          uint64
 	reasonPhraseLength uint64
 	reasonPhrase       string
 }
 
 func (frame ApplicationCloseFrame) FrameType() FrameType { return ApplicationCloseType }
-func (frame ApplicationCloseFrame) writeTo(buffer *bytes.Buffer) {
+func (frame ApplicationCloseFrame) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
 	WriteVarInt(buffer, uint64(frame.FrameType()))
-	binary.Write(buffer, binary.BigEndian, frame.errorCode)
+	writeErrorCode(buffer, profile, frame.errorCode)
 	WriteVarInt(buffer, frame.reasonPhraseLength)
 	if frame.reasonPhraseLength > 0 {
 		buffer.Write([]byte(frame.reasonPhrase))
 	}
 }
 func (frame ApplicationCloseFrame) shouldBeRetransmitted() bool { return false }
-func (frame ApplicationCloseFrame) FrameLength() uint16         { return 1 + 2 + uint16(VarIntLen(frame.reasonPhraseLength)) + uint16(frame.reasonPhraseLength) }
-func NewApplicationCloseFrame(buffer *bytes.Reader) *ApplicationCloseFrame {
+func (frame ApplicationCloseFrame) FrameLength() uint16         { return 1 + errorCodeLength(frame.errorCode) + uint16(VarIntLen(frame.reasonPhraseLength)) + uint16(frame.reasonPhraseLength) }
+func NewApplicationCloseFrame(buffer *bytes.Reader, conn *Connection) *ApplicationCloseFrame {
 	frame := new(ApplicationCloseFrame)
 	buffer.ReadByte() // Discard frame type
-	binary.Read(buffer, binary.BigEndian, &frame.errorCode)
+	frame.errorCode = readErrorCode(buffer, conn.VersionProfile)
 	frame.reasonPhraseLength, _ = ReadVarIntValue(buffer)
 	if frame.reasonPhraseLength > 0 {
 		reasonBytes := make([]byte, frame.reasonPhraseLength, frame.reasonPhraseLength)
@@ -693,3 +751,17 @@ func NewApplicationCloseFrame(buffer *bytes.Reader) *ApplicationCloseFrame {
 	}
 	return frame
 }
+
+type HandshakeDoneFrame byte
+
+func (frame HandshakeDoneFrame) FrameType() FrameType { return HandshakeDoneType }
+func (frame HandshakeDoneFrame) writeTo(buffer *bytes.Buffer, profile *VersionProfile) {
+	WriteVarInt(buffer, uint64(frame.FrameType()))
+}
+func (frame HandshakeDoneFrame) shouldBeRetransmitted() bool { return true }
+func (frame HandshakeDoneFrame) FrameLength() uint16         { return 1 }
+func ReadHandshakeDoneFrame(buffer *bytes.Reader) *HandshakeDoneFrame {
+	frame := new(HandshakeDoneFrame)
+	buffer.ReadByte() // Discard frame type
+	return frame
+}
@@ -0,0 +1,27 @@
+package quictracker
+
+import (
+	"reflect"
+	"testing"
+)
+
+// See https://tools.ietf.org/html/rfc9000#section-19.3.1
+func TestAckFrameGetAckedRanges(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		frame    AckFrame
+		expected []PacketNumberRange
+	}{
+		{"single range", AckFrame{LargestAcknowledged: 10, AckBlocks: []AckBlock{{0, 3}}}, []PacketNumberRange{{7, 10}}},
+		{"several ranges", AckFrame{LargestAcknowledged: 10, AckBlocks: []AckBlock{{0, 2}, {1, 1}, {0, 0}}}, []PacketNumberRange{{8, 10}, {4, 5}, {2, 2}}},
+		{"range down to zero", AckFrame{LargestAcknowledged: 4, AckBlocks: []AckBlock{{0, 0}, {0, 2}}}, []PacketNumberRange{{4, 4}, {0, 2}}},
+		{"first range below zero", AckFrame{LargestAcknowledged: 3, AckBlocks: []AckBlock{{0, 5}}}, nil},
+		{"gap below zero", AckFrame{LargestAcknowledged: 10, AckBlocks: []AckBlock{{0, 0}, {20, 0}}}, []PacketNumberRange{{10, 10}}},
+		{"range below zero", AckFrame{LargestAcknowledged: 10, AckBlocks: []AckBlock{{0, 0}, {0, 9}}}, []PacketNumberRange{{10, 10}}},
+		{"no range", AckFrame{LargestAcknowledged: 10}, nil},
+	} {
+		if ranges := c.frame.GetAckedRanges(); !reflect.DeepEqual(ranges, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, ranges)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package quictracker
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
 )
 
 type PacketType uint8
@@ -47,7 +48,9 @@ func ReadHeader(buffer *bytes.Reader, conn *Connection) Header {
 	var h Header
 	typeByte, _ := buffer.ReadByte()
 	buffer.UnreadByte()
-	if typeByte & 0x80 == 0x80 {
+	if typeByte & 0x80 == 0x80 && peekLongHeaderType(buffer, conn) == Retry {
+		h = ReadRetryHeader(buffer, conn)
+	} else if typeByte & 0x80 == 0x80 {
 		h = ReadLongHeader(buffer, conn)
 	} else {
 		h = ReadShortHeader(buffer, conn)
@@ -66,17 +69,20 @@ type LongHeader struct {
 	Length         VarInt
 	packetNumber   PacketNumber
 	truncatedPN    TruncatedPN
+	profile        *VersionProfile
 }
 func (h *LongHeader) Encode() []byte {
 	buffer := new(bytes.Buffer)
 	typeByte := uint8(0xC0)
-	typeByte |= uint8(h.packetType) << 4
-	typeByte |= uint8(h.truncatedPN.Length) - 1
+	typeByte |= h.profile.encodePacketType(h.packetType) << 4
+	if h.packetType == Retry {
+		typeByte |= h.lowerBits
+	} else {
+		typeByte |= uint8(h.truncatedPN.Length) - 1
+	}
 	binary.Write(buffer, binary.BigEndian, typeByte)
 	binary.Write(buffer, binary.BigEndian, h.Version)
-	buffer.WriteByte((h.DestinationCID.CIDL() << 4) | h.SourceCID.CIDL())
-	binary.Write(buffer, binary.BigEndian, h.DestinationCID)
-	binary.Write(buffer, binary.BigEndian, h.SourceCID)
+	writeLongHeaderCIDs(buffer, h.DestinationCID, h.SourceCID, h.profile)
 	if h.packetType == Initial {
 		buffer.Write(h.TokenLength.Encode())
 		buffer.Write(h.Token)
@@ -92,8 +98,12 @@ func (h *LongHeader) DestinationConnectionID() ConnectionID { return h.Destinati
 func (h *LongHeader) PacketNumber() PacketNumber { return h.packetNumber }
 func (h *LongHeader) TruncatedPN() TruncatedPN { return h.truncatedPN }
 func (h *LongHeader) EncryptionLevel() EncryptionLevel { return packetTypeToEncryptionLevel[h.PacketType()] }
+func (h *LongHeader) Profile() *VersionProfile { return h.profile }
 func (h *LongHeader) HeaderLength() int {
 	length := 6 + len(h.DestinationCID) + len(h.SourceCID) + h.Length.Length + h.truncatedPN.Length
+	if h.profile.ExplicitCIDLengths {
+		length++
+	}
 	if h.packetType == Initial {
 		length += h.TokenLength.Length + len(h.Token)
 	}
@@ -103,15 +113,13 @@ func ReadLongHeader(buffer *bytes.Reader, conn *Connection) *LongHeader {
 	h := new(LongHeader)
 	typeByte, _ := buffer.ReadByte()
 	h.lowerBits = typeByte & 0x0F
-	h.packetType = PacketType(typeByte - 0xC0) >> 4
 	binary.Read(buffer, binary.BigEndian, &h.Version)
-	CIDL, _ := buffer.ReadByte()
-	DCIL := 3 + ((CIDL & 0xf0) >> 4)
-	SCIL := 3 + (CIDL & 0xf)
-	h.DestinationCID = make([]byte, DCIL, DCIL)
-	binary.Read(buffer, binary.BigEndian, &h.DestinationCID)
-	h.SourceCID = make([]byte, SCIL, SCIL)
-	binary.Read(buffer, binary.BigEndian, &h.SourceCID)
+	h.profile = GetVersionProfile(h.Version)
+	if h.profile == nil {
+		h.profile = conn.VersionProfile
+	}
+	h.packetType = h.profile.decodePacketType((typeByte & 0x30) >> 4)
+	h.DestinationCID, h.SourceCID = readLongHeaderCIDs(buffer, h.profile)
 	if h.packetType == Initial {
 		h.TokenLength, _ = ReadVarInt(buffer)
 		h.Token = make([]byte, h.TokenLength.Value)
@@ -124,10 +132,57 @@ func ReadLongHeader(buffer *bytes.Reader, conn *Connection) *LongHeader {
 	}
 	return h
 }
+// Returns the type of the long header at the current position of the buffer without consuming it. Version
+// Negotiation packets have no type and are reported as ShortHeaderPacket.
+func peekLongHeaderType(buffer *bytes.Reader, conn *Connection) PacketType {
+	position, _ := buffer.Seek(0, io.SeekCurrent)
+	defer buffer.Seek(position, io.SeekStart)
+	typeByte, _ := buffer.ReadByte()
+	var version uint32
+	if binary.Read(buffer, binary.BigEndian, &version) != nil || version == 0 {
+		return ShortHeaderPacket
+	}
+	profile := GetVersionProfile(version)
+	if profile == nil {
+		profile = conn.VersionProfile
+	}
+	return profile.decodePacketType((typeByte & 0x30) >> 4)
+}
+func writeLongHeaderCIDs(buffer *bytes.Buffer, DCID ConnectionID, SCID ConnectionID, profile *VersionProfile) {
+	if profile.ExplicitCIDLengths {
+		buffer.WriteByte(uint8(len(DCID)))
+		buffer.Write(DCID)
+		buffer.WriteByte(uint8(len(SCID)))
+		buffer.Write(SCID)
+	} else {
+		buffer.WriteByte((DCID.CIDL() << 4) | SCID.CIDL())
+		buffer.Write(DCID)
+		buffer.Write(SCID)
+	}
+}
+func readLongHeaderCIDs(buffer *bytes.Reader, profile *VersionProfile) (ConnectionID, ConnectionID) {
+	var DCIL, SCIL byte
+	if profile.ExplicitCIDLengths {
+		DCIL, _ = buffer.ReadByte()
+	} else {
+		CIDL, _ := buffer.ReadByte()
+		DCIL = 3 + ((CIDL & 0xf0) >> 4)
+		SCIL = 3 + (CIDL & 0xf)
+	}
+	DCID := make([]byte, DCIL, DCIL)
+	binary.Read(buffer, binary.BigEndian, &DCID)
+	if profile.ExplicitCIDLengths {
+		SCIL, _ = buffer.ReadByte()
+	}
+	SCID := make([]byte, SCIL, SCIL)
+	binary.Read(buffer, binary.BigEndian, &SCID)
+	return DCID, SCID
+}
 func NewLongHeader(packetType PacketType, conn *Connection, space PNSpace) *LongHeader {
 	h := new(LongHeader)
 	h.packetType = packetType
 	h.Version = conn.Version
+	h.profile = conn.VersionProfile
 	h.SourceCID = conn.SourceCID
 	if packetType == ZeroRTTProtected {
 		h.DestinationCID = conn.OriginalDestinationCID
@@ -140,6 +195,47 @@ func NewLongHeader(packetType PacketType, conn *Connection, space PNSpace) *Long
 	return h
 }
 
+// Retry packets have a long header without Length and Packet Number fields, see https://tools.ietf.org/html/rfc9000#section-17.2.5
+type RetryHeader struct {
+	lowerBits      byte
+	Version        uint32
+	DestinationCID ConnectionID
+	SourceCID      ConnectionID
+	profile        *VersionProfile
+}
+func (h *RetryHeader) Encode() []byte {
+	buffer := new(bytes.Buffer)
+	buffer.WriteByte(0xC0 | h.profile.encodePacketType(Retry) << 4 | h.lowerBits)
+	binary.Write(buffer, binary.BigEndian, h.Version)
+	writeLongHeaderCIDs(buffer, h.DestinationCID, h.SourceCID, h.profile)
+	return buffer.Bytes()
+}
+func (h *RetryHeader) PacketType() PacketType { return Retry }
+func (h *RetryHeader) DestinationConnectionID() ConnectionID { return h.DestinationCID }
+func (h *RetryHeader) PacketNumber() PacketNumber { return 0 }
+func (h *RetryHeader) TruncatedPN() TruncatedPN { return TruncatedPN{} }
+func (h *RetryHeader) EncryptionLevel() EncryptionLevel { return EncryptionLevelNone }
+func (h *RetryHeader) Profile() *VersionProfile { return h.profile }
+func (h *RetryHeader) HeaderLength() int {
+	length := 6 + len(h.DestinationCID) + len(h.SourceCID)
+	if h.profile.ExplicitCIDLengths {
+		length++
+	}
+	return length
+}
+func ReadRetryHeader(buffer *bytes.Reader, conn *Connection) *RetryHeader {
+	h := new(RetryHeader)
+	typeByte, _ := buffer.ReadByte()
+	h.lowerBits = typeByte & 0x0F
+	binary.Read(buffer, binary.BigEndian, &h.Version)
+	h.profile = GetVersionProfile(h.Version)
+	if h.profile == nil {
+		h.profile = conn.VersionProfile
+	}
+	h.DestinationCID, h.SourceCID = readLongHeaderCIDs(buffer, h.profile)
+	return h
+}
+
 func (t PacketType) String() string {
 	return packetTypeToString[t]
 }
@@ -11,12 +11,10 @@ export GOPATH=~/go
 #export GOPATH=$PWD/go-pkg
 
 go get github.com/RohitPanda/quic-tracker  
-# This will fail because of the missing dependencies that should be build using the 4 lines below
+# This will fail because of the missing dependencies that should be build using the 2 lines below
 
 cd $GOPATH/src/github.com/mpiraux/pigotls
 make
-cd $GOPATH/src/github.com/mpiraux/ls-qpack-go
-make
 
 cd $GOPATH/src/github.com/RohitPanda/quic-tracker
 
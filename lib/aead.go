@@ -34,6 +34,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
 	"hash/fnv"
 )
 
@@ -130,3 +131,12 @@ func NewWrappedAESGCM(key []byte, iv []byte) (cipher.AEAD, error) {
 
 	return &aeadWrapper{iv, aead}, nil
 }
+
+func NewWrappedChaCha20Poly1305(key []byte, iv []byte) (cipher.AEAD, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &aeadWrapper{iv, aead}, nil
+}
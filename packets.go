@@ -2,9 +2,12 @@ package quictracker
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"errors"
 	"encoding/binary"
 	"io"
 	"github.com/davecgh/go-spew/spew"
+	"os"
 	"unsafe"
 	"fmt"
 	"encoding/hex"
@@ -23,7 +26,8 @@ type Packet interface {
 }
 
 type abstractPacket struct {
-	header Header
+	header  Header
+	profile *VersionProfile
 }
 func (p abstractPacket) Header() Header {
 	return p.header
@@ -56,11 +60,18 @@ func (v SupportedVersion) String() string {
 func (p *VersionNegotiationPacket) ShouldBeAcknowledged() bool { return false }
 func (p *VersionNegotiationPacket) EncodePayload() []byte {
 	buffer := new(bytes.Buffer)
-	buffer.WriteByte(p.UnusedField & 0x80)
+	buffer.WriteByte(0x80 | p.UnusedField&0x7f)
 	binary.Write(buffer, binary.BigEndian, p.Version)
-	buffer.WriteByte((p.DestinationCID.CIDL() << 4) | p.SourceCID.CIDL())
-	binary.Write(buffer, binary.BigEndian, p.DestinationCID)
-	binary.Write(buffer, binary.BigEndian, p.SourceCID)
+	if p.profile.ExplicitCIDLengths {
+		buffer.WriteByte(uint8(len(p.DestinationCID)))
+		binary.Write(buffer, binary.BigEndian, p.DestinationCID)
+		buffer.WriteByte(uint8(len(p.SourceCID)))
+		binary.Write(buffer, binary.BigEndian, p.SourceCID)
+	} else {
+		buffer.WriteByte((p.DestinationCID.CIDL() << 4) | p.SourceCID.CIDL())
+		binary.Write(buffer, binary.BigEndian, p.DestinationCID)
+		binary.Write(buffer, binary.BigEndian, p.SourceCID)
+	}
 	for _, version := range p.SupportedVersions {
 		binary.Write(buffer, binary.BigEndian, version)
 	}
@@ -71,21 +82,16 @@ func (p *VersionNegotiationPacket) Pointer() unsafe.Pointer {
 }
 func (p *VersionNegotiationPacket) PNSpace() PNSpace                 { return PNSpaceNoSpace }
 func (p *VersionNegotiationPacket) EncryptionLevel() EncryptionLevel { return EncryptionLevelNone }
-func ReadVersionNegotationPacket(buffer *bytes.Reader) *VersionNegotiationPacket {
+func ReadVersionNegotationPacket(buffer *bytes.Reader, conn *Connection) *VersionNegotiationPacket {
 	p := new(VersionNegotiationPacket)
+	p.profile = conn.VersionProfile
 	b, err := buffer.ReadByte()
 	if err != nil {
 		panic(err)
 	}
 	p.UnusedField = b & 0x7f
 	binary.Read(buffer, binary.BigEndian, &p.Version)
-	CIDL, _ := buffer.ReadByte()
-	DCIL := 3 + ((CIDL & 0xf0) >> 4)
-	SCIL := 3 + (CIDL & 0xf)
-	p.DestinationCID = make([]byte, DCIL, DCIL)
-	binary.Read(buffer, binary.BigEndian, &p.DestinationCID)
-	p.SourceCID = make([]byte, SCIL, SCIL)
-	binary.Read(buffer, binary.BigEndian, &p.SourceCID)
+	p.DestinationCID, p.SourceCID = readLongHeaderCIDs(buffer, p.profile)
 	for {
 		var version uint32
 		err := binary.Read(buffer, binary.BigEndian, &version)
@@ -100,6 +106,7 @@ func ReadVersionNegotationPacket(buffer *bytes.Reader) *VersionNegotiationPacket
 }
 func NewVersionNegotiationPacket(unusedField uint8, version uint32, versions []SupportedVersion, conn *Connection) *VersionNegotiationPacket {
 	p := new(VersionNegotiationPacket)
+	p.profile = conn.VersionProfile
 	p.UnusedField = unusedField
 	p.DestinationCID = conn.DestinationCID
 	p.SourceCID = conn.SourceCID
@@ -186,7 +193,7 @@ func (p *FramePacket) ShouldBeAcknowledged() bool {
 func (p *FramePacket) EncodePayload() []byte {
 	buffer := new(bytes.Buffer)
 	for _, frame := range p.Frames {
-		frame.writeTo(buffer)
+		frame.writeTo(buffer, p.profile)
 	}
 	return buffer.Bytes()
 }
@@ -207,11 +214,12 @@ func (p *InitialPacket) PNSpace() PNSpace { return PNSpaceInitial }
 func (p *InitialPacket) EncryptionLevel() EncryptionLevel { return EncryptionLevelInitial }
 func ReadInitialPacket(buffer *bytes.Reader, conn *Connection) *InitialPacket {
 	p := new(InitialPacket)
+	p.profile = conn.VersionProfile
 	p.header = ReadLongHeader(buffer, conn)
 	for {
 		frame, err := NewFrame(buffer, conn)
 		if err != nil {
-			spew.Dump(p)
+			spew.Fdump(os.Stderr, p)
 			panic(err)
 		}
 		if frame == nil {
@@ -226,6 +234,7 @@ func ReadInitialPacket(buffer *bytes.Reader, conn *Connection) *InitialPacket {
 }
 func NewInitialPacket(conn *Connection) *InitialPacket {
 	p := new(InitialPacket)
+	p.profile = conn.VersionProfile
 	p.header = NewLongHeader(Initial, conn, PNSpaceInitial)
 	if len(conn.Token) > 0 {
 		p.header.(*LongHeader).Token = conn.Token
@@ -236,13 +245,27 @@ func NewInitialPacket(conn *Connection) *InitialPacket {
 
 type RetryPacket struct {
 	abstractPacket
-	OriginalDestinationCID ConnectionID
+	OriginalDestinationCID ConnectionID  // Only present in draft versions
 	RetryToken []byte
+	RetryIntegrityTag []byte  // Only present in RFC versions, see https://tools.ietf.org/html/rfc9001#section-5.8
 }
 func ReadRetryPacket(buffer *bytes.Reader, conn *Connection) *RetryPacket {
 	p := new(RetryPacket)
-	h := ReadLongHeader(buffer, conn)  // TODO: This should not be a full-length long header. Retry header ?
+	h := ReadRetryHeader(buffer, conn)
 	p.header = h
+	p.profile = h.profile
+	if p.profile.RetryIntegrityTag {
+		if buffer.Len() < 16 {
+			p.RetryToken = make([]byte, buffer.Len())
+			buffer.Read(p.RetryToken)
+			return p
+		}
+		p.RetryToken = make([]byte, buffer.Len() - 16)
+		buffer.Read(p.RetryToken)
+		p.RetryIntegrityTag = make([]byte, 16)
+		buffer.Read(p.RetryIntegrityTag)
+		return p
+	}
 	OCIDL := h.lowerBits & 0x0f
 	if OCIDL > 0 {
 		OCIDL += 3
@@ -253,6 +276,51 @@ func ReadRetryPacket(buffer *bytes.Reader, conn *Connection) *RetryPacket {
 	buffer.Read(p.RetryToken)
 	return p
 }
+// Creates a Retry packet sent in response to an Initial packet addressed to the original destination CID of the
+// connection. The source CID of the connection is the one the client must use afterwards.
+func NewRetryPacket(conn *Connection, token []byte) *RetryPacket {
+	p := new(RetryPacket)
+	p.profile = conn.VersionProfile
+	h := &RetryHeader{Version: conn.Version, DestinationCID: conn.DestinationCID, SourceCID: conn.SourceCID, profile: conn.VersionProfile}
+	p.header = h
+	p.RetryToken = token
+	if p.profile.RetryIntegrityTag {
+		p.RetryIntegrityTag, _ = ComputeRetryIntegrityTag(p.profile, conn.OriginalDestinationCID, p.Encode(token))
+		return p
+	}
+	p.OriginalDestinationCID = conn.OriginalDestinationCID
+	if len(p.OriginalDestinationCID) > 0 {
+		h.lowerBits = uint8(len(p.OriginalDestinationCID) - 3)
+	}
+	return p
+}
+// Checks that the Retry packet was sent in response to an Initial packet with the given destination CID, either by
+// verifying its integrity tag or its ODCID field in draft versions. See https://tools.ietf.org/html/rfc9000#section-17.2.5.2
+func (p *RetryPacket) Validate(originalDestinationCID ConnectionID) error {
+	if bytes.Equal(p.header.(*RetryHeader).SourceCID, originalDestinationCID) {
+		return errors.New("the Retry source CID is equal to the original destination CID")
+	}
+	if len(p.RetryToken) == 0 {
+		return errors.New("the Retry token is empty")
+	}
+	if !p.profile.RetryIntegrityTag {
+		if !bytes.Equal(p.OriginalDestinationCID, originalDestinationCID) {
+			return errors.New("the Retry ODCID does not match")
+		}
+		return nil
+	}
+	if len(p.RetryIntegrityTag) != 16 {
+		return errors.New("the Retry integrity tag is missing")
+	}
+	tag, err := ComputeRetryIntegrityTag(p.profile, originalDestinationCID, p.Encode(p.RetryToken))
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(tag, p.RetryIntegrityTag) {
+		return fmt.Errorf("the Retry integrity tag is invalid, expected %s", hex.EncodeToString(tag))
+	}
+	return nil
+}
 func (p *RetryPacket) GetRetransmittableFrames() []Frame { return nil }
 func (p *RetryPacket) Pointer() unsafe.Pointer { return unsafe.Pointer(p) }
 func (p *RetryPacket) PNSpace() PNSpace { return PNSpaceNoSpace }
@@ -260,6 +328,11 @@ func (p *RetryPacket) EncryptionLevel() EncryptionLevel { return EncryptionLevel
 func (p *RetryPacket) ShouldBeAcknowledged() bool { return false }
 func (p *RetryPacket) EncodePayload() []byte {
 	buffer := new(bytes.Buffer)
+	if p.profile.RetryIntegrityTag {
+		buffer.Write(p.RetryToken)
+		buffer.Write(p.RetryIntegrityTag)
+		return buffer.Bytes()
+	}
 	buffer.WriteByte(byte(len(p.OriginalDestinationCID)))
 	buffer.Write(p.OriginalDestinationCID)
 	buffer.Write(p.RetryToken)
@@ -273,11 +346,12 @@ func (p *HandshakePacket) PNSpace() PNSpace { return PNSpaceHandshake }
 func (p *HandshakePacket) EncryptionLevel() EncryptionLevel { return EncryptionLevelHandshake }
 func ReadHandshakePacket(buffer *bytes.Reader, conn *Connection) *HandshakePacket {
 	p := new(HandshakePacket)
+	p.profile = conn.VersionProfile
 	p.header = ReadLongHeader(buffer, conn)
 	for {
 		frame, err := NewFrame(buffer, conn)
 		if err != nil {
-			spew.Dump(p)
+			spew.Fdump(os.Stderr, p)
 			panic(err)
 		}
 		if frame == nil {
@@ -292,6 +366,7 @@ func ReadHandshakePacket(buffer *bytes.Reader, conn *Connection) *HandshakePacke
 }
 func NewHandshakePacket(conn *Connection) *HandshakePacket {
 	p := new(HandshakePacket)
+	p.profile = conn.VersionProfile
 	p.header = NewLongHeader(Handshake, conn, PNSpaceHandshake)
 	return p
 }
@@ -303,11 +378,12 @@ func (p *ProtectedPacket) PNSpace() PNSpace { return PNSpaceAppData }
 func (p *ProtectedPacket) EncryptionLevel() EncryptionLevel { return EncryptionLevel1RTT }
 func ReadProtectedPacket(buffer *bytes.Reader, conn *Connection) *ProtectedPacket {
 	p := new(ProtectedPacket)
+	p.profile = conn.VersionProfile
 	p.header = ReadHeader(buffer, conn)
 	for {
 		frame, err := NewFrame(buffer, conn)
 		if err != nil {
-			spew.Dump(p)
+			spew.Fdump(os.Stderr, p)
 			panic(err)
 		}
 		if frame == nil {
@@ -322,6 +398,7 @@ func ReadProtectedPacket(buffer *bytes.Reader, conn *Connection) *ProtectedPacke
 }
 func NewProtectedPacket(conn *Connection) *ProtectedPacket {
 	p := new(ProtectedPacket)
+	p.profile = conn.VersionProfile
 	p.header = NewShortHeader(conn)
 	return p
 }
@@ -331,8 +408,26 @@ type ZeroRTTProtectedPacket struct {
 }
 func (p *ZeroRTTProtectedPacket) PNSpace() PNSpace { return PNSpaceAppData }
 func (p *ZeroRTTProtectedPacket) EncryptionLevel() EncryptionLevel { return EncryptionLevel0RTT }
+func ReadZeroRTTProtectedPacket(buffer *bytes.Reader, conn *Connection) *ZeroRTTProtectedPacket {
+	p := new(ZeroRTTProtectedPacket)
+	p.profile = conn.VersionProfile
+	p.header = ReadLongHeader(buffer, conn)
+	for {
+		frame, err := NewFrame(buffer, conn)
+		if err != nil {
+			spew.Fdump(os.Stderr, p)
+			panic(err)
+		}
+		if frame == nil {
+			break
+		}
+		p.Frames = append(p.Frames, frame)
+	}
+	return p
+}
 func NewZeroRTTProtectedPacket(conn *Connection) *ZeroRTTProtectedPacket {
 	p := new(ZeroRTTProtectedPacket)
+	p.profile = conn.VersionProfile
 	p.header = NewLongHeader(ZeroRTTProtected, conn, PNSpaceAppData)
 	return p
 }
\ No newline at end of file
@@ -0,0 +1,35 @@
+package quictracker
+
+import (
+	"bytes"
+	"testing"
+)
+
+// See https://tools.ietf.org/html/rfc9001#appendix-A.4 and https://tools.ietf.org/html/rfc9369#appendix-A.4
+func TestRetryValidate(t *testing.T) {
+	originalDestinationCID := ConnectionID{0x83, 0x94, 0xc8, 0xf0, 0x3e, 0x51, 0x57, 0x08}
+	for _, c := range []struct {
+		profile *VersionProfile
+		retry   string
+	}{
+		{VersionProfileV1, "ff000000010008f067a5502a4262b5746f6b656e04a265ba2eff4d829058fb3f0f2496ba"},
+		{VersionProfileV2, "cf6b3343cf0008f067a5502a4262b5746f6b656ec8646ce8bfe33952d955543665dcc7b6"},
+	} {
+		conn := testConnection(c.profile)
+		data := decodeHex(t, c.retry)
+		retry := ReadRetryPacket(bytes.NewReader(data), conn)
+		if err := retry.Validate(originalDestinationCID); err != nil {
+			t.Errorf("%s: %s", c.profile, err.Error())
+		}
+		if string(retry.RetryToken) != "token" || !bytes.Equal(retry.Encode(retry.EncodePayload()), data) {
+			t.Errorf("%s: the Retry was not decoded, got %+v", c.profile, retry)
+		}
+		if err := retry.Validate(ConnectionID{1, 2, 3, 4, 5, 6, 7, 8}); err == nil {
+			t.Errorf("%s: a Retry with another original destination CID was accepted", c.profile)
+		}
+		data[len(data)-1] ^= 0xff
+		if err := ReadRetryPacket(bytes.NewReader(data), conn).Validate(originalDestinationCID); err == nil {
+			t.Errorf("%s: a Retry with an invalid integrity tag was accepted", c.profile)
+		}
+	}
+}
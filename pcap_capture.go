@@ -1,37 +1,210 @@
 package quictracker
 
 import (
-	"fmt"
-	"os/exec"
-	"io/ioutil"
-	"syscall"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
 	"time"
-	"os"
-	"encoding/hex"
 )
 
-func StartPcapCapture(conn *Connection, netInterface string) (*exec.Cmd, error) {
-	bpfFilter := fmt.Sprintf("host %s and udp src or dst port %d", conn.Host.IP.String(), conn.Host.Port)
-	var cmd *exec.Cmd
-	if netInterface == "" {
-		cmd = exec.Command("/usr/sbin/tcpdump", bpfFilter, "-w", "/tmp/pcap_" + hex.EncodeToString(conn.SourceCID))
+// See https://tools.ietf.org/html/draft-ietf-opsawg-pcapng
+const (
+	pcapngSectionHeaderBlock        = 0x0A0D0D0A
+	pcapngInterfaceDescriptionBlock = 0x00000001
+	pcapngEnhancedPacketBlock       = 0x00000006
+	pcapngDecryptionSecretsBlock    = 0x0000000A
+	pcapngByteOrderMagic            = 0x1A2B3C4D
+	pcapngTLSKeyLog                 = 0x544C534B // The secrets are in the NSS key log format
+	pcapngLinkTypeRaw               = 101        // Packets begin with an IPv4 or IPv6 header
+	pcapngOptionEnd                 = 0
+	pcapngOptionUserApplication     = 4
+	pcapngOptionTimestampResolution = 9
+)
+
+type capturedDatagram struct {
+	timestamp   time.Time
+	source      *net.UDPAddr
+	destination *net.UDPAddr
+	data        []byte
+}
+
+// A PcapCapture records the UDP datagrams sent and received by a connection and writes them in the pcapng format.
+// The IP and UDP headers are synthesized from the addresses of the connection, no privilege nor external tool is
+// needed.
+type PcapCapture struct {
+	mutex     sync.Mutex
+	conn      *Connection
+	datagrams []capturedDatagram
+}
+
+// Starts recording the datagrams of the connection. It must be called before the agents are attached.
+func StartPcapCapture(conn *Connection) *PcapCapture {
+	c := &PcapCapture{conn: conn}
+	conn.SentDatagramHandler = func(data []byte) {
+		c.record(data, ToServer)
+	}
+	conn.ReceivedDatagramHandler = func(data []byte) {
+		c.record(data, ToClient)
+	}
+	return c
+}
+
+func (c *PcapCapture) record(data []byte, direction Direction) {
+	local, _ := c.conn.UdpConnection.LocalAddr().(*net.UDPAddr)
+	remote := c.conn.Host
+	if local == nil || remote == nil {
+		return
+	}
+	if (local.IP.To4() == nil) != (remote.IP.To4() == nil) { // e.g. a dual-stack socket, the local IP is then unknown
+		local = &net.UDPAddr{IP: net.IPv6unspecified, Port: local.Port}
+		if remote.IP.To4() != nil {
+			local.IP = net.IPv4zero
+		}
+	}
+	datagram := capturedDatagram{timestamp: time.Now(), source: local, destination: remote, data: append([]byte(nil), data...)}
+	if direction == ToClient {
+		datagram.source, datagram.destination = remote, local
+	}
+	c.mutex.Lock()
+	c.datagrams = append(c.datagrams, datagram)
+	c.mutex.Unlock()
+}
+
+// Writes the datagrams recorded in the pcapng format. The secrets in the NSS key log format are written in a Decryption
+// Secrets Block, so that the capture can be decrypted without additional files.
+func (c *PcapCapture) WritePcapng(w io.Writer, keyLog []byte) error {
+	buffer := new(bytes.Buffer)
+
+	shb := new(bytes.Buffer)
+	binary.Write(shb, binary.LittleEndian, uint32(pcapngByteOrderMagic))
+	binary.Write(shb, binary.LittleEndian, uint16(1)) // Major version
+	binary.Write(shb, binary.LittleEndian, uint16(0)) // Minor version
+	binary.Write(shb, binary.LittleEndian, int64(-1)) // The section length is not specified
+	writePcapngOption(shb, pcapngOptionUserApplication, []byte("QUIC-Tracker"))
+	writePcapngOption(shb, pcapngOptionEnd, nil)
+	writePcapngBlock(buffer, pcapngSectionHeaderBlock, shb.Bytes())
+
+	idb := new(bytes.Buffer)
+	binary.Write(idb, binary.LittleEndian, uint16(pcapngLinkTypeRaw))
+	binary.Write(idb, binary.LittleEndian, uint16(0))                  // Reserved
+	binary.Write(idb, binary.LittleEndian, uint32(0))                  // No snapshot length
+	writePcapngOption(idb, pcapngOptionTimestampResolution, []byte{9}) // Nanoseconds
+	writePcapngOption(idb, pcapngOptionEnd, nil)
+	writePcapngBlock(buffer, pcapngInterfaceDescriptionBlock, idb.Bytes())
+
+	if len(keyLog) > 0 {
+		dsb := new(bytes.Buffer)
+		binary.Write(dsb, binary.LittleEndian, uint32(pcapngTLSKeyLog))
+		binary.Write(dsb, binary.LittleEndian, uint32(len(keyLog)))
+		dsb.Write(keyLog)
+		writePcapngBlock(buffer, pcapngDecryptionSecretsBlock, dsb.Bytes())
+	}
+
+	c.mutex.Lock()
+	datagrams := c.datagrams
+	c.mutex.Unlock()
+	for _, d := range datagrams {
+		packet := synthesizeIPPacket(d.source, d.destination, d.data)
+		timestamp := uint64(d.timestamp.UnixNano())
+		epb := new(bytes.Buffer)
+		binary.Write(epb, binary.LittleEndian, uint32(0)) // Interface ID
+		binary.Write(epb, binary.LittleEndian, uint32(timestamp>>32))
+		binary.Write(epb, binary.LittleEndian, uint32(timestamp))
+		binary.Write(epb, binary.LittleEndian, uint32(len(packet))) // Captured length
+		binary.Write(epb, binary.LittleEndian, uint32(len(packet))) // Original length
+		epb.Write(packet)
+		writePcapngBlock(buffer, pcapngEnhancedPacketBlock, epb.Bytes())
+	}
+
+	_, err := w.Write(buffer.Bytes())
+	return err
+}
+
+func writePcapngBlock(buffer *bytes.Buffer, blockType uint32, body []byte) {
+	padding := (4 - len(body)%4) % 4
+	length := uint32(12 + len(body) + padding)
+	binary.Write(buffer, binary.LittleEndian, blockType)
+	binary.Write(buffer, binary.LittleEndian, length)
+	buffer.Write(body)
+	buffer.Write(make([]byte, padding))
+	binary.Write(buffer, binary.LittleEndian, length)
+}
+
+func writePcapngOption(buffer *bytes.Buffer, code uint16, value []byte) {
+	binary.Write(buffer, binary.LittleEndian, code)
+	binary.Write(buffer, binary.LittleEndian, uint16(len(value)))
+	buffer.Write(value)
+	buffer.Write(make([]byte, (4-len(value)%4)%4))
+}
+
+// Returns an IPv4 or IPv6 packet carrying the UDP datagram, see https://tools.ietf.org/html/rfc791,
+// https://tools.ietf.org/html/rfc8200 and https://tools.ietf.org/html/rfc768
+func synthesizeIPPacket(source *net.UDPAddr, destination *net.UDPAddr, data []byte) []byte {
+	udp := new(bytes.Buffer)
+	binary.Write(udp, binary.BigEndian, uint16(source.Port))
+	binary.Write(udp, binary.BigEndian, uint16(destination.Port))
+	binary.Write(udp, binary.BigEndian, uint16(8+len(data)))
+	binary.Write(udp, binary.BigEndian, uint16(0)) // Checksum
+	udp.Write(data)
+	segment := udp.Bytes()
+
+	pseudoHeader := new(bytes.Buffer)
+	packet := new(bytes.Buffer)
+	if source.IP.To4() != nil {
+		pseudoHeader.Write(source.IP.To4())
+		pseudoHeader.Write(destination.IP.To4())
+		binary.Write(pseudoHeader, binary.BigEndian, uint16(17))
+		binary.Write(pseudoHeader, binary.BigEndian, uint16(len(segment)))
+
+		header := make([]byte, 20)
+		header[0] = 0x45                                                // Version 4, 5 words of header
+		binary.BigEndian.PutUint16(header[2:], uint16(20+len(segment))) // Total length
+		binary.BigEndian.PutUint16(header[6:], 0x4000)                  // Don't fragment
+		header[8] = 64                                                  // TTL
+		header[9] = 17                                                  // UDP
+		copy(header[12:], source.IP.To4())
+		copy(header[16:], destination.IP.To4())
+		binary.BigEndian.PutUint16(header[10:], internetChecksum(header))
+		packet.Write(header)
 	} else {
-		cmd = exec.Command("/usr/sbin/tcpdump", bpfFilter, "-i", netInterface, "-w", "/tmp/pcap_" + hex.EncodeToString(conn.SourceCID))
+		pseudoHeader.Write(source.IP.To16())
+		pseudoHeader.Write(destination.IP.To16())
+		binary.Write(pseudoHeader, binary.BigEndian, uint32(len(segment)))
+		binary.Write(pseudoHeader, binary.BigEndian, uint32(17))
+
+		header := make([]byte, 40)
+		header[0] = 0x60                                             // Version 6
+		binary.BigEndian.PutUint16(header[4:], uint16(len(segment))) // Payload length
+		header[6] = 17                                               // UDP
+		header[7] = 64                                               // Hop limit
+		copy(header[8:], source.IP.To16())
+		copy(header[24:], destination.IP.To16())
+		packet.Write(header)
 	}
-	err := cmd.Start()
-	if err == nil {
-		time.Sleep(1 * time.Second)
+
+	pseudoHeader.Write(segment)
+	checksum := internetChecksum(pseudoHeader.Bytes())
+	if checksum == 0 {
+		checksum = 0xffff // Zero means no checksum
 	}
-	return cmd, err
+	binary.BigEndian.PutUint16(segment[6:], checksum)
+	packet.Write(segment)
+	return packet.Bytes()
 }
 
-func StopPcapCapture(conn *Connection, cmd *exec.Cmd) ([]byte, error) {
-	time.Sleep(1 * time.Second)
-	cmd.Process.Signal(syscall.SIGTERM)
-	err := cmd.Wait()
-	if err != nil {
-		return nil, err
+// See https://tools.ietf.org/html/rfc1071
+func internetChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
 	}
-	defer os.Remove("/tmp/pcap_" + hex.EncodeToString(conn.SourceCID))
-	return ioutil.ReadFile("/tmp/pcap_" + hex.EncodeToString(conn.SourceCID))
-}
\ No newline at end of file
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,72 @@
+package quictracker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSynthesizedIPPacket(t *testing.T) {
+	for _, addresses := range [][2]string{{"192.0.2.1:4433", "198.51.100.7:443"}, {"[2001:db8::1]:4433", "[2001:db8::7]:443"}} {
+		source, _ := net.ResolveUDPAddr("udp", addresses[0])
+		destination, _ := net.ResolveUDPAddr("udp", addresses[1])
+		payload := []byte("a QUIC packet")
+		packet := synthesizeIPPacket(source, destination, payload)
+
+		var segment, pseudoHeader []byte
+		if source.IP.To4() != nil {
+			if internetChecksum(packet[:20]) != 0 {
+				t.Errorf("invalid IPv4 header checksum")
+			}
+			segment = packet[20:]
+			pseudoHeader = append(append(append([]byte(nil), packet[12:20]...), 0, 17), packet[2:4]...)
+			binary.BigEndian.PutUint16(pseudoHeader[10:], uint16(len(segment)))
+		} else {
+			segment = packet[40:]
+			pseudoHeader = append(append([]byte(nil), packet[8:40]...), 0, 0, packet[4], packet[5], 0, 0, 0, 17)
+		}
+		if !bytes.Equal(segment[8:], payload) || binary.BigEndian.Uint16(segment[4:]) != uint16(len(segment)) {
+			t.Errorf("invalid UDP datagram %x", segment)
+		}
+		if internetChecksum(append(pseudoHeader, segment...)) != 0 {
+			t.Errorf("invalid UDP checksum for %s", addresses[0])
+		}
+	}
+}
+
+func TestPcapngBlocks(t *testing.T) {
+	local, _ := net.ResolveUDPAddr("udp", "192.0.2.1:4433")
+	remote, _ := net.ResolveUDPAddr("udp", "198.51.100.7:443")
+	capture := &PcapCapture{datagrams: []capturedDatagram{
+		{time.Now(), local, remote, make([]byte, 1200)},
+		{time.Now(), remote, local, make([]byte, 31)},
+	}}
+	buffer := new(bytes.Buffer)
+	capture.WritePcapng(buffer, []byte("CLIENT_TRAFFIC_SECRET_0 00 00\n"))
+
+	var blockTypes []uint32
+	content := buffer.Bytes()
+	for len(content) > 0 {
+		if len(content) < 12 {
+			t.Fatalf("truncated block")
+		}
+		blockType := binary.LittleEndian.Uint32(content)
+		length := binary.LittleEndian.Uint32(content[4:])
+		if length%4 != 0 || int(length) > len(content) || binary.LittleEndian.Uint32(content[length-4:]) != length {
+			t.Fatalf("invalid length %d for block type %x", length, blockType)
+		}
+		blockTypes = append(blockTypes, blockType)
+		content = content[length:]
+	}
+	expected := []uint32{pcapngSectionHeaderBlock, pcapngInterfaceDescriptionBlock, pcapngDecryptionSecretsBlock, pcapngEnhancedPacketBlock, pcapngEnhancedPacketBlock}
+	if len(blockTypes) != len(expected) {
+		t.Fatalf("expected blocks %x, got %x", expected, blockTypes)
+	}
+	for i := range expected {
+		if blockTypes[i] != expected[i] {
+			t.Errorf("expected blocks %x, got %x", expected, blockTypes)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	qt "github.com/RohitPanda/quic-tracker"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Duration is a time.Duration written as a string in JSON, e.g. "50ms"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	value, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(value)
+	return nil
+}
+
+const (
+	Bernoulli      = "bernoulli"       // Each datagram is lost independently with probability P
+	GilbertElliott = "gilbert_elliott" // A two-state Markov chain producing bursts of losses
+)
+
+// A Loss model decides which datagrams are lost. The Gilbert-Elliott model moves from its good state to its bad
+// state with probability P and back with probability R at each datagram, datagrams are lost with probability
+// LossGood in the good state and LossBad in the bad state.
+type Loss struct {
+	Model    string  `json:"model"`
+	P        float64 `json:"p"`
+	R        float64 `json:"r,omitempty"`
+	LossGood float64 `json:"loss_good,omitempty"`
+	LossBad  float64 `json:"loss_bad,omitempty"`
+}
+
+// The impairments applied to the datagrams flowing in one direction
+type Impairments struct {
+	Loss         *Loss    `json:"loss,omitempty"`
+	Delay        Duration `json:"delay,omitempty"`         // Added to every datagram
+	Jitter       Duration `json:"jitter,omitempty"`        // The delay varies uniformly within [Delay - Jitter, Delay + Jitter]
+	Reorder      float64  `json:"reorder,omitempty"`       // The probability for a datagram to be held back by ReorderDelay
+	ReorderDelay Duration `json:"reorder_delay,omitempty"` // 10ms when not set
+	Duplicate    float64  `json:"duplicate,omitempty"`     // The probability for a datagram to be sent twice
+	Rate         uint64   `json:"rate,omitempty"`          // The rate limit in bytes per second, unlimited when zero
+	QueueDelay   Duration `json:"queue_delay,omitempty"`   // Datagrams that would wait longer for the rate limit are dropped, 1s when not set
+}
+
+const (
+	DropAction      = "drop"
+	DelayAction     = "delay"
+	DuplicateAction = "duplicate"
+)
+
+// The packet types that rules can target
+const (
+	InitialPacket            = "initial"
+	ZeroRTTPacket            = "0rtt"
+	HandshakePacket          = "handshake"
+	RetryPacket              = "retry"
+	VersionNegotiationPacket = "version_negotiation"
+	OneRTTPacket             = "1rtt"
+)
+
+// A Rule applies an action to the datagrams of a direction that contain a given type of packet, e.g. to drop the
+// first Handshake packet sent by the server.
+type Rule struct {
+	Direction  qt.Direction `json:"direction"`
+	PacketType string       `json:"packet_type"`
+	Occurrence int          `json:"occurrence,omitempty"` // The 1-based index of the matching datagram to act upon, every one when zero
+	Action     string       `json:"action"`
+	Delay      Duration     `json:"delay,omitempty"` // The delay added by the delay action
+}
+
+func (r Rule) String() string {
+	occurrence := "every"
+	if r.Occurrence > 0 {
+		occurrence = fmt.Sprintf("#%d", r.Occurrence)
+	}
+	return fmt.Sprintf("%s %s %s %s", r.Action, occurrence, r.PacketType, r.Direction)
+}
+
+// A Profile describes the impairments of the path between the client and the host. The random choices are made
+// from Seed, so that a profile can be replayed.
+type Profile struct {
+	Name     string      `json:"name,omitempty"`
+	Seed     int64       `json:"seed,omitempty"`
+	ToServer Impairments `json:"to_server"`
+	ToClient Impairments `json:"to_client"`
+	Rules    []Rule      `json:"rules,omitempty"`
+}
+
+func (p Profile) Validate() error {
+	for _, i := range []Impairments{p.ToServer, p.ToClient} {
+		if i.Loss != nil && i.Loss.Model != Bernoulli && i.Loss.Model != GilbertElliott {
+			return fmt.Errorf("unknown loss model %s", i.Loss.Model)
+		}
+		if i.Jitter > i.Delay {
+			return errors.New("the jitter cannot exceed the delay")
+		}
+	}
+	for _, r := range p.Rules {
+		if r.Direction != qt.ToServer && r.Direction != qt.ToClient {
+			return fmt.Errorf("rule %s: unknown direction %s", r, r.Direction)
+		}
+		switch r.PacketType {
+		case InitialPacket, ZeroRTTPacket, HandshakePacket, RetryPacket, VersionNegotiationPacket, OneRTTPacket:
+		default:
+			return fmt.Errorf("rule %s: unknown packet type %s", r, r.PacketType)
+		}
+		switch r.Action {
+		case DropAction, DelayAction, DuplicateAction:
+		default:
+			return fmt.Errorf("rule %s: unknown action %s", r, r.Action)
+		}
+	}
+	return nil
+}
+
+func (p Profile) impairments(direction qt.Direction) Impairments {
+	if direction == qt.ToServer {
+		return p.ToServer
+	}
+	return p.ToClient
+}
+
+// Predefined profiles that can be referred to by their name
+var Profiles = map[string]Profile{
+	"lossy": {
+		Name:     "lossy",
+		ToServer: Impairments{Loss: &Loss{Model: Bernoulli, P: 0.05}},
+		ToClient: Impairments{Loss: &Loss{Model: Bernoulli, P: 0.05}},
+	},
+	"bursty_loss": {
+		Name:     "bursty_loss",
+		ToServer: Impairments{Loss: &Loss{Model: GilbertElliott, P: 0.05, R: 0.5, LossBad: 1}},
+		ToClient: Impairments{Loss: &Loss{Model: GilbertElliott, P: 0.05, R: 0.5, LossBad: 1}},
+	},
+	"satellite": {
+		Name:     "satellite",
+		ToServer: Impairments{Delay: Duration(300 * time.Millisecond), Jitter: Duration(10 * time.Millisecond), Rate: 1 << 17},
+		ToClient: Impairments{Delay: Duration(300 * time.Millisecond), Jitter: Duration(10 * time.Millisecond), Rate: 1 << 20},
+	},
+	"reordering": {
+		Name:     "reordering",
+		ToServer: Impairments{Reorder: 0.1, ReorderDelay: Duration(20 * time.Millisecond)},
+		ToClient: Impairments{Reorder: 0.1, ReorderDelay: Duration(20 * time.Millisecond)},
+	},
+	"duplication": {
+		Name:     "duplication",
+		ToServer: Impairments{Duplicate: 0.1},
+		ToClient: Impairments{Duplicate: 0.1},
+	},
+	"drop_first_server_handshake": {
+		Name:  "drop_first_server_handshake",
+		Rules: []Rule{{Direction: qt.ToClient, PacketType: HandshakePacket, Occurrence: 1, Action: DropAction}},
+	},
+}
+
+// Returns the names of the predefined profiles
+func ProfileNames() []string {
+	var names []string
+	for name := range Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Loads a profile given either by the name of a predefined profile, by a JSON document or by the path to a JSON file
+func LoadProfile(profile string) (Profile, error) {
+	if p, ok := Profiles[profile]; ok {
+		return p, nil
+	}
+	content := []byte(profile)
+	if !strings.HasPrefix(strings.TrimSpace(profile), "{") {
+		var err error
+		content, err = ioutil.ReadFile(profile)
+		if err != nil {
+			return Profile{}, fmt.Errorf("%s is neither a known profile (%s) nor a readable file: %s", profile, strings.Join(ProfileNames(), ", "), err.Error())
+		}
+	}
+	var p Profile
+	if err := json.Unmarshal(content, &p); err != nil {
+		return Profile{}, err
+	}
+	return p, p.Validate()
+}
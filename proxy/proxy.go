@@ -0,0 +1,331 @@
+// Package proxy implements a UDP proxy that impairs the path between a Connection and its host. It drops, delays,
+// reorders and duplicates the datagrams it relays according to a Profile, which can also target packets of a given
+// type, e.g. the first Handshake packet sent by the server.
+//
+// A scenario opts into it by calling Attach before starting its agents. The connection then sends its datagrams to
+// the proxy, which relays them to the host from a socket of its own. Scenarios that create their own sockets, such as
+// connection_migration, bypass the proxy.
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	qt "github.com/RohitPanda/quic-tracker"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReorderDelay = 10 * time.Millisecond
+	defaultQueueDelay   = time.Second
+)
+
+// Counts the datagrams relayed in one direction
+type Statistics struct {
+	Received   int `json:"received"`
+	Dropped    int `json:"dropped"`
+	Duplicated int `json:"duplicated"`
+}
+
+type path struct {
+	impairments Impairments
+	badState    bool      // The state of the Gilbert-Elliott model
+	departure   time.Time // The time at which the rate-limited link is idle again
+	statistics  Statistics
+}
+
+// A Proxy relays the datagrams between the local address returned by Addr and a host. The first client address it
+// receives a datagram from is the one it relays the datagrams of the host to.
+type Proxy struct {
+	Profile Profile
+	Logger  *log.Logger
+
+	listener        *net.UDPConn
+	upstream        *net.UDPConn
+	mutex           sync.Mutex
+	client          *net.UDPAddr
+	random          *rand.Rand
+	paths           map[qt.Direction]*path
+	ruleOccurrences []int
+	trace           *qt.Trace
+}
+
+// Creates a proxy relaying to the given host through a loopback address
+func NewProxy(host *net.UDPAddr, profile Profile) (*Proxy, error) {
+	if err := profile.Validate(); err != nil {
+		return nil, err
+	}
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	if host.IP.To4() == nil {
+		loopback = &net.UDPAddr{IP: net.IPv6loopback}
+	}
+	listener, err := net.ListenUDP("udp", loopback)
+	if err != nil {
+		return nil, err
+	}
+	upstream, err := qt.EstablishUDPConnection(host)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	seed := profile.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	p := &Proxy{
+		Profile:         profile,
+		listener:        listener,
+		upstream:        upstream,
+		random:          rand.New(rand.NewSource(seed)),
+		paths:           make(map[qt.Direction]*path),
+		ruleOccurrences: make([]int, len(profile.Rules)),
+	}
+	p.Logger = log.New(os.Stderr, fmt.Sprintf("[proxy %s] ", listener.LocalAddr().String()), log.Lshortfile)
+	for _, direction := range []qt.Direction{qt.ToServer, qt.ToClient} {
+		p.paths[direction] = &path{impairments: profile.impairments(direction)}
+	}
+
+	go p.readFromClient()
+	go p.readFromHost()
+	return p, nil
+}
+
+// Relays the datagrams of the connection through a new proxy impairing them according to the profile. The profile is
+// recorded in the trace, as well as the statistics of the proxy when it is closed.
+func Attach(conn *qt.Connection, trace *qt.Trace, profile Profile) (*Proxy, error) {
+	p, err := NewProxy(conn.Host, profile)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := qt.EstablishUDPConnection(p.Addr())
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	conn.UdpConnection.Close()
+	conn.UdpConnection = udpConn
+	if trace != nil {
+		p.trace = trace
+		trace.Impairment = p.Profile
+	}
+	return p, nil
+}
+
+func (p *Proxy) Addr() *net.UDPAddr {
+	return p.listener.LocalAddr().(*net.UDPAddr)
+}
+
+// Returns the statistics of each direction
+func (p *Proxy) Statistics() map[qt.Direction]Statistics {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	statistics := make(map[qt.Direction]Statistics)
+	for direction, path := range p.paths {
+		statistics[direction] = path.statistics
+	}
+	return statistics
+}
+
+// Stops relaying datagrams. The datagrams still delayed are lost.
+func (p *Proxy) Close() {
+	p.listener.Close()
+	p.upstream.Close()
+	if p.trace != nil {
+		p.trace.Results["impairment_statistics"] = p.Statistics()
+	}
+}
+
+func (p *Proxy) readFromClient() {
+	for {
+		buffer := make([]byte, qt.MaxUDPPayloadSize)
+		n, addr, err := p.listener.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		p.mutex.Lock()
+		if p.client == nil {
+			p.client = addr
+		}
+		p.mutex.Unlock()
+		p.relay(qt.ToServer, buffer[:n])
+	}
+}
+
+func (p *Proxy) readFromHost() {
+	for {
+		buffer := make([]byte, qt.MaxUDPPayloadSize)
+		n, err := p.upstream.Read(buffer)
+		if err != nil {
+			return
+		}
+		p.relay(qt.ToClient, buffer[:n])
+	}
+}
+
+func (p *Proxy) relay(direction qt.Direction, datagram []byte) {
+	p.mutex.Lock()
+	delays := p.impair(direction, datagram, time.Now())
+	p.mutex.Unlock()
+	for _, delay := range delays {
+		if delay <= 0 {
+			p.write(direction, datagram)
+			continue
+		}
+		time.AfterFunc(delay, func() { p.write(direction, datagram) })
+	}
+}
+
+func (p *Proxy) write(direction qt.Direction, datagram []byte) {
+	if direction == qt.ToServer {
+		p.upstream.Write(datagram)
+		return
+	}
+	p.mutex.Lock()
+	client := p.client
+	p.mutex.Unlock()
+	p.listener.WriteToUDP(datagram, client)
+}
+
+// Returns the delay of each copy of the datagram to send, none when it is dropped
+func (p *Proxy) impair(direction qt.Direction, datagram []byte, now time.Time) []time.Duration {
+	path := p.paths[direction]
+	path.statistics.Received++
+	var delay time.Duration
+	copies := 1
+
+	types := packetTypes(datagram)
+	for i, r := range p.Profile.Rules {
+		if r.Direction != direction || !contains(types, r.PacketType) {
+			continue
+		}
+		p.ruleOccurrences[i]++
+		if r.Occurrence != 0 && r.Occurrence != p.ruleOccurrences[i] {
+			continue
+		}
+		switch r.Action {
+		case DropAction:
+			p.Logger.Printf("Rule %s drops a datagram of %d bytes\n", r, len(datagram))
+			path.statistics.Dropped++
+			return nil
+		case DelayAction:
+			delay += time.Duration(r.Delay)
+		case DuplicateAction:
+			copies++
+		}
+	}
+
+	impairments := path.impairments
+	if impairments.Loss != nil && impairments.Loss.lost(&path.badState, p.random) {
+		path.statistics.Dropped++
+		return nil
+	}
+	delay += time.Duration(impairments.Delay)
+	if impairments.Jitter > 0 {
+		delay += time.Duration(p.random.Int63n(2*int64(impairments.Jitter)+1)) - time.Duration(impairments.Jitter)
+	}
+	if impairments.Reorder > 0 && p.random.Float64() < impairments.Reorder {
+		reorderDelay := time.Duration(impairments.ReorderDelay)
+		if reorderDelay == 0 {
+			reorderDelay = defaultReorderDelay
+		}
+		delay += reorderDelay
+	}
+	if impairments.Duplicate > 0 && p.random.Float64() < impairments.Duplicate {
+		copies++
+	}
+	if impairments.Rate > 0 {
+		queueDelay := time.Duration(impairments.QueueDelay)
+		if queueDelay == 0 {
+			queueDelay = defaultQueueDelay
+		}
+		queue := path.departure.Sub(now)
+		if queue < 0 {
+			queue = 0
+		}
+		if queue > queueDelay {
+			path.statistics.Dropped++
+			return nil
+		}
+		transmission := time.Duration(uint64(len(datagram)*copies) * uint64(time.Second) / impairments.Rate)
+		path.departure = now.Add(queue + transmission)
+		delay += queue + transmission
+	}
+
+	path.statistics.Duplicated += copies - 1
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = delay
+	}
+	return delays
+}
+
+func (l *Loss) lost(badState *bool, random *rand.Rand) bool {
+	switch l.Model {
+	case Bernoulli:
+		return random.Float64() < l.P
+	case GilbertElliott:
+		if *badState && random.Float64() < l.R {
+			*badState = false
+		} else if !*badState && random.Float64() < l.P {
+			*badState = true
+		}
+		if *badState {
+			return random.Float64() < l.LossBad
+		}
+		return random.Float64() < l.LossGood
+	}
+	return false
+}
+
+// Returns the types of the packets coalesced in the datagram. Only the unprotected parts of the headers are read.
+func packetTypes(datagram []byte) (types []string) {
+	defer func() {
+		recover() // The header readers panic on truncated packets, the types found so far are kept
+	}()
+	buffer := bytes.NewReader(datagram)
+	for buffer.Len() > 0 {
+		start := len(datagram) - buffer.Len()
+		if datagram[start]&0x80 == 0 {
+			return append(types, OneRTTPacket)
+		}
+		if len(datagram)-start < 5 {
+			return
+		}
+		if binary.BigEndian.Uint32(datagram[start+1:start+5]) == 0 {
+			return append(types, VersionNegotiationPacket)
+		}
+		header := qt.ReadLongHeader(buffer, &qt.Connection{VersionProfile: qt.VersionProfileV1})
+		switch header.PacketType() {
+		case qt.Initial:
+			types = append(types, InitialPacket)
+		case qt.ZeroRTTProtected:
+			types = append(types, ZeroRTTPacket)
+		case qt.Handshake:
+			types = append(types, HandshakePacket)
+		case qt.Retry:
+			return append(types, RetryPacket)
+		}
+		next := start + header.HeaderLength() - header.TruncatedPN().Length + int(header.Length.Value)
+		if next <= start || next > len(datagram) {
+			return
+		}
+		buffer.Seek(int64(next), io.SeekStart)
+	}
+	return
+}
+
+func contains(types []string, packetType string) bool {
+	for _, t := range types {
+		if t == packetType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"bytes"
+	qt "github.com/RohitPanda/quic-tracker"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Builds a QUIC version 1 long header packet of the given type with a payload of the given length
+func longHeaderPacket(typeBits byte, payloadLength int) []byte {
+	buffer := new(bytes.Buffer)
+	buffer.WriteByte(0xc0 | typeBits<<4)
+	buffer.Write([]byte{0, 0, 0, 1})
+	buffer.WriteByte(8)
+	buffer.Write(make([]byte, 8))
+	buffer.WriteByte(8)
+	buffer.Write(make([]byte, 8))
+	if typeBits == 0 {
+		buffer.WriteByte(0) // Token length
+	}
+	buffer.Write(qt.NewVarInt(uint64(1 + payloadLength)).Encode())
+	buffer.WriteByte(0) // Packet number
+	buffer.Write(make([]byte, payloadLength))
+	return buffer.Bytes()
+}
+
+func TestPacketTypes(t *testing.T) {
+	coalesced := append(longHeaderPacket(0, 100), longHeaderPacket(2, 50)...)
+	coalesced = append(coalesced, 0x40, 1, 2, 3)
+	tests := []struct {
+		datagram []byte
+		types    []string
+	}{
+		{longHeaderPacket(0, 1200), []string{InitialPacket}},
+		{coalesced, []string{InitialPacket, HandshakePacket, OneRTTPacket}},
+		{[]byte{0x80, 0, 0, 0, 0, 8}, []string{VersionNegotiationPacket}},
+		{longHeaderPacket(2, 100)[:30], []string{HandshakePacket}},
+	}
+	for _, test := range tests {
+		if types := packetTypes(test.datagram); !reflect.DeepEqual(types, test.types) {
+			t.Errorf("expected %v, got %v", test.types, types)
+		}
+	}
+}
+
+func newTestProxy(profile Profile) *Proxy {
+	p := &Proxy{
+		Profile:         profile,
+		Logger:          log.New(ioutil.Discard, "", 0),
+		random:          rand.New(rand.NewSource(1)),
+		paths:           make(map[qt.Direction]*path),
+		ruleOccurrences: make([]int, len(profile.Rules)),
+	}
+	for _, direction := range []qt.Direction{qt.ToServer, qt.ToClient} {
+		p.paths[direction] = &path{impairments: profile.impairments(direction)}
+	}
+	return p
+}
+
+func TestRules(t *testing.T) {
+	p := newTestProxy(Profiles["drop_first_server_handshake"])
+	handshake := longHeaderPacket(2, 100)
+	now := time.Now()
+	if delays := p.impair(qt.ToServer, handshake, now); len(delays) != 1 {
+		t.Errorf("the Handshake packet of the client was impaired")
+	}
+	if delays := p.impair(qt.ToClient, longHeaderPacket(0, 100), now); len(delays) != 1 {
+		t.Errorf("the Initial packet of the server was impaired")
+	}
+	if delays := p.impair(qt.ToClient, handshake, now); len(delays) != 0 {
+		t.Errorf("the first Handshake packet of the server was not dropped")
+	}
+	if delays := p.impair(qt.ToClient, handshake, now); len(delays) != 1 {
+		t.Errorf("the second Handshake packet of the server was impaired")
+	}
+}
+
+func TestLossModels(t *testing.T) {
+	datagram := []byte{0x40, 0}
+	for _, name := range []string{"lossy", "bursty_loss"} {
+		p := newTestProxy(Profiles[name])
+		for i := 0; i < 10000; i++ {
+			p.impair(qt.ToServer, datagram, time.Now())
+		}
+		statistics := p.Statistics()[qt.ToServer]
+		if statistics.Dropped < 300 || statistics.Dropped > 1000 {
+			t.Errorf("%s dropped %d datagrams out of %d", name, statistics.Dropped, statistics.Received)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	p := newTestProxy(Profile{ToServer: Impairments{Rate: 1000, QueueDelay: Duration(time.Second)}})
+	now := time.Now()
+	datagram := make([]byte, 500)
+	for i := 1; i <= 3; i++ {
+		delays := p.impair(qt.ToServer, datagram, now)
+		if len(delays) != 1 || delays[0] != time.Duration(i)*500*time.Millisecond {
+			t.Errorf("datagram %d was given delays %v", i, delays)
+		}
+	}
+	if delays := p.impair(qt.ToServer, datagram, now); len(delays) != 0 {
+		t.Errorf("the queue overflowed without dropping datagrams")
+	}
+}
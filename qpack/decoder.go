@@ -0,0 +1,315 @@
+package qpack
+
+import (
+	"bytes"
+	"io"
+)
+
+type DecodedFieldSection struct {
+	StreamID uint64
+	Headers  []HeaderField
+}
+
+type blockedFieldSection struct {
+	streamID            uint64
+	requiredInsertCount uint64
+	data                []byte
+}
+
+// The Decoder decodes the field sections of the peer using the dynamic table it builds from the encoder stream of the
+// peer. A field section referencing entries not yet received is blocked until they are, at most MaxBlockedStreams
+// streams can be blocked at once.
+type Decoder struct {
+	table               dynamicTable
+	MaxBlockedStreams   uint64
+	blocked             []blockedFieldSection
+	encoderStream       []byte
+	pendingInstructions []Instruction
+	acknowledgedInserts uint64 // The insert count the encoder is known to have been notified of
+}
+
+// Returns a new decoder given the values of SETTINGS_QPACK_MAX_TABLE_CAPACITY and SETTINGS_QPACK_BLOCKED_STREAMS it
+// announced
+func NewDecoder(maxTableCapacity uint64, maxBlockedStreams uint64) *Decoder {
+	return &Decoder{table: dynamicTable{maxCapacity: maxTableCapacity}, MaxBlockedStreams: maxBlockedStreams}
+}
+
+func (d *Decoder) InsertCount() uint64 { return d.table.InsertCount() }
+
+// Returns the number of streams currently blocked
+func (d *Decoder) BlockedStreams() int {
+	streams := make(map[uint64]bool)
+	for _, b := range d.blocked {
+		streams[b.streamID] = true
+	}
+	return len(streams)
+}
+
+// Feeds data received on the encoder stream. It returns the instructions read and the field sections they unblocked.
+func (d *Decoder) EncoderIn(data []byte) ([]Instruction, []DecodedFieldSection, error) {
+	d.encoderStream = append(d.encoderStream, data...)
+	instructions, err := readInstructions(&d.encoderStream, ReadEncoderInstruction)
+	if err != nil {
+		return instructions, nil, newError(QPACK_ENCODER_STREAM_ERROR, "malformed encoder instruction: %s", err.Error())
+	}
+	for _, i := range instructions {
+		if err := d.apply(i); err != nil {
+			return instructions, nil, err
+		}
+	}
+
+	var unblocked []DecodedFieldSection
+	var stillBlocked []blockedFieldSection
+	for _, b := range d.blocked {
+		if b.requiredInsertCount > d.table.InsertCount() {
+			stillBlocked = append(stillBlocked, b)
+			continue
+		}
+		headers, _, err := d.decode(b.streamID, b.data)
+		if err != nil {
+			return instructions, unblocked, err
+		}
+		unblocked = append(unblocked, DecodedFieldSection{b.streamID, headers})
+	}
+	d.blocked = stillBlocked
+	return instructions, unblocked, nil
+}
+
+func (d *Decoder) apply(instruction Instruction) error {
+	insertCount := d.table.InsertCount()
+	var field HeaderField
+	switch i := instruction.(type) {
+	case *SetDynamicTableCapacity:
+		if !d.table.SetCapacity(i.Capacity) {
+			return newError(QPACK_ENCODER_STREAM_ERROR, "capacity %d exceeds the maximum of %d", i.Capacity, d.table.maxCapacity)
+		}
+		return nil
+	case *InsertWithNameReference:
+		if i.Static {
+			if i.NameIndex >= uint64(len(staticTable)) {
+				return newError(QPACK_ENCODER_STREAM_ERROR, "invalid static index %d", i.NameIndex)
+			}
+			field = HeaderField{staticTable[i.NameIndex].Name, i.Value}
+		} else {
+			e, ok := d.table.Get(insertCount - 1 - i.NameIndex)
+			if !ok || i.NameIndex >= insertCount {
+				return newError(QPACK_ENCODER_STREAM_ERROR, "invalid relative index %d", i.NameIndex)
+			}
+			field = HeaderField{e.Name, i.Value}
+		}
+	case *InsertWithLiteralName:
+		field = HeaderField{i.HeaderName, i.Value}
+	case *Duplicate:
+		e, ok := d.table.Get(insertCount - 1 - i.Index)
+		if !ok || i.Index >= insertCount {
+			return newError(QPACK_ENCODER_STREAM_ERROR, "invalid relative index %d", i.Index)
+		}
+		field = e
+	}
+	if !d.table.Insert(field) {
+		return newError(QPACK_ENCODER_STREAM_ERROR, "entry of %d bytes exceeds the capacity of %d", field.Size(), d.table.capacity)
+	}
+	return nil
+}
+
+// Decodes a field section received on a stream. It returns whether the field section is blocked, in which case the
+// headers will be returned by EncoderIn() when the entries it references are received.
+func (d *Decoder) HeaderIn(streamID uint64, data []byte) ([]HeaderField, bool, error) {
+	headers, requiredInsertCount, err := d.decode(streamID, data)
+	if err != errBlocked {
+		return headers, false, err
+	}
+	blocked := d.BlockedStreams()
+	for _, b := range d.blocked {
+		if b.streamID == streamID {
+			blocked--
+			break
+		}
+	}
+	if uint64(blocked) >= d.MaxBlockedStreams {
+		return nil, false, newError(QPACK_DECOMPRESSION_FAILED, "stream %d would exceed the %d blocked streams allowed", streamID, d.MaxBlockedStreams)
+	}
+	d.blocked = append(d.blocked, blockedFieldSection{streamID, requiredInsertCount, append([]byte(nil), data...)})
+	return nil, true, nil
+}
+
+// Abandons the field sections blocked on a stream that was reset, see https://tools.ietf.org/html/rfc9204#section-4.4.2
+func (d *Decoder) CancelStream(streamID uint64) {
+	var stillBlocked []blockedFieldSection
+	for _, b := range d.blocked {
+		if b.streamID != streamID {
+			stillBlocked = append(stillBlocked, b)
+		}
+	}
+	d.blocked = stillBlocked
+	d.pendingInstructions = append(d.pendingInstructions, &StreamCancellation{streamID})
+}
+
+// Returns the instructions to send on the decoder stream, i.e. the acknowledgments of the field sections that
+// referenced the dynamic table followed by the insertions not acknowledged otherwise
+func (d *Decoder) DecoderInstructions() []Instruction {
+	instructions := d.pendingInstructions
+	d.pendingInstructions = nil
+	if insertCount := d.table.InsertCount(); insertCount > d.acknowledgedInserts {
+		instructions = append(instructions, &InsertCountIncrement{insertCount - d.acknowledgedInserts})
+		d.acknowledgedInserts = insertCount
+	}
+	return instructions
+}
+
+var errBlocked = newError(QPACK_DECOMPRESSION_FAILED, "field section is blocked")
+
+// Decodes a field section, see https://tools.ietf.org/html/rfc9204#section-4.5
+func (d *Decoder) decode(streamID uint64, data []byte) ([]HeaderField, uint64, error) {
+	reader := bytes.NewReader(data)
+	malformed := func(err error) error {
+		if err == io.ErrUnexpectedEOF {
+			return newError(QPACK_DECOMPRESSION_FAILED, "field section is truncated")
+		}
+		return newError(QPACK_DECOMPRESSION_FAILED, "malformed field section: %s", err.Error())
+	}
+
+	encodedInsertCount, _, err := readInteger(reader, 8)
+	if err != nil {
+		return nil, 0, malformed(err)
+	}
+	requiredInsertCount, err := d.decodeRequiredInsertCount(encodedInsertCount)
+	if err != nil {
+		return nil, 0, err
+	}
+	deltaBase, sign, err := readInteger(reader, 7)
+	if err != nil {
+		return nil, 0, malformed(err)
+	}
+	base := requiredInsertCount + deltaBase
+	if sign != 0 {
+		if deltaBase >= requiredInsertCount {
+			return nil, 0, newError(QPACK_DECOMPRESSION_FAILED, "invalid base")
+		}
+		base = requiredInsertCount - deltaBase - 1
+	}
+	if requiredInsertCount > d.table.InsertCount() {
+		return nil, requiredInsertCount, errBlocked
+	}
+
+	dynamicEntry := func(absoluteIndex uint64) (HeaderField, error) {
+		if absoluteIndex >= requiredInsertCount {
+			return HeaderField{}, newError(QPACK_DECOMPRESSION_FAILED, "reference to entry %d beyond the required insert count", absoluteIndex)
+		}
+		e, ok := d.table.Get(absoluteIndex)
+		if !ok {
+			return HeaderField{}, newError(QPACK_DECOMPRESSION_FAILED, "reference to evicted entry %d", absoluteIndex)
+		}
+		return e, nil
+	}
+	staticEntry := func(index uint64) (HeaderField, error) {
+		if index >= uint64(len(staticTable)) {
+			return HeaderField{}, newError(QPACK_DECOMPRESSION_FAILED, "invalid static index %d", index)
+		}
+		return staticTable[index], nil
+	}
+	relative := func(index uint64) (uint64, error) {
+		if index >= base {
+			return 0, newError(QPACK_DECOMPRESSION_FAILED, "invalid relative index %d", index)
+		}
+		return base - 1 - index, nil
+	}
+
+	var headers []HeaderField
+	for reader.Len() > 0 {
+		first, _ := reader.ReadByte()
+		reader.UnreadByte()
+
+		var field HeaderField
+		var err error
+		switch {
+		case first&0x80 != 0: // Indexed field line
+			var index uint64
+			var flags byte
+			if index, flags, err = readInteger(reader, 6); err != nil {
+				return nil, 0, malformed(err)
+			}
+			if flags&0x40 != 0 {
+				field, err = staticEntry(index)
+			} else if index, err = relative(index); err == nil {
+				field, err = dynamicEntry(index)
+			}
+		case first&0x40 != 0: // Literal field line with name reference
+			var index uint64
+			var flags byte
+			if index, flags, err = readInteger(reader, 4); err != nil {
+				return nil, 0, malformed(err)
+			}
+			if flags&0x10 != 0 {
+				field, err = staticEntry(index)
+			} else if index, err = relative(index); err == nil {
+				field, err = dynamicEntry(index)
+			}
+			if err == nil {
+				if field.Value, _, err = readString(reader, 7); err != nil {
+					return nil, 0, malformed(err)
+				}
+			}
+		case first&0x20 != 0: // Literal field line with literal name
+			if field.Name, _, err = readString(reader, 3); err != nil {
+				return nil, 0, malformed(err)
+			}
+			if field.Value, _, err = readString(reader, 7); err != nil {
+				return nil, 0, malformed(err)
+			}
+		case first&0x10 != 0: // Indexed field line with post-base index
+			var index uint64
+			if index, _, err = readInteger(reader, 4); err != nil {
+				return nil, 0, malformed(err)
+			}
+			field, err = dynamicEntry(base + index)
+		default: // Literal field line with post-base name reference
+			var index uint64
+			if index, _, err = readInteger(reader, 3); err != nil {
+				return nil, 0, malformed(err)
+			}
+			if field, err = dynamicEntry(base + index); err == nil {
+				if field.Value, _, err = readString(reader, 7); err != nil {
+					return nil, 0, malformed(err)
+				}
+			}
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		headers = append(headers, field)
+	}
+
+	if requiredInsertCount > 0 {
+		d.pendingInstructions = append(d.pendingInstructions, &SectionAcknowledgment{streamID})
+		if requiredInsertCount > d.acknowledgedInserts {
+			d.acknowledgedInserts = requiredInsertCount
+		}
+	}
+	return headers, requiredInsertCount, nil
+}
+
+// See https://tools.ietf.org/html/rfc9204#section-4.5.1.1
+func (d *Decoder) decodeRequiredInsertCount(encoded uint64) (uint64, error) {
+	if encoded == 0 {
+		return 0, nil
+	}
+	maxEntries := d.table.MaxEntries()
+	fullRange := 2 * maxEntries
+	if encoded > fullRange {
+		return 0, newError(QPACK_DECOMPRESSION_FAILED, "invalid encoded required insert count %d", encoded)
+	}
+	maxValue := d.table.InsertCount() + maxEntries
+	maxWrapped := (maxValue / fullRange) * fullRange
+	requiredInsertCount := maxWrapped + encoded - 1
+	if requiredInsertCount > maxValue {
+		if requiredInsertCount <= fullRange {
+			return 0, newError(QPACK_DECOMPRESSION_FAILED, "invalid encoded required insert count %d", encoded)
+		}
+		requiredInsertCount -= fullRange
+	}
+	if requiredInsertCount == 0 {
+		return 0, newError(QPACK_DECOMPRESSION_FAILED, "invalid encoded required insert count %d", encoded)
+	}
+	return requiredInsertCount, nil
+}
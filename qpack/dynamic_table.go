@@ -0,0 +1,86 @@
+package qpack
+
+// The dynamic table of https://tools.ietf.org/html/rfc9204#section-3.2. Entries are addressed by their absolute index,
+// i.e. the number of insertions that preceded them.
+type dynamicTable struct {
+	entries     []HeaderField
+	dropped     uint64 // The absolute index of the first entry
+	size        uint64
+	capacity    uint64
+	maxCapacity uint64
+}
+
+func (t *dynamicTable) InsertCount() uint64 { return t.dropped + uint64(len(t.entries)) }
+
+func (t *dynamicTable) Get(absoluteIndex uint64) (HeaderField, bool) {
+	if absoluteIndex < t.dropped || absoluteIndex >= t.InsertCount() {
+		return HeaderField{}, false
+	}
+	return t.entries[absoluteIndex-t.dropped], true
+}
+
+// Returns the absolute index of the newest entry matching the field and whether its value matches as well
+func (t *dynamicTable) Lookup(field HeaderField) (uint64, bool, bool) {
+	var nameIndex uint64
+	var nameFound bool
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		if t.entries[i].Name == field.Name {
+			if t.entries[i].Value == field.Value {
+				return t.dropped + uint64(i), true, true
+			}
+			if !nameFound {
+				nameIndex, nameFound = t.dropped+uint64(i), true
+			}
+		}
+	}
+	return nameIndex, nameFound, false
+}
+
+// Returns the number of entries that must be evicted to make room for the given size
+func (t *dynamicTable) evictionsNeeded(size uint64) (int, bool) {
+	if size > t.capacity {
+		return 0, false
+	}
+	used := t.size
+	var n int
+	for used+size > t.capacity {
+		used -= t.entries[n].Size()
+		n++
+	}
+	return n, true
+}
+
+func (t *dynamicTable) evict(n int) {
+	for i := 0; i < n; i++ {
+		t.size -= t.entries[0].Size()
+		t.entries = t.entries[1:]
+		t.dropped++
+	}
+}
+
+func (t *dynamicTable) Insert(field HeaderField) bool {
+	n, ok := t.evictionsNeeded(field.Size())
+	if !ok {
+		return false
+	}
+	t.evict(n)
+	t.entries = append(t.entries, field)
+	t.size += field.Size()
+	return true
+}
+
+func (t *dynamicTable) SetCapacity(capacity uint64) bool {
+	if capacity > t.maxCapacity {
+		return false
+	}
+	t.capacity = capacity
+	var n int
+	for used := t.size; used > capacity; n++ {
+		used -= t.entries[n].Size()
+	}
+	t.evict(n)
+	return true
+}
+
+// See https://tools.ietf.org/html/rfc9204#section-3.2.3
+func (t *dynamicTable) MaxEntries() uint64 { return t.maxCapacity / 32 }
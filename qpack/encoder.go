@@ -0,0 +1,229 @@
+package qpack
+
+import (
+	"bytes"
+)
+
+type EncoderOpts uint32
+
+const (
+	// Inserts every header that fits in the dynamic table and references it, even if it blocks the stream. Without
+	// it, the encoder only references the static table and never writes on the encoder stream.
+	EncoderOptIndexAggressively EncoderOpts = 1 << iota
+)
+
+type encodedFieldSection struct {
+	requiredInsertCount uint64
+	minReference        uint64 // The smallest absolute index referenced
+	referencesDynamic   bool
+}
+
+// The Encoder encodes field sections. It tracks the field sections not yet acknowledged by the decoder of the peer, so
+// that it neither evicts the entries they reference nor blocks more than MaxBlockedStreams streams.
+type Encoder struct {
+	table              dynamicTable
+	Opts               EncoderOpts
+	MaxBlockedStreams  uint64
+	knownReceivedCount uint64
+	sections           map[uint64][]encodedFieldSection // The unacknowledged field sections of each stream, in order
+	decoderStream      []byte
+}
+
+func NewEncoder(opts EncoderOpts) *Encoder {
+	return &Encoder{Opts: opts, sections: make(map[uint64][]encodedFieldSection)}
+}
+
+// Configures the encoder with the values of SETTINGS_QPACK_MAX_TABLE_CAPACITY and SETTINGS_QPACK_BLOCKED_STREAMS sent
+// by the peer and the capacity of the dynamic table to use. It returns the instructions to send on the encoder stream.
+func (e *Encoder) Init(maxTableCapacity uint64, tableCapacity uint64, maxBlockedStreams uint64) []Instruction {
+	e.table.maxCapacity = maxTableCapacity
+	e.MaxBlockedStreams = maxBlockedStreams
+	if e.Opts&EncoderOptIndexAggressively == 0 || tableCapacity == 0 {
+		return nil
+	}
+	if tableCapacity > maxTableCapacity {
+		tableCapacity = maxTableCapacity
+	}
+	e.table.SetCapacity(tableCapacity)
+	return []Instruction{&SetDynamicTableCapacity{tableCapacity}}
+}
+
+func (e *Encoder) InsertCount() uint64        { return e.table.InsertCount() }
+func (e *Encoder) KnownReceivedCount() uint64 { return e.knownReceivedCount }
+
+// Returns the number of streams with unacknowledged field sections referencing entries the decoder may not have
+func (e *Encoder) BlockedStreams() int {
+	var n int
+	for streamID := range e.sections {
+		if e.isBlocking(streamID) {
+			n++
+		}
+	}
+	return n
+}
+
+func (e *Encoder) isBlocking(streamID uint64) bool {
+	for _, s := range e.sections[streamID] {
+		if s.requiredInsertCount > e.knownReceivedCount {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the entry can be evicted, i.e. it was received by the decoder and no unacknowledged field section
+// references it, including the one being encoded
+func (e *Encoder) isEvictable(absoluteIndex uint64, current encodedFieldSection) bool {
+	if absoluteIndex >= e.knownReceivedCount || (current.referencesDynamic && current.minReference <= absoluteIndex) {
+		return false
+	}
+	for _, sections := range e.sections {
+		for _, s := range sections {
+			if s.referencesDynamic && s.minReference <= absoluteIndex {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Returns whether the field can be inserted and the smallest absolute index that remains afterwards
+func (e *Encoder) canInsert(field HeaderField, current encodedFieldSection) (bool, uint64) {
+	n, ok := e.table.evictionsNeeded(field.Size())
+	if !ok || (n > 0 && !e.isEvictable(e.table.dropped+uint64(n)-1, current)) {
+		return false, 0
+	}
+	return true, e.table.dropped + uint64(n)
+}
+
+// Encodes the headers of a stream. It returns the field section and the instructions to send on the encoder stream
+// beforehand.
+func (e *Encoder) Encode(streamID uint64, headers []HeaderField) ([]byte, []Instruction) {
+	var instructions []Instruction
+	mayBlock := e.isBlocking(streamID) || uint64(e.BlockedStreams()) < e.MaxBlockedStreams
+	aggressive := e.Opts&EncoderOptIndexAggressively != 0 && e.table.capacity > 0
+
+	type line struct {
+		field         HeaderField
+		static        bool
+		dynamic       bool
+		nameReference bool
+		index         uint64 // The static index or the absolute dynamic index
+	}
+	var lines []line
+	var section encodedFieldSection
+	reference := func(absoluteIndex uint64) {
+		if !section.referencesDynamic || absoluteIndex < section.minReference {
+			section.minReference = absoluteIndex
+		}
+		section.referencesDynamic = true
+		if absoluteIndex+1 > section.requiredInsertCount {
+			section.requiredInsertCount = absoluteIndex + 1
+		}
+	}
+	usable := func(absoluteIndex uint64) bool {
+		return absoluteIndex < e.knownReceivedCount || mayBlock
+	}
+
+	for _, h := range headers {
+		staticIndex, staticMatch := staticTableLookup(h)
+		if staticMatch {
+			lines = append(lines, line{field: h, static: true, index: uint64(staticIndex)})
+			continue
+		}
+		if dynamicIndex, nameFound, valueMatch := e.table.Lookup(h); valueMatch && usable(dynamicIndex) {
+			reference(dynamicIndex)
+			lines = append(lines, line{field: h, dynamic: true, index: dynamicIndex})
+			continue
+		} else if ok, oldestRemaining := e.canInsert(h, section); aggressive && mayBlock && ok {
+			switch {
+			case staticIndex >= 0:
+				instructions = append(instructions, &InsertWithNameReference{true, uint64(staticIndex), h.Value, shouldHuffmanEncode(h.Value)})
+			case nameFound && dynamicIndex >= oldestRemaining:
+				instructions = append(instructions, &InsertWithNameReference{false, e.table.InsertCount() - 1 - dynamicIndex, h.Value, shouldHuffmanEncode(h.Value)})
+			default:
+				instructions = append(instructions, &InsertWithLiteralName{h.Name, h.Value, shouldHuffmanEncode(h.Name), shouldHuffmanEncode(h.Value)})
+			}
+			e.table.Insert(h)
+			absoluteIndex := e.table.InsertCount() - 1
+			reference(absoluteIndex)
+			lines = append(lines, line{field: h, dynamic: true, index: absoluteIndex})
+			continue
+		} else if nameFound && usable(dynamicIndex) && staticIndex < 0 {
+			reference(dynamicIndex)
+			lines = append(lines, line{field: h, dynamic: true, nameReference: true, index: dynamicIndex})
+			continue
+		}
+		if staticIndex >= 0 {
+			lines = append(lines, line{field: h, static: true, nameReference: true, index: uint64(staticIndex)})
+		} else {
+			lines = append(lines, line{field: h})
+		}
+	}
+
+	// Every reference is made relative to a base equal to the required insert count
+	base := section.requiredInsertCount
+	buffer := new(bytes.Buffer)
+	var encodedInsertCount uint64
+	if section.requiredInsertCount > 0 { // See https://tools.ietf.org/html/rfc9204#section-4.5.1.1
+		encodedInsertCount = section.requiredInsertCount%(2*e.table.MaxEntries()) + 1
+	}
+	writeInteger(buffer, 0, 8, encodedInsertCount)
+	writeInteger(buffer, 0, 7, 0)
+	for _, l := range lines {
+		switch {
+		case l.static && !l.nameReference:
+			writeInteger(buffer, 0xc0, 6, l.index)
+		case l.dynamic && !l.nameReference:
+			writeInteger(buffer, 0x80, 6, base-1-l.index)
+		case l.static:
+			writeInteger(buffer, 0x50, 4, l.index)
+			writeString(buffer, 0, 7, l.field.Value, shouldHuffmanEncode(l.field.Value))
+		case l.dynamic:
+			writeInteger(buffer, 0x40, 4, base-1-l.index)
+			writeString(buffer, 0, 7, l.field.Value, shouldHuffmanEncode(l.field.Value))
+		default:
+			writeString(buffer, 0x20, 3, l.field.Name, shouldHuffmanEncode(l.field.Name))
+			writeString(buffer, 0, 7, l.field.Value, shouldHuffmanEncode(l.field.Value))
+		}
+	}
+
+	if section.referencesDynamic {
+		e.sections[streamID] = append(e.sections[streamID], section)
+	}
+	return buffer.Bytes(), instructions
+}
+
+// Feeds data received on the decoder stream. It returns the instructions read.
+func (e *Encoder) DecoderIn(data []byte) ([]Instruction, error) {
+	e.decoderStream = append(e.decoderStream, data...)
+	instructions, err := readInstructions(&e.decoderStream, ReadDecoderInstruction)
+	if err != nil {
+		return instructions, newError(QPACK_DECODER_STREAM_ERROR, "malformed decoder instruction: %s", err.Error())
+	}
+	for _, instruction := range instructions {
+		switch i := instruction.(type) {
+		case *SectionAcknowledgment:
+			sections := e.sections[i.StreamID]
+			if len(sections) == 0 {
+				return instructions, newError(QPACK_DECODER_STREAM_ERROR, "no field section to acknowledge on stream %d", i.StreamID)
+			}
+			if sections[0].requiredInsertCount > e.knownReceivedCount {
+				e.knownReceivedCount = sections[0].requiredInsertCount
+			}
+			if len(sections) == 1 {
+				delete(e.sections, i.StreamID)
+			} else {
+				e.sections[i.StreamID] = sections[1:]
+			}
+		case *StreamCancellation:
+			delete(e.sections, i.StreamID)
+		case *InsertCountIncrement:
+			if i.Increment == 0 || e.knownReceivedCount+i.Increment > e.table.InsertCount() {
+				return instructions, newError(QPACK_DECODER_STREAM_ERROR, "invalid insert count increment of %d", i.Increment)
+			}
+			e.knownReceivedCount += i.Increment
+		}
+	}
+	return instructions, nil
+}
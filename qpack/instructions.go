@@ -0,0 +1,215 @@
+package qpack
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// An Instruction is sent either on the encoder stream or on the decoder stream, see
+// https://tools.ietf.org/html/rfc9204#section-4.3 and https://tools.ietf.org/html/rfc9204#section-4.4
+type Instruction interface {
+	Name() string
+	WriteTo(buffer *bytes.Buffer)
+	String() string
+}
+
+type SetDynamicTableCapacity struct {
+	Capacity uint64
+}
+
+func (i *SetDynamicTableCapacity) Name() string { return "set_dynamic_table_capacity" }
+func (i *SetDynamicTableCapacity) WriteTo(buffer *bytes.Buffer) {
+	writeInteger(buffer, 0x20, 5, i.Capacity)
+}
+func (i *SetDynamicTableCapacity) String() string {
+	return fmt.Sprintf("%s(capacity=%d)", i.Name(), i.Capacity)
+}
+
+// Inserts an entry which name is the one of a static entry, or of a dynamic entry given its relative index
+type InsertWithNameReference struct {
+	Static    bool
+	NameIndex uint64
+	Value     string
+	Huffman   bool
+}
+
+func (i *InsertWithNameReference) Name() string { return "insert_with_name_reference" }
+func (i *InsertWithNameReference) WriteTo(buffer *bytes.Buffer) {
+	var flags byte = 0x80
+	if i.Static {
+		flags |= 0x40
+	}
+	writeInteger(buffer, flags, 6, i.NameIndex)
+	writeString(buffer, 0, 7, i.Value, i.Huffman)
+}
+func (i *InsertWithNameReference) String() string {
+	table := "dynamic"
+	if i.Static {
+		table = "static"
+	}
+	return fmt.Sprintf("%s(%s=%d, value=%q)", i.Name(), table, i.NameIndex, i.Value)
+}
+
+type InsertWithLiteralName struct {
+	HeaderName   string
+	Value        string
+	HuffmanName  bool
+	HuffmanValue bool
+}
+
+func (i *InsertWithLiteralName) Name() string { return "insert_with_literal_name" }
+func (i *InsertWithLiteralName) WriteTo(buffer *bytes.Buffer) {
+	writeString(buffer, 0x40, 5, i.HeaderName, i.HuffmanName)
+	writeString(buffer, 0, 7, i.Value, i.HuffmanValue)
+}
+func (i *InsertWithLiteralName) String() string {
+	return fmt.Sprintf("%s(name=%q, value=%q)", i.Name(), i.HeaderName, i.Value)
+}
+
+// Duplicates a dynamic entry given its relative index
+type Duplicate struct {
+	Index uint64
+}
+
+func (i *Duplicate) Name() string                 { return "duplicate" }
+func (i *Duplicate) WriteTo(buffer *bytes.Buffer) { writeInteger(buffer, 0, 5, i.Index) }
+func (i *Duplicate) String() string               { return fmt.Sprintf("%s(index=%d)", i.Name(), i.Index) }
+
+type SectionAcknowledgment struct {
+	StreamID uint64
+}
+
+func (i *SectionAcknowledgment) Name() string { return "section_acknowledgment" }
+func (i *SectionAcknowledgment) WriteTo(buffer *bytes.Buffer) {
+	writeInteger(buffer, 0x80, 7, i.StreamID)
+}
+func (i *SectionAcknowledgment) String() string {
+	return fmt.Sprintf("%s(stream=%d)", i.Name(), i.StreamID)
+}
+
+type StreamCancellation struct {
+	StreamID uint64
+}
+
+func (i *StreamCancellation) Name() string { return "stream_cancellation" }
+func (i *StreamCancellation) WriteTo(buffer *bytes.Buffer) {
+	writeInteger(buffer, 0x40, 6, i.StreamID)
+}
+func (i *StreamCancellation) String() string {
+	return fmt.Sprintf("%s(stream=%d)", i.Name(), i.StreamID)
+}
+
+type InsertCountIncrement struct {
+	Increment uint64
+}
+
+func (i *InsertCountIncrement) Name() string { return "insert_count_increment" }
+func (i *InsertCountIncrement) WriteTo(buffer *bytes.Buffer) {
+	writeInteger(buffer, 0, 6, i.Increment)
+}
+func (i *InsertCountIncrement) String() string {
+	return fmt.Sprintf("%s(increment=%d)", i.Name(), i.Increment)
+}
+
+// Reads an instruction sent on the encoder stream. It returns io.ErrUnexpectedEOF when the instruction is truncated.
+func ReadEncoderInstruction(buffer *bytes.Reader) (Instruction, error) {
+	first, err := buffer.ReadByte()
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	buffer.UnreadByte()
+
+	switch {
+	case first&0x80 != 0:
+		index, flags, err := readInteger(buffer, 6)
+		if err != nil {
+			return nil, err
+		}
+		value, huffman, err := readString(buffer, 7)
+		if err != nil {
+			return nil, err
+		}
+		return &InsertWithNameReference{flags&0x40 != 0, index, value, huffman}, nil
+	case first&0x40 != 0:
+		name, huffmanName, err := readString(buffer, 5)
+		if err != nil {
+			return nil, err
+		}
+		value, huffmanValue, err := readString(buffer, 7)
+		if err != nil {
+			return nil, err
+		}
+		return &InsertWithLiteralName{name, value, huffmanName, huffmanValue}, nil
+	case first&0x20 != 0:
+		capacity, _, err := readInteger(buffer, 5)
+		if err != nil {
+			return nil, err
+		}
+		return &SetDynamicTableCapacity{capacity}, nil
+	default:
+		index, _, err := readInteger(buffer, 5)
+		if err != nil {
+			return nil, err
+		}
+		return &Duplicate{index}, nil
+	}
+}
+
+// Reads an instruction sent on the decoder stream. It returns io.ErrUnexpectedEOF when the instruction is truncated.
+func ReadDecoderInstruction(buffer *bytes.Reader) (Instruction, error) {
+	first, err := buffer.ReadByte()
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	buffer.UnreadByte()
+
+	switch {
+	case first&0x80 != 0:
+		streamID, _, err := readInteger(buffer, 7)
+		if err != nil {
+			return nil, err
+		}
+		return &SectionAcknowledgment{streamID}, nil
+	case first&0x40 != 0:
+		streamID, _, err := readInteger(buffer, 6)
+		if err != nil {
+			return nil, err
+		}
+		return &StreamCancellation{streamID}, nil
+	default:
+		increment, _, err := readInteger(buffer, 6)
+		if err != nil {
+			return nil, err
+		}
+		return &InsertCountIncrement{increment}, nil
+	}
+}
+
+// Reads all the complete instructions contained in the data buffered for a stream and removes them from it
+func readInstructions(buffered *[]byte, read func(*bytes.Reader) (Instruction, error)) ([]Instruction, error) {
+	var instructions []Instruction
+	reader := bytes.NewReader(*buffered)
+	for reader.Len() > 0 {
+		start := reader.Len()
+		i, err := read(reader)
+		if err == io.ErrUnexpectedEOF {
+			reader = bytes.NewReader((*buffered)[len(*buffered)-start:])
+			break
+		} else if err != nil {
+			return instructions, err
+		}
+		instructions = append(instructions, i)
+	}
+	*buffered = append([]byte(nil), (*buffered)[len(*buffered)-reader.Len():]...)
+	return instructions, nil
+}
+
+// Encodes instructions as sent on a stream
+func EncodeInstructions(instructions []Instruction) []byte {
+	buffer := new(bytes.Buffer)
+	for _, i := range instructions {
+		i.WriteTo(buffer)
+	}
+	return buffer.Bytes()
+}
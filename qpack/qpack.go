@@ -0,0 +1,134 @@
+// Package qpack implements the QPACK field compression of HTTP/3, as described in https://tools.ietf.org/html/rfc9204.
+//
+// The Encoder and the Decoder do not perform any I/O. They consume the instructions received on the peer's decoder
+// and encoder streams and return the instructions to send on their own streams, so that every instruction exchanged
+// can be observed.
+package qpack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type HeaderField struct {
+	Name, Value string
+}
+
+func (f HeaderField) Size() uint64 { // See https://tools.ietf.org/html/rfc9204#section-3.2.1
+	return uint64(len(f.Name) + len(f.Value) + 32)
+}
+
+// The errors of https://tools.ietf.org/html/rfc9204#section-6
+const (
+	QPACK_DECOMPRESSION_FAILED = 0x200
+	QPACK_ENCODER_STREAM_ERROR = 0x201
+	QPACK_DECODER_STREAM_ERROR = 0x202
+)
+
+// The unidirectional stream types of https://tools.ietf.org/html/rfc9204#section-4.2
+const (
+	EncoderStreamType = 0x02
+	DecoderStreamType = 0x03
+)
+
+type Error struct {
+	Code   uint64
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("qpack error 0x%x: %s", e.Code, e.Reason)
+}
+
+func newError(code uint64, format string, args ...interface{}) *Error {
+	return &Error{code, fmt.Sprintf(format, args...)}
+}
+
+var errIntegerOverflow = errors.New("integer overflows 62 bits")
+
+// Writes an integer with a prefix of n bits, the upper bits of the first byte are given in flags. See
+// https://tools.ietf.org/html/rfc7541#section-5.1
+func writeInteger(buffer *bytes.Buffer, flags byte, n uint, value uint64) {
+	max := uint64(1)<<n - 1
+	if value < max {
+		buffer.WriteByte(flags | byte(value))
+		return
+	}
+	buffer.WriteByte(flags | byte(max))
+	value -= max
+	for value >= 0x80 {
+		buffer.WriteByte(byte(value&0x7f) | 0x80)
+		value >>= 7
+	}
+	buffer.WriteByte(byte(value))
+}
+
+// Reads an integer with a prefix of n bits and returns the upper bits of its first byte as well. It returns
+// io.ErrUnexpectedEOF when the buffer ends before the integer does.
+func readInteger(buffer *bytes.Reader, n uint) (uint64, byte, error) {
+	first, err := buffer.ReadByte()
+	if err != nil {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	max := uint64(1)<<n - 1
+	flags := first &^ byte(max)
+	value := uint64(first) & max
+	if value < max {
+		return value, flags, nil
+	}
+	for shift := uint(0); ; shift += 7 {
+		b, err := buffer.ReadByte()
+		if err != nil {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+		if shift > 56 {
+			return 0, 0, errIntegerOverflow
+		}
+		value += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if value >= 1<<62 {
+		return 0, 0, errIntegerOverflow
+	}
+	return value, flags, nil
+}
+
+// Writes a string literal with a length prefix of n bits. The H bit lies just above the prefix.
+func writeString(buffer *bytes.Buffer, flags byte, n uint, s string, huffman bool) {
+	if huffman {
+		encoded := huffmanEncode(s)
+		writeInteger(buffer, flags|1<<n, n, uint64(len(encoded)))
+		buffer.Write(encoded)
+		return
+	}
+	writeInteger(buffer, flags, n, uint64(len(s)))
+	buffer.WriteString(s)
+}
+
+// Reads a string literal with a length prefix of n bits and returns whether it was Huffman-encoded
+func readString(buffer *bytes.Reader, n uint) (string, bool, error) {
+	length, flags, err := readInteger(buffer, n)
+	if err != nil {
+		return "", false, err
+	}
+	if length > uint64(buffer.Len()) {
+		return "", false, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, length)
+	buffer.Read(data)
+	huffman := flags&(1<<n) != 0
+	if !huffman {
+		return string(data), false, nil
+	}
+	s, err := huffmanDecode(data)
+	return s, true, err
+}
+
+// Returns whether a string is shorter once Huffman-encoded
+func shouldHuffmanEncode(s string) bool {
+	return huffmanEncodedLength(s) < len(s)
+}
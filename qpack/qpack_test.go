@@ -0,0 +1,131 @@
+package qpack
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestHuffman(t *testing.T) {
+	for _, s := range []string{"", "www.example.com", "no-cache", "custom-key", "/sample/path", "\x00\xff"} {
+		decoded, err := huffmanDecode(huffmanEncode(s))
+		if err != nil || decoded != s {
+			t.Errorf("%q was decoded as %q (%v)", s, decoded, err)
+		}
+	}
+	// See https://tools.ietf.org/html/rfc7541#appendix-C.4.1
+	if encoded := hex.EncodeToString(huffmanEncode("www.example.com")); encoded != "f1e3c2e5f23a6ba0ab90f4ff" {
+		t.Errorf("www.example.com was encoded as %s", encoded)
+	}
+}
+
+// See https://tools.ietf.org/html/rfc9204#appendix-B.1
+func TestDecodeLiteralFieldLine(t *testing.T) {
+	d := NewDecoder(0, 0)
+	headers, blocked, err := d.HeaderIn(0, unhex(t, "0000510b2f696e6465782e68746d6c"))
+	if err != nil || blocked {
+		t.Fatal(err, blocked)
+	}
+	if expected := []HeaderField{{":path", "/index.html"}}; !reflect.DeepEqual(headers, expected) {
+		t.Errorf("decoded %v instead of %v", headers, expected)
+	}
+	if instructions := d.DecoderInstructions(); len(instructions) != 0 {
+		t.Errorf("unexpected decoder instructions %v", instructions)
+	}
+}
+
+// See https://tools.ietf.org/html/rfc9204#appendix-B.2
+func TestDecodeDynamicTable(t *testing.T) {
+	d := NewDecoder(220, 1)
+	headers, blocked, err := d.HeaderIn(4, unhex(t, "03811011"))
+	if err != nil || !blocked || headers != nil {
+		t.Fatal("field section should be blocked", err)
+	}
+
+	instructions, unblocked, err := d.EncoderIn(unhex(t, "3fbd01c00f7777772e6578616d706c652e636f6dc10c2f73616d706c652f70617468"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedInstructions := []Instruction{
+		&SetDynamicTableCapacity{220},
+		&InsertWithNameReference{true, 0, "www.example.com", false},
+		&InsertWithNameReference{true, 1, "/sample/path", false},
+	}
+	if !reflect.DeepEqual(instructions, expectedInstructions) {
+		t.Errorf("read %v instead of %v", instructions, expectedInstructions)
+	}
+	expected := []DecodedFieldSection{{4, []HeaderField{{":authority", "www.example.com"}, {":path", "/sample/path"}}}}
+	if !reflect.DeepEqual(unblocked, expected) {
+		t.Errorf("decoded %v instead of %v", unblocked, expected)
+	}
+	if encoded := EncodeInstructions(d.DecoderInstructions()); hex.EncodeToString(encoded) != "84" {
+		t.Errorf("decoder stream contains %x instead of 84", encoded)
+	}
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	e := NewEncoder(EncoderOptIndexAggressively)
+	d := NewDecoder(4096, 1)
+	encoderStream := EncodeInstructions(e.Init(4096, 256, 1))
+
+	requests := [][]HeaderField{
+		{{":method", "GET"}, {":path", "/index.html"}, {":authority", "example.com"}, {"user-agent", "quic-tracker"}},
+		{{":method", "GET"}, {":path", "/index.html"}, {":authority", "example.com"}, {"x-custom", "a value"}},
+		{{":method", "POST"}, {":path", "/form"}, {":authority", "example.com"}, {"x-custom", "another value"}},
+	}
+	for i, headers := range requests {
+		streamID := uint64(4 * i)
+		section, instructions := e.Encode(streamID, headers)
+		encoderStream = append(encoderStream, EncodeInstructions(instructions)...)
+
+		decoded, blocked, err := d.HeaderIn(streamID, section)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blocked {
+			var unblocked []DecodedFieldSection
+			if _, unblocked, err = d.EncoderIn(encoderStream); err != nil || len(unblocked) != 1 {
+				t.Fatal("field section was not unblocked", err)
+			}
+			decoded = unblocked[0].Headers
+			encoderStream = nil
+		}
+		if !reflect.DeepEqual(decoded, headers) {
+			t.Errorf("decoded %v instead of %v", decoded, headers)
+		}
+		if _, err := e.DecoderIn(EncodeInstructions(d.DecoderInstructions())); err != nil {
+			t.Fatal(err)
+		}
+		if e.KnownReceivedCount() != e.InsertCount() || e.BlockedStreams() != 0 {
+			t.Errorf("encoder has %d entries but the decoder acknowledged %d", e.InsertCount(), e.KnownReceivedCount())
+		}
+	}
+	if e.InsertCount() == 0 {
+		t.Error("the encoder did not use its dynamic table")
+	}
+}
+
+func TestTruncatedInstructions(t *testing.T) {
+	d := NewDecoder(4096, 0)
+	encoded := EncodeInstructions([]Instruction{&SetDynamicTableCapacity{4096}, &InsertWithLiteralName{"x-custom", "some value", true, false}})
+	for i := range encoded {
+		instructions, _, err := d.EncoderIn(encoded[i : i+1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < len(encoded)-1 && d.InsertCount() != 0 || len(instructions) > 1 {
+			t.Fatalf("read %v after %d bytes", instructions, i+1)
+		}
+	}
+	if d.InsertCount() != 1 {
+		t.Errorf("decoder has %d entries instead of 1", d.InsertCount())
+	}
+}
@@ -22,7 +22,7 @@ func NewAckECNScenario() *AckECNScenario {
 	return &AckECNScenario{AbstractScenario{name: "ack_ecn", version: 1}}
 }
 func (s *AckECNScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
-	s.timeout = time.NewTimer(10 * time.Second)
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
 
 	connAgents := s.CompleteHandshake(conn, trace, AE_TLSHandshakeFailed)
 	if connAgents == nil {
@@ -19,7 +19,7 @@ func NewAckOnlyScenario() *AckOnlyScenario {
 	return &AckOnlyScenario{AbstractScenario{name: "ack_only", version: 1}}
 }
 func (s *AckOnlyScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
-	s.timeout = time.NewTimer(10 * time.Second)
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
 	connAgents := s.CompleteHandshake(conn, trace, AO_TLSHandshakeFailed)
 	if connAgents == nil {
 		return
@@ -20,7 +20,7 @@ func NewAddressValidationScenario() *AddressValidationScenario {
 	return &AddressValidationScenario{AbstractScenario{name: "address_validation", version: 3}}
 }
 func (s *AddressValidationScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
-	s.timeout = time.NewTimer(10 * time.Second)
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
 
 	connAgents := agents.AttachAgentsToConnection(conn, agents.GetDefaultAgents()...)
 	defer connAgents.StopAll()
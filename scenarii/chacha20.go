@@ -0,0 +1,47 @@
+package scenarii
+
+import (
+	"fmt"
+	qt "github.com/RohitPanda/quic-tracker"
+	"time"
+)
+
+const (
+	CH_TLSHandshakeFailed          = 1
+	CH_CipherSuitesNotConfigurable = 2
+	CH_WrongCipherSuiteNegotiated  = 3
+)
+
+// Checks that the host completes a handshake when only TLS_CHACHA20_POLY1305_SHA256 is allowed. Packets of the
+// Handshake and 1-RTT encryption levels are then protected with ChaCha20-Poly1305 and their header with ChaCha20, see
+// https://tools.ietf.org/html/rfc9001#section-5.4.4. The TLS providers that offer all the cipher suites abort the
+// handshake when the host selects another one, the host is then not tested.
+type ChaCha20Scenario struct {
+	AbstractScenario
+}
+
+func NewChaCha20Scenario() *ChaCha20Scenario {
+	return &ChaCha20Scenario{AbstractScenario{name: "chacha20", version: 1}}
+}
+func (s *ChaCha20Scenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
+
+	if err := conn.SetCipherSuites([]qt.CipherSuite{qt.TLS_CHACHA20_POLY1305_SHA256}); err != nil {
+		trace.MarkError(CH_CipherSuitesNotConfigurable, fmt.Sprintf("skipped: %s", err.Error()), nil)
+		return
+	}
+	trace.Results["all_cipher_suites_offered"] = conn.Tls.OffersAllCipherSuites()
+
+	connAgents := s.CompleteHandshake(conn, trace, CH_TLSHandshakeFailed)
+	if connAgents == nil {
+		if selected := conn.Tls.CipherSuite(); conn.Tls.OffersAllCipherSuites() && selected != 0 && selected != qt.TLS_CHACHA20_POLY1305_SHA256 {
+			trace.MarkError(CH_CipherSuitesNotConfigurable, fmt.Sprintf("skipped: all the cipher suites were offered and the server selected %s", selected.String()), nil)
+		}
+		return
+	}
+	defer connAgents.CloseConnection(false, 0, "")
+
+	if conn.CipherSuite != qt.TLS_CHACHA20_POLY1305_SHA256 {
+		trace.MarkError(CH_WrongCipherSuiteNegotiated, fmt.Sprintf("server selected %s", conn.CipherSuite.String()), nil)
+	}
+}
@@ -0,0 +1,130 @@
+package scenarii
+
+import (
+	qt "github.com/RohitPanda/quic-tracker"
+	"time"
+)
+
+// A host×scenario pair that differs between two runs of the test suite
+type Change struct {
+	Scenario string
+	Host     string
+	Baseline *TestCase // It is nil when the pair was not run in the baseline
+	Current  *TestCase // It is nil when the pair was not run anymore
+}
+
+// Returns whether the pair was run in both runs
+func (c Change) Compared() bool {
+	return c.Baseline != nil && c.Current != nil
+}
+
+// Returns the difference between the durations of the runs in milliseconds
+func (c Change) DurationDelta() int64 {
+	if !c.Compared() {
+		return 0
+	}
+	return int64(c.Current.Duration) - int64(c.Baseline.Duration)
+}
+
+// Returns whether the current run crashed or failed to use the UDP socket while the baseline did not
+func (c Change) Crash() bool {
+	if c.Current == nil || !crashed(c.Current.ErrorCode) {
+		return false
+	}
+	return c.Baseline == nil || c.Baseline.ErrorCode != c.Current.ErrorCode
+}
+
+// Returns whether the result of the current run is worse than the one of the baseline, e.g. a success that became a
+// failure or a warning that became an error. The new crashes are regressions.
+func (c Change) Regression() bool {
+	if c.Crash() {
+		return true
+	}
+	return c.Compared() && resultRank(c.Current) > resultRank(c.Baseline)
+}
+
+func crashed(errorCode uint8) bool {
+	return errorCode == R_Crashed || errorCode == R_UDPError
+}
+
+// Orders the results from the best to the worst
+func resultRank(c *TestCase) int {
+	switch c.Severity {
+	case SeverityInconclusive:
+		return 1
+	case SeverityWarning:
+		return 2
+	case SeverityFailure:
+		return 3
+	case SeverityError:
+		return 4
+	}
+	return 0
+}
+
+// The differences between two runs of the test suite
+type Comparison struct {
+	Verdicts  []Change // The pairs whose verdict changed, in the order of the current run, followed by the pairs removed
+	Durations []Change // The pairs whose verdict did not change and whose duration changed by more than the threshold
+}
+
+// Returns the verdict changes that are regressions
+func (c *Comparison) Regressions() []Change {
+	var regressions []Change
+	for _, v := range c.Verdicts {
+		if v.Regression() {
+			regressions = append(regressions, v)
+		}
+	}
+	return regressions
+}
+
+// Returns the verdict changes that are new crashes
+func (c *Comparison) Crashes() []Change {
+	var crashes []Change
+	for _, v := range c.Verdicts {
+		if v.Crash() {
+			crashes = append(crashes, v)
+		}
+	}
+	return crashes
+}
+
+// Compares the traces of a run of the test suite to the ones of a baseline. The host×scenario pairs are matched as in
+// the reports, see TestCases. A threshold of zero does not report the duration changes.
+func Compare(baseline []qt.Trace, current []qt.Trace, threshold time.Duration) *Comparison {
+	baselineCases := TestCases(baseline)
+	currentCases := TestCases(current)
+
+	key := func(c *TestCase) string {
+		return c.Scenario + "\x00" + c.Host
+	}
+	baselineIndex := make(map[string]*TestCase)
+	for i := range baselineCases {
+		baselineIndex[key(&baselineCases[i])] = &baselineCases[i]
+	}
+
+	comparison := &Comparison{}
+	seen := make(map[string]bool)
+	for i := range currentCases {
+		c := &currentCases[i]
+		if seen[key(c)] {
+			continue
+		}
+		seen[key(c)] = true
+		change := Change{Scenario: c.Scenario, Host: c.Host, Baseline: baselineIndex[key(c)], Current: c}
+		if change.Baseline == nil || change.Baseline.ErrorCode != c.ErrorCode {
+			comparison.Verdicts = append(comparison.Verdicts, change)
+		} else if delta := time.Duration(change.DurationDelta()) * time.Millisecond; threshold > 0 && (delta >= threshold || -delta >= threshold) {
+			comparison.Durations = append(comparison.Durations, change)
+		}
+	}
+	for i := range baselineCases {
+		b := &baselineCases[i]
+		if !seen[key(b)] {
+			seen[key(b)] = true
+			comparison.Verdicts = append(comparison.Verdicts, Change{Scenario: b.Scenario, Host: b.Host, Baseline: b})
+		}
+	}
+	return comparison
+}
@@ -0,0 +1,63 @@
+package scenarii
+
+import (
+	qt "github.com/RohitPanda/quic-tracker"
+	"testing"
+	"time"
+)
+
+func TestCompare(t *testing.T) {
+	baseline := []qt.Trace{
+		{Scenario: "connection_migration", Host: "a:443", Duration: 1000},
+		{Scenario: "connection_migration", Host: "b:443", ErrorCode: CM_TLSHandshakeFailed, Duration: 1000},
+		{Scenario: "connection_migration", Host: "c:443", ErrorCode: CM_HostDidNotMigrate, Duration: 1000},
+		{Scenario: "zero_rtt", Host: "a:443", Duration: 1000},
+		{Scenario: "zero_rtt", Host: "b:443", Duration: 1000},
+		{Scenario: "zero_rtt", Host: "c:443", Duration: 1000},
+		{Scenario: "zero_rtt", Host: "d:443", Duration: 1000},
+	}
+	current := []qt.Trace{
+		{Scenario: "connection_migration", Host: "a:443", ErrorCode: CM_HostDidNotMigrate, Duration: 1000},
+		{Scenario: "connection_migration", Host: "b:443", ErrorCode: CM_HostDidNotMigrate, Duration: 1000},
+		{Scenario: "connection_migration", Host: "c:443", Duration: 1000},
+		{Scenario: "zero_rtt", Host: "a:443", ErrorCode: R_Crashed, Duration: 1000},
+		{Scenario: "zero_rtt", Host: "b:443", Duration: 3500},
+		{Scenario: "zero_rtt", Host: "c:443", Duration: 1500},
+		{Scenario: "zero_rtt", Host: "e:443", ErrorCode: R_UDPError, Duration: 1000},
+	}
+
+	comparison := Compare(baseline, current, 2*time.Second)
+	expected := []struct {
+		host       string
+		regression bool
+		crash      bool
+	}{
+		{"a:443", true, false},  // connection_migration, a success that became a failure
+		{"b:443", true, false},  // connection_migration, an inconclusive run that became a failure
+		{"c:443", false, false}, // connection_migration, a failure that became a success
+		{"a:443", true, true},   // zero_rtt
+		{"e:443", true, true},   // zero_rtt, added
+		{"d:443", false, false}, // zero_rtt, removed
+	}
+	if len(comparison.Verdicts) != len(expected) {
+		t.Fatalf("expected %d verdict changes, got %d", len(expected), len(comparison.Verdicts))
+	}
+	for i, e := range expected {
+		c := comparison.Verdicts[i]
+		if c.Host != e.host || c.Regression() != e.regression || c.Crash() != e.crash {
+			t.Errorf("%d: expected %+v, got %s %s regression=%v crash=%v", i, e, c.Scenario, c.Host, c.Regression(), c.Crash())
+		}
+	}
+	if c := comparison.Verdicts[5]; c.Current != nil || c.Baseline == nil {
+		t.Errorf("the removed pair is not reported: %+v", c)
+	}
+	if len(comparison.Regressions()) != 4 || len(comparison.Crashes()) != 2 {
+		t.Errorf("expected 4 regressions and 2 crashes, got %d and %d", len(comparison.Regressions()), len(comparison.Crashes()))
+	}
+	if len(comparison.Durations) != 1 || comparison.Durations[0].Host != "b:443" || comparison.Durations[0].DurationDelta() != 2500 {
+		t.Errorf("unexpected duration changes %+v", comparison.Durations)
+	}
+	if len(Compare(baseline, current, 0).Durations) != 0 {
+		t.Error("the durations were compared with a zero threshold")
+	}
+}
@@ -0,0 +1,680 @@
+package scenarii
+
+import (
+	"errors"
+	"fmt"
+	qt "github.com/RohitPanda/quic-tracker"
+	"github.com/RohitPanda/quic-tracker/agents"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A scenario written in YAML rather than in Go, see the definitions directory for examples. Its steps are run in order,
+// the first one must complete the handshake. The first step that fails marks its error code in the trace and ends the
+// run.
+type Definition struct {
+	Name        string        `yaml:"name"`
+	Version     int           `yaml:"version"`
+	Description string        `yaml:"description"`
+	RFCSections []string      `yaml:"rfc_sections"`
+	Tags        []string      `yaml:"tags"`
+	IPv6        bool          `yaml:"ipv6"`
+	HTTP3       bool          `yaml:"http3"`
+	Timeout     time.Duration `yaml:"timeout"` // The scenario ends after it, e.g. 10s, DefaultTimeout is used if not set
+	ErrorCodes  []ErrorCode   `yaml:"error_codes"`
+	Steps       []Step        `yaml:"steps"`
+}
+
+// A step of a scenario, exactly one of its fields must be set
+type Step struct {
+	Handshake    *HandshakeStep `yaml:"handshake"`
+	Send         *SendStep      `yaml:"send"`
+	Request      *RequestStep   `yaml:"request"`
+	Wait         *WaitStep      `yaml:"wait"`
+	Sleep        time.Duration  `yaml:"sleep"`
+	Assert       *AssertStep    `yaml:"assert"`
+	SetErrorCode *Failure       `yaml:"set_error_code"` // Marks the error code in the trace and ends the run
+}
+
+// Completes the handshake with the default agents
+type HandshakeStep struct {
+	ErrorCode uint8 `yaml:"error_code"` // Marked when the handshake fails
+}
+
+// Sends frames at an encryption level, either initial, handshake, 0rtt or 1rtt, the latter is used if not set
+type SendStep struct {
+	Level  string            `yaml:"level"`
+	Frames []FrameDefinition `yaml:"frames"`
+}
+
+// A frame to send, the fields that are not used by its type are ignored
+type FrameDefinition struct {
+	Type      string         `yaml:"type"` // e.g. ping, stream, stop_sending or connection_close
+	StreamId  uint64         `yaml:"stream_id"`
+	Data      string         `yaml:"data"` // The data of a STREAM frame or of a PATH_CHALLENGE frame
+	Fin       bool           `yaml:"fin"`
+	Offset    uint64         `yaml:"offset"` // The final size of a RESET_STREAM frame
+	ErrorCode TransportError `yaml:"error_code"`
+	Reason    string         `yaml:"reason"`
+	Maximum   uint64         `yaml:"maximum"` // The limit of a MAX_* or *_BLOCKED frame
+	Uni       bool           `yaml:"uni"`     // Whether a MAX_STREAMS or STREAMS_BLOCKED frame is about unidirectional streams
+	Sequence  uint64         `yaml:"sequence"`
+	Token     string         `yaml:"token"`
+}
+
+// Sends a GET request for the URL, or for the URL of the host if not set. HTTP/0.9 requests are sent on the given
+// stream, HTTP/3 requests on the next stream available.
+type RequestStep struct {
+	URL      string `yaml:"url"`
+	StreamId uint64 `yaml:"stream_id"`
+}
+
+// Waits for a packet of the host matching the predicate. The packets received before the step are considered, except
+// those that were matched by a previous step.
+type WaitStep struct {
+	PacketPredicate `yaml:",inline"`
+	Timeout         time.Duration `yaml:"timeout"` // The remaining time of the scenario is used if not set
+	ErrorCode       uint8         `yaml:"error_code"`
+	Message         string        `yaml:"message"`
+}
+
+// Checks conditions on the packets received and on the streams, all the conditions set must hold
+type AssertStep struct {
+	Matched      *PacketPredicate `yaml:"matched"`       // The packet matched by the last wait step matches it
+	Received     *PacketPredicate `yaml:"received"`      // A packet matching it was received
+	NotReceived  *PacketPredicate `yaml:"not_received"`  // No packet matching it was received
+	StreamClosed *uint64          `yaml:"stream_closed"` // The host closed the stream, i.e. sent all its data
+	ErrorCode    uint8            `yaml:"error_code"`
+	Message      string           `yaml:"message"`
+}
+
+type Failure struct {
+	ErrorCode uint8  `yaml:"error_code"`
+	Message   string `yaml:"message"`
+}
+
+// Matches a packet by its type and by the frames it contains. The conditions on the frame apply to the same frame.
+type PacketPredicate struct {
+	Packet         string          `yaml:"packet"` // Either initial, handshake, 0rtt, 1rtt, retry or version_negotiation
+	Frame          string          `yaml:"frame"`  // e.g. ack, stream or connection_close
+	StreamId       *uint64         `yaml:"stream_id"`
+	Fin            *bool           `yaml:"fin"`
+	TransportError *TransportError `yaml:"transport_error"` // The error code of a CONNECTION_CLOSE frame
+}
+
+// A transport error code, it is written either as a number or as its name, e.g. STREAM_STATE_ERROR
+type TransportError uint64
+
+var transportErrors = map[string]TransportError{
+	"NO_ERROR":                  0x00,
+	"INTERNAL_ERROR":            0x01,
+	"CONNECTION_REFUSED":        0x02,
+	"FLOW_CONTROL_ERROR":        0x03,
+	"STREAM_LIMIT_ERROR":        0x04,
+	"STREAM_STATE_ERROR":        0x05,
+	"FINAL_SIZE_ERROR":          0x06,
+	"FRAME_ENCODING_ERROR":      0x07,
+	"TRANSPORT_PARAMETER_ERROR": 0x08,
+	"CONNECTION_ID_LIMIT_ERROR": 0x09,
+	"PROTOCOL_VIOLATION":        0x0a,
+	"INVALID_TOKEN":             0x0b,
+	"APPLICATION_ERROR":         0x0c,
+	"CRYPTO_BUFFER_EXCEEDED":    0x0d,
+	"KEY_UPDATE_ERROR":          0x0e,
+	"AEAD_LIMIT_REACHED":        0x0f,
+	"NO_VIABLE_PATH":            0x10,
+}
+
+func (e *TransportError) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var code uint64
+	if err := unmarshal(&code); err == nil {
+		*e = TransportError(code)
+		return nil
+	}
+	var name string
+	if err := unmarshal(&name); err != nil {
+		return err
+	}
+	named, ok := transportErrors[strings.ToUpper(name)]
+	if !ok {
+		return fmt.Errorf("unknown transport error %s", name)
+	}
+	*e = named
+	return nil
+}
+
+var encryptionLevels = map[string]qt.EncryptionLevel{
+	"initial":   qt.EncryptionLevelInitial,
+	"0rtt":      qt.EncryptionLevel0RTT,
+	"handshake": qt.EncryptionLevelHandshake,
+	"1rtt":      qt.EncryptionLevel1RTT,
+}
+
+var frameTypes = map[string]qt.FrameType{
+	"padding":              qt.PaddingFrameType,
+	"ping":                 qt.PingType,
+	"ack":                  qt.AckType,
+	"ack_ecn":              qt.AckECNType,
+	"reset_stream":         qt.ResetStreamType,
+	"stop_sending":         qt.StopSendingType,
+	"crypto":               qt.CryptoType,
+	"new_token":            qt.NewTokenType,
+	"stream":               qt.StreamType,
+	"max_data":             qt.MaxDataType,
+	"max_stream_data":      qt.MaxStreamDataType,
+	"max_streams":          qt.MaxStreamsType,
+	"data_blocked":         qt.DataBlockedType,
+	"stream_data_blocked":  qt.StreamDataBlockedType,
+	"streams_blocked":      qt.StreamsBlockedType,
+	"new_connection_id":    qt.NewConnectionIdType,
+	"retire_connection_id": qt.RetireConnectionIdType,
+	"path_challenge":       qt.PathChallengeType,
+	"path_response":        qt.PathResponseType,
+	"connection_close":     qt.ConnectionCloseType,
+	"application_close":    qt.ApplicationCloseType,
+	"handshake_done":       qt.HandshakeDoneType,
+}
+
+// These frames are built by the agents, a step cannot send them
+var unsendableFrames = map[string]bool{"ack": true, "ack_ecn": true, "crypto": true, "new_connection_id": true, "application_close": true}
+
+var definitionName = regexp.MustCompile("^[a-z0-9_]+$")
+
+// The scenarii defined in YAML that were registered, keyed by their names
+var definitions = make(map[string]*Definition)
+
+// Reads and validates the definition of a scenario in the YAML format
+func LoadDefinition(filename string) (*Definition, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	d := new(Definition)
+	if err := yaml.UnmarshalStrict(content, d); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	if d.Version == 0 {
+		d.Version = 1
+	}
+	if err := d.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	return d, nil
+}
+
+// Reads the definitions of a YAML file, or of the YAML files of a directory, and registers them so that they are
+// returned by GetAllScenarii(). It must be called before running the scenarii.
+func RegisterDefinitions(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	filenames := []string{path}
+	if info.IsDir() {
+		filenames = nil
+		for _, pattern := range []string{"*.yaml", "*.yml"} {
+			matches, _ := filepath.Glob(filepath.Join(path, pattern))
+			filenames = append(filenames, matches...)
+		}
+		sort.Strings(filenames)
+	}
+	for _, filename := range filenames {
+		d, err := LoadDefinition(filename)
+		if err != nil {
+			return err
+		}
+		if err := RegisterDefinition(d); err != nil {
+			return fmt.Errorf("%s: %s", filename, err.Error())
+		}
+	}
+	return nil
+}
+
+func RegisterDefinition(d *Definition) error {
+	if _, ok := metadata[d.Name]; ok {
+		return fmt.Errorf("the scenario %s already exists", d.Name)
+	}
+	if _, ok := definitions[d.Name]; ok {
+		return fmt.Errorf("the scenario %s is already defined", d.Name)
+	}
+	definitions[d.Name] = d
+	return nil
+}
+
+func (d *Definition) Metadata() *Metadata {
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	return &Metadata{Description: d.Description, RFCSections: d.RFCSections, Tags: d.Tags, ErrorCodes: d.ErrorCodes, Timeout: timeout}
+}
+
+func (d *Definition) Validate() error {
+	if !definitionName.MatchString(d.Name) {
+		return fmt.Errorf("invalid name %q, it must only contain lower case letters, digits and underscores", d.Name)
+	}
+	codes := make(map[uint8]bool)
+	for _, e := range d.ErrorCodes {
+		if e.Code == 0 || e.Code >= R_UnsupportedVersion || e.Name == "" {
+			return fmt.Errorf("invalid error code %d %q", e.Code, e.Name)
+		}
+		switch e.Severity {
+		case SeverityFailure, SeverityWarning, SeverityInconclusive:
+		default:
+			return fmt.Errorf("invalid severity %q of error code %d", e.Severity, e.Code)
+		}
+		if codes[e.Code] {
+			return fmt.Errorf("the error code %d is declared twice", e.Code)
+		}
+		codes[e.Code] = true
+	}
+	errorCode := func(code uint8) error {
+		if !codes[code] {
+			return fmt.Errorf("the error code %d is not declared", code)
+		}
+		return nil
+	}
+
+	if len(d.Steps) == 0 || d.Steps[0].Handshake == nil {
+		return errors.New("the first step must be a handshake")
+	}
+	for i, s := range d.Steps {
+		if err := s.validate(errorCode); err != nil {
+			return fmt.Errorf("step %d: %s", i+1, err.Error())
+		}
+	}
+	return nil
+}
+
+func (s Step) validate(errorCode func(uint8) error) error {
+	actions := 0
+	for _, set := range []bool{s.Handshake != nil, s.Send != nil, s.Request != nil, s.Wait != nil, s.Sleep > 0, s.Assert != nil, s.SetErrorCode != nil} {
+		if set {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return errors.New("a step must have exactly one action")
+	}
+	switch {
+	case s.Handshake != nil:
+		return errorCode(s.Handshake.ErrorCode)
+	case s.Send != nil:
+		if _, ok := encryptionLevels[s.Send.Level]; !ok && s.Send.Level != "" {
+			return fmt.Errorf("unknown encryption level %s", s.Send.Level)
+		}
+		if len(s.Send.Frames) == 0 {
+			return errors.New("no frame to send")
+		}
+		for _, f := range s.Send.Frames {
+			if _, ok := frameTypes[f.Type]; !ok || unsendableFrames[f.Type] {
+				return fmt.Errorf("%s frames cannot be sent", f.Type)
+			}
+		}
+	case s.Wait != nil:
+		if err := s.Wait.PacketPredicate.validate(); err != nil {
+			return err
+		}
+		return errorCode(s.Wait.ErrorCode)
+	case s.Assert != nil:
+		a := s.Assert
+		if a.Matched == nil && a.Received == nil && a.NotReceived == nil && a.StreamClosed == nil {
+			return errors.New("the assertion has no condition")
+		}
+		for _, p := range []*PacketPredicate{a.Matched, a.Received, a.NotReceived} {
+			if p != nil {
+				if err := p.validate(); err != nil {
+					return err
+				}
+			}
+		}
+		return errorCode(a.ErrorCode)
+	case s.SetErrorCode != nil:
+		return errorCode(s.SetErrorCode.ErrorCode)
+	}
+	return nil
+}
+
+func (p *PacketPredicate) validate() error {
+	if _, ok := encryptionLevels[p.Packet]; !ok && p.Packet != "" && p.Packet != "retry" && p.Packet != "version_negotiation" {
+		return fmt.Errorf("unknown packet type %s", p.Packet)
+	}
+	if _, ok := frameTypes[p.Frame]; !ok && p.Frame != "" {
+		return fmt.Errorf("unknown frame type %s", p.Frame)
+	}
+	if p.Frame == "" && (p.StreamId != nil || p.Fin != nil || p.TransportError != nil) {
+		return errors.New("the conditions on frames require a frame type")
+	}
+	if p.Fin != nil && p.Frame != "stream" {
+		return errors.New("the fin condition only applies to stream frames")
+	}
+	if p.TransportError != nil && p.Frame != "connection_close" {
+		return errors.New("the transport_error condition only applies to connection_close frames")
+	}
+	return nil
+}
+
+func (p *PacketPredicate) String() string {
+	var conditions []string
+	if p.Packet != "" {
+		conditions = append(conditions, "packet: "+p.Packet)
+	}
+	if p.Frame != "" {
+		conditions = append(conditions, "frame: "+p.Frame)
+	}
+	if p.StreamId != nil {
+		conditions = append(conditions, fmt.Sprintf("stream_id: %d", *p.StreamId))
+	}
+	if p.Fin != nil {
+		conditions = append(conditions, fmt.Sprintf("fin: %t", *p.Fin))
+	}
+	if p.TransportError != nil {
+		conditions = append(conditions, fmt.Sprintf("transport_error: 0x%x", uint64(*p.TransportError)))
+	}
+	return "{" + strings.Join(conditions, ", ") + "}"
+}
+
+func (p *PacketPredicate) Matches(packet qt.Packet) bool {
+	switch p.Packet {
+	case "":
+	case "retry":
+		if _, ok := packet.(*qt.RetryPacket); !ok {
+			return false
+		}
+	case "version_negotiation":
+		if _, ok := packet.(*qt.VersionNegotiationPacket); !ok {
+			return false
+		}
+	default:
+		if packet.EncryptionLevel() != encryptionLevels[p.Packet] {
+			return false
+		}
+	}
+	if p.Frame == "" {
+		return true
+	}
+	framer, ok := packet.(qt.Framer)
+	if !ok {
+		return false
+	}
+	for _, f := range framer.GetFrames() {
+		if p.matchesFrame(f) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PacketPredicate) matchesFrame(frame qt.Frame) bool {
+	frameType := frame.FrameType()
+	if frameType == qt.MaxStreamsType+1 || frameType == qt.StreamsBlockedType+1 {
+		frameType &= 0xfe // The unidirectional variants
+	}
+	if frameType != frameTypes[p.Frame] {
+		return false
+	}
+	if p.StreamId != nil {
+		var streamId uint64
+		switch f := frame.(type) {
+		case *qt.StreamFrame:
+			streamId = f.StreamId
+		case *qt.ResetStream:
+			streamId = f.StreamId
+		case *qt.StopSendingFrame:
+			streamId = f.StreamId
+		case *qt.MaxStreamDataFrame:
+			streamId = f.StreamId
+		case *qt.StreamDataBlockedFrame:
+			streamId = f.StreamId
+		default:
+			return false
+		}
+		if streamId != *p.StreamId {
+			return false
+		}
+	}
+	if f, ok := frame.(*qt.StreamFrame); ok && p.Fin != nil && f.FinBit != *p.Fin {
+		return false
+	}
+	if f, ok := frame.(*qt.ConnectionCloseFrame); ok && p.TransportError != nil && f.ErrorCode != uint64(*p.TransportError) {
+		return false
+	}
+	return true
+}
+
+func (f FrameDefinition) build(conn *qt.Connection) qt.Frame {
+	streamsType := qt.BidiStreams
+	if f.Uni {
+		streamsType = qt.UniStreams
+	}
+	var data [8]byte
+	copy(data[:], f.Data)
+	switch f.Type {
+	case "padding":
+		return new(qt.PaddingFrame)
+	case "ping":
+		return new(qt.PingFrame)
+	case "reset_stream":
+		return &qt.ResetStream{StreamId: f.StreamId, ApplicationErrorCode: uint64(f.ErrorCode), FinalOffset: f.Offset}
+	case "stop_sending":
+		return &qt.StopSendingFrame{StreamId: f.StreamId, ApplicationErrorCode: uint64(f.ErrorCode)}
+	case "new_token":
+		return &qt.NewTokenFrame{Token: []byte(f.Token)}
+	case "stream":
+		return qt.NewStreamFrame(f.StreamId, conn.Streams.Get(f.StreamId), []byte(f.Data), f.Fin)
+	case "max_data":
+		return &qt.MaxDataFrame{MaximumData: f.Maximum}
+	case "max_stream_data":
+		return &qt.MaxStreamDataFrame{StreamId: f.StreamId, MaximumStreamData: f.Maximum}
+	case "max_streams":
+		return &qt.MaxStreamsFrame{StreamsType: streamsType, MaximumStreams: f.Maximum}
+	case "data_blocked":
+		return &qt.DataBlockedFrame{DataLimit: f.Maximum}
+	case "stream_data_blocked":
+		return &qt.StreamDataBlockedFrame{StreamId: f.StreamId, StreamDataLimit: f.Maximum}
+	case "streams_blocked":
+		return &qt.StreamsBlockedFrame{StreamsType: streamsType, StreamLimit: f.Maximum}
+	case "retire_connection_id":
+		return &qt.RetireConnectionId{SequenceNumber: f.Sequence}
+	case "path_challenge":
+		return &qt.PathChallenge{Data: data}
+	case "path_response":
+		return &qt.PathResponse{Data: data}
+	case "connection_close":
+		return &qt.ConnectionCloseFrame{ErrorCode: uint64(f.ErrorCode), ReasonPhraseLength: uint64(len(f.Reason)), ReasonPhrase: f.Reason}
+	case "handshake_done":
+		return new(qt.HandshakeDoneFrame)
+	}
+	return nil
+}
+
+// Runs a scenario defined in YAML
+type DeclarativeScenario struct {
+	AbstractScenario
+	definition *Definition
+}
+
+func NewDeclarativeScenario(d *Definition) *DeclarativeScenario {
+	return &DeclarativeScenario{AbstractScenario{name: d.Name, version: d.Version, ipv6: d.IPv6, http3: d.HTTP3}, d}
+}
+
+func (s *DeclarativeScenario) Metadata() *Metadata {
+	return s.definition.Metadata()
+}
+
+// The state of a run of a declarative scenario
+type stepRunner struct {
+	scenario   *DeclarativeScenario
+	conn       *qt.Connection
+	trace      *qt.Trace
+	url        string
+	deadline   time.Time
+	connAgents *agents.ConnectionAgents
+	http       *agents.HTTPAgent
+	incoming   chan interface{}
+	received   []qt.Packet
+	cursor     int       // The index of the first packet received that can be matched by a wait step
+	matched    qt.Packet // The packet matched by the last wait step
+}
+
+func (s *DeclarativeScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
+	timeout := s.Metadata().Timeout
+	s.timeout = time.NewTimer(timeout)
+
+	r := &stepRunner{scenario: s, conn: conn, trace: trace, url: preferredUrl, deadline: time.Now().Add(timeout), incoming: make(chan interface{}, 1000)}
+	conn.IncomingPackets.Register(r.incoming)
+	defer func() {
+		if r.connAgents != nil {
+			r.connAgents.CloseConnection(false, 0, "")
+		}
+	}()
+
+	for i, step := range s.definition.Steps {
+		if debug {
+			conn.Logger.Printf("Running step %d of %s\n", i+1, s.definition.Name)
+		}
+		if !r.run(step) {
+			return
+		}
+	}
+}
+
+// Runs the step and returns whether the run should continue
+func (r *stepRunner) run(step Step) bool {
+	switch {
+	case step.Handshake != nil:
+		var additionalAgents []agents.Agent
+		if r.scenario.HTTP3() {
+			r.http = &agents.HTTPAgent{}
+			additionalAgents = append(additionalAgents, r.http)
+		}
+		r.connAgents = r.scenario.CompleteHandshake(r.conn, r.trace, step.Handshake.ErrorCode, additionalAgents...)
+		return r.connAgents != nil
+	case step.Send != nil:
+		level := qt.EncryptionLevel1RTT
+		if step.Send.Level != "" {
+			level = encryptionLevels[step.Send.Level]
+		}
+		for _, f := range step.Send.Frames {
+			r.conn.FrameQueue.Submit(qt.QueuedFrame{Frame: f.build(r.conn), EncryptionLevel: level})
+		}
+	case step.Request != nil:
+		url := step.Request.URL
+		if url == "" {
+			url = r.url
+		}
+		if r.http != nil {
+			r.http.SendRequest(url, "GET", r.trace.Host, nil)
+		} else {
+			r.conn.SendHTTPGETRequest(url, step.Request.StreamId)
+		}
+	case step.Wait != nil:
+		return r.wait(step.Wait)
+	case step.Sleep > 0:
+		r.collect(step.Sleep)
+	case step.Assert != nil:
+		return r.assert(step.Assert)
+	case step.SetErrorCode != nil:
+		r.trace.MarkError(step.SetErrorCode.ErrorCode, step.SetErrorCode.Message, nil)
+		return false
+	}
+	return true
+}
+
+func (r *stepRunner) wait(w *WaitStep) bool {
+	timeout := time.NewTimer(r.remaining(w.Timeout))
+	defer timeout.Stop()
+	for {
+		for ; r.cursor < len(r.received); r.cursor++ {
+			if p := r.received[r.cursor]; w.Matches(p) {
+				r.matched = p
+				r.cursor++
+				return true
+			}
+		}
+		select {
+		case i := <-r.incoming:
+			r.received = append(r.received, i.(qt.Packet))
+		case <-timeout.C:
+			return r.fail(w.ErrorCode, w.Message, fmt.Sprintf("no packet matching %s was received", w.PacketPredicate.String()), nil)
+		}
+	}
+}
+
+func (r *stepRunner) assert(a *AssertStep) bool {
+	r.collect(0)
+	if a.Matched != nil && (r.matched == nil || !a.Matched.Matches(r.matched)) {
+		return r.fail(a.ErrorCode, a.Message, fmt.Sprintf("the packet matched does not match %s", a.Matched.String()), r.matched)
+	}
+	if a.Received != nil && r.find(a.Received) == nil {
+		return r.fail(a.ErrorCode, a.Message, fmt.Sprintf("no packet matching %s was received", a.Received.String()), nil)
+	}
+	if a.NotReceived != nil {
+		if p := r.find(a.NotReceived); p != nil {
+			return r.fail(a.ErrorCode, a.Message, fmt.Sprintf("a packet matching %s was received", a.NotReceived.String()), p)
+		}
+	}
+	if a.StreamClosed != nil && !r.conn.Streams.Get(*a.StreamClosed).ReadClosed {
+		return r.fail(a.ErrorCode, a.Message, fmt.Sprintf("the stream %d was not closed", *a.StreamClosed), nil)
+	}
+	return true
+}
+
+func (r *stepRunner) fail(errorCode uint8, message string, defaultMessage string, packet qt.Packet) bool {
+	if message == "" {
+		message = defaultMessage
+	}
+	r.trace.MarkError(errorCode, message, packet)
+	return false
+}
+
+// Collects the packets received during the given duration, or those already received if it is zero
+func (r *stepRunner) collect(duration time.Duration) {
+	if duration == 0 {
+		for {
+			select {
+			case i := <-r.incoming:
+				r.received = append(r.received, i.(qt.Packet))
+			default:
+				return
+			}
+		}
+	}
+	timeout := time.NewTimer(r.remaining(duration))
+	defer timeout.Stop()
+	for {
+		select {
+		case i := <-r.incoming:
+			r.received = append(r.received, i.(qt.Packet))
+		case <-timeout.C:
+			return
+		}
+	}
+}
+
+func (r *stepRunner) find(p *PacketPredicate) qt.Packet {
+	for _, packet := range r.received {
+		if p.Matches(packet) {
+			return packet
+		}
+	}
+	return nil
+}
+
+// Returns the given duration, bounded by the time remaining before the timeout of the scenario
+func (r *stepRunner) remaining(d time.Duration) time.Duration {
+	remaining := time.Until(r.deadline)
+	if remaining < 0 {
+		return 0
+	}
+	if d > 0 && d < remaining {
+		return d
+	}
+	return remaining
+}
@@ -0,0 +1,85 @@
+package scenarii
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadDefinitions(t *testing.T) {
+	filenames, _ := filepath.Glob(filepath.Join("definitions", "*.yaml"))
+	if len(filenames) == 0 {
+		t.Fatal("no definition found")
+	}
+	for _, filename := range filenames {
+		d, err := LoadDefinition(filename)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if d.Name+".yaml" != filepath.Base(filename) {
+			t.Errorf("%s: the name %s does not match the file", filename, d.Name)
+		}
+		if _, ok := metadata[d.Name]; ok {
+			t.Errorf("%s: the scenario %s already exists", filename, d.Name)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "definitions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	header := "name: invalid\nerror_codes:\n  - {code: 1, name: TLSHandshakeFailed, severity: inconclusive}\nsteps:\n"
+	for _, invalid := range []string{
+		"name: Invalid\nsteps:\n  - handshake: {error_code: 1}\n",
+		header + "  - sleep: 1s\n",
+		header + "  - handshake: {error_code: 2}\n",
+		header + "  - handshake: {error_code: 1}\n  - send: {frames: [{type: ack}]}\n",
+		header + "  - handshake: {error_code: 1}\n  - send: {level: 2rtt, frames: [{type: ping}]}\n",
+		header + "  - handshake: {error_code: 1}\n  - wait: {frame: stream, transport_error: NO_ERROR, error_code: 1}\n",
+		header + "  - handshake: {error_code: 1}\n  - wait: {frame: connection_close, transport_error: NO_SUCH_ERROR, error_code: 1}\n",
+		header + "  - handshake: {error_code: 1}\n    sleep: 1s\n",
+		header + "  - handshake: {error_code: 1}\n  - assert: {error_code: 1}\n",
+		header + "  - handshake: {error_code: 1}\n  - shutdown: {}\n",
+	} {
+		filename := filepath.Join(dir, "invalid.yaml")
+		if err := ioutil.WriteFile(filename, []byte(invalid), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadDefinition(filename); err == nil {
+			t.Errorf("the invalid definition %q was loaded", invalid)
+		}
+	}
+}
+
+func TestTransportErrorNames(t *testing.T) {
+	content := "name: close\nerror_codes:\n  - {code: 1, name: TLSHandshakeFailed, severity: inconclusive}\nsteps:\n  - handshake: {error_code: 1}\n" +
+		"  - send: {frames: [{type: connection_close, error_code: protocol_violation}, {type: connection_close, error_code: 0x100}]}\n"
+	dir, err := ioutil.TempDir("", "definitions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "close.yaml")
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadDefinition(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := loaded.Steps[1].Send.Frames
+	if frames[0].ErrorCode != 0x0a || frames[1].ErrorCode != 0x100 {
+		t.Errorf("unexpected error codes %v", frames)
+	}
+	if loaded.Name != "close" || loaded.Version != 1 || loaded.Metadata().Timeout != DefaultTimeout {
+		t.Errorf("unexpected defaults %+v", loaded)
+	}
+	if err := RegisterDefinition(&Definition{Name: "handshake"}); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("a definition replaced a scenario: %v", err)
+	}
+}
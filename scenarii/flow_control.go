@@ -20,10 +20,10 @@ type FlowControlScenario struct {
 }
 
 func NewFlowControlScenario() *FlowControlScenario {
-	return &FlowControlScenario{AbstractScenario{name: "flow_control", version: 2}}
+	return &FlowControlScenario{AbstractScenario{name: "flow_control", version: 3}}
 }
 func (s *FlowControlScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
-	s.timeout = time.NewTimer(10 * time.Second)
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
 	conn.TLSTPHandler.MaxStreamDataBidiLocal = 80
 
 	connAgents := s.CompleteHandshake(conn, trace, FC_TLSHandshakeFailed)
@@ -34,10 +34,13 @@ func (s *FlowControlScenario) Run(conn *qt.Connection, trace *qt.Trace, preferre
 
 	incPackets := make(chan interface{}, 1000)
 	conn.IncomingPackets.Register(incPackets)
+	outPackets := make(chan interface{}, 1000)
+	conn.OutgoingPackets.Register(outPackets)
 
 	conn.SendHTTPGETRequest(preferredUrl, 0)
 
 	var shouldResume bool
+	var limitRaised, resumed time.Time  // The delay is measured from when the frame leaves, so that it doesn't depend on our pacing
 
 forLoop:
 	for {
@@ -54,6 +57,9 @@ forLoop:
 			}
 
 			readOffset := conn.Streams.Get(0).ReadOffset
+			if shouldResume && resumed.IsZero() && !limitRaised.IsZero() && readOffset > uint64(conn.TLSTPHandler.MaxStreamDataBidiLocal)/2 {
+				resumed = time.Now()
+			}
 			if readOffset == uint64(conn.TLSTPHandler.MaxStreamDataBidiLocal) && !shouldResume {
 				conn.TLSTPHandler.MaxData *= 2
 				conn.TLSTPHandler.MaxStreamDataBidiLocal *= 2
@@ -61,11 +67,19 @@ forLoop:
 				conn.FrameQueue.Submit(qt.QueuedFrame{qt.MaxStreamDataFrame{0, uint64(conn.TLSTPHandler.MaxStreamDataBidiLocal)}, qt.EncryptionLevel1RTT})
 				shouldResume = true
 			}
+			case i := <-outPackets:
+				if p, ok := i.(qt.Framer); ok && shouldResume && limitRaised.IsZero() && p.Contains(qt.MaxStreamDataType) {
+					limitRaised = time.Now()
+				}
 			case <-s.Timeout().C:
 				break forLoop
 		}
 	}
 
+	if !resumed.IsZero() {
+		trace.Results["resume_delay"] = resumed.Sub(limitRaised).Nanoseconds() / int64(time.Millisecond)
+	}
+
 	readOffset := conn.Streams.Get(0).ReadOffset
 	if readOffset == uint64(conn.TLSTPHandler.MaxStreamDataBidiLocal) {
 		trace.ErrorCode = 0
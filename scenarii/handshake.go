@@ -22,7 +22,7 @@ func NewHandshakeScenario() *HandshakeScenario {
 	return &HandshakeScenario{AbstractScenario{name: "handshake", version: 2}}
 }
 func (s *HandshakeScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
-	s.timeout = time.NewTimer(10 * time.Second)
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
 	connAgents := agents.AttachAgentsToConnection(conn, agents.GetDefaultAgents()...)
 	handshakeAgent := &agents.HandshakeAgent{TLSAgent: connAgents.Get("TLSAgent").(*agents.TLSAgent), SocketAgent: connAgents.Get("SocketAgent").(*agents.SocketAgent)}
 	connAgents.Add(handshakeAgent)
@@ -36,7 +36,9 @@ func (s *HandshakeScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredU
 		select {
 		case i := <-handshakeStatus:
 			status = i.(agents.HandshakeStatus)
-			if !status.Completed {
+			if _, ok := status.Error.(*qt.UnsupportedVersionError); ok {
+				trace.MarkError(R_UnsupportedVersion, status.Error.Error(), status.Packet)
+			} else if !status.Completed {
 				switch status.Error.Error() {
 				case "no appropriate version found":
 					trace.MarkError(H_NoCompatibleVersionAvailable, status.Error.Error(), status.Packet)
@@ -0,0 +1,135 @@
+package scenarii
+
+import (
+	"errors"
+	qt "github.com/RohitPanda/quic-tracker"
+	"github.com/RohitPanda/quic-tracker/agents"
+	"io"
+	"net"
+	"time"
+)
+
+// The delay between two connection attempts, see https://tools.ietf.org/html/rfc8305#section-5
+const ConnectionAttemptDelay = 250 * time.Millisecond
+
+// The outcome of a connection attempt of a race
+type Attempt struct {
+	Ip       string `json:"ip"`
+	Started  uint64 `json:"started"`            // The time at which the attempt started after the start of the race in milliseconds
+	Duration uint64 `json:"duration,omitempty"` // The duration of the handshake in milliseconds
+	Error    string `json:"error,omitempty"`
+	Won      bool   `json:"won"`
+}
+
+// Configures the connections of a race
+type RaceConfig struct {
+	ServerName string
+	ALPN       string
+	HTTP3      bool // Negotiates HTTP/3 rather than HTTP/0.9 when ALPN is not set
+	Version    uint32
+	LogOutput  io.Writer
+	Timeout    time.Duration
+}
+
+// Races handshakes with the addresses in their order, as described in https://tools.ietf.org/html/rfc8305#section-5.
+// A new attempt starts after ConnectionAttemptDelay or as soon as the previous one failed. The connections are closed
+// once the race is over. Returns the address of the first handshake completed and the outcome of each attempt.
+func RaceAddresses(addresses []*net.UDPAddr, config RaceConfig) (*net.UDPAddr, []Attempt, error) {
+	type outcome struct {
+		index int
+		err   error
+	}
+	outcomes := make(chan outcome, len(addresses))
+	stop := make(chan bool)
+	defer close(stop)
+
+	start := time.Now()
+	attempts := make([]Attempt, 0, len(addresses))
+	startAttempt := func() {
+		i := len(attempts)
+		attempts = append(attempts, Attempt{Ip: addresses[i].IP.String(), Started: uint64(time.Now().Sub(start).Seconds() * 1000)})
+		go func() {
+			outcomes <- outcome{i, attemptHandshake(addresses[i], config, stop)}
+		}()
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	timeout := time.After(config.Timeout)
+	pending := 0
+	for {
+		select {
+		case <-timer.C:
+			if len(attempts) < len(addresses) {
+				startAttempt()
+				pending++
+				timer.Reset(ConnectionAttemptDelay)
+			}
+		case o := <-outcomes:
+			pending--
+			a := &attempts[o.index]
+			a.Duration = uint64(time.Now().Sub(start).Seconds()*1000) - a.Started
+			if o.err == nil {
+				a.Won = true
+				return addresses[o.index], attempts, nil
+			}
+			a.Error = o.err.Error()
+			if len(attempts) < len(addresses) {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				startAttempt()
+				pending++
+				timer.Reset(ConnectionAttemptDelay)
+			} else if pending == 0 {
+				return nil, attempts, errors.New("no handshake completed")
+			}
+		case <-timeout:
+			return nil, attempts, errors.New("no handshake completed before the timeout")
+		}
+	}
+}
+
+func attemptHandshake(address *net.UDPAddr, config RaceConfig, stop chan bool) error {
+	conn, err := qt.NewDefaultConnection(address.String(), config.ServerName, nil, address.IP.To4() == nil, config.HTTP3, config.Version, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if config.ALPN != "" {
+		if err := conn.TransitionTo(conn.Version, config.ALPN); err != nil {
+			return err
+		}
+	}
+	if config.LogOutput != nil {
+		conn.SetLogOutput(config.LogOutput)
+	}
+
+	connAgents := agents.AttachAgentsToConnection(conn, agents.GetDefaultAgents()...)
+	handshakeAgent := &agents.HandshakeAgent{TLSAgent: connAgents.Get("TLSAgent").(*agents.TLSAgent), SocketAgent: connAgents.Get("SocketAgent").(*agents.SocketAgent)}
+	connAgents.Add(handshakeAgent)
+
+	handshakeStatus := make(chan interface{}, 10)
+	handshakeAgent.HandshakeStatus.Register(handshakeStatus)
+	handshakeAgent.InitiateHandshake()
+
+	select {
+	case i := <-handshakeStatus:
+		status := i.(agents.HandshakeStatus)
+		if !status.Completed {
+			connAgents.StopAll()
+			if status.Error == nil {
+				return errors.New("the handshake failed")
+			}
+			return status.Error
+		}
+		connAgents.CloseConnection(false, 0, "")
+		return nil
+	case <-stop:
+		connAgents.StopAll()
+		return errors.New("the race is over")
+	}
+}
@@ -4,7 +4,7 @@ import (
 	qt "github.com/RohitPanda/quic-tracker"
 	"github.com/RohitPanda/quic-tracker/agents"
 	"github.com/RohitPanda/quic-tracker/http3"
-	"github.com/mpiraux/ls-qpack-go"
+	"github.com/RohitPanda/quic-tracker/qpack"
 	"time"
 )
 
@@ -23,10 +23,10 @@ func NewHTTP3EncoderStreamScenario() *HTTP3EncoderStreamScenario {
 	return &HTTP3EncoderStreamScenario{AbstractScenario{name: "http3_encoder_stream", version: 1, http3: true}}
 }
 func (s *HTTP3EncoderStreamScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
-	s.timeout = time.NewTimer(10 * time.Second)
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
 	conn.TLSTPHandler.MaxUniStreams = 3
 
-	http := agents.HTTPAgent{QPACKEncoderOpts: ls_qpack_go.LSQPackEncOptIxAggr}
+	http := agents.HTTPAgent{QPACKEncoderOpts: qpack.EncoderOptIndexAggressively}
 	connAgents := s.CompleteHandshake(conn, trace, H3ES_TLSHandshakeFailed, &http)
 	if connAgents == nil {
 		return
@@ -46,6 +46,27 @@ func (s *HTTP3EncoderStreamScenario) Run(conn *qt.Connection, trace *qt.Trace, p
 	responseReceived := make(chan interface{}, 1000)
 	http.HTTPResponseReceived.Register(responseReceived)
 
+	instructionReceived := make(chan interface{}, 1000)
+	http.QPACK.InstructionReceived.Register(instructionReceived)
+	var encoderInstructions, decoderInstructions []string
+	defer func() { // Records what the peer wrote on its encoder and decoder streams
+		for {
+			select {
+			case i := <-instructionReceived:
+				switch instruction := i.(agents.QPACKInstruction).Instruction.(type) {
+				case *qpack.SectionAcknowledgment, *qpack.StreamCancellation, *qpack.InsertCountIncrement:
+					decoderInstructions = append(decoderInstructions, instruction.String())
+				default:
+					encoderInstructions = append(encoderInstructions, instruction.String())
+				}
+			default:
+				trace.Results["peer_encoder_instructions"] = encoderInstructions
+				trace.Results["peer_decoder_instructions"] = decoderInstructions
+				return
+			}
+		}
+	}()
+
 forLoop:
 	for {
 		select {
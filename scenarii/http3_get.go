@@ -20,9 +20,12 @@ func NewHTTP3GETScenario() *HTTP3GETScenario {
 	return &HTTP3GETScenario{AbstractScenario{name: "http3_get", version: 1, http3: true}}
 }
 func (s *HTTP3GETScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
-	s.timeout = time.NewTimer(10 * time.Second)
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
 	conn.TLSTPHandler.MaxUniStreams = 3
-	conn.TransitionTo(qt.QuicVersion, qt.QuicH3ALPNToken)
+	if err := conn.TransitionTo(conn.Version, conn.VersionProfile.H3ALPN); err != nil {
+		trace.MarkError(R_UnsupportedVersion, err.Error(), nil)
+		return
+	}
 
 	http := agents.HTTPAgent{}
 	connAgents := s.CompleteHandshake(conn, trace, H3G_TLSHandshakeFailed, &http)
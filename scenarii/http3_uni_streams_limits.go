@@ -21,7 +21,7 @@ func NewHTTP3UniStreamsLimitsScenario() *HTTP3UniStreamsLimitsScenario {
 	return &HTTP3UniStreamsLimitsScenario{AbstractScenario{name: "http3_uni_streams_limits", version: 1, http3: true}}
 }
 func (s *HTTP3UniStreamsLimitsScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
-	s.timeout = time.NewTimer(10 * time.Second)
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
 	conn.TLSTPHandler.MaxUniStreams = 1
 
 	http := agents.HTTPAgent{}
@@ -25,11 +25,11 @@ type SimpleGetAndWaitScenario struct {
 }
 
 func NewSimpleGetAndWaitScenario() *SimpleGetAndWaitScenario {
-	return &SimpleGetAndWaitScenario{AbstractScenario{name: "http_get_and_wait", version: 1}}
+	return &SimpleGetAndWaitScenario{AbstractScenario{name: "http_get_and_wait", version: 2}}
 }
 
 func (s *SimpleGetAndWaitScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
-	s.timeout = time.NewTimer(10 * time.Second)
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
 	conn.TLSTPHandler.MaxBidiStreams = 0
 	conn.TLSTPHandler.MaxUniStreams = 0
 
@@ -46,10 +46,13 @@ func (s *SimpleGetAndWaitScenario) Run(conn *qt.Connection, trace *qt.Trace, pre
 	errors := make(map[uint8]string)
 	incomingPackets := make(chan interface{}, 1000)
 	conn.IncomingPackets.Register(incomingPackets)
+	outgoingPackets := make(chan interface{}, 1000)
+	conn.OutgoingPackets.Register(outgoingPackets)
 
 	conn.SendHTTPGETRequest(preferredUrl, 0)
 
 	var connectionCloseReceived bool
+	var requestSent, firstByteReceived, lastByteReceived time.Time  // Timings start when the request leaves, so that they don't depend on our pacing
 
 forLoop:
 	for {
@@ -60,6 +63,12 @@ forLoop:
 				for _, f := range p.GetFrames() {
 					switch f := f.(type) {
 					case *qt.StreamFrame:
+						if f.StreamId == 0 && !requestSent.IsZero() {
+							if firstByteReceived.IsZero() {
+								firstByteReceived = time.Now()
+							}
+							lastByteReceived = time.Now()
+						}
 						if f.StreamId != 0 {
 							errors[SGW_WrongStreamIDReceived] = fmt.Sprintf("received StreamID %d", f.StreamId)
 							trace.MarkError(SGW_WrongStreamIDReceived, "", p)
@@ -73,11 +82,21 @@ forLoop:
 					}
 				}
 			}
+		case i := <-outgoingPackets:
+			if p, ok := i.(*qt.ProtectedPacket); ok && requestSent.IsZero() && p.Contains(qt.StreamType) {
+				requestSent = time.Now()
+			}
 		case <-s.Timeout().C:
 			break forLoop
 		}
 	}
 
+	trace.Results["bytes_received"] = conn.Streams.Get(0).ReadOffset
+	if !firstByteReceived.IsZero() {
+		trace.Results["time_to_first_byte"] = firstByteReceived.Sub(requestSent).Nanoseconds() / int64(time.Millisecond)
+		trace.Results["response_duration"] = lastByteReceived.Sub(firstByteReceived).Nanoseconds() / int64(time.Millisecond)
+	}
+
 	if conn.TLSTPHandler.ReceivedParameters.MaxBidiStreams == 0 {
 		if conn.Streams.Get(0).ReadOffset > 0 {
 			errors[SGW_AnsweredOnUnannouncedStream] = "data was received on stream 0 despite not being announced in TP"
@@ -0,0 +1,187 @@
+package scenarii
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	qt "github.com/RohitPanda/quic-tracker"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultPort = 443
+	DefaultURL  = "/index.html"
+)
+
+// A host of the inventory the scenarii are run against
+type Host struct {
+	Address  string   `json:"address" yaml:"address"`             // A hostname or an IP address, without port
+	SNI      string   `json:"sni,omitempty" yaml:"sni"`           // The server name to indicate, defaults to the address
+	Ports    []int    `json:"ports,omitempty" yaml:"ports"`       // The scenarii are run against each port, defaults to 443
+	Versions []string `json:"versions,omitempty" yaml:"versions"` // The versions supported by the host, the first one is used, e.g. v1 or draft-17
+	ALPNs    []string `json:"alpns,omitempty" yaml:"alpns"`       // The ALPN tokens supported by the host, e.g. hq-interop or h3
+	URLs     []string `json:"urls,omitempty" yaml:"urls"`         // The URLs to request, the first one is used by the scenarii
+	Tags     []string `json:"tags,omitempty" yaml:"tags"`
+	Skip     []string `json:"skip,omitempty" yaml:"skip"` // The names of the scenarii not to run against the host
+}
+
+// The hosts the scenarii are run against
+type Inventory struct {
+	Hosts []Host `json:"hosts" yaml:"hosts"`
+}
+
+// Reads an inventory in the YAML or JSON format, depending on the extension of the file. Other files are read as
+// tab-separated lines of host and URL, e.g. "quic.example.org:4433	/index.html".
+func LoadInventory(filename string) (*Inventory, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	inventory := new(Inventory)
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		err = json.Unmarshal(content, inventory)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(content, inventory)
+	default:
+		inventory, err = readTSVInventory(filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	for i, h := range inventory.Hosts {
+		if err := h.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: host %d: %s", filename, i+1, err.Error())
+		}
+	}
+	return inventory, nil
+}
+
+func readTSVInventory(filename string) (*Inventory, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	inventory := new(Inventory)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.Split(scanner.Text(), "\t")
+		if strings.TrimSpace(line[0]) == "" {
+			continue
+		}
+		h := Host{Address: line[0]}
+		if address, port, err := net.SplitHostPort(line[0]); err == nil {
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port in %s", line[0])
+			}
+			h.Address, h.Ports = address, []int{p}
+		}
+		if len(line) > 1 && line[1] != "" {
+			h.URLs = []string{line[1]}
+		}
+		inventory.Hosts = append(inventory.Hosts, h)
+	}
+	return inventory, scanner.Err()
+}
+
+func (h Host) Validate() error {
+	if h.Address == "" {
+		return errors.New("the address is missing")
+	}
+	for _, p := range h.Ports {
+		if p <= 0 || p > 65535 {
+			return fmt.Errorf("invalid port %d", p)
+		}
+	}
+	for _, v := range h.Versions {
+		if _, err := qt.ParseVersion(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the address and port pairs to run the scenarii against, e.g. [2001:db8::1]:443
+func (h Host) Targets() []string {
+	ports := h.Ports
+	if len(ports) == 0 {
+		ports = []int{DefaultPort}
+	}
+	var targets []string
+	for _, p := range ports {
+		targets = append(targets, net.JoinHostPort(h.Address, strconv.Itoa(p)))
+	}
+	return targets
+}
+
+// Returns the server name to indicate, which is empty for IP addresses unless the SNI is set, see
+// https://tools.ietf.org/html/rfc6066#section-3
+func (h Host) ServerName() string {
+	if h.SNI != "" {
+		return h.SNI
+	}
+	if net.ParseIP(h.Address) != nil {
+		return ""
+	}
+	return h.Address
+}
+
+func (h Host) URL() string {
+	if len(h.URLs) > 0 {
+		return h.URLs[0]
+	}
+	return DefaultURL
+}
+
+// Returns the first version supported by the host, or the given one when none is listed
+func (h Host) Version(defaultVersion string) string {
+	if len(h.Versions) > 0 {
+		return h.Versions[0]
+	}
+	return defaultVersion
+}
+
+// Returns the ALPN token of the host for HTTP/3 or for HTTP/0.9. It is empty when the host lists no ALPN, the default
+// token of the version should then be used. The host does not support the application when ok is false.
+func (h Host) ALPN(http3 bool) (alpn string, ok bool) {
+	if len(h.ALPNs) == 0 {
+		return "", true
+	}
+	for _, a := range h.ALPNs {
+		if strings.HasPrefix(a, "h3") == http3 {
+			return a, true
+		}
+	}
+	return "", false
+}
+
+func (h Host) Skips(scenario string) bool {
+	for _, s := range h.Skip {
+		if s == scenario {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the host has one of the tags
+func (h Host) HasTag(tags ...string) bool {
+	for _, t := range h.Tags {
+		for _, tag := range tags {
+			if t == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
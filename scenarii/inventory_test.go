@@ -0,0 +1,87 @@
+package scenarii
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeInventory(t *testing.T, dir string, name string, content string) string {
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	yamlInventory := `
+hosts:
+  - address: 2001:db8::1
+    sni: quic.example.org
+    ports: [443, 4433]
+    versions: [v2, v1]
+    alpns: [h3, hq-interop]
+    urls: [/large.html]
+    tags: [ietf]
+    skip: [zero_rtt]
+  - address: quic.example.com
+`
+	jsonInventory := `{"hosts": [{"address": "2001:db8::1", "sni": "quic.example.org", "ports": [443, 4433], "versions": ["v2", "v1"],
+		"alpns": ["h3", "hq-interop"], "urls": ["/large.html"], "tags": ["ietf"], "skip": ["zero_rtt"]}, {"address": "quic.example.com"}]}`
+	for _, filename := range []string{writeInventory(t, dir, "hosts.yaml", yamlInventory), writeInventory(t, dir, "hosts.json", jsonInventory)} {
+		inventory, err := LoadInventory(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(inventory.Hosts) != 2 {
+			t.Fatalf("%s: expected two hosts, got %v", filename, inventory.Hosts)
+		}
+		h := inventory.Hosts[0]
+		if targets := h.Targets(); !reflect.DeepEqual(targets, []string{"[2001:db8::1]:443", "[2001:db8::1]:4433"}) {
+			t.Errorf("%s: unexpected targets %v", filename, targets)
+		}
+		if h.ServerName() != "quic.example.org" || h.URL() != "/large.html" || h.Version("v1") != "v2" || !h.HasTag("ietf") || !h.Skips("zero_rtt") {
+			t.Errorf("%s: unexpected host %+v", filename, h)
+		}
+		if alpn, ok := h.ALPN(true); alpn != "h3" || !ok {
+			t.Errorf("%s: unexpected HTTP/3 ALPN %s", filename, alpn)
+		}
+		if alpn, ok := h.ALPN(false); alpn != "hq-interop" || !ok {
+			t.Errorf("%s: unexpected HTTP/0.9 ALPN %s", filename, alpn)
+		}
+		h = inventory.Hosts[1]
+		if targets := h.Targets(); !reflect.DeepEqual(targets, []string{"quic.example.com:443"}) || h.ServerName() != "quic.example.com" || h.URL() != DefaultURL {
+			t.Errorf("%s: unexpected defaults for host %+v", filename, h)
+		}
+	}
+
+	for _, address := range []string{"192.0.2.1", "2001:db8::1"} {
+		if name := (Host{Address: address}).ServerName(); name != "" {
+			t.Errorf("the server name %s is indicated for the IP address %s", name, address)
+		}
+	}
+
+	inventory, err := LoadInventory(writeInventory(t, dir, "hosts.txt", "quic.example.org:4433\t/index.html\n[2001:db8::1]:443\t/large.html\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Host{{Address: "quic.example.org", Ports: []int{4433}, URLs: []string{"/index.html"}}, {Address: "2001:db8::1", Ports: []int{443}, URLs: []string{"/large.html"}}}
+	if !reflect.DeepEqual(inventory.Hosts, expected) {
+		t.Errorf("expected %+v, got %+v", expected, inventory.Hosts)
+	}
+
+	for _, invalid := range []string{"hosts:\n  - sni: quic.example.org\n", "hosts:\n  - address: quic.example.org\n    versions: [v42]\n", "hosts:\n  - address: quic.example.org\n    port: 443\n"} {
+		if _, err := LoadInventory(writeInventory(t, dir, "invalid.yaml", invalid)); err == nil {
+			t.Errorf("the invalid inventory %q was loaded", invalid)
+		}
+	}
+}
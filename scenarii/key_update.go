@@ -2,7 +2,6 @@ package scenarii
 
 import (
 	qt "github.com/RohitPanda/quic-tracker"
-	"github.com/mpiraux/pigotls"
 	"time"
 )
 
@@ -19,7 +18,7 @@ func NewKeyUpdateScenario() *KeyUpdateScenario {
 	return &KeyUpdateScenario{AbstractScenario{name: "key_update", version: 1}}
 }
 func (s *KeyUpdateScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
-	s.timeout = time.NewTimer(10 * time.Second)
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
 
 	connAgents := s.CompleteHandshake(conn, trace, KU_TLSHandshakeFailed)
 	if connAgents == nil {
@@ -30,16 +29,7 @@ func (s *KeyUpdateScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredU
 	incPackets := make(chan interface{}, 1000)
 	conn.IncomingPackets.Register(incPackets)
 
-	// TODO: Move this to crypto.go
-	readSecret := conn.Tls.HkdfExpandLabel(conn.Tls.ProtectedReadSecret(), "traffic upd", nil, conn.Tls.HashDigestSize(), pigotls.BaseLabel)
-	writeSecret := conn.Tls.HkdfExpandLabel(conn.Tls.ProtectedWriteSecret(), "traffic upd", nil, conn.Tls.HashDigestSize(), pigotls.BaseLabel)
-
-	oldState := conn.CryptoStates[qt.EncryptionLevel1RTT]
-
-	conn.CryptoStates[qt.EncryptionLevel1RTT] = qt.NewProtectedCryptoState(conn.Tls, readSecret, writeSecret)
-	conn.CryptoStates[qt.EncryptionLevel1RTT].HeaderRead = oldState.HeaderRead
-	conn.CryptoStates[qt.EncryptionLevel1RTT].HeaderWrite = oldState.HeaderWrite
-	conn.KeyPhaseIndex++
+	conn.UpdateKeys()
 
 	conn.SendHTTPGETRequest(preferredUrl, 0)
 
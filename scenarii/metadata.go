@@ -0,0 +1,417 @@
+package scenarii
+
+import (
+	"time"
+)
+
+// The tags of the scenarii, see the -tags and -exclude-tags flags of the test suite
+const (
+	TagTransport = "transport" // The scenario tests the QUIC transport
+	TagHandshake = "handshake" // The scenario tests the handshake itself
+	TagTLS       = "tls"
+	TagH3        = "h3"
+	Tag0RTT      = "0rtt"
+	TagMigration = "migration" // The scenario tests the connection IDs or the migration of the connection
+	TagIPv6      = "ipv6"
+	TagVersion   = "version" // The scenario tests the negotiation of the version
+)
+
+// The severity of an error code
+type Severity string
+
+const (
+	SeverityFailure      Severity = "failure"      // The host does not behave as specified
+	SeverityWarning      Severity = "warning"      // The host lacks an optional feature or does not follow a recommendation
+	SeverityInconclusive Severity = "inconclusive" // The host could not be tested, e.g. because the handshake failed
+	SeverityError        Severity = "error"        // The run did not complete, see the R_ error codes
+)
+
+// The default time after which a scenario stops waiting for the host
+const DefaultTimeout = 10 * time.Second
+
+type ErrorCode struct {
+	Code     uint8    `json:"code" yaml:"code"`
+	Name     string   `json:"name" yaml:"name"` // The name of its constant without the prefix of the scenario, an underscore separates adjacent acronyms
+	Severity Severity `json:"severity" yaml:"severity"`
+}
+
+// Describes what a scenario tests and how its error codes should be read
+type Metadata struct {
+	Description string        `json:"description"`
+	RFCSections []string      `json:"rfc_sections"` // The sections exercised, e.g. "RFC 9000 §9"
+	Tags        []string      `json:"tags"`
+	ErrorCodes  []ErrorCode   `json:"error_codes"`
+	Timeout     time.Duration `json:"timeout"`
+}
+
+// Returns the error code with the given value, the error codes of RunScenario are included
+func (m *Metadata) ErrorCode(code uint8) (ErrorCode, bool) {
+	for _, e := range m.ErrorCodes {
+		if e.Code == code {
+			return e, true
+		}
+	}
+	for _, e := range runErrorCodes {
+		if e.Code == code {
+			return e, true
+		}
+	}
+	return ErrorCode{Code: code, Severity: SeverityFailure}, false
+}
+
+// Returns whether the scenario has one of the tags
+func (m *Metadata) HasTag(tags ...string) bool {
+	for _, t := range m.Tags {
+		for _, tag := range tags {
+			if t == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The error codes set by RunScenario, they are shared by all the scenarii
+var runErrorCodes = []ErrorCode{
+	{R_UnsupportedVersion, "UnsupportedVersion", SeverityInconclusive},
+	{R_DeadlineExceeded, "DeadlineExceeded", SeverityError},
+	{R_Crashed, "Crashed", SeverityError},
+	{R_UDPError, "UDPError", SeverityError},
+}
+
+// Returns the metadata of the scenario with the given name, as it appears in the traces, including the scenarii defined
+// in YAML that were registered. A scenario that is not registered has no description nor error codes.
+func ScenarioMetadata(name string) *Metadata {
+	if m, ok := metadata[name]; ok {
+		return m
+	}
+	if d, ok := definitions[name]; ok {
+		return d.Metadata()
+	}
+	return &Metadata{Timeout: DefaultTimeout}
+}
+
+var handshakeErrorCodes = []ErrorCode{
+	{H_ReceivedUnexpectedPacketType, "ReceivedUnexpectedPacketType", SeverityFailure},
+	{H_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityFailure},
+	{H_NoCompatibleVersionAvailable, "NoCompatibleVersionAvailable", SeverityInconclusive},
+	{H_Timeout, "Timeout", SeverityFailure},
+}
+
+// The metadata of the scenarii keyed by their names. It must be completed when adding a scenario or an error code.
+var metadata = map[string]*Metadata{
+	"ack_ecn": {
+		Description: "Marks the packets sent with ECT(0) and checks that the host reports the ECN counts in its ACK frames.",
+		RFCSections: []string{"RFC 9000 §13.4", "RFC 9000 §19.3.2"},
+		Tags:        []string{TagTransport},
+		ErrorCodes: []ErrorCode{
+			{AE_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{AE_FailedToSetECN, "FailedToSetECN", SeverityInconclusive},
+			{AE_NonECN, "NonECN", SeverityWarning},
+			{AE_NoACKECNReceived, "NoACK_ECNReceived", SeverityWarning},
+			{AE_NonECNButACKECN, "NonECNButACK_ECN", SeverityFailure},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"ack_only": {
+		Description: "Acknowledges each packet of the host in an ACK-only packet and checks that the host does not acknowledge them, as they are not ack-eliciting.",
+		RFCSections: []string{"RFC 9000 §13.2.1"},
+		Tags:        []string{TagTransport},
+		ErrorCodes: []ErrorCode{
+			{AO_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{AO_SentAOInResponseOfAO, "SentAOInResponseOfAO", SeverityFailure},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"address_validation": {
+		Description: "Starts a handshake without acknowledging the packets of the host and checks that it respects the anti-amplification limit before validating the address.",
+		RFCSections: []string{"RFC 9000 §8.1"},
+		Tags:        []string{TagTransport, TagHandshake},
+		ErrorCodes: []ErrorCode{
+			{AV_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{AV_SentMoreThan3Datagrams, "SentMoreThan3Datagrams", SeverityFailure},
+			{AV_SentMoreThan3TimesAmount, "SentMoreThan3TimesAmount", SeverityFailure},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"chacha20": {
+		Description: "Allows only TLS_CHACHA20_POLY1305_SHA256 and checks that the host completes the handshake with it. The host is not tested when the TLS provider offers all the cipher suites and the host selects another one.",
+		RFCSections: []string{"RFC 9001 §5.3", "RFC 9001 §5.4.4"},
+		Tags:        []string{TagTransport, TagHandshake, TagTLS},
+		ErrorCodes: []ErrorCode{
+			{CH_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityFailure},
+			{CH_CipherSuitesNotConfigurable, "CipherSuitesNotConfigurable", SeverityInconclusive},
+			{CH_WrongCipherSuiteNegotiated, "WrongCipherSuiteNegotiated", SeverityFailure},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"connection_migration": {
+		Description: "Migrates the connection to a new UDP port and checks that the host validates the new path and continues the connection on it.",
+		RFCSections: []string{"RFC 9000 §9", "RFC 9000 §8.2"},
+		Tags:        []string{TagTransport, TagMigration},
+		ErrorCodes: []ErrorCode{
+			{CM_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{CM_UDPConnectionFailed, "UDPConnectionFailed", SeverityInconclusive},
+			{CM_HostDidNotMigrate, "HostDidNotMigrate", SeverityFailure},
+			{CM_HostDidNotValidateNewPath, "HostDidNotValidateNewPath", SeverityFailure},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"flow_control": {
+		Description: "Advertises small flow control limits and checks that the host respects them and resumes sending once they are raised.",
+		RFCSections: []string{"RFC 9000 §4"},
+		Tags:        []string{TagTransport},
+		ErrorCodes: []ErrorCode{
+			{FC_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{FC_HostSentMoreThanLimit, "HostSentMoreThanLimit", SeverityFailure},
+			{FC_HostDidNotResumeSending, "HostDidNotResumeSending", SeverityFailure},
+			{FC_NotEnoughDataAvailable, "NotEnoughDataAvailable", SeverityInconclusive},
+			{FC_RespectedLimitsButNoBlocked, "RespectedLimitsButNoBlocked", SeverityWarning},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"handshake": {
+		Description: "Completes a handshake with the host.",
+		RFCSections: []string{"RFC 9000 §7", "RFC 9001 §4"},
+		Tags:        []string{TagTransport, TagHandshake},
+		ErrorCodes:  handshakeErrorCodes,
+		Timeout:     DefaultTimeout,
+	},
+	"handshake_v6": {
+		Description: "Completes a handshake with the host over IPv6.",
+		RFCSections: []string{"RFC 9000 §7", "RFC 9001 §4"},
+		Tags:        []string{TagTransport, TagHandshake, TagIPv6},
+		ErrorCodes:  handshakeErrorCodes,
+		Timeout:     DefaultTimeout,
+	},
+	"http3_encoder_stream": {
+		Description: "Opens the QPACK encoder stream, sends a request whose headers reference the dynamic table and checks that the host answers it.",
+		RFCSections: []string{"RFC 9204 §4.2", "RFC 9114 §6.2"},
+		Tags:        []string{TagH3},
+		ErrorCodes: []ErrorCode{
+			{H3ES_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{H3ES_RequestTimeout, "RequestTimeout", SeverityFailure},
+			{H3ES_NotEnoughStreamsAvailable, "NotEnoughStreamsAvailable", SeverityInconclusive},
+			{H3ES_SETTINGSNotSent, "SETTINGSNotSent", SeverityFailure},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"http3_get": {
+		Description: "Sends an HTTP/3 GET request and checks that the host answers it.",
+		RFCSections: []string{"RFC 9114 §4"},
+		Tags:        []string{TagH3},
+		ErrorCodes: []ErrorCode{
+			{H3G_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{H3G_RequestTimeout, "RequestTimeout", SeverityFailure},
+			{H3G_NotEnoughStreamsAvailable, "NotEnoughStreamsAvailable", SeverityInconclusive},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"http3_uni_streams_limits": {
+		Description: "Allows a single unidirectional stream and checks that the host answers an HTTP/3 request without opening more of them.",
+		RFCSections: []string{"RFC 9114 §6.2", "RFC 9000 §4.6"},
+		Tags:        []string{TagH3},
+		ErrorCodes: []ErrorCode{
+			{H3USFC_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{H3USFC_RequestTimeout, "RequestTimeout", SeverityFailure},
+			{H3USFC_NotEnoughStreamsAvailable, "NotEnoughStreamsAvailable", SeverityInconclusive},
+			{H3USFC_StreamIDError, "StreamIDError", SeverityFailure},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"http_get_and_wait": {
+		Description: "Sends an HTTP/0.9 GET request, checks the response and that the host closes the connection once idle.",
+		RFCSections: []string{"RFC 9000 §2", "RFC 9000 §10.1"},
+		Tags:        []string{TagTransport},
+		ErrorCodes: []ErrorCode{
+			{SGW_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{SGW_EmptyStreamFrameNoFinBit, "EmptyStreamFrameNoFinBit", SeverityFailure},
+			{SGW_RetransmittedAck, "RetransmittedAck", SeverityWarning},
+			{SGW_WrongStreamIDReceived, "WrongStreamIDReceived", SeverityFailure},
+			{SGW_UnknownError, "UnknownError", SeverityFailure},
+			{SGW_DidNotCloseTheConnection, "DidNotCloseTheConnection", SeverityFailure},
+			{SGW_MultipleErrors, "MultipleErrors", SeverityFailure},
+			{SGW_TooLowStreamIdBidiToSendRequest, "TooLowStreamIdBidiToSendRequest", SeverityInconclusive},
+			{SGW_DidntReceiveTheRequestedData, "DidntReceiveTheRequestedData", SeverityFailure},
+			{SGW_AnsweredOnUnannouncedStream, "AnsweredOnUnannouncedStream", SeverityFailure},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"http_get_on_uni_stream": {
+		Description: "Sends an HTTP/0.9 GET request on a client-initiated unidirectional stream and checks that the host does not answer it.",
+		RFCSections: []string{"RFC 9000 §2.1", "RFC 9000 §19.8"},
+		Tags:        []string{TagTransport},
+		ErrorCodes: []ErrorCode{
+			{GS2_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{GS2_TooLowStreamIdUniToSendRequest, "TooLowStreamIdUniToSendRequest", SeverityInconclusive},
+			{GS2_ReceivedDataOnStream2, "ReceivedDataOnStream2", SeverityFailure},
+			{GS2_ReceivedDataOnUnauthorizedStream, "ReceivedDataOnUnauthorizedStream", SeverityFailure},
+			{GS2_AnswersToARequestOnAForbiddenStreamID, "AnswersToARequestOnAForbiddenStreamID", SeverityFailure},
+			{GS2_DidNotCloseTheConnection, "DidNotCloseTheConnection", SeverityWarning},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"key_update": {
+		Description: "Updates the 1-RTT keys and checks that the host keeps answering with the new keys.",
+		RFCSections: []string{"RFC 9001 §6"},
+		Tags:        []string{TagTransport, TagTLS},
+		ErrorCodes: []ErrorCode{
+			{KU_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{KU_HostDidNotRespond, "HostDidNotRespond", SeverityFailure},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"multi_stream": {
+		Description: "Sends requests on several streams at once and checks that the host answers and closes each of them.",
+		RFCSections: []string{"RFC 9000 §2", "RFC 9000 §4.6"},
+		Tags:        []string{TagTransport},
+		ErrorCodes: []ErrorCode{
+			{MS_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{MS_NoTPReceived, "NoTPReceived", SeverityInconclusive},
+			{MS_NotAllStreamsWereClosed, "NotAllStreamsWereClosed", SeverityFailure},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"new_connection_id": {
+		Description: "Provides new connection IDs to the host, switches to those it provided and checks that it follows.",
+		RFCSections: []string{"RFC 9000 §5.1", "RFC 9000 §19.15"},
+		Tags:        []string{TagTransport, TagMigration},
+		ErrorCodes: []ErrorCode{
+			{NCI_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{NCI_HostDidNotProvideCID, "HostDidNotProvideCID", SeverityInconclusive},
+			{NCI_HostDidNotAnswerToNewCID, "HostDidNotAnswerToNewCID", SeverityFailure},
+			{NCI_HostDidNotAdaptCID, "HostDidNotAdaptCID", SeverityFailure},
+			{NCI_HostSentInvalidCIDLength, "HostSentInvalidCIDLength", SeverityFailure},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"padding": {
+		Description: "Sends an Initial packet containing only padding and checks that the host does not answer it.",
+		RFCSections: []string{"RFC 9000 §14.1", "RFC 9000 §12.4"},
+		Tags:        []string{TagTransport, TagHandshake},
+		ErrorCodes: []ErrorCode{
+			{P_VNDidNotComplete, "VNDidNotComplete", SeverityInconclusive},
+			{P_ReceivedSmth, "ReceivedSmth", SeverityFailure},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"pmtud": {
+		Description: "Discovers the largest datagram the host accepts with DPLPMTUD probes.",
+		RFCSections: []string{"RFC 9000 §14.3", "RFC 8899"},
+		Tags:        []string{TagTransport},
+		ErrorCodes: []ErrorCode{
+			{PM_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{PM_SearchDidNotComplete, "SearchDidNotComplete", SeverityWarning},
+			{PM_NoProbeAcknowledged, "NoProbeAcknowledged", SeverityWarning},
+		},
+		Timeout: 20 * time.Second,
+	},
+	"retire_connection_id": {
+		Description: "Retires the connection IDs provided by the host and checks that it provides new ones.",
+		RFCSections: []string{"RFC 9000 §5.1.2", "RFC 9000 §19.16"},
+		Tags:        []string{TagTransport, TagMigration},
+		ErrorCodes: []ErrorCode{
+			{RCI_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{RCI_HostDidNotProvideCID, "HostDidNotProvideCID", SeverityInconclusive},
+			{RCI_HostDidNotProvideNewCID, "HostDidNotProvideNewCID", SeverityFailure},
+			{RCI_HostSentInvalidCIDLength, "HostSentInvalidCIDLength", SeverityFailure},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"retry_integrity": {
+		Description: "Checks that the Retry packets sent by the host carry a valid integrity tag.",
+		RFCSections: []string{"RFC 9001 §5.8", "RFC 9000 §17.2.5"},
+		Tags:        []string{TagTransport, TagHandshake},
+		ErrorCodes: []ErrorCode{
+			{RI_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{RI_NoRetryReceived, "NoRetryReceived", SeverityInconclusive},
+			{RI_InvalidRetry, "InvalidRetry", SeverityFailure},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"stop_sending_frame_on_receive_stream": {
+		Description: "Sends a STOP_SENDING frame on a receive-only stream and checks that the host closes the connection with a STREAM_STATE_ERROR.",
+		RFCSections: []string{"RFC 9000 §3.5", "RFC 9000 §19.5"},
+		Tags:        []string{TagTransport},
+		ErrorCodes: []ErrorCode{
+			{SSRS_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{SSRS_DidNotCloseTheConnection, "DidNotCloseTheConnection", SeverityFailure},
+			{SSRS_CloseTheConnectionWithWrongError, "CloseTheConnectionWithWrongError", SeverityFailure},
+			{SSRS_MaxStreamUniTooLow, "MaxStreamUniTooLow", SeverityInconclusive},
+			{SSRS_UnknownError, "UnknownError", SeverityFailure},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"stream_opening_reordering": {
+		Description: "Sends the end of a request before its data and checks that the host reorders them and answers it.",
+		RFCSections: []string{"RFC 9000 §2.2", "RFC 9000 §3.2"},
+		Tags:        []string{TagTransport},
+		ErrorCodes: []ErrorCode{
+			{SOR_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{SOR_HostDidNotRespond, "HostDidNotRespond", SeverityFailure},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"transport_parameters": {
+		Description: "Completes a handshake and records the transport parameters of the host.",
+		RFCSections: []string{"RFC 9000 §7.4", "RFC 9000 §18"},
+		Tags:        []string{TagTransport, TagHandshake},
+		ErrorCodes: []ErrorCode{
+			{TP_NoTPReceived, "NoTPReceived", SeverityFailure},
+			{TP_TPResentAfterVN, "TPResentAfterVN", SeverityFailure},
+			{TP_HandshakeDidNotComplete, "HandshakeDidNotComplete", SeverityInconclusive},
+			{TP_MissingParameters, "MissingParameters", SeverityWarning},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"unsupported_tls_version": {
+		Description: "Offers only an unsupported TLS version and checks that the host closes the connection with the corresponding error.",
+		RFCSections: []string{"RFC 9001 §4.2", "RFC 9001 §4.8"},
+		Tags:        []string{TagTransport, TagHandshake, TagTLS},
+		ErrorCodes: []ErrorCode{
+			{UTS_NoConnectionCloseSent, "NoConnectionCloseSent", SeverityFailure},
+			{UTS_WrongErrorCodeIsUsed, "WrongErrorCodeIsUsed", SeverityFailure},
+			{UTS_VNDidNotComplete, "VNDidNotComplete", SeverityInconclusive},
+			{UTS_ReceivedUnexpectedPacketType, "ReceivedUnexpectedPacketType", SeverityFailure},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"version_negotiation": {
+		Description: "Offers a reserved version and checks the Version Negotiation packet sent by the host.",
+		RFCSections: []string{"RFC 9000 §6", "RFC 8999 §6"},
+		Tags:        []string{TagTransport, TagVersion},
+		ErrorCodes: []ErrorCode{
+			{VN_NotAnsweringToVN, "NotAnsweringToVN", SeverityFailure},
+			{VN_DidNotEchoVersion, "DidNotEchoVersion", SeverityWarning},
+			{VN_LastTwoVersionsAreActuallySeal, "LastTwoVersionsAreActuallySeal", SeverityFailure},
+			{VN_Timeout, "Timeout", SeverityFailure},
+			{VN_UnusedFieldIsIdentical, "UnusedFieldIsIdentical", SeverityWarning},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"version_upgrade": {
+		Description: "Offers an upgrade from QUIC v1 to QUIC v2 using compatible version negotiation and checks how the host handles it.",
+		RFCSections: []string{"RFC 9368", "RFC 9369"},
+		Tags:        []string{TagTransport, TagVersion},
+		ErrorCodes: []ErrorCode{
+			{VU_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{VU_UpgradeIgnored, "UpgradeIgnored", SeverityWarning},
+			{VU_NoVersionInformation, "NoVersionInformation", SeverityWarning},
+			{VU_VersionInformationMismatch, "VersionInformationMismatch", SeverityFailure},
+			{VU_HostDidNotRespondAfterUpgrade, "HostDidNotRespondAfterUpgrade", SeverityFailure},
+		},
+		Timeout: DefaultTimeout,
+	},
+	"zero_rtt": {
+		Description: "Resumes a first connection with a request sent in 0-RTT packets and checks that the host answers it.",
+		RFCSections: []string{"RFC 9001 §4.6", "RFC 9000 §7.4.1"},
+		Tags:        []string{TagTransport, Tag0RTT},
+		ErrorCodes: []ErrorCode{
+			{ZR_TLSHandshakeFailed, "TLSHandshakeFailed", SeverityInconclusive},
+			{ZR_NoResumptionSecret, "NoResumptionSecret", SeverityInconclusive},
+			{ZR_ZeroRTTFailed, "ZeroRTTFailed", SeverityFailure},
+			{ZR_DidntReceiveTheRequestedData, "DidntReceiveTheRequestedData", SeverityFailure},
+		},
+		Timeout: DefaultTimeout,
+	},
+}
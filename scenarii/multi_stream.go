@@ -22,7 +22,7 @@ func NewMultiStreamScenario() *MultiStreamScenario {
 	return &MultiStreamScenario{AbstractScenario{name: "multi_stream", version: 1}}
 }
 func (s *MultiStreamScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
-	s.timeout = time.NewTimer(10 * time.Second)
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
 	conn.TLSTPHandler.MaxData = 1024 * 1024
 	conn.TLSTPHandler.MaxStreamDataBidiLocal = 1024 * 1024 / 10
 
@@ -20,7 +20,7 @@ func NewPaddingScenario() *PaddingScenario {
 	return &PaddingScenario{AbstractScenario{name: "padding", version: 1}}
 }
 func (s *PaddingScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
-	s.timeout = time.NewTimer(10 * time.Second)
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
 	connAgents := agents.AttachAgentsToConnection(conn, agents.GetDefaultAgents()...)
 	defer connAgents.StopAll()
 
@@ -52,6 +52,10 @@ func (s *PaddingScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl
 		packet := i.(qt.Packet)
 		if vn, ok := packet.(*qt.VersionNegotiationPacket); ok {
 			if err := conn.ProcessVersionNegotation(vn); err != nil {
+				if _, ok := err.(*qt.UnsupportedVersionError); ok {
+					trace.MarkError(R_UnsupportedVersion, err.Error(), vn)
+					return
+				}
 				trace.MarkError(P_VNDidNotComplete, err.Error(), vn)
 				return
 			}
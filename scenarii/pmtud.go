@@ -0,0 +1,76 @@
+package scenarii
+
+import (
+	qt "github.com/RohitPanda/quic-tracker"
+	"github.com/RohitPanda/quic-tracker/agents"
+	"time"
+)
+
+const (
+	PM_TLSHandshakeFailed   = 1
+	PM_SearchDidNotComplete = 2
+	PM_NoProbeAcknowledged  = 3
+)
+
+// Discovers the largest datagram the host accepts using DPLPMTUD probes, bounded by its max_udp_payload_size. Hosts
+// that acknowledge none of the probes larger than the base PLPMTU of 1200 bytes are reported. See
+// https://tools.ietf.org/html/rfc9000#section-14.3
+type PMTUDScenario struct {
+	AbstractScenario
+}
+
+func NewPMTUDScenario() *PMTUDScenario {
+	return &PMTUDScenario{AbstractScenario{name: "pmtud", version: 1}}
+}
+func (s *PMTUDScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
+
+	connAgents := s.CompleteHandshake(conn, trace, PM_TLSHandshakeFailed)
+	if connAgents == nil {
+		return
+	}
+	defer connAgents.CloseConnection(false, 0, "")
+
+	pmtudAgent := &agents.PMTUDAgent{
+		SocketAgent:   connAgents.Get("SocketAgent").(*agents.SocketAgent),
+		SendingAgent:  connAgents.Get("SendingAgent").(*agents.SendingAgent),
+		RecoveryAgent: connAgents.Get("RecoveryAgent").(*agents.RecoveryAgent),
+	}
+	connAgents.Add(pmtudAgent)
+
+	status := make(chan interface{}, 10)
+	pmtudAgent.Status.Register(status)
+
+	if tp := conn.TLSTPHandler.ReceivedParameters; tp != nil && tp.MaxPacketSize > 0 {
+		trace.Results["max_udp_payload_size"] = tp.MaxPacketSize
+	}
+
+	searchComplete := false
+forLoop:
+	for {
+		select {
+		case i := <-status:
+			st := i.(agents.PMTUDStatus)
+			if st.BlackHole {
+				trace.Results["black_hole_detected"] = true
+			}
+			if st.SearchComplete {
+				searchComplete = true
+				break forLoop
+			}
+		case <-s.Timeout().C:
+			break forLoop
+		}
+	}
+	pmtudAgent.Stop()
+	pmtudAgent.Join()
+
+	trace.Results["max_accepted_size"] = pmtudAgent.PLPMTU
+	trace.Results["probed_sizes"] = pmtudAgent.ProbedSizes
+
+	if !searchComplete {
+		trace.MarkError(PM_SearchDidNotComplete, "", nil)
+	} else if len(pmtudAgent.ProbedSizes) > 0 && pmtudAgent.PLPMTU == pmtudAgent.BasePLPMTU {
+		trace.MarkError(PM_NoProbeAcknowledged, "", nil)
+	}
+}
@@ -0,0 +1,349 @@
+package scenarii
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	qt "github.com/RohitPanda/quic-tracker"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// The formats of the reports of a test suite
+const (
+	FormatJSON     = "json"
+	FormatJUnit    = "junit"
+	FormatMarkdown = "markdown"
+	FormatHTML     = "html"
+)
+
+// A host×scenario pair of a report
+type TestCase struct {
+	Scenario  string
+	Host      string // The host, followed by the IP when the scenario ran against several of its addresses
+	ErrorCode uint8
+	Verdict   string
+	Severity  Severity // The severity of the error code, it is empty when the scenario succeeded
+	Message   string   // Explains the failure, it is empty when the scenario succeeded
+	Duration  uint64   // In milliseconds
+	Metadata  *Metadata
+	trace     *qt.Trace
+}
+
+func (c TestCase) Passed() bool {
+	return c.ErrorCode == 0
+}
+
+// Returns either "passed" or the severity of the error code
+func (c TestCase) Result() string {
+	if c.Passed() {
+		return "passed"
+	}
+	return string(c.Severity)
+}
+
+// Returns the test cases of the traces in their order
+func TestCases(traces []qt.Trace) []TestCase {
+	addresses := make(map[string]map[string]bool)
+	for _, t := range traces {
+		key := t.Scenario + " " + t.Host
+		if addresses[key] == nil {
+			addresses[key] = make(map[string]bool)
+		}
+		addresses[key][t.Ip] = true
+	}
+
+	var cases []TestCase
+	for i := range traces {
+		t := &traces[i]
+		c := TestCase{
+			Scenario:  t.Scenario,
+			Host:      t.Host,
+			ErrorCode: t.ErrorCode,
+			Verdict:   Verdict(t.Scenario, t.ErrorCode),
+			Duration:  t.Duration,
+			Metadata:  ScenarioMetadata(t.Scenario),
+			trace:     t,
+		}
+		if len(addresses[t.Scenario+" "+t.Host]) > 1 {
+			c.Host = fmt.Sprintf("%s (%s)", t.Host, t.Ip)
+		}
+		if !c.Passed() {
+			c.Severity = VerdictSeverity(t.Scenario, t.ErrorCode)
+			c.Message = failureMessage(t, c.Verdict)
+		}
+		cases = append(cases, c)
+	}
+	return cases
+}
+
+// Returns the error reported in the results of the trace, or the verdict when there is none
+func failureMessage(trace *qt.Trace, verdict string) string {
+	for _, key := range []string{"error", "crash", "udp_error"} {
+		if v, ok := trace.Results[key]; ok && v != nil {
+			if s, ok := v.(string); ok {
+				return s
+			}
+			return fmt.Sprint(v)
+		}
+	}
+	return verdict
+}
+
+// Reads a test suite results file, which contains an array of traces, or the single trace output by scenario_runner.
+// The traces are read from stdin when the filename is "-".
+func ReadTraces(filename string) ([]qt.Trace, error) {
+	var content []byte
+	var err error
+	if filename == "-" {
+		content, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		content, err = ioutil.ReadFile(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	content = bytes.TrimSpace(content)
+
+	var traces []qt.Trace
+	if len(content) > 0 && content[0] == '{' {
+		var trace qt.Trace
+		err = json.Unmarshal(content, &trace)
+		traces = append(traces, trace)
+	} else {
+		err = json.Unmarshal(content, &traces)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	return traces, nil
+}
+
+// Writes a report of the traces in the given format
+func WriteReport(w io.Writer, format string, traces []qt.Trace) error {
+	switch format {
+	case FormatJSON:
+		return json.NewEncoder(w).Encode(traces)
+	case FormatJUnit:
+		return WriteJUnit(w, traces)
+	case FormatMarkdown:
+		return WriteMarkdown(w, traces)
+	case FormatHTML:
+		return WriteHTML(w, traces)
+	}
+	return fmt.Errorf("unknown report format %s", format)
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Errors     int             `xml:"errors,attr"`
+	Skipped    int             `xml:"skipped,attr"`
+	Time       string          `xml:"time,attr"`
+	Properties []junitProperty `xml:"properties>property,omitempty"`
+	Cases      []junitTestCase `xml:"testcase"`
+	duration   uint64
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+	Skipped   *junitFailure `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Content string `xml:",chardata"`
+}
+
+func junitTime(duration uint64) string {
+	return fmt.Sprintf("%.3f", float64(duration)/1000)
+}
+
+// Writes the traces as a JUnit XML report, with a test suite per scenario and a test case per host. The runs that did
+// not complete are reported as errors, the inconclusive ones as skipped and the other scenarii that did not succeed as
+// failures. The metadata of each scenario is reported in the properties of its test suite.
+func WriteJUnit(w io.Writer, traces []qt.Trace) error {
+	report := junitTestSuites{}
+	suites := make(map[string]int)
+	for _, c := range TestCases(traces) {
+		i, ok := suites[c.Scenario]
+		if !ok {
+			i = len(report.Suites)
+			suites[c.Scenario] = i
+			report.Suites = append(report.Suites, junitTestSuite{Name: c.Scenario, Properties: junitProperties(c.Metadata)})
+		}
+		suite := &report.Suites[i]
+		testCase := junitTestCase{Name: c.Host, ClassName: c.Scenario, Time: junitTime(c.Duration)}
+		if !c.Passed() {
+			failure := &junitFailure{Message: c.Message, Type: c.Verdict, Content: fmt.Sprintf("%s (error code %d)", c.Verdict, c.ErrorCode)}
+			switch c.Severity {
+			case SeverityError:
+				if stackTrace, ok := c.trace.Results["stack_trace"].(string); ok {
+					failure.Content += "\n" + stackTrace
+				}
+				testCase.Error = failure
+				suite.Errors++
+				report.Errors++
+			case SeverityInconclusive:
+				testCase.Skipped = failure
+				suite.Skipped++
+				report.Skipped++
+			default:
+				testCase.Failure = failure
+				suite.Failures++
+				report.Failures++
+			}
+		}
+		suite.Cases = append(suite.Cases, testCase)
+		suite.Tests++
+		suite.duration += c.Duration
+		suite.Time = junitTime(suite.duration)
+		report.Tests++
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func junitProperties(m *Metadata) []junitProperty {
+	var properties []junitProperty
+	if m.Description != "" {
+		properties = append(properties, junitProperty{"description", m.Description})
+	}
+	if len(m.RFCSections) > 0 {
+		properties = append(properties, junitProperty{"rfc_sections", strings.Join(m.RFCSections, ", ")})
+	}
+	if len(m.Tags) > 0 {
+		properties = append(properties, junitProperty{"tags", strings.Join(m.Tags, ", ")})
+	}
+	return properties
+}
+
+// Returns the scenarii of the test cases in their order, with their metadata
+func reportScenarii(cases []TestCase) []TestCase {
+	seen := make(map[string]bool)
+	var scenarii []TestCase
+	for _, c := range cases {
+		if !seen[c.Scenario] {
+			seen[c.Scenario] = true
+			scenarii = append(scenarii, c)
+		}
+	}
+	return scenarii
+}
+
+var markdownResults = map[string]string{
+	"passed":                     "✅ passed",
+	string(SeverityFailure):      "❌ failure",
+	string(SeverityWarning):      "⚠️ warning",
+	string(SeverityInconclusive): "➖ inconclusive",
+	string(SeverityError):        "💥 error",
+}
+
+// Writes the traces as a Markdown table with a row per host×scenario pair, followed by the descriptions of the
+// scenarii
+func WriteMarkdown(w io.Writer, traces []qt.Trace) error {
+	escape := strings.NewReplacer("|", "\\|", "\n", " ", "\r", "")
+	cases := TestCases(traces)
+	passed := 0
+	for _, c := range cases {
+		if c.Passed() {
+			passed++
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# QUIC-Tracker test suite\n\n%d of %d runs succeeded.\n\n", passed, len(cases))
+	b.WriteString("| Scenario | Host | Result | Verdict | Message | Duration (ms) |\n")
+	b.WriteString("|---|---|---|---|---|---:|\n")
+	for _, c := range cases {
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %d |\n", escape.Replace(c.Scenario), escape.Replace(c.Host), markdownResults[c.Result()], escape.Replace(c.Verdict), escape.Replace(c.Message), c.Duration)
+	}
+	b.WriteString("\n## Scenarii\n\n")
+	b.WriteString("| Scenario | Description | RFC sections | Tags |\n")
+	b.WriteString("|---|---|---|---|\n")
+	for _, c := range reportScenarii(cases) {
+		fmt.Fprintf(&b, "| %s | %s | %s | %s |\n", escape.Replace(c.Scenario), escape.Replace(c.Metadata.Description), strings.Join(c.Metadata.RFCSections, ", "), strings.Join(c.Metadata.Tags, ", "))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var htmlReport = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>QUIC-Tracker test suite</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+tr.passed td.result { background: #d4edda; }
+tr.failure td.result, tr.error td.result { background: #f8d7da; }
+tr.warning td.result { background: #fff3cd; }
+tr.inconclusive td.result { background: #e2e3e5; }
+</style>
+</head>
+<body>
+<h1>QUIC-Tracker test suite</h1>
+<p>{{.Passed}} of {{len .Cases}} runs succeeded.</p>
+<table>
+<tr><th>Scenario</th><th>Host</th><th>Result</th><th>Verdict</th><th>Message</th><th>Duration (ms)</th></tr>
+{{range .Cases}}<tr class="{{.Result}}"><td title="{{.Metadata.Description}}">{{.Scenario}}</td><td>{{.Host}}</td><td class="result">{{.Result}}</td><td>{{.Verdict}}</td><td>{{.Message}}</td><td>{{.Duration}}</td></tr>
+{{end}}</table>
+<h2>Scenarii</h2>
+<table>
+<tr><th>Scenario</th><th>Description</th><th>RFC sections</th><th>Tags</th></tr>
+{{range .Scenarii}}<tr><td>{{.Scenario}}</td><td>{{.Metadata.Description}}</td><td>{{range $i, $s := .Metadata.RFCSections}}{{if $i}}, {{end}}{{$s}}{{end}}</td><td>{{range $i, $t := .Metadata.Tags}}{{if $i}}, {{end}}{{$t}}{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// Writes the traces as an HTML page with a row per host×scenario pair, followed by the descriptions of the scenarii
+func WriteHTML(w io.Writer, traces []qt.Trace) error {
+	cases := TestCases(traces)
+	passed := 0
+	for _, c := range cases {
+		if c.Passed() {
+			passed++
+		}
+	}
+	return htmlReport.Execute(w, struct {
+		Passed   int
+		Cases    []TestCase
+		Scenarii []TestCase
+	}{passed, cases, reportScenarii(cases)})
+}
@@ -0,0 +1,83 @@
+package scenarii
+
+import (
+	"bytes"
+	"encoding/xml"
+	qt "github.com/RohitPanda/quic-tracker"
+	"strings"
+	"testing"
+)
+
+func TestVerdict(t *testing.T) {
+	for _, c := range []struct {
+		scenario  string
+		errorCode uint8
+		expected  string
+	}{
+		{"zero_rtt", 0, "Success"},
+		{"zero_rtt", ZR_ZeroRTTFailed, "Zero RTT failed"},
+		{"connection_migration", CM_HostDidNotMigrate, "Host did not migrate"},
+		{"handshake_v6", H_TLSHandshakeFailed, "TLS handshake failed"},
+		{"ack_ecn", AE_NoACKECNReceived, "No ACK ECN received"},
+		{"ack_ecn", AE_NonECNButACKECN, "Non ECN but ACK ECN"},
+		{"flow_control", R_Crashed, "Crashed"},
+		{"flow_control", 42, "Error code 42"},
+	} {
+		if v := Verdict(c.scenario, c.errorCode); v != c.expected {
+			t.Errorf("%s %d: expected %q, got %q", c.scenario, c.errorCode, c.expected, v)
+		}
+	}
+}
+
+func TestScenariiMetadata(t *testing.T) {
+	for id, scenario := range GetAllScenarii() {
+		m, ok := metadata[scenario.Name()]
+		if !ok {
+			t.Errorf("%s: the metadata is not registered", id)
+			continue
+		}
+		if m.Description == "" || len(m.RFCSections) == 0 || len(m.Tags) == 0 || len(m.ErrorCodes) == 0 || m.Timeout == 0 {
+			t.Errorf("%s: incomplete metadata %+v", id, m)
+		}
+		codes := make(map[uint8]bool)
+		for _, e := range m.ErrorCodes {
+			if codes[e.Code] || e.Code == 0 || e.Name == "" || e.Severity == "" {
+				t.Errorf("%s: invalid error code %+v", id, e)
+			}
+			codes[e.Code] = true
+		}
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	traces := []qt.Trace{
+		{Scenario: "connection_migration", Host: "quic.example.org:443", ErrorCode: CM_HostDidNotMigrate, Results: map[string]interface{}{"error": "no packet on the new path"}},
+		{Scenario: "connection_migration", Host: "quic.example.com:443", Results: map[string]interface{}{}},
+		{Scenario: "connection_migration", Host: "quic.example.net:443", ErrorCode: CM_TLSHandshakeFailed, Results: map[string]interface{}{}},
+		{Scenario: "zero_rtt", Host: "quic.example.org:443", ErrorCode: R_Crashed, Results: map[string]interface{}{"crash": "boom", "stack_trace": "goroutine 1"}},
+	}
+	buffer := new(bytes.Buffer)
+	if err := WriteJUnit(buffer, traces); err != nil {
+		t.Fatal(err)
+	}
+	var report junitTestSuites
+	if err := xml.Unmarshal(buffer.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Tests != 4 || report.Failures != 1 || report.Errors != 1 || report.Skipped != 1 || len(report.Suites) != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	failure := report.Suites[0].Cases[0].Failure
+	if failure == nil || failure.Message != "no packet on the new path" || failure.Type != "Host did not migrate" {
+		t.Errorf("unexpected failure %+v", failure)
+	}
+	if skipped := report.Suites[0].Cases[2].Skipped; skipped == nil || skipped.Type != "TLS handshake failed" {
+		t.Errorf("unexpected skipped test case %+v", skipped)
+	}
+	if len(report.Suites[0].Properties) != 3 {
+		t.Errorf("unexpected properties %+v", report.Suites[0].Properties)
+	}
+	if e := report.Suites[1].Cases[0].Error; e == nil || e.Message != "boom" || !strings.Contains(e.Content, "goroutine 1") {
+		t.Errorf("unexpected error %+v", e)
+	}
+}
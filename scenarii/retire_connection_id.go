@@ -23,7 +23,7 @@ func NewRetireConnectionIDScenario() *RetireConnectionIDScenario {
 	return &RetireConnectionIDScenario{AbstractScenario{name: "retire_connection_id", version: 1}}
 }
 func (s *RetireConnectionIDScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
-	s.timeout = time.NewTimer(10 * time.Second)
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
 
 	incPackets := make(chan interface{}, 1000)
 	conn.IncomingPackets.Register(incPackets)
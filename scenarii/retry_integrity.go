@@ -0,0 +1,59 @@
+package scenarii
+
+import (
+	qt "github.com/RohitPanda/quic-tracker"
+	"time"
+)
+
+const (
+	RI_TLSHandshakeFailed = 1
+	RI_NoRetryReceived    = 2
+	RI_InvalidRetry       = 3
+)
+
+// Checks that the Retry packets sent by the host carry a valid integrity tag, or a matching ODCID in draft versions.
+// Hosts that do not send Retry packets cannot be graded. See https://tools.ietf.org/html/rfc9001#section-5.8
+type RetryIntegrityScenario struct {
+	AbstractScenario
+}
+
+func NewRetryIntegrityScenario() *RetryIntegrityScenario {
+	return &RetryIntegrityScenario{AbstractScenario{name: "retry_integrity", version: 1}}
+}
+func (s *RetryIntegrityScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
+
+	incPackets := make(chan interface{}, 1000)
+	conn.IncomingPackets.Register(incPackets)
+
+	connAgents := s.CompleteHandshake(conn, trace, RI_TLSHandshakeFailed)
+	rejectedRetries := conn.RejectedRetries()
+	if len(rejectedRetries) > 0 {  // An invalid Retry is likely to be the cause of a failed handshake
+		r := rejectedRetries[0]
+		trace.Results["retry_received"] = true
+		trace.MarkError(RI_InvalidRetry, r.Reason, r.Packet)
+	}
+	if connAgents == nil {
+		return
+	}
+	defer connAgents.CloseConnection(false, 0, "")
+
+	if len(rejectedRetries) > 0 {
+		return
+	}
+
+	for {
+		select {
+		case i := <-incPackets:
+			if p, ok := i.(*qt.RetryPacket); ok {
+				trace.Results["retry_received"] = true
+				trace.Results["integrity_tag"] = p.RetryIntegrityTag
+				return
+			}
+		default:
+			trace.Results["retry_received"] = false
+			trace.ErrorCode = RI_NoRetryReceived
+			return
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package scenarii
+
+import (
+	"fmt"
+	qt "github.com/RohitPanda/quic-tracker"
+	"github.com/RohitPanda/quic-tracker/proxy"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"time"
+)
+
+// The error codes of the traces of runs that did not complete
+const (
+	R_UnsupportedVersion = 252 // The version of the run or the one negotiated with the host cannot be used
+	R_DeadlineExceeded   = 253
+	R_Crashed            = 254
+	R_UDPError           = 255
+)
+
+const DefaultRunDeadline = time.Minute
+
+// Configures a run of a scenario against a host
+type RunConfig struct {
+	URL        string
+	SNI        string // The server name to indicate, defaults to the hostname of the host unless it is an IP address
+	ALPN       string // Replaces the ALPN token of the version when set
+	Debug      bool
+	Version    uint32
+	Impairment *proxy.Profile // The path is not impaired if not set
+	KeyLog     io.Writer      // The TLS secrets are appended to it in the NSS key log format when set
+	LogOutput  io.Writer      // The logs of the run are written to it, or to os.Stderr if not set
+	Deadline   time.Duration  // The run is abandoned after it, DefaultRunDeadline is used if not set
+
+	Address       *net.UDPAddr // The address to connect to, the host is resolved if not set
+	RaceAddresses bool         // Selects the address by racing handshakes with the addresses of the host when Address is not set
+
+	CongestionControl string // The congestion controller used, see agents.NewCongestionController. NewReno is used if not set
+	DisablePacing     bool   // The packets are sent as soon as the congestion controller allows it when set
+}
+
+// Runs the scenario against the host and returns its trace. A panic of the scenario is recovered and recorded in the
+// trace with its stack trace. When an agent of the connection panics or when the deadline is exceeded, the run is
+// abandoned and a trace recording it is returned.
+func RunScenario(scenario Scenario, host string, config RunConfig) *qt.Trace {
+	deadline := config.Deadline
+	if deadline == 0 {
+		deadline = DefaultRunDeadline
+	}
+	trace := qt.NewTrace(scenario.Name(), scenario.Version(), host)
+
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+	ip := net.ParseIP(hostname)
+	serverName := config.SNI
+	if serverName == "" && ip == nil { // See https://tools.ietf.org/html/rfc6066#section-3
+		serverName = hostname
+	}
+	useIPv6 := scenario.IPv6()
+	if ip != nil && ip.To4() == nil {
+		useIPv6 = true
+	}
+
+	address := config.Address
+	if address == nil && config.RaceAddresses {
+		address = raceAddresses(scenario, host, serverName, config, trace)
+	}
+	target := host
+	if address != nil {
+		target, useIPv6 = address.String(), address.IP.To4() == nil
+		trace.Ip, trace.AddressFamily = address.IP.String(), qt.AddressFamily(address.IP)
+	}
+
+	conn, err := qt.NewDefaultConnection(target, serverName, nil, useIPv6, scenario.HTTP3(), config.Version, config.KeyLog)
+	if _, ok := err.(*qt.UnsupportedVersionError); ok {
+		trace.MarkError(R_UnsupportedVersion, err.Error(), nil)
+		return trace
+	} else if err != nil {
+		trace.ErrorCode = R_UDPError
+		trace.Results["udp_error"] = err.Error()
+		return trace
+	}
+	if config.ALPN != "" {
+		if err := conn.TransitionTo(conn.Version, config.ALPN); err != nil {
+			conn.Close()
+			trace.MarkError(R_UnsupportedVersion, err.Error(), nil)
+			return trace
+		}
+	}
+	if config.LogOutput != nil {
+		conn.SetLogOutput(config.LogOutput)
+	}
+	conn.CongestionControl, conn.DisablePacing = config.CongestionControl, config.DisablePacing
+
+	pcap := qt.StartPcapCapture(conn)
+
+	var impairmentProxy *proxy.Proxy
+	if config.Impairment != nil {
+		impairmentProxy, err = proxy.Attach(conn, trace, *config.Impairment)
+		if err != nil {
+			trace.Results["impairment_error"] = err.Error()
+		} else if config.LogOutput != nil {
+			impairmentProxy.Logger.SetOutput(config.LogOutput)
+		}
+	}
+
+	trace.AttachTo(conn)
+
+	start := time.Now()
+	trace.StartedAt = start.Unix()
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		defer recoverCrash(trace, conn.Logger)
+		scenario.Run(conn, trace, config.URL, config.Debug)
+	}()
+
+	abandon := func() *qt.Trace {
+		conn.UdpConnection.Close() // The scenario still holds the trace and the proxy recording in it, both are left to it
+		abandoned := qt.NewTrace(scenario.Name(), scenario.Version(), host)
+		abandoned.StartedAt = trace.StartedAt
+		abandoned.Ip, abandoned.AddressFamily = conn.Host.IP.String(), qt.AddressFamily(conn.Host.IP)
+		abandoned.Duration = uint64(time.Now().Sub(start).Seconds() * 1000)
+		return abandoned
+	}
+
+	select {
+	case <-done:
+	case crash := <-conn.Crashes:
+		conn.Logger.Printf("The agent %s panicked, abandoning the run\n", crash.Agent)
+		abandoned := abandon()
+		abandoned.ErrorCode = R_Crashed
+		abandoned.Results["crash"] = crash.Panic
+		abandoned.Results["crashed_agent"] = crash.Agent
+		abandoned.Results["stack_trace"] = crash.StackTrace
+		return abandoned
+	case <-time.After(deadline):
+		conn.Logger.Printf("The run did not complete within %s, abandoning it\n", deadline)
+		abandoned := abandon()
+		abandoned.ErrorCode = R_DeadlineExceeded
+		abandoned.Results["error"] = fmt.Sprintf("the run did not complete within %s", deadline)
+		return abandoned
+	}
+
+	trace.Duration = uint64(time.Now().Sub(start).Seconds() * 1000)
+	trace.Ip, trace.AddressFamily = conn.Host.IP.String(), qt.AddressFamily(conn.Host.IP)
+
+	func() {
+		defer recoverCrash(trace, conn.Logger)
+		trace.Complete(conn)
+		conn.Close()
+	}()
+	if impairmentProxy != nil {
+		impairmentProxy.Close()
+	}
+	err = trace.AddPcap(pcap)
+	if err != nil {
+		trace.Results["pcap_completed_error"] = err.Error()
+	}
+	return trace
+}
+
+// Returns the addresses of the host the scenario can be run against, i.e. only its IPv6 addresses when the scenario
+// requires IPv6
+func ScenarioAddresses(scenario Scenario, host string) ([]*net.UDPAddr, error) {
+	addresses, err := qt.ResolveAddresses(host)
+	if err != nil || !scenario.IPv6() {
+		return addresses, err
+	}
+	var v6 []*net.UDPAddr
+	for _, a := range addresses {
+		if a.IP.To4() == nil {
+			v6 = append(v6, a)
+		}
+	}
+	return v6, nil
+}
+
+// Selects the address of the run by racing handshakes with the addresses of the host. The outcome of the race is
+// recorded in the trace. The first address is used when no handshake completes.
+func raceAddresses(scenario Scenario, host string, serverName string, config RunConfig, trace *qt.Trace) *net.UDPAddr {
+	addresses, err := ScenarioAddresses(scenario, host)
+	if err != nil || len(addresses) == 0 {
+		return nil // The resolution fails again when the connection is created and is reported then
+	}
+	winner, attempts, err := RaceAddresses(addresses, RaceConfig{
+		ServerName: serverName,
+		ALPN:       config.ALPN,
+		HTTP3:      scenario.HTTP3(),
+		Version:    config.Version,
+		LogOutput:  config.LogOutput,
+		Timeout:    10 * time.Second,
+	})
+	trace.Results["happy_eyeballs"] = attempts
+	if err != nil {
+		trace.Results["happy_eyeballs_error"] = err.Error()
+		return addresses[0]
+	}
+	return winner
+}
+
+// Records a panic in the trace with its stack trace, it must be deferred
+func recoverCrash(trace *qt.Trace, logger *log.Logger) {
+	if r := recover(); r != nil {
+		logger.Printf("The run panicked: %v\n", r)
+		trace.ErrorCode = R_Crashed
+		trace.Results["crash"] = fmt.Sprint(r)
+		trace.Results["stack_trace"] = string(debug.Stack())
+	}
+}
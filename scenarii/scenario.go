@@ -6,6 +6,7 @@
 //
 // 	Its Name() must match its source code file without the extension.
 // 	It must be registered in the GetAllScenarii() function.
+// 	Its metadata, i.e. its description, tags and error codes, must be registered in the metadata.go file.
 // 	It must define an upper bound on its completion time. It should use the Timeout() function to achieve this.
 //
 //
@@ -25,6 +26,7 @@ type Scenario interface {
 	HTTP3() bool
 	Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool)
 	Timeout() *time.Timer
+	Metadata() *Metadata
 }
 
 // Each scenario should embed this structure
@@ -51,6 +53,9 @@ func (s *AbstractScenario) HTTP3() bool {
 func (s *AbstractScenario) Timeout() *time.Timer {
 	return s.timeout
 }
+func (s *AbstractScenario) Metadata() *Metadata {
+	return ScenarioMetadata(s.name)
+}
 
 // Useful helper for scenarii that requires the handshake to complete before executing their test and don't want to
 // discern the cause of its failure.
@@ -66,7 +71,11 @@ func (s *AbstractScenario) CompleteHandshake(conn *qt.Connection, trace *qt.Trac
 	select {
 	case i := <-handshakeStatus:
 		status := i.(agents.HandshakeStatus)
-		if !status.Completed {
+		if _, ok := status.Error.(*qt.UnsupportedVersionError); ok {
+			trace.MarkError(R_UnsupportedVersion, status.Error.Error(), status.Packet)
+			connAgents.StopAll()
+			return nil
+		} else if !status.Completed {
 			trace.MarkError(handshakeErrorCode, status.Error.Error(), status.Packet)
 			connAgents.StopAll()
 			return nil
@@ -79,8 +88,9 @@ func (s *AbstractScenario) CompleteHandshake(conn *qt.Connection, trace *qt.Trac
 	return connAgents
 }
 
+// Returns a new instance of each scenario, including those defined in YAML that were registered
 func GetAllScenarii() map[string]Scenario {
-	return map[string]Scenario{
+	scenarii := map[string]Scenario{
 		"zero_rtt":                  NewZeroRTTScenario(),
 		"connection_migration":      NewConnectionMigrationScenario(),
 		"unsupported_tls_version":   NewUnsupportedTLSVersionScenario(),
@@ -104,5 +114,13 @@ func GetAllScenarii() map[string]Scenario {
 		"http3_get":                 NewHTTP3GETScenario(),
 		"http3_encoder_stream":      NewHTTP3EncoderStreamScenario(),
 		"http3_uni_streams_limits":  NewHTTP3UniStreamsLimitsScenario(),
+		"version_upgrade":           NewVersionUpgradeScenario(),
+		"retry_integrity":           NewRetryIntegrityScenario(),
+		"pmtud":                     NewPMTUDScenario(),
+		"chacha20":                  NewChaCha20Scenario(),
+	}
+	for name, d := range definitions {
+		scenarii[name] = NewDeclarativeScenario(d)
 	}
+	return scenarii
 }
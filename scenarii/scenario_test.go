@@ -0,0 +1,469 @@
+// +build go1.21
+
+package scenarii
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	qt "github.com/RohitPanda/quic-tracker"
+	"github.com/RohitPanda/quic-tracker/agents"
+	"github.com/RohitPanda/quic-tracker/server"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	// The local server is built on crypto/tls, using it on both sides keeps the tests independent of cgo
+	if err := qt.SetDefaultTLSProvider("crypto/tls"); err != nil {
+		panic(err)
+	}
+}
+
+// Runs the scenario against a local server using the given configuration and returns its trace
+func runAgainstLocalServer(t *testing.T, scenario Scenario, config server.Config, keyLog io.Writer) *qt.Trace {
+	t.Helper()
+	s, err := server.NewServer("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	trace := qt.NewTrace(scenario.Name(), scenario.Version(), s.Addr().String())
+	conn, err := qt.NewDefaultConnection(s.Addr().String(), "localhost", nil, scenario.IPv6(), scenario.HTTP3(), 0, keyLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace.AttachTo(conn)
+	scenario.Run(conn, trace, "/index.html", false)
+	trace.Complete(conn)
+	conn.Close()
+	return trace
+}
+
+type scenarioTest struct {
+	name      string
+	scenario  func() Scenario
+	config    func(*server.Config)
+	errorCode uint8
+}
+
+// Each scenario is run against a compliant server and against a server breaking the rule it checks. The scenarios
+// wait for their timeout, the tests are thus run in parallel.
+var scenarioTests = []scenarioTest{
+	{"handshake/compliant", func() Scenario { return NewHandshakeScenario() }, nil, 0},
+	{"handshake/no_compatible_version", func() Scenario { return NewHandshakeScenario() }, func(c *server.Config) {
+		c.Versions = []uint32{0x1a2a3a4a}
+	}, H_NoCompatibleVersionAvailable},
+	{"retry_integrity/compliant", func() Scenario { return NewRetryIntegrityScenario() }, func(c *server.Config) {
+		c.Retry = true
+	}, 0},
+	{"retry_integrity/skip_retry", func() Scenario { return NewRetryIntegrityScenario() }, func(c *server.Config) {
+		c.Retry = true
+		c.Misbehaviors = server.SkipRetry
+	}, RI_NoRetryReceived},
+	{"retry_integrity/invalid_integrity_tag", func() Scenario { return NewRetryIntegrityScenario() }, func(c *server.Config) {
+		c.Retry = true
+		c.Misbehaviors = server.InvalidRetryIntegrityTag
+	}, RI_InvalidRetry},
+	{"version_upgrade/compliant", func() Scenario { return NewVersionUpgradeScenario() }, func(c *server.Config) {
+		c.Versions = []uint32{qt.QuicVersion2, qt.QuicVersion1}
+	}, 0},
+	{"version_upgrade/after_retry", func() Scenario { return NewVersionUpgradeScenario() }, func(c *server.Config) {
+		c.Versions = []uint32{qt.QuicVersion2, qt.QuicVersion1}
+		c.Retry = true
+	}, 0},
+	{"version_upgrade/prefer_v1", func() Scenario { return NewVersionUpgradeScenario() }, func(c *server.Config) {
+		c.Versions = []uint32{qt.QuicVersion1, qt.QuicVersion2}
+	}, VU_UpgradeIgnored},
+	{"key_update/compliant", func() Scenario { return NewKeyUpdateScenario() }, nil, 0},
+	{"key_update/ignore_key_update", func() Scenario { return NewKeyUpdateScenario() }, func(c *server.Config) {
+		c.Misbehaviors = server.IgnoreKeyUpdate
+	}, KU_HostDidNotRespond},
+	{"connection_migration/compliant", func() Scenario { return NewConnectionMigrationScenario() }, nil, 0},
+	{"connection_migration/refuse_migration", func() Scenario { return NewConnectionMigrationScenario() }, func(c *server.Config) {
+		c.Misbehaviors = server.RefuseMigration
+	}, CM_HostDidNotMigrate},
+	{"flow_control/compliant", func() Scenario { return NewFlowControlScenario() }, nil, 0},
+	{"flow_control/ignore_flow_control", func() Scenario { return NewFlowControlScenario() }, func(c *server.Config) {
+		c.Misbehaviors = server.IgnoreFlowControl
+	}, FC_HostSentMoreThanLimit},
+	{"address_validation/compliant", func() Scenario { return NewAddressValidationScenario() }, nil, 0},
+	{"address_validation/ignore_amplification_limit", func() Scenario { return NewAddressValidationScenario() }, func(c *server.Config) {
+		c.Misbehaviors = server.IgnoreAmplificationLimit
+	}, AV_SentMoreThan3TimesAmount},
+	{"version_negotiation/compliant", func() Scenario { return NewVersionNegotiationScenario() }, nil, 0},
+	{"version_negotiation/fixed_unused_bits", func() Scenario { return NewVersionNegotiationScenario() }, func(c *server.Config) {
+		c.Misbehaviors = server.FixedVersionNegotiationBits
+	}, VN_UnusedFieldIsIdentical},
+	{"ack_only/compliant", func() Scenario { return NewAckOnlyScenario() }, nil, 0},
+	{"ack_only/acknowledge_ack_only", func() Scenario { return NewAckOnlyScenario() }, func(c *server.Config) {
+		c.Misbehaviors = server.AcknowledgeAckOnly
+	}, AO_SentAOInResponseOfAO},
+	{"stop_sending/compliant", func() Scenario { return NewStopSendingOnReceiveStreamScenario() }, nil, 0},
+	{"stop_sending/ignore_stop_sending", func() Scenario { return NewStopSendingOnReceiveStreamScenario() }, func(c *server.Config) {
+		c.Misbehaviors = server.IgnoreStopSendingOnReceiveStream
+	}, SSRS_DidNotCloseTheConnection},
+	{"new_connection_id/compliant", func() Scenario { return NewNewConnectionIDScenario() }, nil, 0},
+	{"new_connection_id/keep_destination_cid", func() Scenario { return NewNewConnectionIDScenario() }, func(c *server.Config) {
+		c.Misbehaviors = server.KeepDestinationCID
+	}, NCI_HostDidNotAdaptCID},
+	{"retire_connection_id/compliant", func() Scenario { return NewRetireConnectionIDScenario() }, nil, 0},
+	{"retire_connection_id/skip_replacement", func() Scenario { return NewRetireConnectionIDScenario() }, func(c *server.Config) {
+		c.Misbehaviors = server.SkipConnectionIDReplacement
+	}, RCI_HostDidNotProvideNewCID},
+}
+
+// The scenarii of GetAllScenarii that are not run against the local server, and why
+var uncoveredScenarii = map[string]string{
+	"zero_rtt":                  "the server does not issue session tickets allowing early data",
+	"unsupported_tls_version":   "the server has no misbehavior for it",
+	"stream_opening_reordering": "the server has no misbehavior for it",
+	"multi_stream":              "the server has no misbehavior for it",
+	"handshake_v6":              "the tests only listen on IPv4",
+	"transport_parameters":      "the server has no misbehavior for it",
+	"padding":                   "the server has no misbehavior for it",
+	"ack_ecn":                   "the server does not support ECN",
+	"http_get_and_wait":         "the server has no misbehavior for it",
+	"http_get_on_uni_stream":    "the server has no misbehavior for it",
+	"http3_get":                 "the server only speaks HTTP/0.9",
+	"http3_encoder_stream":      "the server only speaks HTTP/0.9",
+	"http3_uni_streams_limits":  "the server only speaks HTTP/0.9",
+	"pmtud":                     "the server sends datagrams of a fixed size",
+}
+
+func TestScenariiCoverage(t *testing.T) {
+	covered := map[string]bool{"chacha20": true} // See TestChaCha20AgainstLocalServer
+	for _, test := range scenarioTests {
+		covered[strings.Split(test.name, "/")[0]] = true
+	}
+	for name := range GetAllScenarii() {
+		if _, declarative := definitions[name]; declarative {
+			continue
+		}
+		if _, uncovered := uncoveredScenarii[name]; covered[name] == uncovered {
+			t.Errorf("the scenario %s must either be tested against the local server or be listed as uncovered", name)
+		}
+	}
+}
+
+func TestScenariiAgainstLocalServer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the scenarii wait for their timeout")
+	}
+	for _, test := range scenarioTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			config := server.DefaultConfig()
+			if test.config != nil {
+				test.config(&config)
+			}
+			trace := runAgainstLocalServer(t, test.scenario(), config, nil)
+			if trace.ErrorCode != test.errorCode {
+				t.Errorf("the scenario reported error code %d instead of %d, results: %v", trace.ErrorCode, test.errorCode, trace.Results)
+			}
+		})
+	}
+}
+
+// The local server selects ChaCha20 only when the client prefers it, i.e. when crypto/tls finds no AES hardware support
+func TestChaCha20AgainstLocalServer(t *testing.T) {
+	trace := runAgainstLocalServer(t, NewChaCha20Scenario(), server.DefaultConfig(), nil)
+	switch trace.ErrorCode {
+	case 0:
+		if trace.CipherSuite != qt.TLS_CHACHA20_POLY1305_SHA256.String() {
+			t.Errorf("the handshake completed with %s", trace.CipherSuite)
+		}
+	case CH_CipherSuitesNotConfigurable:
+		if trace.CipherSuite == "" || trace.CipherSuite == qt.TLS_CHACHA20_POLY1305_SHA256.String() {
+			t.Errorf("the scenario was skipped although the server selected %q", trace.CipherSuite)
+		}
+	default:
+		t.Errorf("the scenario reported error code %d, results: %v", trace.ErrorCode, trace.Results)
+	}
+}
+
+func TestQlogOfHandshake(t *testing.T) {
+	agents.QlogDirectory = t.TempDir()
+	defer func() { agents.QlogDirectory = "" }()
+	trace := runAgainstLocalServer(t, NewHandshakeScenario(), server.DefaultConfig(), nil)
+	if trace.ErrorCode != 0 {
+		t.Fatalf("the handshake failed, results: %v", trace.Results)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(agents.QlogDirectory, "*.sqlog"))
+	if len(files) != 1 {
+		t.Fatalf("expected one qlog file, found %v", files)
+	}
+	content, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(map[string]int)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var record struct{ Name string }
+		if err := json.Unmarshal(bytes.TrimPrefix(scanner.Bytes(), []byte{0x1e}), &record); err != nil {
+			t.Fatalf("invalid record %q: %s", scanner.Text(), err)
+		}
+		events[record.Name]++
+	}
+	for _, name := range []string{"transport:packet_sent", "transport:packet_received", "transport:frames_processed", "security:key_updated", "recovery:metrics_updated"} {
+		if events[name] == 0 {
+			t.Errorf("no %s event was logged, events: %v", name, events)
+		}
+	}
+}
+
+func TestKeyLogOfKeyUpdate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the scenario waits for its timeout")
+	}
+	keyLog := new(bytes.Buffer)
+	trace := runAgainstLocalServer(t, NewKeyUpdateScenario(), server.DefaultConfig(), keyLog)
+	if trace.ErrorCode != 0 {
+		t.Fatalf("the key update failed, results: %v", trace.Results)
+	}
+	var labels []string
+	for _, line := range strings.Split(strings.TrimSpace(keyLog.String()), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[1] != fmt.Sprintf("%x", trace.ClientRandom) {
+			t.Fatalf("invalid key log line %q", line)
+		}
+		labels = append(labels, fields[0])
+	}
+	expected := []string{"SERVER_HANDSHAKE_TRAFFIC_SECRET", "CLIENT_HANDSHAKE_TRAFFIC_SECRET", "CLIENT_TRAFFIC_SECRET_0", "SERVER_TRAFFIC_SECRET_0", "CLIENT_TRAFFIC_SECRET_1", "SERVER_TRAFFIC_SECRET_1"}
+	if strings.Join(labels, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected the secrets %v, got %v", expected, labels)
+	}
+}
+
+func TestDecodeStreamOfHandshake(t *testing.T) {
+	trace := runAgainstLocalServer(t, NewHandshakeScenario(), server.DefaultConfig(), nil)
+	if trace.ErrorCode != 0 {
+		t.Fatalf("the handshake failed, results: %v", trace.Results)
+	}
+	content, err := json.Marshal(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded qt.Trace // Decodes the trace as it is read from a results file
+	if err := json.Unmarshal(content, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	connections := decoded.DecodeStream()
+	if len(connections) != 1 {
+		t.Fatalf("expected one connection, got %d", len(connections))
+	}
+	packets := connections[0].Packets
+	if len(packets) != len(trace.Stream) {
+		t.Fatalf("expected %d packets, got %d", len(trace.Stream), len(packets))
+	}
+	types := make(map[qt.PacketType]int)
+	handshakeDone := false
+	for i, p := range packets {
+		if p.Error != nil {
+			t.Fatalf("packet %d could not be parsed: %s", i, p.Error)
+		}
+		types[p.Packet.Header().PacketType()]++
+		if framer, ok := p.Packet.(qt.Framer); ok && p.Direction == qt.ToClient && framer.Contains(qt.HandshakeDoneType) {
+			handshakeDone = true
+		}
+	}
+	if packets[0].Direction != qt.ToServer || packets[0].Packet.Header().PacketType() != qt.Initial {
+		t.Errorf("the trace does not start with an Initial packet of the client")
+	}
+	if types[qt.Initial] == 0 || types[qt.Handshake] == 0 || !handshakeDone {
+		t.Errorf("the handshake could not be followed, packet types: %v", types)
+	}
+}
+
+type panickingScenario struct{ AbstractScenario }
+
+func (s *panickingScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
+	panic("the scenario panicked")
+}
+
+type blockingScenario struct {
+	AbstractScenario
+	unblock chan bool
+}
+
+func (s *blockingScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
+	<-s.unblock
+}
+
+func TestRunScenarioRecoversPanics(t *testing.T) {
+	trace := RunScenario(&panickingScenario{AbstractScenario{name: "panicking", version: 1}}, "127.0.0.1:4433", RunConfig{LogOutput: io.Discard})
+	if trace.ErrorCode != R_Crashed || trace.Results["crash"] != "the scenario panicked" {
+		t.Fatalf("the panic was not recorded, error code %d, results: %v", trace.ErrorCode, trace.Results)
+	}
+	if stack, _ := trace.Results["stack_trace"].(string); !strings.Contains(stack, "panickingScenario") {
+		t.Errorf("the stack trace does not locate the panic: %s", stack)
+	}
+}
+
+type panickingAgent struct{ agents.BaseAgent }
+
+func (a *panickingAgent) Run(conn *qt.Connection) {
+	a.Init("PanickingAgent", conn)
+	go func() {
+		defer a.RecoverCrash()
+		panic("the agent panicked")
+	}()
+}
+
+type panickingAgentScenario struct {
+	AbstractScenario
+	unblock chan bool
+}
+
+func (s *panickingAgentScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
+	agents.AttachAgentsToConnection(conn, &panickingAgent{})
+	<-s.unblock
+}
+
+func TestRunScenarioRecoversAgentPanics(t *testing.T) {
+	scenario := &panickingAgentScenario{AbstractScenario{name: "panicking_agent", version: 1}, make(chan bool)}
+	defer close(scenario.unblock)
+	trace := RunScenario(scenario, "127.0.0.1:4433", RunConfig{LogOutput: io.Discard, Deadline: 10 * time.Second})
+	if trace.ErrorCode != R_Crashed || trace.Results["crash"] != "the agent panicked" || trace.Results["crashed_agent"] != "PanickingAgent" {
+		t.Fatalf("the panic was not recorded, error code %d, results: %v", trace.ErrorCode, trace.Results)
+	}
+	if stack, _ := trace.Results["stack_trace"].(string); !strings.Contains(stack, "panickingAgent") {
+		t.Errorf("the stack trace does not locate the panic: %s", stack)
+	}
+}
+
+func TestRunScenarioDeadline(t *testing.T) {
+	scenario := &blockingScenario{AbstractScenario{name: "blocking", version: 1}, make(chan bool)}
+	defer close(scenario.unblock)
+	trace := RunScenario(scenario, "127.0.0.1:4433", RunConfig{LogOutput: io.Discard, Deadline: 100 * time.Millisecond})
+	if trace.ErrorCode != R_DeadlineExceeded || trace.Scenario != "blocking" {
+		t.Errorf("the deadline was not enforced, error code %d, results: %v", trace.ErrorCode, trace.Results)
+	}
+}
+
+// The tests use crypto/tls, which does not send the transport parameters extension of the drafts
+func TestRunScenarioUnsupportedVersion(t *testing.T) {
+	trace := RunScenario(NewHandshakeScenario(), "127.0.0.1:4433", RunConfig{LogOutput: io.Discard, Version: qt.QuicVersionDraft17})
+	if trace.ErrorCode != R_UnsupportedVersion {
+		t.Errorf("the scenario reported error code %d instead of %d, results: %v", trace.ErrorCode, R_UnsupportedVersion, trace.Results)
+	}
+}
+
+// Records the congestion controller and the pacing of the SendingAgent of the connection
+type sendingAgentScenario struct{ AbstractScenario }
+
+func (s *sendingAgentScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
+	s.timeout = time.NewTimer(5 * time.Second)
+	connAgents := s.CompleteHandshake(conn, trace, 1)
+	if connAgents == nil {
+		return
+	}
+	sendingAgent := connAgents.Get("SendingAgent").(*agents.SendingAgent)
+	trace.Results["congestion_controller"] = sendingAgent.CongestionController.Name() // Before the RecoveryAgent stops
+	trace.Results["pacing_disabled"] = sendingAgent.DisablePacing
+	connAgents.CloseConnection(false, 0, "")
+}
+
+func TestRunScenarioSendingOptions(t *testing.T) {
+	s, err := server.NewServer("127.0.0.1:0", server.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, config := range []RunConfig{{}, {CongestionControl: "cubic", DisablePacing: true}, {CongestionControl: "bbr-lite"}} {
+		config.SNI, config.LogOutput = "localhost", io.Discard
+		trace := RunScenario(&sendingAgentScenario{AbstractScenario{name: "sending_agent", version: 1}}, s.Addr().String(), config)
+		if trace.ErrorCode != 0 {
+			t.Fatalf("the handshake failed, results: %v", trace.Results)
+		}
+		expected := config.CongestionControl
+		if expected == "" {
+			expected = "newreno"
+		}
+		if trace.Results["congestion_controller"] != expected || trace.Results["pacing_disabled"] != config.DisablePacing {
+			t.Errorf("expected the %s congestion controller with pacing disabled %t, got %v", expected, config.DisablePacing, trace.Results)
+		}
+	}
+}
+
+func TestRaceAddresses(t *testing.T) {
+	s, err := server.NewServer("127.0.0.1:0", server.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) // Receives the packets without answering them
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	addresses := []*net.UDPAddr{silent.LocalAddr().(*net.UDPAddr), s.Addr()}
+	winner, attempts, err := RaceAddresses(addresses, RaceConfig{ServerName: "localhost", LogOutput: io.Discard, Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if winner != addresses[1] || len(attempts) != 2 || attempts[0].Won || !attempts[1].Won {
+		t.Errorf("the second address did not win the race, attempts: %+v", attempts)
+	}
+	if attempts[1].Started < uint64(ConnectionAttemptDelay/time.Millisecond) {
+		t.Errorf("the second attempt started after %d ms", attempts[1].Started)
+	}
+}
+
+func TestDeclarativeScenarioAgainstLocalServer(t *testing.T) {
+	errorCodes := []ErrorCode{{1, "TLSHandshakeFailed", SeverityInconclusive}, {2, "DidntReceiveTheRequestedData", SeverityFailure}, {3, "NoRetryReceived", SeverityInconclusive}}
+	stream := uint64(0)
+	fin := true
+	request := []Step{
+		{Handshake: &HandshakeStep{ErrorCode: 1}},
+		{Request: &RequestStep{StreamId: 0}},
+		{Wait: &WaitStep{PacketPredicate: PacketPredicate{Packet: "1rtt", Frame: "stream", StreamId: &stream, Fin: &fin}, ErrorCode: 2}},
+		{Assert: &AssertStep{StreamClosed: &stream, NotReceived: &PacketPredicate{Frame: "connection_close"}, ErrorCode: 2}},
+	}
+	retry := []Step{
+		{Handshake: &HandshakeStep{ErrorCode: 1}},
+		{Assert: &AssertStep{Received: &PacketPredicate{Packet: "retry"}, ErrorCode: 3}},
+	}
+	for _, test := range []struct {
+		name      string
+		steps     []Step
+		config    func(*server.Config)
+		errorCode uint8
+	}{
+		{"request/compliant", request, nil, 0},
+		{"request/no_compatible_version", request, func(c *server.Config) { c.Versions = []uint32{0x1a2a3a4a} }, 1},
+		{"retry/compliant", retry, func(c *server.Config) { c.Retry = true }, 0},
+		{"retry/skip_retry", retry, func(c *server.Config) { c.Retry = true; c.Misbehaviors = server.SkipRetry }, 3},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			d := &Definition{Name: "declarative", Version: 1, Timeout: 5 * time.Second, ErrorCodes: errorCodes, Steps: test.steps}
+			if err := d.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			config := server.DefaultConfig()
+			if test.config != nil {
+				test.config(&config)
+			}
+			trace := runAgainstLocalServer(t, NewDeclarativeScenario(d), config, nil)
+			if trace.ErrorCode != test.errorCode {
+				t.Errorf("the scenario reported error code %d instead of %d, results: %v", trace.ErrorCode, test.errorCode, trace.Results)
+			}
+		})
+	}
+}
@@ -22,7 +22,7 @@ func NewTransportParameterScenario() *TransportParameterScenario {
 	return &TransportParameterScenario{AbstractScenario{name: "transport_parameters", version: 3}}
 }
 func (s *TransportParameterScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
-	s.timeout = time.NewTimer(10 * time.Second)
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
 	for i := uint16(0xff00); i <= 0xff0f; i++ {
 		p := qt.TransportParameter{ParameterType: qt.TransportParametersType(i)}
 		p.Value = make([]byte, 2, 2)
@@ -23,7 +23,7 @@ func NewUnsupportedTLSVersionScenario() *UnsupportedTLSVersionScenario {
 	return &UnsupportedTLSVersionScenario{AbstractScenario{name: "unsupported_tls_version", version: 1}}
 }
 func (s *UnsupportedTLSVersionScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
-	s.timeout = time.NewTimer(10 * time.Second)
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
 	connAgents := agents.AttachAgentsToConnection(conn, agents.GetDefaultAgents()...)
 	connAgents.Get("TLSAgent").(*agents.TLSAgent).DisableFrameSending = true
 	defer connAgents.StopAll()
@@ -41,13 +41,20 @@ forLoop:
 			switch p := i.(type) {
 			case *qt.VersionNegotiationPacket:
 				if err := conn.ProcessVersionNegotation(p); err != nil {
-					trace.MarkError(UTS_VNDidNotComplete, err.Error(), p)
+					if _, ok := err.(*qt.UnsupportedVersionError); ok {
+						trace.MarkError(R_UnsupportedVersion, err.Error(), p)
+					} else {
+						trace.MarkError(UTS_VNDidNotComplete, err.Error(), p)
+					}
 					return
 				}
 				sendUnsupportedInitial(conn)
 			case *qt.RetryPacket:
-				conn.DestinationCID = p.Header().(*qt.LongHeader).SourceCID
-				conn.TransitionTo(qt.QuicVersion, qt.QuicALPNToken)
+				conn.DestinationCID = p.Header().(*qt.RetryHeader).SourceCID
+				if err := conn.TransitionTo(conn.Version, conn.ALPN); err != nil {
+					trace.MarkError(R_UnsupportedVersion, err.Error(), p)
+					return
+				}
 				conn.Token = p.RetryToken
 				sendUnsupportedInitial(conn)
 			case qt.Framer:
@@ -0,0 +1,54 @@
+package scenarii
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Returns a human-readable name of the error code reported by the scenario, e.g. "Host did not migrate" for the
+// error code CM_HostDidNotMigrate of the connection_migration scenario. The error code 0 is reported as "Success".
+func Verdict(scenario string, errorCode uint8) string {
+	if errorCode == 0 {
+		return "Success"
+	}
+	e, ok := ScenarioMetadata(scenario).ErrorCode(errorCode)
+	if !ok {
+		return fmt.Sprintf("Error code %d", errorCode)
+	}
+	return humanize(e.Name)
+}
+
+// Returns the severity of the error code reported by the scenario. The error codes that are not registered are
+// failures.
+func VerdictSeverity(scenario string, errorCode uint8) Severity {
+	e, _ := ScenarioMetadata(scenario).ErrorCode(errorCode)
+	return e.Severity
+}
+
+// Splits a CamelCase name into words, the acronyms are kept in upper case, e.g. "TLS handshake failed"
+func humanize(name string) string {
+	var words []string
+	for _, part := range strings.Split(name, "_") {
+		words = append(words, splitCamelCase(part, len(words) == 0)...)
+	}
+	return strings.Join(words, " ")
+}
+
+func splitCamelCase(name string, capitalize bool) []string {
+	runes := []rune(name)
+	var words []string
+	start := 0
+	for i := 1; i <= len(runes); i++ {
+		if i < len(runes) && !(unicode.IsUpper(runes[i]) && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+			continue
+		}
+		word := string(runes[start:i])
+		if (len(words) > 0 || !capitalize) && word != strings.ToUpper(word) {
+			word = strings.ToLower(word)
+		}
+		words = append(words, word)
+		start = i
+	}
+	return words
+}
@@ -0,0 +1,86 @@
+package scenarii
+
+import (
+	"fmt"
+	qt "github.com/RohitPanda/quic-tracker"
+	"time"
+)
+
+const (
+	VU_TLSHandshakeFailed            = 1
+	VU_UpgradeIgnored                = 2
+	VU_NoVersionInformation          = 3
+	VU_VersionInformationMismatch    = 4
+	VU_HostDidNotRespondAfterUpgrade = 5
+)
+
+// Offers an upgrade from QUIC v1 to QUIC v2 using compatible version negotiation and reports whether the server
+// honors it, ignores it or breaks on it. See https://tools.ietf.org/html/rfc9368 and https://tools.ietf.org/html/rfc9369
+type VersionUpgradeScenario struct {
+	AbstractScenario
+}
+
+func NewVersionUpgradeScenario() *VersionUpgradeScenario {
+	return &VersionUpgradeScenario{AbstractScenario{name: "version_upgrade", version: 1}}
+}
+func (s *VersionUpgradeScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
+
+	if conn.Version != qt.QuicVersion1 {
+		if err := conn.TransitionTo(qt.QuicVersion1, qt.VersionProfileV1.TranslateALPN(conn.ALPN, conn.VersionProfile)); err != nil {
+			trace.MarkError(R_UnsupportedVersion, err.Error(), nil)
+			return
+		}
+	}
+	if err := conn.OfferCompatibleVersions(qt.QuicVersion2); err != nil {
+		trace.MarkError(VU_TLSHandshakeFailed, err.Error(), nil)
+		return
+	}
+	trace.Results["upgrade"] = "broken"
+
+	connAgents := s.CompleteHandshake(conn, trace, VU_TLSHandshakeFailed)
+	if connAgents == nil {
+		return
+	}
+	defer connAgents.CloseConnection(false, 0, "")
+
+	trace.Results["negotiated_version"] = conn.Version
+
+	if conn.Version != qt.QuicVersion2 {
+		trace.Results["upgrade"] = "ignored"
+		trace.ErrorCode = VU_UpgradeIgnored
+		return
+	}
+
+	var versionInformation *qt.VersionInformationParameter
+	if conn.TLSTPHandler.ReceivedParameters != nil {
+		versionInformation = conn.TLSTPHandler.ReceivedParameters.VersionInformation
+	}
+	if versionInformation == nil {
+		trace.MarkError(VU_NoVersionInformation, "the server upgraded without sending version_information", nil)
+		return
+	}
+	if versionInformation.ChosenVersion != conn.Version {
+		trace.MarkError(VU_VersionInformationMismatch, fmt.Sprintf("the server upgraded to %08x but chose %08x in version_information", conn.Version, versionInformation.ChosenVersion), nil)
+		return
+	}
+
+	incPackets := make(chan interface{}, 1000)
+	conn.IncomingPackets.Register(incPackets)
+
+	conn.SendHTTPGETRequest(preferredUrl, 0)
+
+	trace.ErrorCode = VU_HostDidNotRespondAfterUpgrade
+	for {
+		select {
+		case <-incPackets:
+			if conn.Streams.Get(0).ReadClosed {
+				trace.Results["upgrade"] = "honored"
+				trace.ErrorCode = 0
+				return
+			}
+		case <-s.Timeout().C:
+			return
+		}
+	}
+}
@@ -22,7 +22,7 @@ func NewZeroRTTScenario() *ZeroRTTScenario {
 	return &ZeroRTTScenario{AbstractScenario{name: "zero_rtt", version: 1}}
 }
 func (s *ZeroRTTScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl string, debug bool) {
-	s.timeout = time.NewTimer(10 * time.Second)
+	s.timeout = time.NewTimer(s.Metadata().Timeout)
 
 	connAgents := s.CompleteHandshake(conn, trace, ZR_TLSHandshakeFailed)
 	if connAgents == nil {
@@ -55,17 +55,18 @@ func (s *ZeroRTTScenario) Run(conn *qt.Connection, trace *qt.Trace, preferredUrl
 
 	<-time.NewTimer(3 * time.Second).C
 
-	rh, sh, token := conn.ReceivedPacketHandler, conn.SentPacketHandler, conn.Token
+	rh, sh, token, logOutput := conn.ReceivedPacketHandler, conn.SentPacketHandler, conn.Token, conn.LogOutput
 
 	var err error
-	conn, err = qt.NewDefaultConnection(conn.Host.String(), conn.ServerName, ticket, s.ipv6, false)
-	conn.ReceivedPacketHandler = rh
-	conn.SentPacketHandler = sh
-	conn.Token = token
+	conn, err = qt.NewDefaultConnection(conn.Host.String(), conn.ServerName, ticket, s.ipv6, false, conn.Version, conn.KeyLog)
 	if err != nil {
 		trace.MarkError(ZR_ZeroRTTFailed, err.Error(), nil)
 		return
 	}
+	conn.ReceivedPacketHandler = rh
+	conn.SentPacketHandler = sh
+	conn.Token = token
+	conn.SetLogOutput(logOutput)
 
 	connAgents = agents.AttachAgentsToConnection(conn, agents.GetDefaultAgents()...)
 	connAgents.Get("RecoveryAgent").Stop()
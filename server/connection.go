@@ -0,0 +1,718 @@
+// +build go1.21
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	qt "github.com/RohitPanda/quic-tracker"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	maxPacketSize      = 1200
+	maxCryptoFrameSize = 1000
+	initialPTO         = 200 * time.Millisecond
+	maxPTOBackoff      = 6
+	streamLimitError   = 0x04 // See https://tools.ietf.org/html/rfc9000#section-20.1
+	cryptoError        = 0x100
+)
+
+var quicLevelToEncryptionLevel = map[tls.QUICEncryptionLevel]qt.EncryptionLevel{
+	tls.QUICEncryptionLevelInitial:     qt.EncryptionLevelInitial,
+	tls.QUICEncryptionLevelEarly:       qt.EncryptionLevel0RTT,
+	tls.QUICEncryptionLevelHandshake:   qt.EncryptionLevelHandshake,
+	tls.QUICEncryptionLevelApplication: qt.EncryptionLevel1RTT,
+}
+
+var encryptionLevelToSpace = map[qt.EncryptionLevel]qt.PNSpace{
+	qt.EncryptionLevelInitial:   qt.PNSpaceInitial,
+	qt.EncryptionLevelHandshake: qt.PNSpaceHandshake,
+	qt.EncryptionLevel1RTT:      qt.PNSpaceAppData,
+}
+
+var spaceToEncryptionLevel = map[qt.PNSpace]qt.EncryptionLevel{
+	qt.PNSpaceInitial:   qt.EncryptionLevelInitial,
+	qt.PNSpaceHandshake: qt.EncryptionLevelHandshake,
+	qt.PNSpaceAppData:   qt.EncryptionLevel1RTT,
+}
+
+var spaceToQUICLevel = map[qt.PNSpace]tls.QUICEncryptionLevel{
+	qt.PNSpaceInitial:   tls.QUICEncryptionLevelInitial,
+	qt.PNSpaceHandshake: tls.QUICEncryptionLevelHandshake,
+	qt.PNSpaceAppData:   tls.QUICEncryptionLevelApplication,
+}
+
+var spaces = []qt.PNSpace{qt.PNSpaceInitial, qt.PNSpaceHandshake, qt.PNSpaceAppData}
+
+type sentPacket struct {
+	frames []qt.Frame
+	ack    *qt.AckFrame // The ACK frame the packet carried, if any
+	time   time.Time
+}
+
+// A connection holds the server side of a QUIC connection. Its qt.Connection is seen from the server, i.e. its source
+// CID is the one chosen by the server and its crypto states read what the client writes.
+type connection struct {
+	server                 *Server
+	conn                   *qt.Connection
+	tls                    *tls.QUICConn
+	addr                   *net.UDPAddr
+	connectionIDs          []string
+	originalDestinationCID qt.ConnectionID
+	retrySourceCID         qt.ConnectionID
+	initialDestinationCID  qt.ConnectionID // The destination CID the Initial keys are derived from
+
+	issuedCIDs         map[uint64]string // The connection IDs issued to the client by sequence number
+	nextCIDSequence    uint64
+	activeCID          string            // The connection ID of the server the client currently uses
+	unusedPeerCIDs     []qt.ConnectionID // The connection IDs issued by the client that were not used yet
+	largestPeerCIDSeen uint64
+
+	addressValidated bool
+	bytesReceived    int
+	bytesSent        int
+
+	handshakeComplete bool
+	clientParameters  *qt.QuicTransportParameters
+	readSecret        []byte // The 1-RTT secrets of the current key phase
+	writeSecret       []byte
+	cryptoRead        map[qt.PNSpace]uint64
+
+	pending   map[qt.PNSpace][]qt.Frame
+	sent      map[qt.PNSpace]map[qt.PacketNumber]sentPacket
+	ackNeeded map[qt.PNSpace]bool
+	ptoCount  uint
+
+	responses    map[uint64][]byte // The response bytes not yet sent on each stream
+	streamLimits map[uint64]uint64
+	maxData      uint64
+	dataSent     uint64
+
+	lastActivity time.Time
+	closed       bool
+}
+
+// Creates the connection started by the given Initial packet. The connection ID is the one chosen by the server, the
+// original destination CID is the one of the first Initial packet sent by the client.
+func newConnection(s *Server, addr *net.UDPAddr, header *qt.LongHeader, connectionID qt.ConnectionID, originalDestinationCID qt.ConnectionID, retrySourceCID qt.ConnectionID) *connection {
+	c := &connection{
+		server:                 s,
+		addr:                   addr,
+		originalDestinationCID: originalDestinationCID,
+		retrySourceCID:         retrySourceCID,
+		initialDestinationCID:  header.DestinationCID,
+		cryptoRead:             make(map[qt.PNSpace]uint64),
+		pending:                make(map[qt.PNSpace][]qt.Frame),
+		sent:                   make(map[qt.PNSpace]map[qt.PacketNumber]sentPacket),
+		ackNeeded:              make(map[qt.PNSpace]bool),
+		responses:              make(map[uint64][]byte),
+		streamLimits:           make(map[uint64]uint64),
+		issuedCIDs:             map[uint64]string{0: string(connectionID)},
+		nextCIDSequence:        1,
+		activeCID:              string(connectionID),
+		lastActivity:           time.Now(),
+	}
+	c.conn = &qt.Connection{
+		Version:                header.Version,
+		VersionProfile:         header.Profile(),
+		SourceCID:              connectionID,
+		DestinationCID:         header.SourceCID,
+		OriginalDestinationCID: originalDestinationCID,
+		CryptoStates:           make(map[qt.EncryptionLevel]*qt.CryptoState),
+		CryptoStreams:          make(qt.CryptoStreams),
+		Streams:                make(qt.Streams),
+		PacketNumber:           make(map[qt.PNSpace]qt.PacketNumber),
+		LargestPNsReceived:     make(map[qt.PNSpace]qt.PacketNumber),
+		LargestPNsAcknowledged: make(map[qt.PNSpace]qt.PacketNumber),
+		AckQueue:               make(map[qt.PNSpace][]qt.PacketNumber),
+		Logger:                 s.Logger,
+	}
+	for _, space := range spaces {
+		c.sent[space] = make(map[qt.PacketNumber]sentPacket)
+	}
+
+	c.installInitialKeys()
+
+	c.tls = tls.QUICServer(&tls.QUICConfig{TLSConfig: s.tlsConfig})
+	c.tls.Start(context.Background())
+
+	for _, cid := range []qt.ConnectionID{header.DestinationCID, connectionID} {
+		s.connections[string(cid)] = c
+		c.connectionIDs = append(c.connectionIDs, string(cid))
+	}
+	s.Logger.Printf("New connection from %s with CID %x\n", addr.String(), []byte(connectionID))
+	return c
+}
+
+// The Initial keys are derived from the destination CID of the client, the client ones are read by the server
+func (c *connection) installInitialKeys() {
+	initialState := qt.NewInitialPacketProtection(&qt.Connection{VersionProfile: c.conn.VersionProfile, DestinationCID: c.initialDestinationCID})
+	initialState.Read, initialState.Write = initialState.Write, initialState.Read
+	initialState.HeaderRead, initialState.HeaderWrite = initialState.HeaderWrite, initialState.HeaderRead
+	c.conn.CryptoStates[qt.EncryptionLevelInitial] = initialState
+}
+
+// Upgrades the connection to the most preferred version the client offers in its version_information transport
+// parameter, when it is compatible with the version of the connection. The packets sent afterwards use this version,
+// see https://tools.ietf.org/html/rfc9368#section-2.3
+func (c *connection) negotiateVersion() {
+	if c.clientParameters.VersionInformation == nil {
+		return
+	}
+	for _, v := range c.server.Config.Versions {
+		if v == c.conn.Version {
+			return
+		}
+		for _, offered := range c.clientParameters.VersionInformation.AvailableVersions {
+			if offered == v && c.conn.VersionProfile.IsCompatibleWith(v) {
+				c.server.Logger.Printf("Upgrading from version %s to version %08x\n", c.conn.VersionProfile, v)
+				c.conn.Version = v
+				c.conn.VersionProfile = qt.GetVersionProfile(v)
+				c.installInitialKeys()
+				return
+			}
+		}
+	}
+}
+
+func (c *connection) handleDatagram(d datagram) {
+	if c.closed {
+		return
+	}
+	c.bytesReceived += len(d.data)
+	c.lastActivity = time.Now()
+	for off := 0; off < len(d.data) && !c.closed; {
+		n := c.handlePacket(d.data[off:], d.addr)
+		if n <= 0 {
+			break
+		}
+		off += n
+	}
+	if !c.closed {
+		c.flush()
+	}
+}
+
+// Removes the protection of a packet and processes it. It returns the number of bytes the packet spans in the
+// datagram, or zero when the rest of the datagram should be discarded.
+func (c *connection) handlePacket(ciphertext []byte, addr *net.UDPAddr) int {
+	header := qt.ReadHeader(bytes.NewReader(ciphertext), c.conn)
+	if lh, ok := header.(*qt.LongHeader); ok && lh.Version != c.conn.Version {
+		return 0
+	}
+	length := len(ciphertext)
+	if lh, ok := header.(*qt.LongHeader); ok {
+		length = lh.HeaderLength() - lh.TruncatedPN().Length + int(lh.Length.Value)
+		if length > len(ciphertext) {
+			return 0
+		}
+		ciphertext = ciphertext[:length]
+	}
+
+	cryptoState := c.conn.CryptoStates[header.EncryptionLevel()]
+	if cryptoState == nil || cryptoState.Read == nil || cryptoState.HeaderRead == nil {
+		c.server.Logger.Printf("No keys to read %s packet, discarding it\n", header.PacketType().String())
+		return length
+	}
+
+	firstByteMask := byte(0x1F)
+	if ciphertext[0]&0x80 == 0x80 {
+		firstByteMask = 0x0F
+	}
+	sample, pnOffset := qt.GetPacketSample(header, ciphertext)
+	mask := cryptoState.HeaderRead.Encrypt(sample, make([]byte, 5))
+	ciphertext[0] ^= mask[0] & firstByteMask
+	pnLength := int(ciphertext[0]&0x3) + 1
+	for i := 0; i < pnLength; i++ {
+		ciphertext[pnOffset+i] ^= mask[1+i]
+	}
+	header = qt.ReadHeader(bytes.NewReader(ciphertext), c.conn)
+	hLen := header.HeaderLength()
+
+	var keyUpdate *qt.CryptoState
+	if sh, ok := header.(*qt.ShortHeader); ok && sh.KeyPhase != (c.conn.KeyPhaseIndex%2 == 1) {
+		if c.server.Config.Misbehaviors&IgnoreKeyUpdate != 0 {
+			c.server.Logger.Println("Ignoring a key update")
+			return length
+		}
+		keyUpdate = qt.NewProtectedCryptoState(nil, c.conn.VersionProfile, c.conn.CipherSuite, qt.NextTrafficSecret(c.conn, c.readSecret), qt.NextTrafficSecret(c.conn, c.writeSecret))
+		keyUpdate.HeaderRead, keyUpdate.HeaderWrite = cryptoState.HeaderRead, cryptoState.HeaderWrite
+		cryptoState = keyUpdate
+	}
+
+	payload := cryptoState.Read.Decrypt(ciphertext[hLen:], uint64(header.PacketNumber()), ciphertext[:hLen])
+	if payload == nil {
+		c.server.Logger.Printf("Could not decrypt packet {type=%s, number=%d}\n", header.PacketType().String(), header.PacketNumber())
+		return length
+	}
+	if keyUpdate != nil { // See https://tools.ietf.org/html/rfc9001#section-6.2
+		c.server.Logger.Println("The client initiated a key update, responding to it")
+		c.readSecret, c.writeSecret = qt.NextTrafficSecret(c.conn, c.readSecret), qt.NextTrafficSecret(c.conn, c.writeSecret)
+		c.conn.CryptoStates[qt.EncryptionLevel1RTT] = keyUpdate
+		c.conn.KeyPhaseIndex++
+	}
+
+	if addr.String() != c.addr.String() {
+		if header.PacketType() != qt.ShortHeaderPacket || c.server.Config.Misbehaviors&RefuseMigration != 0 {
+			c.server.Logger.Printf("Discarding packet received from %s instead of %s\n", addr.String(), c.addr.String())
+			return length
+		}
+		c.migrate(addr)
+	}
+
+	cleartext := append(append([]byte(nil), ciphertext[:hLen]...), payload...)
+	var packet qt.Framer
+	switch header.PacketType() {
+	case qt.Initial:
+		packet = qt.ReadInitialPacket(bytes.NewReader(cleartext), c.conn)
+	case qt.Handshake:
+		packet = qt.ReadHandshakePacket(bytes.NewReader(cleartext), c.conn)
+		c.addressValidated = true // See https://tools.ietf.org/html/rfc9000#section-8.1
+	case qt.ShortHeaderPacket:
+		packet = qt.ReadProtectedPacket(bytes.NewReader(cleartext), c.conn)
+	default:
+		return length
+	}
+	c.handleFrames(packet)
+
+	if sh, ok := header.(*qt.ShortHeader); ok && !c.closed && string(sh.DestinationCID) != c.activeCID {
+		c.activeCID = string(sh.DestinationCID)
+		c.followConnectionID()
+	}
+	return length
+}
+
+// Switches to a connection ID of the client not used yet when the client switched to another connection ID of the
+// server, see https://tools.ietf.org/html/rfc9000#section-5.1.2
+func (c *connection) followConnectionID() {
+	if c.server.Config.Misbehaviors&KeepDestinationCID != 0 {
+		c.server.Logger.Println("Keeping the destination CID after the client switched connection ID")
+		return
+	}
+	if len(c.unusedPeerCIDs) == 0 {
+		c.server.Logger.Println("The client switched connection ID but provided no connection ID to switch to")
+		return
+	}
+	c.conn.DestinationCID = c.unusedPeerCIDs[0]
+	c.unusedPeerCIDs = c.unusedPeerCIDs[1:]
+	c.server.Logger.Printf("Switched to the destination CID %x\n", []byte(c.conn.DestinationCID))
+}
+
+// Issues a new connection ID to the client, see https://tools.ietf.org/html/rfc9000#section-5.1.1
+func (c *connection) issueConnectionID() {
+	connectionID := make([]byte, connectionIDLength)
+	rand.Read(connectionID)
+	frame := &qt.NewConnectionIdFrame{Sequence: c.nextCIDSequence, Length: connectionIDLength, ConnectionId: connectionID}
+	rand.Read(frame.StatelessResetToken[:])
+	c.server.connections[string(connectionID)] = c
+	c.connectionIDs = append(c.connectionIDs, string(connectionID))
+	c.issuedCIDs[c.nextCIDSequence] = string(connectionID)
+	c.nextCIDSequence++
+	c.pending[qt.PNSpaceAppData] = append(c.pending[qt.PNSpaceAppData], frame)
+}
+
+// See https://tools.ietf.org/html/rfc9000#section-19.16
+func (c *connection) retireConnectionID(sequence uint64) {
+	connectionID, ok := c.issuedCIDs[sequence]
+	if !ok || connectionID == c.activeCID {
+		return
+	}
+	delete(c.issuedCIDs, sequence)
+	delete(c.server.connections, connectionID)
+	for i, cid := range c.connectionIDs {
+		if cid == connectionID {
+			c.connectionIDs = append(c.connectionIDs[:i], c.connectionIDs[i+1:]...)
+			break
+		}
+	}
+	if c.server.Config.Misbehaviors&SkipConnectionIDReplacement != 0 {
+		c.server.Logger.Printf("Not replacing the retired connection ID %d\n", sequence)
+		return
+	}
+	c.issueConnectionID()
+}
+
+// Switches to the new address of the client and validates it, see https://tools.ietf.org/html/rfc9000#section-9
+func (c *connection) migrate(addr *net.UDPAddr) {
+	c.server.Logger.Printf("The client migrated from %s to %s\n", c.addr.String(), addr.String())
+	c.addr = addr
+	challenge := new(qt.PathChallenge)
+	rand.Read(challenge.Data[:])
+	c.pending[qt.PNSpaceAppData] = append(c.pending[qt.PNSpaceAppData], challenge)
+}
+
+func (c *connection) handleFrames(packet qt.Framer) {
+	space := packet.PNSpace()
+	pn := packet.Header().PacketNumber()
+	if pn > c.conn.LargestPNsReceived[space] {
+		c.conn.LargestPNsReceived[space] = pn
+	}
+	c.conn.AckQueue[space] = append(c.conn.AckQueue[space], pn)
+	if packet.ShouldBeAcknowledged() || c.server.Config.Misbehaviors&AcknowledgeAckOnly != 0 {
+		c.ackNeeded[space] = true
+	}
+
+	for _, frame := range packet.GetFrames() {
+		switch f := frame.(type) {
+		case *qt.AckFrame:
+			c.handleAck(space, f)
+		case *qt.AckECNFrame:
+			c.handleAck(space, &f.AckFrame)
+		case *qt.StreamFrame:
+			c.handleStreamFrame(f)
+			if c.closed {
+				return
+			}
+		case *qt.MaxDataFrame:
+			if f.MaximumData > c.maxData {
+				c.maxData = f.MaximumData
+			}
+		case *qt.MaxStreamDataFrame:
+			if f.MaximumStreamData > c.streamLimits[f.StreamId] {
+				c.streamLimits[f.StreamId] = f.MaximumStreamData
+			}
+		case *qt.StopSendingFrame:
+			// A stream opened by the client on which the server cannot send, see https://tools.ietf.org/html/rfc9000#section-19.5
+			if f.StreamId%4 == 2 && c.server.Config.Misbehaviors&IgnoreStopSendingOnReceiveStream == 0 {
+				c.closeWithError(qt.ERR_STREAM_STATE_ERROR, "STOP_SENDING received for a receive-only stream")
+				return
+			}
+		case *qt.NewConnectionIdFrame:
+			if f.Sequence > c.largestPeerCIDSeen {
+				c.largestPeerCIDSeen = f.Sequence
+				c.unusedPeerCIDs = append(c.unusedPeerCIDs, append(qt.ConnectionID(nil), f.ConnectionId...))
+			}
+		case *qt.RetireConnectionId:
+			c.retireConnectionID(f.SequenceNumber)
+		case *qt.PathChallenge:
+			c.pending[space] = append(c.pending[space], qt.NewPathResponse(f.Data))
+		case *qt.ConnectionCloseFrame, *qt.ApplicationCloseFrame:
+			c.server.Logger.Println("The client closed the connection")
+			c.close()
+			return
+		}
+	}
+
+	if space != qt.PNSpaceAppData {
+		stream := c.conn.CryptoStreams.Get(space)
+		if stream.ReadOffset > c.cryptoRead[space] {
+			data := stream.ReadData[c.cryptoRead[space]:stream.ReadOffset]
+			c.cryptoRead[space] = stream.ReadOffset
+			if err := c.tls.HandleData(spaceToQUICLevel[space], data); err != nil {
+				c.server.Logger.Printf("TLS error: %s\n", err.Error())
+				var alert tls.AlertError
+				code := uint64(cryptoError)
+				if errors.As(err, &alert) {
+					code += uint64(alert)
+				}
+				c.closeWithError(code, err.Error())
+				return
+			}
+			c.handleTLSEvents()
+		}
+	}
+}
+
+func (c *connection) handleAck(space qt.PNSpace, ack *qt.AckFrame) {
+	if ack.LargestAcknowledged > c.conn.LargestPNsAcknowledged[space] {
+		c.conn.LargestPNsAcknowledged[space] = ack.LargestAcknowledged
+	}
+	for _, r := range ack.GetAckedRanges() {
+		for pn, p := range c.sent[space] {
+			if r.Contains(pn) {
+				delete(c.sent[space], pn)
+				c.ptoCount = 0
+				if p.ack != nil {
+					c.stopAcknowledging(space, p.ack.LargestAcknowledged)
+				}
+			}
+		}
+	}
+}
+
+// Stops acknowledging the packets up to the largest one acknowledged by an ACK frame the client received, see
+// https://tools.ietf.org/html/rfc9000#section-13.2.4
+func (c *connection) stopAcknowledging(space qt.PNSpace, largestAcknowledged qt.PacketNumber) {
+	var packetNumbers []qt.PacketNumber
+	for _, pn := range c.conn.AckQueue[space] {
+		if pn > largestAcknowledged {
+			packetNumbers = append(packetNumbers, pn)
+		}
+	}
+	c.conn.AckQueue[space] = packetNumbers
+}
+
+// Answers HTTP/0.9 requests once their stream is closed by the client, see https://tools.ietf.org/html/rfc1945#section-4.1
+func (c *connection) handleStreamFrame(f *qt.StreamFrame) {
+	if f.StreamId%4 != 0 {
+		return
+	}
+	if f.StreamId/4 >= c.server.Config.MaxBidiStreams {
+		c.closeWithError(streamLimitError, "stream limit exceeded")
+		return
+	}
+	if _, responded := c.streamLimits[f.StreamId]; !responded && c.conn.Streams.Get(f.StreamId).ReadClosed {
+		c.streamLimits[f.StreamId] = c.clientParameters.MaxStreamDataBidiLocal
+		c.responses[f.StreamId] = make([]byte, c.server.Config.ResponseSize)
+	}
+}
+
+func (c *connection) handleTLSEvents() {
+	for {
+		e := c.tls.NextEvent()
+		switch e.Kind {
+		case tls.QUICNoEvent:
+			return
+		case tls.QUICWriteData:
+			space := encryptionLevelToSpace[quicLevelToEncryptionLevel[e.Level]]
+			stream := c.conn.CryptoStreams.Get(space)
+			for data := e.Data; len(data) > 0; {
+				n := len(data)
+				if n > maxCryptoFrameSize {
+					n = maxCryptoFrameSize
+				}
+				c.pending[space] = append(c.pending[space], qt.NewCryptoFrame(stream, append([]byte(nil), data[:n]...)))
+				data = data[n:]
+			}
+		case tls.QUICSetReadSecret, tls.QUICSetWriteSecret:
+			level := quicLevelToEncryptionLevel[e.Level]
+			if level == qt.EncryptionLevel0RTT {
+				break
+			}
+			suite := qt.CipherSuite(e.Suite)
+			secret := append([]byte(nil), e.Data...)
+			if c.conn.CryptoStates[level] == nil {
+				c.conn.CryptoStates[level] = new(qt.CryptoState)
+			}
+			if e.Kind == tls.QUICSetReadSecret {
+				c.conn.CryptoStates[level].InitRead(nil, c.conn.VersionProfile, suite, secret)
+			} else {
+				c.conn.CryptoStates[level].InitWrite(nil, c.conn.VersionProfile, suite, secret)
+			}
+			if level == qt.EncryptionLevel1RTT {
+				c.conn.CipherSuite = suite
+				if e.Kind == tls.QUICSetReadSecret {
+					c.readSecret = secret
+				} else {
+					c.writeSecret = secret
+				}
+			}
+		case tls.QUICTransportParameters:
+			handler := qt.NewTLSTransportParameterHandler(c.conn.Version, c.conn.Version)
+			if err := handler.ReceiveExtensionData(e.Data); err != nil {
+				c.server.Logger.Printf("Invalid transport parameters: %s\n", err.Error())
+				handler.ReceivedParameters = new(qt.QuicTransportParameters)
+			}
+			c.clientParameters = handler.ReceivedParameters
+			c.maxData = c.clientParameters.MaxData
+			c.negotiateVersion()
+		case tls.QUICTransportParametersRequired:
+			c.tls.SetTransportParameters(c.transportParameters())
+		case tls.QUICHandshakeDone:
+			c.server.Logger.Println("The handshake completed")
+			c.handshakeComplete = true
+			c.addressValidated = true
+			for _, space := range []qt.PNSpace{qt.PNSpaceInitial, qt.PNSpaceHandshake} {
+				c.pending[space] = nil
+				c.sent[space] = make(map[qt.PacketNumber]sentPacket)
+				c.ackNeeded[space] = false
+			}
+			if c.conn.VersionProfile.SupportsFrame(qt.HandshakeDoneType) {
+				c.pending[qt.PNSpaceAppData] = append(c.pending[qt.PNSpaceAppData], new(qt.HandshakeDoneFrame))
+			}
+			c.issueConnectionID()
+		}
+	}
+}
+
+// Returns the time after which the packets not acknowledged are considered lost, see https://tools.ietf.org/html/rfc9002#section-6.2
+func (c *connection) probeTimeout() time.Duration {
+	backoff := c.ptoCount
+	if backoff > maxPTOBackoff {
+		backoff = maxPTOBackoff
+	}
+	return initialPTO << backoff
+}
+
+func (c *connection) onTick(now time.Time) {
+	if c.closed {
+		return
+	}
+	if now.Sub(c.lastActivity) > c.server.Config.IdleTimeout {
+		c.server.Logger.Println("The connection timed out")
+		c.close()
+		return
+	}
+	var lost bool
+	for _, space := range spaces {
+		for pn, p := range c.sent[space] {
+			if now.Sub(p.time) > c.probeTimeout() {
+				for _, f := range p.frames {
+					if f.FrameType() != qt.PaddingFrameType {
+						c.pending[space] = append(c.pending[space], f)
+					}
+				}
+				delete(c.sent[space], pn)
+				lost = true
+			}
+		}
+	}
+	if lost {
+		c.ptoCount++
+	}
+	c.flush()
+}
+
+// Returns whether sending a datagram of the maximum size would exceed the amplification limit
+func (c *connection) amplificationLimited() bool {
+	if c.addressValidated || c.server.Config.Misbehaviors&IgnoreAmplificationLimit != 0 {
+		return false
+	}
+	return c.bytesSent+maxPacketSize > amplificationLimit*c.bytesReceived
+}
+
+// Sends the pending frames, the acknowledgements and the stream data allowed by flow control, one packet per datagram
+func (c *connection) flush() {
+	for _, space := range spaces {
+		cryptoState := c.conn.CryptoStates[spaceToEncryptionLevel[space]]
+		if cryptoState == nil || cryptoState.Write == nil {
+			continue
+		}
+		for !c.closed && !c.amplificationLimited() {
+			packet := c.newPacket(space)
+			if packet == nil {
+				break
+			}
+			packetBytes := c.conn.EncryptPacket(packet, spaceToEncryptionLevel[space])
+			c.server.socket.WriteToUDP(packetBytes, c.addr)
+			c.bytesSent += len(packetBytes)
+			if packet.ShouldBeAcknowledged() {
+				var ack *qt.AckFrame
+				if packet.Contains(qt.AckType) {
+					ack = packet.GetFirst(qt.AckType).(*qt.AckFrame)
+				}
+				c.sent[space][packet.Header().PacketNumber()] = sentPacket{packet.GetRetransmittableFrames(), ack, time.Now()}
+			}
+		}
+	}
+}
+
+// Returns a packet containing what remains to be sent in the given space, or nil when there is nothing to send
+func (c *connection) newPacket(space qt.PNSpace) qt.Framer {
+	var packet qt.Framer
+	switch space {
+	case qt.PNSpaceInitial:
+		packet = qt.NewInitialPacket(c.conn)
+	case qt.PNSpaceHandshake:
+		packet = qt.NewHandshakePacket(c.conn)
+	default:
+		packet = qt.NewProtectedPacket(c.conn)
+	}
+	room := maxPacketSize - len(packet.EncodeHeader()) - 2 - c.conn.CryptoStates[spaceToEncryptionLevel[space]].Write.Overhead()
+
+	if c.ackNeeded[space] || (len(c.pending[space]) > 0 && len(c.conn.AckQueue[space]) > 0) {
+		if ack := c.conn.GetAckFrame(space); ack != nil && int(ack.FrameLength()) <= room {
+			packet.AddFrame(ack)
+			room -= int(ack.FrameLength())
+		}
+		c.ackNeeded[space] = false
+	}
+
+	for len(c.pending[space]) > 0 && int(c.pending[space][0].FrameLength()) <= room {
+		f := c.pending[space][0]
+		c.pending[space] = c.pending[space][1:]
+		packet.AddFrame(f)
+		room -= int(f.FrameLength())
+	}
+
+	if space == qt.PNSpaceAppData {
+		c.addStreamFrames(packet, room)
+	}
+
+	if len(packet.GetFrames()) == 0 {
+		c.conn.PacketNumber[space]-- // The packet number was not used
+		return nil
+	}
+	if space == qt.PNSpaceInitial && packet.ShouldBeAcknowledged() {
+		length := len(c.conn.EncryptPacket(packet, qt.EncryptionLevelInitial))
+		for i := length; i < minimumInitialSize; i++ {
+			packet.AddFrame(new(qt.PaddingFrame))
+		}
+	}
+	return packet
+}
+
+func (c *connection) addStreamFrames(packet qt.Framer, room int) {
+	var streamIDs []uint64
+	for streamID := range c.responses {
+		streamIDs = append(streamIDs, streamID)
+	}
+	sort.Slice(streamIDs, func(i, j int) bool { return streamIDs[i] < streamIDs[j] })
+
+	for _, streamID := range streamIDs {
+		data := c.responses[streamID]
+		stream := c.conn.Streams.Get(streamID)
+		n := uint64(len(data))
+		if c.server.Config.Misbehaviors&IgnoreFlowControl == 0 {
+			n = minimum(n, c.streamLimits[streamID]-stream.WriteOffset, c.maxData-c.dataSent)
+		}
+		overhead := 1 + 8 + 8 + 8 // The type byte and the largest varints for the stream ID, offset and length
+		if room <= overhead {
+			return
+		}
+		n = minimum(n, uint64(room-overhead))
+		if n == 0 && len(data) > 0 {
+			continue
+		}
+		fin := n == uint64(len(data))
+		frame := qt.NewStreamFrame(streamID, stream, data[:n], fin)
+		packet.AddFrame(frame)
+		room -= int(frame.FrameLength())
+		c.dataSent += n
+		if fin {
+			delete(c.responses, streamID)
+		} else {
+			c.responses[streamID] = data[n:]
+		}
+	}
+}
+
+// Closes the connection with a CONNECTION_CLOSE frame sent at the highest encryption level available
+func (c *connection) closeWithError(errorCode uint64, reason string) {
+	space := qt.PNSpaceInitial
+	for _, s := range spaces {
+		if state := c.conn.CryptoStates[spaceToEncryptionLevel[s]]; state != nil && state.Write != nil {
+			space = s
+		}
+	}
+	c.pending[space] = append(c.pending[space], &qt.ConnectionCloseFrame{ErrorCode: errorCode, ReasonPhraseLength: uint64(len(reason)), ReasonPhrase: reason})
+	c.flush()
+	c.close()
+}
+
+func (c *connection) close() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.tls.Close()
+	for _, cid := range c.connectionIDs {
+		delete(c.server.connections, cid)
+	}
+}
+
+func minimum(values ...uint64) uint64 {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
@@ -0,0 +1,303 @@
+// +build go1.21
+
+// Package server implements a minimal QUIC server on top of the packet and frame types of QUIC-Tracker. It answers
+// HTTP/0.9 requests and can be configured to misbehave in the ways the test scenarios detect, so that the scenarios
+// can be tested against a local host rather than against the hosts of ietf_quic_hosts.txt. It relies on the QUIC API
+// of crypto/tls and is only meant for testing.
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	qt "github.com/RohitPanda/quic-tracker"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// A Misbehavior makes the server break a rule of QUIC on purpose
+type Misbehavior uint32
+
+const (
+	SkipRetry                        Misbehavior = 1 << iota // Does not send Retry packets even when Config.Retry is set
+	InvalidRetryIntegrityTag                                 // Sends Retry packets with a corrupted integrity tag
+	IgnoreKeyUpdate                                          // Discards the packets protected with the keys of the next key phase
+	RefuseMigration                                          // Discards the packets received from another address than the one of the handshake
+	IgnoreFlowControl                                        // Sends stream data regardless of the flow control limits of the client
+	IgnoreAmplificationLimit                                 // Sends more than three times the amount of data received before the address of the client is validated
+	FixedVersionNegotiationBits                              // Sends Version Negotiation packets with unused bits that are always zero
+	AcknowledgeAckOnly                                       // Acknowledges the packets that are not ack-eliciting in ACK-only packets
+	IgnoreStopSendingOnReceiveStream                         // Ignores STOP_SENDING frames received for the streams the server cannot send on
+	KeepDestinationCID                                       // Keeps its destination CID when the client switches to a new connection ID of the server
+	SkipConnectionIDReplacement                              // Does not issue a new connection ID when the client retires one
+)
+
+const (
+	connectionIDLength = 8
+	minimumInitialSize = 1200 // See https://tools.ietf.org/html/rfc9000#section-14.1
+	amplificationLimit = 3    // See https://tools.ietf.org/html/rfc9000#section-8
+	tickInterval       = 10 * time.Millisecond
+)
+
+type Config struct {
+	Versions     []uint32 // The versions accepted in order of preference, Initial packets of other versions are answered with a Version Negotiation packet
+	Retry        bool     // Whether a Retry token is required before creating a connection
+	ResponseSize int      // The number of bytes sent in response to HTTP/0.9 requests
+
+	// The transport parameters announced
+	MaxData        uint64
+	MaxStreamData  uint64
+	MaxBidiStreams uint64
+	MaxUniStreams  uint64
+	IdleTimeout    time.Duration
+
+	Misbehaviors Misbehavior
+}
+
+// Returns the configuration of a compliant server accepting QUIC version 1
+func DefaultConfig() Config {
+	return Config{
+		Versions:       []uint32{qt.QuicVersion1},
+		ResponseSize:   4096,
+		MaxData:        1 << 20,
+		MaxStreamData:  1 << 18,
+		MaxBidiStreams: 16,
+		MaxUniStreams:  16,
+		IdleTimeout:    10 * time.Second,
+	}
+}
+
+type datagram struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// A Server listens on a UDP socket and serves each connection from a single goroutine. The connections are found by
+// the destination CID of the packets received.
+type Server struct {
+	Config      Config
+	Logger      *log.Logger
+	socket      *net.UDPConn
+	tlsConfig   *tls.Config
+	tokenPrefix []byte
+	connections map[string]*connection
+	datagrams   chan datagram
+	close       chan bool
+	closed      chan bool
+}
+
+// Creates a server listening on the given address, e.g. "127.0.0.1:0" for a random port
+func NewServer(address string, config Config) (*Server, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := newSelfSignedCertificate()
+	if err != nil {
+		return nil, err
+	}
+	socket, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Config:      config,
+		socket:      socket,
+		tokenPrefix: make([]byte, 16),
+		connections: make(map[string]*connection),
+		datagrams:   make(chan datagram, 1000),
+		close:       make(chan bool),
+		closed:      make(chan bool),
+	}
+	s.Logger = log.New(os.Stderr, fmt.Sprintf("[server %s] ", socket.LocalAddr().String()), log.Lshortfile)
+	rand.Read(s.tokenPrefix)
+	s.tlsConfig = &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{certificate},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c := s.tlsConfig.Clone()
+			c.GetConfigForClient = nil
+			c.NextProtos = hello.SupportedProtos // Every ALPN token is accepted
+			return c, nil
+		},
+	}
+
+	go s.read()
+	go s.run()
+	return s, nil
+}
+
+func (s *Server) Addr() *net.UDPAddr {
+	return s.socket.LocalAddr().(*net.UDPAddr)
+}
+
+// Stops serving the connections and closes the socket
+func (s *Server) Close() {
+	close(s.close)
+	s.socket.Close()
+	<-s.closed
+}
+
+func (s *Server) read() {
+	for {
+		buffer := make([]byte, qt.MaxUDPPayloadSize)
+		n, addr, err := s.socket.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		select {
+		case s.datagrams <- datagram{buffer[:n], addr}:
+		case <-s.close:
+			return
+		}
+	}
+}
+
+func (s *Server) run() {
+	defer close(s.closed)
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case d := <-s.datagrams:
+			s.handleDatagram(d)
+		case now := <-ticker.C:
+			for _, c := range s.uniqueConnections() {
+				c.onTick(now)
+			}
+		case <-s.close:
+			for _, c := range s.uniqueConnections() {
+				c.close()
+			}
+			return
+		}
+	}
+}
+
+func (s *Server) uniqueConnections() []*connection {
+	var connections []*connection
+	seen := make(map[*connection]bool)
+	for _, c := range s.connections {
+		if !seen[c] {
+			seen[c] = true
+			connections = append(connections, c)
+		}
+	}
+	return connections
+}
+
+func (s *Server) handleDatagram(d datagram) {
+	defer func() {
+		if r := recover(); r != nil { // The packet readers panic on malformed frames
+			s.Logger.Printf("Discarding malformed datagram from %s: %v\n", d.addr.String(), r)
+		}
+	}()
+	if len(d.data) == 0 {
+		return
+	}
+
+	if d.data[0]&0x80 == 0 {
+		if len(d.data) < 1+connectionIDLength {
+			return
+		}
+		if c := s.connections[string(d.data[1:1+connectionIDLength])]; c != nil {
+			c.handleDatagram(d)
+		}
+		return
+	}
+
+	if len(d.data) < 5 {
+		return
+	}
+	version := binary.BigEndian.Uint32(d.data[1:5])
+	profile := qt.GetVersionProfile(version)
+	if !s.supports(version) || profile == nil {
+		s.sendVersionNegotiation(d, profile)
+		return
+	}
+	header := qt.ReadLongHeader(bytes.NewReader(d.data), &qt.Connection{VersionProfile: profile})
+	if c := s.connections[string(header.DestinationCID)]; c != nil {
+		c.handleDatagram(d)
+		return
+	}
+	if header.PacketType() != qt.Initial || len(d.data) < minimumInitialSize {
+		return
+	}
+
+	if s.Config.Retry && s.Config.Misbehaviors&SkipRetry == 0 {
+		if len(header.Token) == 0 {
+			s.sendRetry(d, header)
+			return
+		}
+		if !bytes.HasPrefix(header.Token, s.tokenPrefix) {
+			s.Logger.Printf("Discarding Initial packet from %s with an invalid token\n", d.addr.String())
+			return
+		}
+		originalDestinationCID := qt.ConnectionID(header.Token[len(s.tokenPrefix):])
+		c := newConnection(s, d.addr, header, header.DestinationCID, originalDestinationCID, header.DestinationCID)
+		c.addressValidated = true
+		c.handleDatagram(d)
+		return
+	}
+
+	connectionID := make([]byte, connectionIDLength)
+	rand.Read(connectionID)
+	c := newConnection(s, d.addr, header, connectionID, header.DestinationCID, nil)
+	c.handleDatagram(d)
+}
+
+func (s *Server) supports(version uint32) bool {
+	for _, v := range s.Config.Versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// See https://tools.ietf.org/html/rfc9000#section-6.1
+func (s *Server) sendVersionNegotiation(d datagram, profile *qt.VersionProfile) {
+	if len(d.data) < minimumInitialSize {
+		return
+	}
+	if profile == nil {
+		profile = qt.GetVersionProfile(qt.QuicVersion)
+	}
+	header := qt.ReadLongHeader(bytes.NewReader(d.data), &qt.Connection{VersionProfile: profile})
+	var versions []qt.SupportedVersion
+	for _, v := range s.Config.Versions {
+		versions = append(versions, qt.SupportedVersion(v))
+	}
+	unusedField := make([]byte, 1) // See https://tools.ietf.org/html/rfc9000#section-17.2.1
+	if s.Config.Misbehaviors&FixedVersionNegotiationBits == 0 {
+		rand.Read(unusedField)
+	}
+	conn := &qt.Connection{VersionProfile: profile, DestinationCID: header.SourceCID, SourceCID: header.DestinationCID}
+	vn := qt.NewVersionNegotiationPacket(unusedField[0]&0x7f, 0, versions, conn)
+	s.Logger.Printf("Sending Version Negotiation packet to %s\n", d.addr.String())
+	s.socket.WriteToUDP(vn.EncodePayload(), d.addr)
+}
+
+// Sends a Retry packet with a token made of the original destination CID, see https://tools.ietf.org/html/rfc9000#section-8.1.2
+func (s *Server) sendRetry(d datagram, header *qt.LongHeader) {
+	connectionID := make([]byte, connectionIDLength)
+	rand.Read(connectionID)
+	conn := &qt.Connection{
+		Version:                header.Version,
+		VersionProfile:         header.Profile(),
+		DestinationCID:         header.SourceCID,
+		SourceCID:              connectionID,
+		OriginalDestinationCID: header.DestinationCID,
+	}
+	retry := qt.NewRetryPacket(conn, append(append([]byte(nil), s.tokenPrefix...), header.DestinationCID...))
+	if s.Config.Misbehaviors&InvalidRetryIntegrityTag != 0 && len(retry.RetryIntegrityTag) > 0 {
+		retry.RetryIntegrityTag[0] ^= 0xff
+	}
+	s.Logger.Printf("Sending Retry packet to %s\n", d.addr.String())
+	s.socket.WriteToUDP(retry.Encode(retry.EncodePayload()), d.addr)
+}
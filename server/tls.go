@@ -0,0 +1,65 @@
+// +build go1.21
+
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	qt "github.com/RohitPanda/quic-tracker"
+	"github.com/RohitPanda/quic-tracker/lib"
+	"math/big"
+	"time"
+)
+
+// Clients do not verify the certificate of the server, a self-signed one is generated for each server
+func newSelfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{certificate}, PrivateKey: key}, nil
+}
+
+// Encodes the transport parameters of the server, see https://tools.ietf.org/html/rfc9000#section-18.2
+func (c *connection) transportParameters() []byte {
+	buffer := new(bytes.Buffer)
+	addParameter := func(parameterType qt.TransportParametersType, value []byte) {
+		lib.WriteVarInt(buffer, uint64(parameterType))
+		lib.WriteVarInt(buffer, uint64(len(value)))
+		buffer.Write(value)
+	}
+	config := c.server.Config
+	addParameter(qt.OriginalConnectionId, c.originalDestinationCID)
+	addParameter(qt.InitialSourceConnectionId, c.conn.SourceCID)
+	if c.retrySourceCID != nil {
+		addParameter(qt.RetrySourceConnectionId, c.retrySourceCID)
+	}
+	addParameter(qt.IdleTimeout, lib.EncodeVarInt(uint64(config.IdleTimeout/time.Millisecond)))
+	addParameter(qt.InitialMaxData, lib.EncodeVarInt(config.MaxData))
+	addParameter(qt.InitialMaxStreamDataBidiLocal, lib.EncodeVarInt(config.MaxStreamData))
+	addParameter(qt.InitialMaxStreamDataBidiRemote, lib.EncodeVarInt(config.MaxStreamData))
+	addParameter(qt.InitialMaxStreamDataUni, lib.EncodeVarInt(config.MaxStreamData))
+	addParameter(qt.InitialMaxStreamsBidi, lib.EncodeVarInt(config.MaxBidiStreams))
+	addParameter(qt.InitialMaxStreamsUni, lib.EncodeVarInt(config.MaxUniStreams))
+	versionInformation := qt.VersionInformationParameter{ChosenVersion: c.conn.Version, AvailableVersions: config.Versions}
+	addParameter(qt.VersionInformation, versionInformation.Encode())
+	return buffer.Bytes()
+}
@@ -0,0 +1,9 @@
+// +build cgo
+
+package store
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var errNoSQLite error
@@ -0,0 +1,10 @@
+// +build !cgo
+
+package store
+
+import (
+	"errors"
+)
+
+// The SQLite driver is a cgo package, the store cannot be opened without it
+var errNoSQLite = errors.New("the store requires SQLite, which is only available when built with cgo, i.e. with CGO_ENABLED=1 and a C compiler")
@@ -0,0 +1,199 @@
+// Package store records the runs of the test suite in a SQLite database, so that the results of the hosts can be
+// followed over time.
+//
+// A run has the git commit of the test suite, the time at which it started and the flags it was given. Each trace of
+// the run is stored with its results and named verdict, and optionally with its pcap and the packets exchanged.
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	qt "github.com/RohitPanda/quic-tracker"
+	"github.com/RohitPanda/quic-tracker/scenarii"
+	"strings"
+	"time"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	commit_id  TEXT NOT NULL,
+	started_at INTEGER NOT NULL,
+	flags      TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS traces (
+	id               INTEGER PRIMARY KEY AUTOINCREMENT,
+	run_id           INTEGER NOT NULL REFERENCES runs(id) ON DELETE CASCADE,
+	scenario         TEXT NOT NULL,
+	scenario_version INTEGER NOT NULL,
+	host             TEXT NOT NULL,
+	ip               TEXT NOT NULL,
+	address_family   TEXT NOT NULL,
+	started_at       INTEGER NOT NULL,
+	duration         INTEGER NOT NULL,
+	error_code       INTEGER NOT NULL,
+	verdict          TEXT NOT NULL,
+	severity         TEXT NOT NULL,
+	results          TEXT NOT NULL,
+	impairment       TEXT,
+	pcap             BLOB,
+	stream           TEXT
+);
+CREATE INDEX IF NOT EXISTS traces_host_scenario ON traces (host, scenario, run_id);
+`
+
+// A run of the test suite
+type Run struct {
+	Id        int64             `json:"id"`
+	Commit    string            `json:"commit"`
+	StartedAt time.Time         `json:"started_at"`
+	Flags     map[string]string `json:"flags"` // The flags that were set, by name
+}
+
+// The result of a scenario against a host in a run of the test suite
+type Entry struct {
+	Run             Run                    `json:"run"`
+	Scenario        string                 `json:"scenario"`
+	ScenarioVersion int                    `json:"scenario_version"`
+	Host            string                 `json:"host"`
+	Ip              string                 `json:"ip"`
+	AddressFamily   string                 `json:"address_family,omitempty"`
+	StartedAt       int64                  `json:"started_at"`
+	Duration        uint64                 `json:"duration"`
+	ErrorCode       uint8                  `json:"error_code"`
+	Verdict         string                 `json:"verdict"`
+	Severity        scenarii.Severity      `json:"severity,omitempty"` // It is empty when the scenario succeeded
+	Results         map[string]interface{} `json:"results"`
+}
+
+type Store struct {
+	db *sql.DB
+}
+
+// Opens the SQLite database, it is created when it does not exist
+func Open(filename string) (*Store, error) {
+	if errNoSQLite != nil {
+		return nil, errNoSQLite
+	}
+	db, err := sql.Open("sqlite3", filename+"?_foreign_keys=1")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	return &Store{db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Records the run and its traces, the id of the run is set. The pcap and the packets of the traces are stored when
+// withPackets is set.
+func (s *Store) AddRun(run *Run, traces []qt.Trace, withPackets bool) error {
+	flags, err := json.Marshal(run.Flags)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO runs (commit_id, started_at, flags) VALUES (?, ?, ?)", run.Commit, run.StartedAt.Unix(), string(flags))
+	if err != nil {
+		return err
+	}
+	runId, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO traces (run_id, scenario, scenario_version, host, ip, address_family, started_at,
+		duration, error_code, verdict, severity, results, impairment, pcap, stream) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i := range traces {
+		t := &traces[i]
+		results, err := json.Marshal(t.Results)
+		if err != nil {
+			return err
+		}
+		var impairment, pcap, stream interface{}
+		if t.Impairment != nil {
+			out, err := json.Marshal(t.Impairment)
+			if err != nil {
+				return err
+			}
+			impairment = string(out)
+		}
+		if withPackets {
+			out, err := json.Marshal(t.Stream)
+			if err != nil {
+				return err
+			}
+			pcap, stream = t.Pcap, string(out)
+		}
+		var severity scenarii.Severity
+		if t.ErrorCode != 0 {
+			severity = scenarii.VerdictSeverity(t.Scenario, t.ErrorCode)
+		}
+		_, err = stmt.Exec(runId, t.Scenario, t.ScenarioVersion, t.Host, t.Ip, t.AddressFamily, t.StartedAt, t.Duration,
+			t.ErrorCode, scenarii.Verdict(t.Scenario, t.ErrorCode), string(severity), string(results), impairment, pcap, stream)
+		if err != nil {
+			return fmt.Errorf("%s %s: %s", t.Scenario, t.Host, err.Error())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	run.Id = runId
+	return nil
+}
+
+var likeEscaper = strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+
+// Returns the results of the host over the last runs in which it was tested, the most recent first. The host matches
+// the host of the traces with or without its port. All the scenarii are returned when scenario is empty.
+func (s *Store) History(host string, scenario string, runs int) ([]Entry, error) {
+	filter := "(t.host = ? OR t.host LIKE ? ESCAPE '\\') AND (? = '' OR t.scenario = ?)"
+	args := []interface{}{host, likeEscaper.Replace(host) + ":%", scenario, scenario}
+
+	rows, err := s.db.Query(`SELECT r.id, r.commit_id, r.started_at, r.flags, t.scenario, t.scenario_version, t.host, t.ip,
+		t.address_family, t.started_at, t.duration, t.error_code, t.verdict, t.severity, t.results
+		FROM traces t JOIN runs r ON r.id = t.run_id
+		WHERE `+filter+` AND t.run_id IN (SELECT DISTINCT t.run_id FROM traces t WHERE `+filter+` ORDER BY t.run_id DESC LIMIT ?)
+		ORDER BY t.run_id DESC, t.id`, append(append(args, args...), runs)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		var e Entry
+		var startedAt int64
+		var flags, severity, results string
+		err := rows.Scan(&e.Run.Id, &e.Run.Commit, &startedAt, &flags, &e.Scenario, &e.ScenarioVersion, &e.Host, &e.Ip,
+			&e.AddressFamily, &e.StartedAt, &e.Duration, &e.ErrorCode, &e.Verdict, &severity, &results)
+		if err != nil {
+			return nil, err
+		}
+		e.Run.StartedAt = time.Unix(startedAt, 0)
+		e.Severity = scenarii.Severity(severity)
+		if err := json.Unmarshal([]byte(flags), &e.Run.Flags); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(results), &e.Results); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
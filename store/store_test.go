@@ -0,0 +1,89 @@
+package store
+
+import (
+	qt "github.com/RohitPanda/quic-tracker"
+	"github.com/RohitPanda/quic-tracker/scenarii"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	if errNoSQLite != nil {
+		t.Skip(errNoSQLite)
+	}
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Open(filepath.Join(dir, "results.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 4; i++ {
+		traces := []qt.Trace{
+			{Scenario: "zero_rtt", Host: "quic.example.org:443", Ip: "192.0.2.1", Duration: uint64(i), Results: map[string]interface{}{"run": i}, Pcap: []byte{1, 2, 3}},
+			{Scenario: "zero_rtt", Host: "quic.example.com:443", ErrorCode: scenarii.ZR_ZeroRTTFailed, Results: map[string]interface{}{}},
+		}
+		if i%2 == 1 {
+			traces[0].ErrorCode = scenarii.ZR_ZeroRTTFailed
+		}
+		if i == 3 {
+			traces = traces[1:] // The host was not tested in the last run
+		}
+		run := &Run{Commit: "0123456789abcdef", StartedAt: time.Unix(int64(1000+i), 0), Flags: map[string]string{"scenario": "zero_rtt"}}
+		if err := s.AddRun(run, traces, i == 0); err != nil {
+			t.Fatal(err)
+		}
+		if run.Id != int64(i+1) {
+			t.Errorf("unexpected run id %d", run.Id)
+		}
+	}
+
+	entries, err := s.History("quic.example.org", "zero_rtt", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if e := entries[0]; e.Run.Id != 3 || e.Duration != 2 || e.ErrorCode != 0 || e.Verdict != "Success" || e.Severity != "" || e.Results["run"] != 2.0 {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e := entries[1]; e.Run.Id != 2 || e.Verdict != "Zero RTT failed" || e.Severity != scenarii.SeverityFailure || e.Run.Flags["scenario"] != "zero_rtt" || e.Run.StartedAt.Unix() != 1001 {
+		t.Errorf("unexpected entry %+v", e)
+	}
+
+	for _, c := range []struct {
+		host     string
+		scenario string
+		expected int
+	}{
+		{"quic.example.org:443", "", 3},
+		{"quic.example.org", "handshake", 0},
+		{"quic.example", "", 0},
+		{"quic.example.%", "", 0},
+	} {
+		entries, err := s.History(c.host, c.scenario, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != c.expected {
+			t.Errorf("%s %s: expected %d entries, got %d", c.host, c.scenario, c.expected, len(entries))
+		}
+	}
+
+	var pcaps int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM traces WHERE pcap IS NOT NULL").Scan(&pcaps); err != nil {
+		t.Fatal(err)
+	}
+	if pcaps != 1 {
+		t.Errorf("expected the pcap of the first run only, got %d", pcaps)
+	}
+}
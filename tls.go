@@ -0,0 +1,133 @@
+package quictracker
+
+import (
+	"fmt"
+	"sort"
+)
+
+// An Epoch is a TLS encryption level as seen by the TLS stack
+type Epoch int
+
+const (
+	EpochInitial Epoch = iota
+	Epoch0RTT
+	EpochHandshake
+	Epoch1RTT
+)
+
+const (
+	BaseLabel     = "tls13 "      // The prefix of HKDF-Expand-Label, see https://tools.ietf.org/html/rfc8446#section-7.1
+	QuicBaseLabel = "tls13 quic " // The prefix of the QUIC packet protection labels, see https://tools.ietf.org/html/rfc9001#section-5.1
+)
+
+// A TLSMessage is a piece of handshake data to send in a CRYPTO frame of the given epoch
+type TLSMessage struct {
+	Data  []byte
+	Epoch Epoch
+}
+
+// A TLSProvider is a TLS 1.3 stack that exchanges its handshake messages over CRYPTO frames. The secrets of each epoch
+// are returned as soon as they are available and empty otherwise. The cipher suite returned is the one of the keys
+// installed and is zero before any is. HandleMessage() must first be called with no data in the Initial epoch to
+// obtain the ClientHello, it then returns the messages to send and whether the handshake is not yet completed.
+type TLSProvider interface {
+	HandleMessage(data []byte, epoch Epoch) ([]TLSMessage, bool, error)
+	ZeroRTTSecret() []byte
+	HandshakeReadSecret() []byte
+	HandshakeWriteSecret() []byte
+	ProtectedReadSecret() []byte
+	ProtectedWriteSecret() []byte
+	ExporterSecret() ([]byte, error) // Returns an error when the TLS stack does not expose it
+	ResumptionTicket() []byte
+	ClientRandom() []byte
+	CipherSuite() CipherSuite
+	SetCipherSuites(suites []CipherSuite) error // Restricts the cipher suites the handshake completes with, in order of preference
+	OffersAllCipherSuites() bool                // Whether all the cipher suites are offered regardless of SetCipherSuites, see CipherSuiteNotAllowedError
+	SetQUICTransportParameters(data []byte)
+	ReceivedQUICTransportParameters() []byte
+	Close()
+}
+
+// Returned by the TLS providers that cannot restrict the cipher suites they offer when the server selects one that is
+// not among those set with SetCipherSuites. The handshake is then aborted.
+type CipherSuiteNotAllowedError struct {
+	Selected CipherSuite
+	Allowed  []CipherSuite
+}
+
+func (e *CipherSuiteNotAllowedError) Error() string {
+	return fmt.Sprintf("the server selected %s, which is not among the cipher suites allowed %v", e.Selected, e.Allowed)
+}
+
+type NewTLSProviderFunc func(serverName string, ALPN string, resumptionTicket []byte) TLSProvider
+
+// The TLS providers compiled in. pigotls requires cgo and crypto/tls requires Go 1.21.
+var TLSProviders = make(map[string]NewTLSProviderFunc)
+
+// The codepoints of the transport parameters extension each TLS provider sends, see VersionProfile. pigotls only sends
+// the draft codepoint and crypto/tls the one of RFC 9001.
+var tlsProvidersExtensions = make(map[string][]uint16)
+
+// The order in which TLS providers are chosen when DefaultTLSProvider is empty
+var tlsProvidersPreference = []string{"pigotls", "crypto/tls"}
+
+// The name of the TLS provider used by new connections
+var DefaultTLSProvider string
+
+// Sets the TLS provider used by new connections, the empty name selects the first one available
+func SetDefaultTLSProvider(name string) error {
+	if _, ok := TLSProviders[name]; name != "" && !ok {
+		return fmt.Errorf("unknown TLS provider %q, available providers are %v", name, TLSProviderNames())
+	}
+	DefaultTLSProvider = name
+	return nil
+}
+
+func registerTLSProvider(name string, f NewTLSProviderFunc, transportParametersExtensions ...uint16) {
+	TLSProviders[name] = f
+	tlsProvidersExtensions[name] = transportParametersExtensions
+}
+
+func tlsProviderSends(name string, transportParametersExtension uint16) bool {
+	for _, e := range tlsProvidersExtensions[name] {
+		if e == transportParametersExtension {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the names of the TLS providers compiled in
+func TLSProviderNames() []string {
+	var names []string
+	for name := range TLSProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns a new instance of DefaultTLSProvider, or of the first provider available that sends the transport parameters
+// in the given TLS extension when it is empty. An error is returned when the provider cannot send this extension.
+func NewTLSProvider(serverName string, ALPN string, resumptionTicket []byte, transportParametersExtension uint16) (TLSProvider, error) {
+	name := DefaultTLSProvider
+	if name == "" {
+		for _, n := range tlsProvidersPreference {
+			if _, ok := TLSProviders[n]; ok && tlsProviderSends(n, transportParametersExtension) {
+				name = n
+				break
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("no TLS provider among %v sends the transport parameters extension %#x", TLSProviderNames(), transportParametersExtension)
+		}
+	}
+	f, ok := TLSProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS provider %q, available providers are %v", name, TLSProviderNames())
+	}
+	if !tlsProviderSends(name, transportParametersExtension) {
+		return nil, fmt.Errorf("the TLS provider %q cannot send the transport parameters extension %#x", name, transportParametersExtension)
+	}
+	return f(serverName, ALPN, resumptionTicket), nil
+}
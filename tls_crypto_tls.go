@@ -0,0 +1,223 @@
+// +build go1.21
+
+package quictracker
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	. "github.com/RohitPanda/quic-tracker/lib"
+	"io"
+	"strings"
+)
+
+func init() {
+	registerTLSProvider("crypto/tls", newCryptoTLSProvider, TransportParametersExtension)
+}
+
+var epochToQUICLevel = map[Epoch]tls.QUICEncryptionLevel{
+	EpochInitial:   tls.QUICEncryptionLevelInitial,
+	Epoch0RTT:      tls.QUICEncryptionLevelEarly,
+	EpochHandshake: tls.QUICEncryptionLevelHandshake,
+	Epoch1RTT:      tls.QUICEncryptionLevelApplication,
+}
+
+var quicLevelToEpoch = map[tls.QUICEncryptionLevel]Epoch{
+	tls.QUICEncryptionLevelInitial:     EpochInitial,
+	tls.QUICEncryptionLevelEarly:       Epoch0RTT,
+	tls.QUICEncryptionLevelHandshake:   EpochHandshake,
+	tls.QUICEncryptionLevelApplication: Epoch1RTT,
+}
+
+// Uses the QUIC API of the TLS stack of the Go standard library, which does not require cgo. This stack does not
+// expose the exporter secret nor allows restricting the TLS 1.3 cipher suites offered, the cipher suites set are thus
+// enforced on the one the server selects. The client random is recovered from its key log. Resumption tickets are
+// only usable with this provider. As with pigotls, the certificate of the server is not verified.
+type cryptoTLSProvider struct {
+	conn                        *tls.QUICConn
+	started                     bool
+	completed                   bool
+	suite                       CipherSuite
+	cipherSuites                []CipherSuite // The cipher suites the handshake can complete with, all when empty
+	err                         error         // The handshake is aborted once an error occurred
+	transportParameters         []byte
+	receivedTransportParameters []byte
+	zeroRTTSecret               []byte
+	handshakeReadSecret         []byte
+	handshakeWriteSecret        []byte
+	protectedReadSecret         []byte
+	protectedWriteSecret        []byte
+	resumptionTicket            []byte
+	clientRandom                []byte
+}
+
+func newCryptoTLSProvider(serverName string, ALPN string, resumptionTicket []byte) TLSProvider {
+	p := new(cryptoTLSProvider)
+	cache := &cryptoTLSSessionCache{provider: p}
+	if len(resumptionTicket) > 0 {
+		cache.session, _ = decodeCryptoTLSResumptionTicket(resumptionTicket)
+	}
+	p.conn = tls.QUICClient(&tls.QUICConfig{TLSConfig: &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         []string{ALPN},
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: true,
+		ClientSessionCache: cache,
+		KeyLogWriter:       cryptoTLSKeyLog{p},
+	}})
+	return p
+}
+
+func (p *cryptoTLSProvider) HandleMessage(data []byte, epoch Epoch) ([]TLSMessage, bool, error) {
+	if p.err != nil {
+		return nil, true, p.err
+	}
+	if !p.started {
+		p.started = true
+		p.conn.SetTransportParameters(p.transportParameters)
+		if err := p.conn.Start(context.Background()); err != nil {
+			return nil, true, err
+		}
+	}
+	if len(data) > 0 {
+		if err := p.conn.HandleData(epochToQUICLevel[epoch], data); err != nil {
+			return nil, !p.completed, err
+		}
+	}
+	var messages []TLSMessage
+	for {
+		e := p.conn.NextEvent()
+		switch e.Kind {
+		case tls.QUICNoEvent:
+			return messages, !p.completed, nil
+		case tls.QUICWriteData:
+			messages = append(messages, TLSMessage{append([]byte(nil), e.Data...), quicLevelToEpoch[e.Level]})
+		case tls.QUICSetReadSecret, tls.QUICSetWriteSecret:
+			p.suite = CipherSuite(e.Suite)
+			if !p.allows(p.suite) {
+				p.err = &CipherSuiteNotAllowedError{p.suite, p.cipherSuites}
+				return nil, true, p.err
+			}
+			secret := append([]byte(nil), e.Data...)
+			read := e.Kind == tls.QUICSetReadSecret
+			switch {
+			case e.Level == tls.QUICEncryptionLevelEarly:
+				p.zeroRTTSecret = secret
+			case e.Level == tls.QUICEncryptionLevelHandshake && read:
+				p.handshakeReadSecret = secret
+			case e.Level == tls.QUICEncryptionLevelHandshake:
+				p.handshakeWriteSecret = secret
+			case e.Level == tls.QUICEncryptionLevelApplication && read:
+				p.protectedReadSecret = secret
+			case e.Level == tls.QUICEncryptionLevelApplication:
+				p.protectedWriteSecret = secret
+			}
+		case tls.QUICTransportParameters:
+			p.receivedTransportParameters = append([]byte(nil), e.Data...)
+		case tls.QUICHandshakeDone:
+			p.completed = true
+		}
+	}
+}
+
+func (p *cryptoTLSProvider) ZeroRTTSecret() []byte        { return p.zeroRTTSecret }
+func (p *cryptoTLSProvider) HandshakeReadSecret() []byte  { return p.handshakeReadSecret }
+func (p *cryptoTLSProvider) HandshakeWriteSecret() []byte { return p.handshakeWriteSecret }
+func (p *cryptoTLSProvider) ProtectedReadSecret() []byte  { return p.protectedReadSecret }
+func (p *cryptoTLSProvider) ProtectedWriteSecret() []byte { return p.protectedWriteSecret }
+func (p *cryptoTLSProvider) ExporterSecret() ([]byte, error) {
+	return nil, errors.New("crypto/tls does not expose the exporter secret, only keying material derived from it")
+}
+func (p *cryptoTLSProvider) ResumptionTicket() []byte { return p.resumptionTicket }
+func (p *cryptoTLSProvider) ClientRandom() []byte     { return p.clientRandom }
+func (p *cryptoTLSProvider) CipherSuite() CipherSuite { return p.suite }
+func (p *cryptoTLSProvider) SetCipherSuites(suites []CipherSuite) error {
+	for _, s := range suites {
+		if _, ok := cipherSuiteToString[s]; !ok {
+			return fmt.Errorf("unknown TLS 1.3 cipher suite %#04x", uint16(s))
+		}
+	}
+	p.cipherSuites = suites
+	return nil
+}
+func (p *cryptoTLSProvider) OffersAllCipherSuites() bool { return true }
+func (p *cryptoTLSProvider) allows(suite CipherSuite) bool {
+	if len(p.cipherSuites) == 0 {
+		return true
+	}
+	for _, s := range p.cipherSuites {
+		if s == suite {
+			return true
+		}
+	}
+	return false
+}
+func (p *cryptoTLSProvider) SetQUICTransportParameters(data []byte) { p.transportParameters = data }
+func (p *cryptoTLSProvider) ReceivedQUICTransportParameters() []byte {
+	return p.receivedTransportParameters
+}
+func (p *cryptoTLSProvider) Close() { p.conn.Close() }
+
+// Offers the session of the resumption ticket given and exports the sessions received as resumption tickets
+type cryptoTLSSessionCache struct {
+	provider *cryptoTLSProvider
+	session  *tls.ClientSessionState
+}
+
+func (c *cryptoTLSSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return c.session, c.session != nil
+}
+func (c *cryptoTLSSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	if cs == nil {
+		return
+	}
+	ticket, state, err := cs.ResumptionState()
+	if err != nil {
+		return
+	}
+	stateBytes, err := state.Bytes()
+	if err != nil {
+		return
+	}
+	buffer := new(bytes.Buffer)
+	WriteVarInt(buffer, uint64(len(ticket)))
+	buffer.Write(ticket)
+	buffer.Write(stateBytes)
+	c.provider.resumptionTicket = buffer.Bytes()
+}
+
+// A resumption ticket is made of the length-prefixed session ticket followed by the session state
+func decodeCryptoTLSResumptionTicket(data []byte) (*tls.ClientSessionState, error) {
+	buffer := bytes.NewReader(data)
+	length, err := ReadVarIntValue(buffer)
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(buffer.Len()) {
+		return nil, errors.New("resumption ticket is too short")
+	}
+	ticket := make([]byte, length)
+	buffer.Read(ticket)
+	stateBytes, _ := io.ReadAll(buffer)
+	state, err := tls.ParseSessionState(stateBytes)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewResumptionState(ticket, state)
+}
+
+// Recovers the client random from the NSS key log lines written, see
+// https://developer.mozilla.org/en-US/docs/Mozilla/Projects/NSS/Key_Log_Format
+type cryptoTLSKeyLog struct {
+	provider *cryptoTLSProvider
+}
+
+func (l cryptoTLSKeyLog) Write(line []byte) (int, error) {
+	if fields := strings.Fields(string(line)); len(fields) == 3 && l.provider.clientRandom == nil {
+		l.provider.clientRandom, _ = hex.DecodeString(fields[1])
+	}
+	return len(line), nil
+}
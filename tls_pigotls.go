@@ -0,0 +1,66 @@
+// +build cgo
+
+package quictracker
+
+import (
+	"errors"
+	"github.com/mpiraux/pigotls"
+)
+
+func init() {
+	registerTLSProvider("pigotls", func(serverName string, ALPN string, resumptionTicket []byte) TLSProvider {
+		return &pigotlsProvider{pigotls.NewConnection(serverName, ALPN, resumptionTicket)}
+	}, TransportParametersExtensionDraft)
+}
+
+var epochToPigotls = map[Epoch]pigotls.Epoch{
+	EpochInitial:   pigotls.EpochInitial,
+	Epoch0RTT:      pigotls.Epoch0RTT,
+	EpochHandshake: pigotls.EpochHandshake,
+	Epoch1RTT:      pigotls.Epoch1RTT,
+}
+
+var pigotlsToEpoch = map[pigotls.Epoch]Epoch{
+	pigotls.EpochInitial:   EpochInitial,
+	pigotls.Epoch0RTT:      Epoch0RTT,
+	pigotls.EpochHandshake: EpochHandshake,
+	pigotls.Epoch1RTT:      Epoch1RTT,
+}
+
+// Uses picotls through cgo, see https://github.com/mpiraux/pigotls. pigotls sends the transport parameters in the
+// extension of the drafts, it is thus only used for draft versions.
+type pigotlsProvider struct {
+	*pigotls.Connection
+}
+
+func (p *pigotlsProvider) HandleMessage(data []byte, epoch Epoch) ([]TLSMessage, bool, error) {
+	output, notCompleted, err := p.Connection.HandleMessage(data, epochToPigotls[epoch])
+	var messages []TLSMessage
+	for _, m := range output {
+		messages = append(messages, TLSMessage{m.Data, pigotlsToEpoch[m.Epoch]})
+	}
+	return messages, notCompleted, err
+}
+
+func (p *pigotlsProvider) ExporterSecret() ([]byte, error) {
+	return p.Connection.ExporterSecret(), nil
+}
+
+// pigotls does not expose the cipher suite negotiated, but the three suites have different key and digest sizes
+func (p *pigotlsProvider) CipherSuite() CipherSuite {
+	if len(p.ZeroRTTSecret()) == 0 && len(p.HandshakeReadSecret()) == 0 && len(p.HandshakeWriteSecret()) == 0 {
+		return 0
+	}
+	if p.AEADKeySize() == 16 {
+		return TLS_AES_128_GCM_SHA256
+	} else if p.HashDigestSize() == 48 {
+		return TLS_AES_256_GCM_SHA384
+	}
+	return TLS_CHACHA20_POLY1305_SHA256
+}
+
+// pigotls does not expose the cipher suites of its context, they cannot be restricted
+func (p *pigotlsProvider) SetCipherSuites(suites []CipherSuite) error {
+	return errors.New("pigotls cannot restrict the cipher suites it offers")
+}
+func (p *pigotlsProvider) OffersAllCipherSuites() bool { return true }
@@ -1,11 +1,14 @@
 package quictracker
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
 	"os/exec"
 	"time"
 	"strings"
 	"unsafe"
-	"github.com/mpiraux/pigotls"
 )
 
 // Contains the result of a test run against a given host.
@@ -15,6 +18,7 @@ type Trace struct {
 	ScenarioVersion     int                    `json:"scenario_version"`
 	Host                string                 `json:"host"`       // The host against which the scenario was run
 	Ip                  string                 `json:"ip"`         // The IP that was resolved for the given host
+	AddressFamily       string                 `json:"address_family,omitempty"` // The family of the IP, either ipv4 or ipv6
 	Results             map[string]interface{} `json:"results"`    // A dictionary that allows to report scenario-specific results
 	StartedAt           int64                  `json:"started_at"` // The time at which the scenario started in epoch seconds
 	Duration            uint64                 `json:"duration"`   // Its duration in epoch milliseconds
@@ -22,11 +26,26 @@ type Trace struct {
 	Stream              []TracePacket          `json:"stream"`     // A clear-text copy of the packets that were sent and received
 	Pcap                []byte                 `json:"pcap"`       // The packet capture file associated with the trace
 	ClientRandom        []byte                 `json:"client_random"`
-	Secrets				map[pigotls.Epoch]Secrets `json:"secrets"`
+	CipherSuite         string                 `json:"cipher_suite,omitempty"` // The TLS cipher suite negotiated
+	Secrets				map[Epoch]Secrets `json:"secrets"`
+	Impairment          interface{}            `json:"impairment,omitempty"` // The impairment profile of the path, see the proxy package
+}
+
+const (
+	IPv4 = "ipv4"
+	IPv6 = "ipv6"
+)
+
+// Returns the address family of the IP, either IPv4 or IPv6
+func AddressFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return IPv4
+	}
+	return IPv6
 }
 
 type Secrets struct {
-	Epoch pigotls.Epoch `json:"epoch"`
+	Epoch Epoch `json:"epoch"`
 	Read  []byte        `json:"read"`
 	Write []byte        `json:"write"`
 }
@@ -44,12 +63,40 @@ func NewTrace(scenarioName string, scenarioVersion int, host string) *Trace {
 	return &trace
 }
 
-func (t *Trace) AddPcap(conn *Connection, cmd *exec.Cmd) error {
-	content, err := StopPcapCapture(conn, cmd)
-	if err != nil {
+// Adds the datagrams captured to the trace as a pcapng file, it must be called once the trace is completed so that the
+// secrets are included
+func (t *Trace) AddPcap(capture *PcapCapture) error {
+	buffer := new(bytes.Buffer)
+	if err := capture.WritePcapng(buffer, t.KeyLog()); err != nil {
 		return err
 	}
-	t.Pcap = content
+	t.Pcap = buffer.Bytes()
+	return nil
+}
+
+// Returns the secrets of the trace in the NSS key log format, see
+// https://developer.mozilla.org/en-US/docs/Mozilla/Projects/NSS/Key_Log_Format
+func (t *Trace) KeyLog() []byte {
+	if len(t.ClientRandom) == 0 {
+		return nil
+	}
+	buffer := new(bytes.Buffer)
+	writeSecret := func(label string, secret []byte) {
+		if len(secret) > 0 {
+			WriteKeyLogLine(buffer, label, t.ClientRandom, secret)
+		}
+	}
+	writeSecret("CLIENT_EARLY_TRAFFIC_SECRET", t.Secrets[Epoch0RTT].Write)
+	writeSecret("CLIENT_HANDSHAKE_TRAFFIC_SECRET", t.Secrets[EpochHandshake].Write)
+	writeSecret("SERVER_HANDSHAKE_TRAFFIC_SECRET", t.Secrets[EpochHandshake].Read)
+	writeSecret("CLIENT_TRAFFIC_SECRET_0", t.Secrets[Epoch1RTT].Write)
+	writeSecret("SERVER_TRAFFIC_SECRET_0", t.Secrets[Epoch1RTT].Read)
+	return buffer.Bytes()
+}
+
+// Writes a line of the NSS key log format in a single write, so that several connections can append to the same file
+func WriteKeyLogLine(w io.Writer, label string, clientRandom []byte, secret []byte) error {
+	_, err := fmt.Fprintf(w, "%s %x %x\n", label, clientRandom, secret)
 	return err
 }
 
@@ -61,9 +108,13 @@ func (t *Trace) MarkError(error uint8, message string, packet Packet) {
 	if packet == nil {
 		return
 	}
-	for _, tp := range t.Stream {
-		if tp.Pointer == packet.Pointer() {
-			tp.IsOfInterest = true
+	t.markPacketOfInterest(packet)
+}
+
+func (t *Trace) markPacketOfInterest(packet Packet) {
+	for i := range t.Stream {
+		if t.Stream[i].Pointer == packet.Pointer() {
+			t.Stream[i].IsOfInterest = true
 			return
 		}
 	}
@@ -82,17 +133,28 @@ func (t *Trace) Complete(conn *Connection) {
 	if len(t.ClientRandom) == 0 {
 		t.ClientRandom = conn.Tls.ClientRandom()
 	}
+	if conn.CipherSuite != 0 {
+		t.CipherSuite = conn.CipherSuite.String()
+	}
+	if rejectedRetries := conn.RejectedRetries(); len(rejectedRetries) > 0 {
+		var reasons []string
+		for _, r := range rejectedRetries {
+			reasons = append(reasons, r.Reason)
+			t.markPacketOfInterest(r.Packet)
+		}
+		t.Results["rejected_retries"] = reasons
+	}
 	if t.Secrets == nil {
-		t.Secrets = make(map[pigotls.Epoch]Secrets)
+		t.Secrets = make(map[Epoch]Secrets)
 	}
-	if _, ok := t.Secrets[pigotls.Epoch0RTT]; !ok && len(conn.Tls.ZeroRTTSecret()) > 0 {
-		t.Secrets[pigotls.Epoch0RTT] = Secrets{Epoch: pigotls.Epoch0RTT, Write: conn.Tls.ZeroRTTSecret()}
+	if _, ok := t.Secrets[Epoch0RTT]; !ok && len(conn.Tls.ZeroRTTSecret()) > 0 {
+		t.Secrets[Epoch0RTT] = Secrets{Epoch: Epoch0RTT, Write: conn.Tls.ZeroRTTSecret()}
 	}
-	if _, ok := t.Secrets[pigotls.EpochHandshake]; !ok && len(conn.Tls.HandshakeReadSecret()) > 0 || len(conn.Tls.HandshakeWriteSecret()) > 0 {
-		t.Secrets[pigotls.EpochHandshake] = Secrets{Epoch: pigotls.EpochHandshake, Read: conn.Tls.HandshakeReadSecret(), Write: conn.Tls.HandshakeWriteSecret()}
+	if _, ok := t.Secrets[EpochHandshake]; !ok && len(conn.Tls.HandshakeReadSecret()) > 0 || len(conn.Tls.HandshakeWriteSecret()) > 0 {
+		t.Secrets[EpochHandshake] = Secrets{Epoch: EpochHandshake, Read: conn.Tls.HandshakeReadSecret(), Write: conn.Tls.HandshakeWriteSecret()}
 	}
-	if _, ok := t.Secrets[pigotls.Epoch1RTT]; !ok && len(conn.Tls.ProtectedReadSecret()) > 0 || len(conn.Tls.ProtectedWriteSecret()) > 0 {
-		t.Secrets[pigotls.Epoch1RTT] = Secrets{Epoch: pigotls.Epoch1RTT, Read: conn.Tls.ProtectedReadSecret(), Write: conn.Tls.ProtectedWriteSecret()}
+	if _, ok := t.Secrets[Epoch1RTT]; !ok && len(conn.Tls.ProtectedReadSecret()) > 0 || len(conn.Tls.ProtectedWriteSecret()) > 0 {
+		t.Secrets[Epoch1RTT] = Secrets{Epoch: Epoch1RTT, Read: conn.Tls.ProtectedReadSecret(), Write: conn.Tls.ProtectedWriteSecret()}
 	}
 }
 
@@ -0,0 +1,129 @@
+package quictracker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// A packet of a trace parsed again, Error reports why it could not be parsed
+type DecodedPacket struct {
+	TracePacket
+	Packet Packet
+	Error  error
+}
+
+// The packets of a trace exchanged over a connection, identified by the source connection IDs of the client and of
+// the server
+type TraceConnection struct {
+	ClientCID ConnectionID
+	ServerCID ConnectionID
+	Packets   []DecodedPacket
+
+	conns map[Direction]*Connection // Holds the parsing state of each direction
+}
+
+func newTraceConnection(clientCID ConnectionID) *TraceConnection {
+	c := &TraceConnection{ClientCID: clientCID, conns: make(map[Direction]*Connection)}
+	for _, direction := range []Direction{ToServer, ToClient} {
+		c.conns[direction] = &Connection{
+			VersionProfile:     VersionProfileV1,
+			CryptoStreams:      make(CryptoStreams),
+			Streams:            make(Streams),
+			LargestPNsReceived: make(map[PNSpace]PacketNumber),
+		}
+	}
+	c.conns[ToClient].SourceCID = clientCID
+	return c
+}
+
+// Parses the clear-text packets of the trace with the parsers used when running the scenario. A new connection starts
+// each time the client sends an Initial packet with a new source connection ID, e.g. in the zero_rtt scenario.
+func (t *Trace) DecodeStream() []*TraceConnection {
+	var connections []*TraceConnection
+	var current *TraceConnection
+	for _, tp := range t.Stream {
+		if len(tp.Data) > 5 && tp.Data[0]&0x80 == 0x80 && tp.Direction == ToServer {
+			header, err := decodeLongHeader(tp.Data)
+			if err == nil && header.PacketType() == Initial && (current == nil || !bytes.Equal(current.ClientCID, header.SourceCID)) {
+				current = newTraceConnection(header.SourceCID)
+				connections = append(connections, current)
+			}
+		}
+		if current == nil {
+			current = newTraceConnection(nil)
+			connections = append(connections, current)
+		}
+		current.Packets = append(current.Packets, current.decode(tp))
+	}
+	return connections
+}
+
+func (c *TraceConnection) decode(tp TracePacket) (decoded DecodedPacket) {
+	decoded.TracePacket = tp
+	conn := c.conns[tp.Direction]
+	defer func() {
+		if r := recover(); r != nil { // The parsers panic on malformed packets
+			decoded.Packet = nil
+			decoded.Error = fmt.Errorf("%v", r)
+		}
+	}()
+	if len(tp.Data) == 0 {
+		decoded.Error = fmt.Errorf("empty packet")
+		return
+	}
+
+	buffer := bytes.NewReader(tp.Data)
+	if tp.Data[0]&0x80 == 0 {
+		if c.conns[ToServer].SourceCID == nil { // The length of the CID of the server is not known yet
+			c.conns[ToServer].SourceCID = make(ConnectionID, len(c.conns[ToClient].SourceCID))
+		}
+		decoded.Packet = ReadProtectedPacket(buffer, conn)
+	} else if len(tp.Data) >= 5 && binary.BigEndian.Uint32(tp.Data[1:5]) == 0 {
+		decoded.Packet = ReadVersionNegotationPacket(buffer, conn)
+		return
+	} else {
+		header, err := decodeLongHeader(tp.Data)
+		if err != nil {
+			decoded.Error = err
+			return
+		}
+		if profile := GetVersionProfile(header.Version); profile != nil {
+			c.conns[ToServer].VersionProfile, c.conns[ToClient].VersionProfile = profile, profile
+		}
+		if tp.Direction == ToClient && header.PacketType() != Retry {
+			c.ServerCID = header.SourceCID
+			c.conns[ToServer].SourceCID = header.SourceCID
+		}
+		switch header.PacketType() {
+		case Initial:
+			decoded.Packet = ReadInitialPacket(buffer, conn)
+		case ZeroRTTProtected:
+			decoded.Packet = ReadZeroRTTProtectedPacket(buffer, conn)
+		case Handshake:
+			decoded.Packet = ReadHandshakePacket(buffer, conn)
+		case Retry:
+			decoded.Packet = ReadRetryPacket(buffer, conn)
+			return
+		default:
+			decoded.Error = fmt.Errorf("unknown packet type %d", header.PacketType())
+			return
+		}
+	}
+
+	space := decoded.Packet.PNSpace()
+	if pn := decoded.Packet.Header().PacketNumber(); pn > conn.LargestPNsReceived[space] {
+		conn.LargestPNsReceived[space] = pn
+	}
+	return
+}
+
+func decodeLongHeader(data []byte) (header *LongHeader, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	conn := &Connection{VersionProfile: VersionProfileV1, LargestPNsReceived: make(map[PNSpace]PacketNumber)}
+	return ReadLongHeader(bytes.NewReader(data), conn), nil
+}
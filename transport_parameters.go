@@ -2,18 +2,20 @@ package quictracker
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"github.com/RohitPanda/quic-tracker/lib"
 	"github.com/bifurcation/mint/syntax"
+	"net"
 )
 
-type TransportParametersType uint16
+type TransportParametersType uint64
 
 const (
-	OriginalConnectionId           TransportParametersType = 0x0000
-	IdleTimeout                                            = 0x0001
+	OriginalConnectionId           TransportParametersType = 0x0000 // original_destination_connection_id in RFC 9000
+	IdleTimeout                                            = 0x0001 // max_idle_timeout in RFC 9000
 	StatelessResetToken                                    = 0x0002
-	MaxPacketSize                                          = 0x0003
+	MaxPacketSize                                          = 0x0003 // max_udp_payload_size in RFC 9000
 	InitialMaxData                                         = 0x0004
 	InitialMaxStreamDataBidiLocal                          = 0x0005
 	InitialMaxStreamDataBidiRemote                         = 0x0006
@@ -23,7 +25,22 @@ const (
 	AckDelayExponent                                       = 0x000a
 	MaxAckDelay                                            = 0x000b
 	DisableMigration                                       = 0x000c // TODO: Handle this parameter
-	PreferredAddress                                       = 0x000d // TODO: Handle this parameter
+	PreferredAddress                                       = 0x000d
+	ActiveConnectionIdLimit                                = 0x000e
+	InitialSourceConnectionId                              = 0x000f
+	RetrySourceConnectionId                                = 0x0010
+	VersionInformation                                     = 0x0011 // See https://tools.ietf.org/html/rfc9368#section-3
+	MaxDatagramFrameSize                                   = 0x0020 // See https://tools.ietf.org/html/rfc9221#section-3
+	GreaseQuicBit                                          = 0x2ab2 // See https://tools.ietf.org/html/rfc9287#section-3
+)
+
+const (
+	MinimumMaxUDPPayloadSize       = 1200
+	MaximumAckDelayExponent        = 20
+	MaximumMaxAckDelay             = 1 << 14
+	MinimumActiveConnectionIdLimit = 2
+	MaximumStreamsLimit            = 1 << 60
+	MaximumConnectionIdLength      = 20
 )
 
 type QuicTransportParameters struct {  // A set of QUIC transport parameters value
@@ -40,11 +57,112 @@ type QuicTransportParameters struct {  // A set of QUIC transport parameters val
 	AckDelayExponent        uint64
 	MaxAckDelay				uint64
 	DisableMigration        bool
-	PreferredAddress        string
+	PreferredAddress        *PreferredAddressParameter
+	ActiveConnectionIdLimit   uint64
+	InitialSourceConnectionId ConnectionID
+	RetrySourceConnectionId   ConnectionID
+	VersionInformation        *VersionInformationParameter
+	MaxDatagramFrameSize      uint64
+	GreaseQuicBit             bool
 	AdditionalParameters    TransportParameterList
 	ToJSON                  map[string]interface{}
 }
 
+// A TransportParameterError is returned when the transport parameters received are malformed or break one of the
+// rules of https://tools.ietf.org/html/rfc9000#section-18.2. It should close the connection with a
+// TRANSPORT_PARAMETER_ERROR.
+type TransportParameterError struct {
+	ParameterType TransportParametersType
+	Reason        string
+}
+
+func (e *TransportParameterError) Error() string {
+	return fmt.Sprintf("transport parameter %#x: %s", uint64(e.ParameterType), e.Reason)
+}
+func (e *TransportParameterError) ErrorCode() uint64 {
+	return ERR_TRANSPORT_PARAMETER_ERROR
+}
+
+func newTransportParameterError(parameterType TransportParametersType, format string, a ...interface{}) *TransportParameterError {
+	return &TransportParameterError{parameterType, fmt.Sprintf(format, a...)}
+}
+
+type VersionInformationParameter struct {
+	ChosenVersion     uint32
+	AvailableVersions []uint32
+}
+
+func (v *VersionInformationParameter) Encode() []byte {
+	buffer := new(bytes.Buffer)
+	buffer.Write(Uint32ToBEBytes(v.ChosenVersion))
+	for _, version := range v.AvailableVersions {
+		buffer.Write(Uint32ToBEBytes(version))
+	}
+	return buffer.Bytes()
+}
+
+func ReadVersionInformationParameter(value []byte) (*VersionInformationParameter, error) {
+	if len(value) < 4 || len(value) % 4 != 0 {
+		return nil, newTransportParameterError(VersionInformation, "invalid length of %d bytes", len(value))
+	}
+	v := &VersionInformationParameter{ChosenVersion: binary.BigEndian.Uint32(value)}
+	for i := 4; i < len(value); i += 4 {
+		v.AvailableVersions = append(v.AvailableVersions, binary.BigEndian.Uint32(value[i:]))
+	}
+	return v, nil
+}
+
+// See https://tools.ietf.org/html/rfc9000#section-18.2
+type PreferredAddressParameter struct {
+	IPv4Address         net.IP
+	IPv4Port            uint16
+	IPv6Address         net.IP
+	IPv6Port            uint16
+	ConnectionId        ConnectionID
+	StatelessResetToken []byte
+}
+
+func (p *PreferredAddressParameter) Encode() []byte {
+	buffer := new(bytes.Buffer)
+	ipv4 := p.IPv4Address.To4()
+	if ipv4 == nil {
+		ipv4 = net.IPv4zero.To4()
+	}
+	buffer.Write(ipv4)
+	buffer.Write(Uint16ToBEBytes(p.IPv4Port))
+	ipv6 := p.IPv6Address.To16()
+	if ipv6 == nil {
+		ipv6 = net.IPv6zero
+	}
+	buffer.Write(ipv6)
+	buffer.Write(Uint16ToBEBytes(p.IPv6Port))
+	buffer.WriteByte(uint8(len(p.ConnectionId)))
+	buffer.Write(p.ConnectionId)
+	buffer.Write(p.StatelessResetToken)
+	return buffer.Bytes()
+}
+
+func ReadPreferredAddressParameter(value []byte) (*PreferredAddressParameter, error) {
+	if len(value) < 4+2+16+2+1 {
+		return nil, newTransportParameterError(PreferredAddress, "invalid length of %d bytes", len(value))
+	}
+	p := &PreferredAddressParameter{}
+	p.IPv4Address = net.IP(append([]byte{}, value[:4]...))
+	p.IPv4Port = binary.BigEndian.Uint16(value[4:])
+	p.IPv6Address = net.IP(append([]byte{}, value[6:22]...))
+	p.IPv6Port = binary.BigEndian.Uint16(value[22:])
+	cidLength := int(value[24])
+	if cidLength == 0 || cidLength > MaximumConnectionIdLength {
+		return nil, newTransportParameterError(PreferredAddress, "invalid connection ID length of %d bytes", cidLength)
+	}
+	if len(value) != 25+cidLength+16 {
+		return nil, newTransportParameterError(PreferredAddress, "invalid length of %d bytes", len(value))
+	}
+	p.ConnectionId = ConnectionID(append([]byte{}, value[25:25+cidLength]...))
+	p.StatelessResetToken = append([]byte{}, value[25+cidLength:]...)
+	return p, nil
+}
+
 type TransportParameter struct {
 	ParameterType TransportParametersType
 	Value         []byte `tls:"head=2"`
@@ -65,28 +183,49 @@ func (list *TransportParameterList) AddParameter(p TransportParameter) {
 	*list = append(*list, p)
 }
 
+type draftTransportParameter struct {
+	ParameterType uint16
+	Value         []byte `tls:"head=2"`
+}
+
+type draftTransportParameterList []draftTransportParameter
+
 type ClientHelloTransportParameters struct {
 	InitialVersion    uint32
-	Parameters        TransportParameterList `tls:"head=2"`
+	Parameters        draftTransportParameterList `tls:"head=2"`
 }
 
 type EncryptedExtensionsTransportParameters struct {
 	NegotiatedVersion uint32
 	SupportedVersions []SupportedVersion `tls:"head=1"`
-	Parameters        TransportParameterList  `tls:"head=2"`
+	Parameters        TransportParameterList
+}
+
+type draftEncryptedExtensionsTransportParameters struct {
+	NegotiatedVersion uint32
+	SupportedVersions []SupportedVersion `tls:"head=1"`
+	Parameters        draftTransportParameterList  `tls:"head=2"`
 }
 
 type TLSTransportParameterHandler struct {
 	NegotiatedVersion uint32
 	InitialVersion    uint32
+	Format            TransportParametersFormat
 	QuicTransportParameters
 	*EncryptedExtensionsTransportParameters
 	ReceivedParameters *QuicTransportParameters
 }
 
 func NewTLSTransportParameterHandler(negotiatedVersion uint32, initialVersion uint32) *TLSTransportParameterHandler {
-	return &TLSTransportParameterHandler{NegotiatedVersion: negotiatedVersion, InitialVersion: initialVersion, QuicTransportParameters:
+	h := &TLSTransportParameterHandler{NegotiatedVersion: negotiatedVersion, InitialVersion: initialVersion, QuicTransportParameters:
 		QuicTransportParameters{MaxStreamDataBidiLocal: 16 * 1024, MaxData: 32 * 1024, MaxBidiStreams: 1, MaxUniStreams: 1, IdleTimeout: 10}}
+	if profile := GetVersionProfile(negotiatedVersion); profile != nil {
+		h.Format = profile.TransportParametersFormat
+	}
+	if h.Format == TransportParametersRFC {
+		h.IdleTimeout = 10 * 1000  // max_idle_timeout is expressed in milliseconds, see https://tools.ietf.org/html/rfc9000#section-18.2
+	}
+	return h
 }
 func (h *TLSTransportParameterHandler) GetExtensionData() ([]byte, error) {
 	var parameters []TransportParameter
@@ -124,68 +263,213 @@ func (h *TLSTransportParameterHandler) GetExtensionData() ([]byte, error) {
 	addParameter(InitialMaxStreamsBidi, h.QuicTransportParameters.MaxBidiStreams)
 	addParameter(InitialMaxStreamsUni, h.QuicTransportParameters.MaxUniStreams)
 	addParameter(IdleTimeout, h.QuicTransportParameters.IdleTimeout)
+	if h.QuicTransportParameters.MaxPacketSize != 0 {
+		addParameter(MaxPacketSize, h.QuicTransportParameters.MaxPacketSize)
+	}
+	if h.QuicTransportParameters.AckDelayExponent != 0 {
+		addParameter(AckDelayExponent, h.QuicTransportParameters.AckDelayExponent)
+	}
+	if h.QuicTransportParameters.MaxAckDelay != 0 {
+		addParameter(MaxAckDelay, h.QuicTransportParameters.MaxAckDelay)
+	}
+	addParameter(DisableMigration, h.QuicTransportParameters.DisableMigration)
+	if h.Format == TransportParametersRFC {
+		if h.QuicTransportParameters.ActiveConnectionIdLimit != 0 {
+			addParameter(ActiveConnectionIdLimit, h.QuicTransportParameters.ActiveConnectionIdLimit)
+		}
+		parameters = append(parameters, TransportParameter{InitialSourceConnectionId, h.QuicTransportParameters.InitialSourceConnectionId})
+		if h.QuicTransportParameters.VersionInformation != nil {
+			parameters = append(parameters, TransportParameter{VersionInformation, h.QuicTransportParameters.VersionInformation.Encode()})
+		}
+		if h.QuicTransportParameters.MaxDatagramFrameSize != 0 {
+			addParameter(MaxDatagramFrameSize, h.QuicTransportParameters.MaxDatagramFrameSize)
+		}
+		addParameter(GreaseQuicBit, h.QuicTransportParameters.GreaseQuicBit)
+	}
 	for _, p := range h.QuicTransportParameters.AdditionalParameters {
 		parameters = append(parameters, p)
 	}
-	return syntax.Marshal(ClientHelloTransportParameters{h.InitialVersion, TransportParameterList(parameters)})
+
+	if h.Format == TransportParametersRFC {
+		buffer := new(bytes.Buffer)
+		for _, p := range parameters {
+			lib.WriteVarInt(buffer, uint64(p.ParameterType))
+			lib.WriteVarInt(buffer, uint64(len(p.Value)))
+			buffer.Write(p.Value)
+		}
+		return buffer.Bytes(), nil
+	}
+
+	var draftParameters draftTransportParameterList
+	for _, p := range parameters {
+		draftParameters = append(draftParameters, draftTransportParameter{uint16(p.ParameterType), p.Value})
+	}
+	return syntax.Marshal(ClientHelloTransportParameters{h.InitialVersion, draftParameters})
+}
+
+func readRFCTransportParameters(data []byte) (TransportParameterList, error) {
+	var parameters TransportParameterList
+	buffer := bytes.NewReader(data)
+	for buffer.Len() > 0 {
+		parameterType, err := lib.ReadVarIntValue(buffer)
+		if err != nil {
+			return nil, newTransportParameterError(TransportParametersType(parameterType), "truncated parameter type")
+		}
+		length, err := lib.ReadVarIntValue(buffer)
+		if err != nil {
+			return nil, newTransportParameterError(TransportParametersType(parameterType), "truncated parameter length")
+		}
+		if length > uint64(buffer.Len()) {
+			return nil, newTransportParameterError(TransportParametersType(parameterType), "length of %d bytes is past the end of the extension data", length)
+		}
+		value := make([]byte, length)
+		buffer.Read(value)
+		parameters = append(parameters, TransportParameter{TransportParametersType(parameterType), value})
+	}
+	return parameters, nil
+}
+
+// Reads a parameter value consisting of a single varint
+func readVarIntParameter(p TransportParameter) (uint64, error) {
+	buffer := bytes.NewReader(p.Value)
+	v, err := lib.ReadVarIntValue(buffer)
+	if err != nil || buffer.Len() > 0 {
+		return 0, newTransportParameterError(p.ParameterType, "value is not a single varint")
+	}
+	return v, nil
+}
+
+func readConnectionIdParameter(p TransportParameter) (ConnectionID, error) {
+	if len(p.Value) > MaximumConnectionIdLength {
+		return nil, newTransportParameterError(p.ParameterType, "connection ID of %d bytes is too long", len(p.Value))
+	}
+	return ConnectionID(p.Value), nil
+}
+
+func readEmptyParameter(p TransportParameter) (bool, error) {
+	if len(p.Value) > 0 {
+		return false, newTransportParameterError(p.ParameterType, "value should be empty but has %d bytes", len(p.Value))
+	}
+	return true, nil
 }
 
 func (h *TLSTransportParameterHandler) ReceiveExtensionData(data []byte) error {
 	if h.EncryptedExtensionsTransportParameters == nil {
 		h.EncryptedExtensionsTransportParameters = &EncryptedExtensionsTransportParameters{}
 	}
-	_, err := syntax.Unmarshal(data, h.EncryptedExtensionsTransportParameters)
+	var err error
+	if h.Format == TransportParametersRFC {
+		h.EncryptedExtensionsTransportParameters.Parameters, err = readRFCTransportParameters(data)
+	} else {
+		draftParameters := draftEncryptedExtensionsTransportParameters{}
+		_, err = syntax.Unmarshal(data, &draftParameters)
+		h.EncryptedExtensionsTransportParameters.NegotiatedVersion = draftParameters.NegotiatedVersion
+		h.EncryptedExtensionsTransportParameters.SupportedVersions = draftParameters.SupportedVersions
+		h.EncryptedExtensionsTransportParameters.Parameters = nil
+		for _, p := range draftParameters.Parameters {
+			h.EncryptedExtensionsTransportParameters.Parameters.AddParameter(TransportParameter{TransportParametersType(p.ParameterType), p.Value})
+		}
+	}
 	if err != nil {
 		return err
 	}
 
 	receivedParameters := QuicTransportParameters{}
 	receivedParameters.ToJSON = make(map[string]interface{})
+	seen := make(map[TransportParametersType]bool)
 
 	for _, p := range h.EncryptedExtensionsTransportParameters.Parameters {
+		if seen[p.ParameterType] {
+			return newTransportParameterError(p.ParameterType, "parameter is present more than once")
+		}
+		seen[p.ParameterType] = true
+
 		switch p.ParameterType {
 		case OriginalConnectionId:
-			receivedParameters.OriginalConnectionId = ConnectionID(p.Value)
-			receivedParameters.ToJSON["original_connection_id"] = ConnectionID(p.Value)
+			receivedParameters.OriginalConnectionId, err = readConnectionIdParameter(p)
+			receivedParameters.ToJSON["original_connection_id"] = receivedParameters.OriginalConnectionId
 		case IdleTimeout:
-			receivedParameters.IdleTimeout, err = lib.ReadVarIntValue(bytes.NewReader(p.Value))
+			receivedParameters.IdleTimeout, err = readVarIntParameter(p)
 			receivedParameters.ToJSON["idle_timeout"] = receivedParameters.IdleTimeout
 		case StatelessResetToken:
+			if len(p.Value) != 16 {
+				return newTransportParameterError(p.ParameterType, "stateless reset token has %d bytes instead of 16", len(p.Value))
+			}
 			receivedParameters.StatelessResetToken = p.Value
 			receivedParameters.ToJSON["stateless_reset_token"] = receivedParameters.StatelessResetToken
 		case MaxPacketSize:
-			receivedParameters.MaxPacketSize, err = lib.ReadVarIntValue(bytes.NewReader(p.Value))
+			receivedParameters.MaxPacketSize, err = readVarIntParameter(p)
+			if err == nil && receivedParameters.MaxPacketSize < MinimumMaxUDPPayloadSize {
+				err = newTransportParameterError(p.ParameterType, "value %d is below %d", receivedParameters.MaxPacketSize, MinimumMaxUDPPayloadSize)
+			}
 			receivedParameters.ToJSON["max_packet_size"] = receivedParameters.MaxPacketSize
 		case InitialMaxData:
-			receivedParameters.MaxData, err = lib.ReadVarIntValue(bytes.NewReader(p.Value))
+			receivedParameters.MaxData, err = readVarIntParameter(p)
 			receivedParameters.ToJSON["initial_max_data"] = receivedParameters.MaxData
 		case InitialMaxStreamDataBidiLocal:
-			receivedParameters.MaxStreamDataBidiLocal, err = lib.ReadVarIntValue(bytes.NewReader(p.Value))
+			receivedParameters.MaxStreamDataBidiLocal, err = readVarIntParameter(p)
 			receivedParameters.ToJSON["initial_max_stream_data_bidi_local"] = receivedParameters.MaxStreamDataBidiLocal
 		case InitialMaxStreamDataBidiRemote:
-			receivedParameters.MaxStreamDataBidiRemote, err = lib.ReadVarIntValue(bytes.NewReader(p.Value))
+			receivedParameters.MaxStreamDataBidiRemote, err = readVarIntParameter(p)
 			receivedParameters.ToJSON["initial_max_stream_data_bidi_remote"] = receivedParameters.MaxStreamDataBidiRemote
 		case InitialMaxStreamDataUni:
-			receivedParameters.MaxStreamDataUni, err = lib.ReadVarIntValue(bytes.NewReader(p.Value))
+			receivedParameters.MaxStreamDataUni, err = readVarIntParameter(p)
 			receivedParameters.ToJSON["initial_max_stream_data_uni"] = receivedParameters.MaxStreamDataUni
 		case InitialMaxStreamsBidi:
-			receivedParameters.MaxBidiStreams, err = lib.ReadVarIntValue(bytes.NewReader(p.Value))
+			receivedParameters.MaxBidiStreams, err = readVarIntParameter(p)
+			if err == nil && receivedParameters.MaxBidiStreams > MaximumStreamsLimit {
+				err = newTransportParameterError(p.ParameterType, "value %d is above 2^60", receivedParameters.MaxBidiStreams)
+			}
 			receivedParameters.ToJSON["initial_max_streams_bidi"] = receivedParameters.MaxBidiStreams
 		case InitialMaxStreamsUni:
-			receivedParameters.MaxUniStreams, err = lib.ReadVarIntValue(bytes.NewReader(p.Value))
+			receivedParameters.MaxUniStreams, err = readVarIntParameter(p)
+			if err == nil && receivedParameters.MaxUniStreams > MaximumStreamsLimit {
+				err = newTransportParameterError(p.ParameterType, "value %d is above 2^60", receivedParameters.MaxUniStreams)
+			}
 			receivedParameters.ToJSON["initial_max_streams_uni"] = receivedParameters.MaxUniStreams
 		case AckDelayExponent:
-			receivedParameters.AckDelayExponent, err = lib.ReadVarIntValue(bytes.NewReader(p.Value))
+			receivedParameters.AckDelayExponent, err = readVarIntParameter(p)
+			if err == nil && receivedParameters.AckDelayExponent > MaximumAckDelayExponent {
+				err = newTransportParameterError(p.ParameterType, "value %d is above %d", receivedParameters.AckDelayExponent, MaximumAckDelayExponent)
+			}
 			receivedParameters.ToJSON["ack_delay_exponent"] = receivedParameters.AckDelayExponent
 		case MaxAckDelay:
-			receivedParameters.MaxAckDelay, err = lib.ReadVarIntValue(bytes.NewReader(p.Value))
+			receivedParameters.MaxAckDelay, err = readVarIntParameter(p)
+			if err == nil && receivedParameters.MaxAckDelay >= MaximumMaxAckDelay {
+				err = newTransportParameterError(p.ParameterType, "value %d is not below 2^14", receivedParameters.MaxAckDelay)
+			}
 			receivedParameters.ToJSON["max_ack_delay"] = receivedParameters.MaxAckDelay
 		case DisableMigration:
-			receivedParameters.DisableMigration = true
-			receivedParameters.ToJSON["disable_migration"] = true
+			receivedParameters.DisableMigration, err = readEmptyParameter(p)
+			receivedParameters.ToJSON["disable_migration"] = receivedParameters.DisableMigration
 		case PreferredAddress:
-			receivedParameters.PreferredAddress = string(p.Value)
-			receivedParameters.ToJSON["preferredAddress"] = receivedParameters.PreferredAddress
+			if h.Format != TransportParametersRFC {  // TODO: Decode the draft format
+				receivedParameters.ToJSON["preferred_address"] = p.Value
+				break
+			}
+			receivedParameters.PreferredAddress, err = ReadPreferredAddressParameter(p.Value)
+			receivedParameters.ToJSON["preferred_address"] = receivedParameters.PreferredAddress
+		case ActiveConnectionIdLimit:
+			receivedParameters.ActiveConnectionIdLimit, err = readVarIntParameter(p)
+			if err == nil && receivedParameters.ActiveConnectionIdLimit < MinimumActiveConnectionIdLimit {
+				err = newTransportParameterError(p.ParameterType, "value %d is below %d", receivedParameters.ActiveConnectionIdLimit, MinimumActiveConnectionIdLimit)
+			}
+			receivedParameters.ToJSON["active_connection_id_limit"] = receivedParameters.ActiveConnectionIdLimit
+		case InitialSourceConnectionId:
+			receivedParameters.InitialSourceConnectionId, err = readConnectionIdParameter(p)
+			receivedParameters.ToJSON["initial_source_connection_id"] = receivedParameters.InitialSourceConnectionId
+		case RetrySourceConnectionId:
+			receivedParameters.RetrySourceConnectionId, err = readConnectionIdParameter(p)
+			receivedParameters.ToJSON["retry_source_connection_id"] = receivedParameters.RetrySourceConnectionId
+		case VersionInformation:
+			receivedParameters.VersionInformation, err = ReadVersionInformationParameter(p.Value)
+			receivedParameters.ToJSON["version_information"] = receivedParameters.VersionInformation
+		case MaxDatagramFrameSize:
+			receivedParameters.MaxDatagramFrameSize, err = readVarIntParameter(p)
+			receivedParameters.ToJSON["max_datagram_frame_size"] = receivedParameters.MaxDatagramFrameSize
+		case GreaseQuicBit:
+			receivedParameters.GreaseQuicBit, err = readEmptyParameter(p)
+			receivedParameters.ToJSON["grease_quic_bit"] = receivedParameters.GreaseQuicBit
 		default:
 			receivedParameters.AdditionalParameters.AddParameter(p)
 			receivedParameters.ToJSON[fmt.Sprintf("%x", p.ParameterType)] = p.Value
@@ -199,3 +483,35 @@ func (h *TLSTransportParameterHandler) ReceiveExtensionData(data []byte) error {
 
 	return nil
 }
+
+// Checks that the connection IDs of the handshake received match the ones used by the client, as required by
+// https://tools.ietf.org/html/rfc9000#section-7.3. The retry source CID must be nil when no Retry was accepted. The
+// draft format is not checked as it does not carry these parameters.
+func (h *TLSTransportParameterHandler) AuthenticateConnectionIds(originalDestinationCID, initialSourceCID, retrySourceCID ConnectionID) error {
+	if h.Format != TransportParametersRFC || h.ReceivedParameters == nil {
+		return nil
+	}
+	received := h.ReceivedParameters
+	check := func(parameterType TransportParametersType, name string, expected ConnectionID, value ConnectionID) error {
+		if _, present := received.ToJSON[name]; !present {
+			return newTransportParameterError(parameterType, "parameter is missing")
+		}
+		if !bytes.Equal(value, expected) {
+			return newTransportParameterError(parameterType, "value %x does not match %x", []byte(value), []byte(expected))
+		}
+		return nil
+	}
+	if err := check(OriginalConnectionId, "original_connection_id", originalDestinationCID, received.OriginalConnectionId); err != nil {
+		return err
+	}
+	if err := check(InitialSourceConnectionId, "initial_source_connection_id", initialSourceCID, received.InitialSourceConnectionId); err != nil {
+		return err
+	}
+	if retrySourceCID == nil {
+		if _, present := received.ToJSON["retry_source_connection_id"]; present {
+			return newTransportParameterError(RetrySourceConnectionId, "parameter is present but no Retry was received")
+		}
+		return nil
+	}
+	return check(RetrySourceConnectionId, "retry_source_connection_id", retrySourceCID, received.RetrySourceConnectionId)
+}
@@ -0,0 +1,161 @@
+package quictracker
+
+import (
+	"bytes"
+	"github.com/RohitPanda/quic-tracker/lib"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestVersionInformationParameter(t *testing.T) {
+	v := &VersionInformationParameter{ChosenVersion: QuicVersion1, AvailableVersions: []uint32{QuicVersion1, QuicVersion2}}
+	encoded := v.Encode()
+	if len(encoded) != 12 {
+		t.Errorf("expected 12 bytes, got %x", encoded)
+	}
+	decoded, err := ReadVersionInformationParameter(encoded)
+	if err != nil || !reflect.DeepEqual(v, decoded) {
+		t.Errorf("expected %+v, got %+v (%v)", v, decoded, err)
+	}
+	for _, invalid := range [][]byte{nil, {0, 0, 0}, {0, 0, 0, 1, 0}} {
+		if _, err := ReadVersionInformationParameter(invalid); err == nil {
+			t.Errorf("the invalid version_information %x was decoded", invalid)
+		}
+	}
+}
+
+func TestOfferCompatibleVersions(t *testing.T) {
+	conn := testConnection(VersionProfileV1)
+	conn.TLSTPHandler = NewTLSTransportParameterHandler(QuicVersion1, QuicVersion1)
+	if conn.OffersVersion(QuicVersion2) {
+		t.Error("v2 is offered by default")
+	}
+	if err := conn.UpgradeVersion(QuicVersion2); err == nil {
+		t.Error("the connection was upgraded to a version it did not offer")
+	}
+	if err := conn.OfferCompatibleVersions(QuicVersionDraft17); err == nil {
+		t.Error("an incompatible version was offered")
+	}
+	if err := conn.OfferCompatibleVersions(QuicVersion2); err != nil {
+		t.Fatal(err)
+	}
+	expected := &VersionInformationParameter{ChosenVersion: QuicVersion1, AvailableVersions: []uint32{QuicVersion1, QuicVersion2}}
+	if !conn.OffersVersion(QuicVersion2) || !reflect.DeepEqual(conn.TLSTPHandler.VersionInformation, expected) {
+		t.Errorf("expected %+v, got %+v", expected, conn.TLSTPHandler.VersionInformation)
+	}
+}
+
+// Encodes the given parameters in the format of https://tools.ietf.org/html/rfc9000#section-18
+func encodeTransportParameters(parameters ...TransportParameter) []byte {
+	buffer := new(bytes.Buffer)
+	for _, p := range parameters {
+		lib.WriteVarInt(buffer, uint64(p.ParameterType))
+		lib.WriteVarInt(buffer, uint64(len(p.Value)))
+		buffer.Write(p.Value)
+	}
+	return buffer.Bytes()
+}
+
+func TestTransportParametersCodec(t *testing.T) {
+	sent := NewTLSTransportParameterHandler(QuicVersion1, QuicVersion1)
+	sent.InitialSourceConnectionId = ConnectionID{1, 2, 3, 4}
+	sent.MaxPacketSize = 1452
+	sent.AckDelayExponent = 4
+	sent.MaxAckDelay = 50
+	sent.ActiveConnectionIdLimit = 4
+	sent.MaxDatagramFrameSize = 1200
+	sent.GreaseQuicBit = true
+	sent.VersionInformation = &VersionInformationParameter{QuicVersion1, []uint32{QuicVersion1}}
+	sent.AdditionalParameters.AddParameter(TransportParameter{0x1f2a, []byte{0xca, 0xfe}})
+	data, err := sent.GetExtensionData()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := NewTLSTransportParameterHandler(QuicVersion1, QuicVersion1)
+	if err := received.ReceiveExtensionData(data); err != nil {
+		t.Fatal(err)
+	}
+	r := received.ReceivedParameters
+	if r.MaxStreamDataBidiLocal != sent.MaxStreamDataBidiLocal || r.MaxData != sent.MaxData || r.MaxBidiStreams != sent.MaxBidiStreams ||
+		r.MaxUniStreams != sent.MaxUniStreams || r.IdleTimeout != sent.IdleTimeout || r.MaxPacketSize != sent.MaxPacketSize ||
+		r.AckDelayExponent != sent.AckDelayExponent || r.MaxAckDelay != sent.MaxAckDelay || r.ActiveConnectionIdLimit != sent.ActiveConnectionIdLimit ||
+		!bytes.Equal(r.InitialSourceConnectionId, sent.InitialSourceConnectionId) || r.MaxDatagramFrameSize != sent.MaxDatagramFrameSize ||
+		r.GreaseQuicBit != sent.GreaseQuicBit || !reflect.DeepEqual(r.VersionInformation, sent.VersionInformation) ||
+		!reflect.DeepEqual(r.AdditionalParameters, sent.AdditionalParameters) {
+		t.Errorf("expected %+v, got %+v", sent.QuicTransportParameters, *r)
+	}
+
+	preferredAddress := &PreferredAddressParameter{net.IPv4(192, 0, 2, 1).To4(), 4433, net.ParseIP("2001:db8::1"), 4434, ConnectionID{1, 2}, make([]byte, 16)}
+	decoded, err := ReadPreferredAddressParameter(preferredAddress.Encode())
+	if err != nil || !reflect.DeepEqual(decoded, preferredAddress) {
+		t.Errorf("expected %+v, got %+v (%v)", preferredAddress, decoded, err)
+	}
+}
+
+func TestTransportParametersValidation(t *testing.T) {
+	varInt := func(parameterType TransportParametersType, v uint64) TransportParameter {
+		return TransportParameter{parameterType, lib.EncodeVarInt(v)}
+	}
+	for _, c := range []struct {
+		name          string
+		data          []byte
+		parameterType TransportParametersType
+	}{
+		{"duplicate", encodeTransportParameters(varInt(InitialMaxData, 1), varInt(InitialMaxData, 2)), InitialMaxData},
+		{"truncated length", []byte{0x04}, InitialMaxData},
+		{"truncated value", []byte{0x04, 0x02, 0x01}, InitialMaxData},
+		{"not a single varint", encodeTransportParameters(TransportParameter{InitialMaxData, []byte{0x01, 0x02}}), InitialMaxData},
+		{"max_udp_payload_size below 1200", encodeTransportParameters(varInt(MaxPacketSize, 1199)), MaxPacketSize},
+		{"ack_delay_exponent above 20", encodeTransportParameters(varInt(AckDelayExponent, 21)), AckDelayExponent},
+		{"max_ack_delay of 2^14", encodeTransportParameters(varInt(MaxAckDelay, 1<<14)), MaxAckDelay},
+		{"active_connection_id_limit below 2", encodeTransportParameters(varInt(ActiveConnectionIdLimit, 1)), ActiveConnectionIdLimit},
+		{"initial_max_streams_bidi above 2^60", encodeTransportParameters(varInt(InitialMaxStreamsBidi, 1<<60+1)), InitialMaxStreamsBidi},
+		{"initial_max_streams_uni above 2^60", encodeTransportParameters(varInt(InitialMaxStreamsUni, 1<<60+1)), InitialMaxStreamsUni},
+		{"stateless_reset_token of 15 bytes", encodeTransportParameters(TransportParameter{StatelessResetToken, make([]byte, 15)}), StatelessResetToken},
+		{"connection ID of 21 bytes", encodeTransportParameters(TransportParameter{InitialSourceConnectionId, make([]byte, 21)}), InitialSourceConnectionId},
+		{"disable_migration with a value", encodeTransportParameters(TransportParameter{DisableMigration, []byte{1}}), DisableMigration},
+		{"preferred_address without connection ID", encodeTransportParameters(TransportParameter{PreferredAddress, make([]byte, 41)}), PreferredAddress},
+		{"version_information of 5 bytes", encodeTransportParameters(TransportParameter{VersionInformation, make([]byte, 5)}), VersionInformation},
+	} {
+		h := NewTLSTransportParameterHandler(QuicVersion1, QuicVersion1)
+		err := h.ReceiveExtensionData(c.data)
+		tpErr, ok := err.(*TransportParameterError)
+		if !ok || tpErr.ParameterType != c.parameterType || tpErr.ErrorCode() != ERR_TRANSPORT_PARAMETER_ERROR {
+			t.Errorf("%s: expected a TRANSPORT_PARAMETER_ERROR on %#x, got %v", c.name, uint64(c.parameterType), err)
+		}
+	}
+}
+
+func TestAuthenticateConnectionIds(t *testing.T) {
+	odcid, scid, rscid := ConnectionID{1, 1, 1, 1}, ConnectionID{2, 2}, ConnectionID{3, 3, 3}
+	for _, c := range []struct {
+		name           string
+		parameters     []TransportParameter
+		retrySourceCID ConnectionID
+		parameterType  TransportParametersType // Ignored when the parameters are valid
+		valid          bool
+	}{
+		{"valid", []TransportParameter{{OriginalConnectionId, odcid}, {InitialSourceConnectionId, scid}}, nil, 0, true},
+		{"valid after a Retry", []TransportParameter{{OriginalConnectionId, odcid}, {InitialSourceConnectionId, scid}, {RetrySourceConnectionId, rscid}}, rscid, 0, true},
+		{"missing original_destination_connection_id", []TransportParameter{{InitialSourceConnectionId, scid}}, nil, OriginalConnectionId, false},
+		{"wrong original_destination_connection_id", []TransportParameter{{OriginalConnectionId, scid}, {InitialSourceConnectionId, scid}}, nil, OriginalConnectionId, false},
+		{"missing initial_source_connection_id", []TransportParameter{{OriginalConnectionId, odcid}}, nil, InitialSourceConnectionId, false},
+		{"empty initial_source_connection_id", []TransportParameter{{OriginalConnectionId, odcid}, {InitialSourceConnectionId, nil}}, nil, InitialSourceConnectionId, false},
+		{"missing retry_source_connection_id", []TransportParameter{{OriginalConnectionId, odcid}, {InitialSourceConnectionId, scid}}, rscid, RetrySourceConnectionId, false},
+		{"wrong retry_source_connection_id", []TransportParameter{{OriginalConnectionId, odcid}, {InitialSourceConnectionId, scid}, {RetrySourceConnectionId, scid}}, rscid, RetrySourceConnectionId, false},
+		{"retry_source_connection_id without Retry", []TransportParameter{{OriginalConnectionId, odcid}, {InitialSourceConnectionId, scid}, {RetrySourceConnectionId, rscid}}, nil, RetrySourceConnectionId, false},
+	} {
+		h := NewTLSTransportParameterHandler(QuicVersion1, QuicVersion1)
+		if err := h.ReceiveExtensionData(encodeTransportParameters(c.parameters...)); err != nil {
+			t.Fatalf("%s: %s", c.name, err.Error())
+		}
+		err := h.AuthenticateConnectionIds(odcid, scid, c.retrySourceCID)
+		if c.valid && err != nil {
+			t.Errorf("%s: %s", c.name, err.Error())
+		} else if tpErr, ok := err.(*TransportParameterError); !c.valid && (!ok || tpErr.ParameterType != c.parameterType) {
+			t.Errorf("%s: expected a TRANSPORT_PARAMETER_ERROR on %#x, got %v", c.name, uint64(c.parameterType), err)
+		}
+	}
+}
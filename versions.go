@@ -0,0 +1,232 @@
+package quictracker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	QuicVersion1       = 0x00000001
+	QuicVersion2       = 0x6b3343cf
+	QuicVersionDraft17 = 0xff000011
+)
+
+// The codepoints of the TLS extension carrying the transport parameters
+const (
+	TransportParametersExtension      = 0x39   // See https://tools.ietf.org/html/rfc9001#section-8.2
+	TransportParametersExtensionDraft = 0xffa5 // Used up to draft-33
+)
+
+type TransportParametersFormat int
+
+const (
+	TransportParametersDraft TransportParametersFormat = iota // Versions fields followed by 16-bit types and lengths
+	TransportParametersRFC                                    // Varint types and lengths, see https://tools.ietf.org/html/rfc9000#section-18
+)
+
+// A VersionProfile gathers everything that differs between the QUIC versions QUIC-Tracker is able to speak, i.e. the
+// Initial salt, the HKDF labels, the transport parameters encoding, the frame types and the long header rules. Each
+// Connection holds the profile of the version it is currently using.
+type VersionProfile struct {
+	Version uint32
+	Name    string
+	ALPN    string // The ALPN token used for HTTP/0.9 over QUIC
+	H3ALPN  string // The ALPN token used for HTTP/3
+
+	CompatibleVersions []uint32 // The versions a connection can be upgraded to during the handshake when it offers them, see https://tools.ietf.org/html/rfc9368#section-2.3
+
+	InitialSalt        []byte
+	KeyLabel           string
+	IVLabel            string
+	HPLabel            string
+	LabelBase          string
+	KeyUpdateLabel     string
+	KeyUpdateLabelBase string
+	RetryKey           []byte // The AEAD key and nonce used to compute Retry integrity tags
+	RetryNonce         []byte
+
+	TransportParametersFormat    TransportParametersFormat
+	TransportParametersExtension uint16 // The codepoint of the TLS extension carrying the transport parameters
+
+	ExplicitCIDLengths bool // Each CID is preceded by its length on a full byte instead of the 4-bit CIDL encoding
+	RetryIntegrityTag  bool // Retry packets end with an integrity tag instead of carrying the original DCID
+	VarIntErrorCodes   bool // Error codes in RESET_STREAM, STOP_SENDING and CONNECTION_CLOSE frames are varints
+	RetirePriorTo      bool // NEW_CONNECTION_ID frames carry a Retire Prior To field
+
+	longHeaderTypes map[PacketType]uint8 // The values of the long header type bits when they differ from PacketType
+	frameTypes      map[FrameType]bool
+}
+
+func (p *VersionProfile) String() string {
+	return p.Name
+}
+
+// Returns whether the given frame type is defined in this version
+func (p *VersionProfile) SupportsFrame(frameType FrameType) bool {
+	return p.frameTypes[frameType]
+}
+
+// Returns whether a connection using this version can be upgraded to the given version
+func (p *VersionProfile) IsCompatibleWith(version uint32) bool {
+	for _, v := range p.CompatibleVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *VersionProfile) encodePacketType(packetType PacketType) uint8 {
+	if p.longHeaderTypes == nil {
+		return uint8(packetType)
+	}
+	return p.longHeaderTypes[packetType]
+}
+
+func (p *VersionProfile) decodePacketType(typeBits uint8) PacketType {
+	for packetType, bits := range p.longHeaderTypes {
+		if bits == typeBits {
+			return packetType
+		}
+	}
+	return PacketType(typeBits)
+}
+
+// Returns the ALPN token of this version corresponding to the application of the given token in another version
+func (p *VersionProfile) TranslateALPN(ALPN string, from *VersionProfile) string {
+	if from != nil && ALPN == from.H3ALPN {
+		return p.H3ALPN
+	}
+	return p.ALPN
+}
+
+func frameTypesUpTo(last FrameType) map[FrameType]bool {
+	types := make(map[FrameType]bool)
+	for t := FrameType(PaddingFrameType); t <= last; t++ {
+		types[t] = true
+	}
+	return types
+}
+
+var VersionProfileV1 = &VersionProfile{ // See https://tools.ietf.org/html/rfc9000 and https://tools.ietf.org/html/rfc9001
+	Version: QuicVersion1,
+	Name:    "v1",
+	ALPN:    "hq-interop",
+	H3ALPN:  "h3",
+	InitialSalt: []byte{ // See https://tools.ietf.org/html/rfc9001#section-5.2
+		0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3,
+		0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad,
+		0xcc, 0xbb, 0x7f, 0x0a,
+	},
+	CompatibleVersions: []uint32{QuicVersion2},
+	KeyLabel:           "key",
+	IVLabel:            "iv",
+	HPLabel:            "hp",
+	LabelBase:          QuicBaseLabel,
+	KeyUpdateLabel:     "ku",
+	KeyUpdateLabelBase: QuicBaseLabel,
+	RetryKey: []byte{ // See https://tools.ietf.org/html/rfc9001#section-5.8
+		0xbe, 0x0c, 0x69, 0x0b, 0x9f, 0x66, 0x57, 0x5a,
+		0x1d, 0x76, 0x6b, 0x54, 0xe3, 0x68, 0xc8, 0x4e,
+	},
+	RetryNonce: []byte{
+		0x46, 0x15, 0x99, 0xd3, 0x5d, 0x63, 0x2b, 0xf2,
+		0x23, 0x98, 0x25, 0xbb,
+	},
+	TransportParametersFormat:    TransportParametersRFC,
+	TransportParametersExtension: TransportParametersExtension,
+	ExplicitCIDLengths:           true,
+	RetryIntegrityTag:            true,
+	VarIntErrorCodes:             true,
+	RetirePriorTo:                true,
+	frameTypes:                   frameTypesUpTo(HandshakeDoneType),
+}
+
+var VersionProfileDraft17 = &VersionProfile{ // See https://tools.ietf.org/html/draft-ietf-quic-transport-17
+	Version: QuicVersionDraft17,
+	Name:    "draft-17",
+	ALPN:    "hq-17",
+	H3ALPN:  "h3-17",
+	InitialSalt: []byte{ // See https://tools.ietf.org/html/draft-ietf-quic-tls-17#section-5.2
+		0xef, 0x4f, 0xb0, 0xab, 0xb4, 0x74, 0x70, 0xc4,
+		0x1b, 0xef, 0xcf, 0x80, 0x31, 0x33, 0x4f, 0xae,
+		0x48, 0x5e, 0x09, 0xa0,
+	},
+	KeyLabel:                     "key",
+	IVLabel:                      "iv",
+	HPLabel:                      "hp",
+	LabelBase:                    QuicBaseLabel,
+	KeyUpdateLabel:               "traffic upd",
+	KeyUpdateLabelBase:           BaseLabel,
+	TransportParametersFormat:    TransportParametersDraft,
+	TransportParametersExtension: TransportParametersExtensionDraft,
+	frameTypes:                   frameTypesUpTo(ApplicationCloseType),
+}
+
+var VersionProfileV2 = &VersionProfile{ // See https://tools.ietf.org/html/rfc9369
+	Version:            QuicVersion2,
+	Name:               "v2",
+	ALPN:               "hq-interop",
+	H3ALPN:             "h3",
+	CompatibleVersions: []uint32{QuicVersion1},
+	InitialSalt: []byte{ // See https://tools.ietf.org/html/rfc9369#section-3.3.1
+		0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb,
+		0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb,
+		0xf9, 0xbd, 0x2e, 0xd9,
+	},
+	KeyLabel:           "quicv2 key", // See https://tools.ietf.org/html/rfc9369#section-3.3.2
+	IVLabel:            "quicv2 iv",
+	HPLabel:            "quicv2 hp",
+	LabelBase:          BaseLabel,
+	KeyUpdateLabel:     "quicv2 ku",
+	KeyUpdateLabelBase: BaseLabel,
+	RetryKey: []byte{ // See https://tools.ietf.org/html/rfc9369#section-3.3.3
+		0x8f, 0xb4, 0xb0, 0x1b, 0x56, 0xac, 0x48, 0xe2,
+		0x60, 0xfb, 0xcb, 0xce, 0xad, 0x7c, 0xcc, 0x92,
+	},
+	RetryNonce: []byte{
+		0xd8, 0x69, 0x69, 0xbc, 0x2d, 0x7c, 0x6d, 0x99,
+		0x90, 0xef, 0xb0, 0x4a,
+	},
+	TransportParametersFormat:    TransportParametersRFC,
+	TransportParametersExtension: TransportParametersExtension,
+	ExplicitCIDLengths:           true,
+	RetryIntegrityTag:            true,
+	VarIntErrorCodes:             true,
+	RetirePriorTo:                true,
+	longHeaderTypes: map[PacketType]uint8{ // See https://tools.ietf.org/html/rfc9369#section-3.2
+		Initial:          0x1,
+		ZeroRTTProtected: 0x2,
+		Handshake:        0x3,
+		Retry:            0x0,
+	},
+	frameTypes: frameTypesUpTo(HandshakeDoneType),
+}
+
+// The profiles of all known versions, in order of preference
+var VersionProfiles = []*VersionProfile{VersionProfileV1, VersionProfileV2, VersionProfileDraft17}
+
+// Returns the profile of the given version, or nil if it is unknown
+func GetVersionProfile(version uint32) *VersionProfile {
+	for _, p := range VersionProfiles {
+		if p.Version == version {
+			return p
+		}
+	}
+	return nil
+}
+
+// Parses a version given either by its profile name, e.g. "v1" or "draft-17", or by its hexadecimal value
+func ParseVersion(version string) (uint32, error) {
+	for _, p := range VersionProfiles {
+		if p.Name == version {
+			return p.Version, nil
+		}
+	}
+	v, err := strconv.ParseUint(strings.TrimPrefix(version, "0x"), 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unknown version %s", version)
+	}
+	return uint32(v), nil
+}
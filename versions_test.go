@@ -0,0 +1,210 @@
+package quictracker
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// Returns a connection with the state needed to encode and decode headers and frames in the given version
+func testConnection(profile *VersionProfile) *Connection {
+	return &Connection{
+		Version:                profile.Version,
+		VersionProfile:         profile,
+		SourceCID:              ConnectionID{1, 2, 3, 4, 5, 6, 7, 8},
+		DestinationCID:         ConnectionID{8, 7, 6, 5, 4, 3, 2, 1},
+		OriginalDestinationCID: ConnectionID{8, 7, 6, 5, 4, 3, 2, 1},
+		PacketNumber:           make(map[PNSpace]PacketNumber),
+		LargestPNsReceived:     make(map[PNSpace]PacketNumber),
+		LargestPNsAcknowledged: make(map[PNSpace]PacketNumber),
+	}
+}
+
+func TestLongHeaderEncoding(t *testing.T) {
+	typeBits := map[uint32]map[PacketType]byte{ // See https://tools.ietf.org/html/rfc9369#section-3.2
+		QuicVersion1:       {Initial: 0x0, ZeroRTTProtected: 0x1, Handshake: 0x2},
+		QuicVersion2:       {Initial: 0x1, ZeroRTTProtected: 0x2, Handshake: 0x3},
+		QuicVersionDraft17: {Initial: 0x0, ZeroRTTProtected: 0x1, Handshake: 0x2},
+	}
+	for _, profile := range VersionProfiles {
+		conn := testConnection(profile)
+		for _, packetType := range []PacketType{Initial, ZeroRTTProtected, Handshake} {
+			h := NewLongHeader(packetType, conn, packetType.PNSpace())
+			h.Length = NewVarInt(1200)
+			encoded := h.Encode()
+			if bits := (encoded[0] & 0x30) >> 4; bits != typeBits[profile.Version][packetType] {
+				t.Errorf("%s %s: unexpected type bits %d", profile, packetType, bits)
+			}
+			if len(encoded) != h.HeaderLength() {
+				t.Errorf("%s %s: the header is %d bytes long, not %d", profile, packetType, len(encoded), h.HeaderLength())
+			}
+			decoded, ok := ReadHeader(bytes.NewReader(encoded), conn).(*LongHeader)
+			if !ok {
+				t.Errorf("%s %s: the header was not decoded as a long header", profile, packetType)
+				continue
+			}
+			if decoded.packetType != packetType || decoded.Version != h.Version || decoded.Profile() != profile ||
+				!bytes.Equal(decoded.DestinationCID, h.DestinationCID) || !bytes.Equal(decoded.SourceCID, h.SourceCID) ||
+				decoded.Length.Value != h.Length.Value || decoded.PacketNumber() != h.PacketNumber() || decoded.TruncatedPN() != h.TruncatedPN() {
+				t.Errorf("%s %s: expected %+v, got %+v", profile, packetType, h, decoded)
+			}
+		}
+	}
+}
+
+func TestShortHeaderEncoding(t *testing.T) {
+	for _, profile := range VersionProfiles {
+		conn := testConnection(profile)
+		conn.PacketNumber[PNSpaceAppData] = 0x1234
+		h := NewShortHeader(conn)
+		decoded, ok := ReadHeader(bytes.NewReader(h.Encode()), conn).(*ShortHeader)
+		if !ok || !bytes.Equal(decoded.DestinationCID, conn.DestinationCID) || decoded.PacketNumber() != h.PacketNumber() || decoded.TruncatedPN() != h.TruncatedPN() {
+			t.Errorf("%s: expected %+v, got %+v", profile, h, decoded)
+		}
+	}
+}
+
+func TestFrameEncoding(t *testing.T) {
+	for _, profile := range VersionProfiles {
+		conn := testConnection(profile)
+		newConnectionId := NewConnectionIdFrame{Sequence: 2, Length: 8, ConnectionId: []byte{1, 2, 3, 4, 5, 6, 7, 8}, StatelessResetToken: [16]byte{0xff}}
+		if profile.RetirePriorTo {
+			newConnectionId.RetirePriorTo = 1
+		}
+		frames := []Frame{
+			&ResetStream{StreamId: 4, ApplicationErrorCode: 0x1234, FinalOffset: 100},
+			&StopSendingFrame{StreamId: 8, ApplicationErrorCode: 0x0a},
+			&newConnectionId,
+			&ConnectionCloseFrame{ErrorCode: 0x0a, ErrorFrameType: 0x08, ReasonPhraseLength: 3, ReasonPhrase: "bye"},
+		}
+		for _, f := range frames {
+			buffer := new(bytes.Buffer)
+			f.writeTo(buffer, profile)
+			if buffer.Len() > int(f.FrameLength()) {
+				t.Errorf("%s %T: the frame is %d bytes long, more than %d", profile, f, buffer.Len(), f.FrameLength())
+			}
+			reader := bytes.NewReader(buffer.Bytes())
+			decoded, err := NewFrame(reader, conn)
+			if err != nil {
+				t.Errorf("%s %T: %s", profile, f, err.Error())
+				continue
+			}
+			if !reflect.DeepEqual(f, decoded) || reader.Len() > 0 {
+				t.Errorf("%s: expected %+v, got %+v", profile, f, decoded)
+			}
+		}
+
+		buffer := new(bytes.Buffer)
+		HandshakeDoneFrame(0).writeTo(buffer, profile)
+		_, err := NewFrame(bytes.NewReader(buffer.Bytes()), conn)
+		if supported := profile.SupportsFrame(HandshakeDoneType); (err == nil) != supported {
+			t.Errorf("%s: HANDSHAKE_DONE is supported %v, decoding it returned %v", profile, supported, err)
+		}
+	}
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// See https://tools.ietf.org/html/rfc9001#appendix-A.1 and https://tools.ietf.org/html/rfc9369#appendix-A.1
+func TestInitialSecrets(t *testing.T) {
+	type keys struct {
+		secret, key, iv, hp string
+	}
+	for _, c := range []struct {
+		profile        *VersionProfile
+		client, server keys
+	}{
+		{
+			VersionProfileV1,
+			keys{"c00cf151ca5be075ed0ebfb5c80323c42d6b7db67881289af4008f1f6c357aea", "1f369613dd76d5467730efcbe3b1a22d", "fa044b2f42a3fd3b46fb255c", "9f50449e04a0e810283a1e9933adedd2"},
+			keys{"3c199828fd139efd216c155ad844cc81fb82fa8d7446fa7d78be803acdda951b", "cf3a5331653c364c88f0f379b6067e37", "0ac1493ca1905853b0bba03e", "c206b8d9b9f0f37644430b490eeaa314"},
+		},
+		{
+			VersionProfileV2,
+			keys{"14ec9d6eb9fd7af83bf5a668bc17a7e283766aade7ecd0891f70f9ff7f4bf47b", "8b1a0bc121284290a29e0971b5cd045d", "91f73e2351d8fa91660e909f", "45b95e15235d6f45a6b19cbcb0294ba9"},
+			keys{"0263db1782731bf4588e7e4d93b7463907cb8cd8200b5da55a8bd488eafc37c1", "82db637861d55e1d011f19ea71d5d2a7", "dd13c276499c0249d3310652", "edf6d05c83121201b436e16877593c3a"},
+		},
+	} {
+		hash := TLS_AES_128_GCM_SHA256.Hash()
+		initialSecret := HkdfExtract(hash, c.profile.InitialSalt, decodeHex(t, "8394c8f03e515708"))
+		for label, expected := range map[string]keys{clientInitialLabel: c.client, serverInitialLabel: c.server} {
+			secret := HkdfExpandLabel(hash, initialSecret, label, nil, hash.Size(), BaseLabel)
+			derived := keys{
+				hex.EncodeToString(secret),
+				hex.EncodeToString(HkdfExpandLabel(hash, secret, c.profile.KeyLabel, nil, 16, c.profile.LabelBase)),
+				hex.EncodeToString(HkdfExpandLabel(hash, secret, c.profile.IVLabel, nil, 12, c.profile.LabelBase)),
+				hex.EncodeToString(HkdfExpandLabel(hash, secret, c.profile.HPLabel, nil, 16, c.profile.LabelBase)),
+			}
+			if derived != expected {
+				t.Errorf("%s %s: expected %+v, got %+v", c.profile, label, expected, derived)
+			}
+		}
+	}
+}
+
+func TestTLSProviderTransportParametersExtension(t *testing.T) {
+	registerTLSProvider("test", func(serverName string, ALPN string, resumptionTicket []byte) TLSProvider { return nil }, TransportParametersExtensionDraft)
+	defer func() {
+		delete(TLSProviders, "test")
+		delete(tlsProvidersExtensions, "test")
+		DefaultTLSProvider = ""
+	}()
+	DefaultTLSProvider = "test"
+	if _, err := NewTLSProvider("", "", nil, VersionProfileDraft17.TransportParametersExtension); err != nil {
+		t.Error(err)
+	}
+	for _, profile := range []*VersionProfile{VersionProfileV1, VersionProfileV2} {
+		if profile.TransportParametersExtension != TransportParametersExtension {
+			t.Errorf("%s: the transport parameters are sent in the extension %#x", profile, profile.TransportParametersExtension)
+		}
+		if _, err := NewTLSProvider("", "", nil, profile.TransportParametersExtension); err == nil {
+			t.Errorf("%s: a provider sending the draft extension was used", profile)
+		}
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	registerTLSProvider("test", func(serverName string, ALPN string, resumptionTicket []byte) TLSProvider { return nil }, TransportParametersExtension)
+	defer func() {
+		delete(TLSProviders, "test")
+		delete(tlsProvidersExtensions, "test")
+		DefaultTLSProvider = ""
+	}()
+	DefaultTLSProvider = "test"
+	if _, err := NewConnection("", QuicVersionDraft17, "hq-17", nil, nil, nil, nil); err == nil {
+		t.Fatal("a connection was created with a provider that cannot send the draft extension")
+	} else if _, ok := err.(*UnsupportedVersionError); !ok {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	conn, err := NewConnection("", QuicVersion1, "hq-interop", nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Logger.SetOutput(ioutil.Discard)
+	vn := NewVersionNegotiationPacket(0, 0, []SupportedVersion{QuicVersionDraft17}, conn)
+	if err := conn.ProcessVersionNegotation(vn); err == nil {
+		t.Fatal("the connection transitioned to draft-17")
+	} else if _, ok := err.(*UnsupportedVersionError); !ok {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if conn.Version != QuicVersion1 || conn.VersionProfile != VersionProfileV1 {
+		t.Errorf("the connection was changed to version %08x", conn.Version)
+	}
+
+	vn.SupportedVersions = []SupportedVersion{QuicVersionDraft17, QuicVersion2}
+	if err := conn.ProcessVersionNegotation(vn); err != nil {
+		t.Fatal(err)
+	}
+	if conn.Version != QuicVersion2 {
+		t.Errorf("the connection transitioned to version %08x instead of QUIC v2", conn.Version)
+	}
+}